@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AnnotateOptions struct {
+	epdRegex       string
+	thinkingTimeMs uint
+	// Search to this depth instead of for the thinking time, if set
+	depth uint
+}
+
+// RunAnnotate searches every position in the EPD file and writes it to the
+// output file with the results: ce, acd, acn, acs, pv and bm (and dm for a mate).
+// Lines are written as they're searched, so a long run can be followed.
+func RunAnnotate(epdFile string, outputFile string, options AnnotateOptions) (bool, error) {
+	if outputFile == "" {
+		return false, errors.New("Must specify an output file for the annotated positions")
+	}
+	lines, err := ParseAndFilterEpdFile(epdFile, options.epdRegex)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	output := bufio.NewWriter(file)
+
+	for i := range lines {
+		line := &lines[i]
+		boardState, err := CreateBoardStateFromFENString(line.fen)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", line.name, err)
+		}
+
+		start := time.Now()
+		result := searchPosition(&boardState, options)
+		AnnotateEpdLine(line, &boardState, result, time.Since(start))
+
+		fmt.Printf("[%s] %s\n", line.name, result.String())
+		if _, err := output.WriteString(line.String() + "\n"); err != nil {
+			return false, err
+		}
+		if err := output.Flush(); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// searchPosition searches for the thinking time, or to the depth if one is set.
+func searchPosition(boardState *BoardState, options AnnotateOptions) SearchResult {
+	config := ExternalSearchConfig{searchToDepth: options.depth}
+	thinkingTimeMs := options.thinkingTimeMs
+	if options.depth != 0 {
+		thinkingTimeMs = NO_TIME_LIMIT
+	}
+
+	return thinkAndWait(boardState, thinkingTimeMs, config, func(ThinkingOutput) {})
+}
+
+// AnnotateEpdLine sets the search opcodes from the result.  Scores are from the
+// point of view of the side to move, as EPD expects.
+func AnnotateEpdLine(line *EpdLine, boardState *BoardState, result SearchResult, elapsed time.Duration) {
+	value := result.value
+	if boardState.sideToMove == BLACK_OFFSET {
+		value = -value
+	}
+
+	line.SetOperation("ce", strconv.Itoa(value))
+	if result.IsCheckmate() {
+		line.SetOperation("dm", strconv.Itoa(MateInMoves(value)))
+	} else {
+		line.RemoveOperation("dm")
+	}
+	line.SetOperation("acd", strconv.FormatUint(uint64(result.depth), 10))
+	line.SetOperation("acn", strconv.FormatUint(result.stats.Nodes(), 10))
+	line.SetOperation("acs", strconv.Itoa(int(elapsed.Seconds())))
+	if result.move != 0 {
+		line.SetOperation("bm", MoveToPrettyString(result.move, boardState))
+	}
+	if pv := strings.Fields(result.pv); len(pv) > 0 {
+		line.SetOperation("pv", pv...)
+	} else {
+		line.RemoveOperation("pv")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunAnnotate(t *testing.T) {
+	filename := writeTestFile(t, "positions.epd",
+		"6k1/5ppp/8/8/8/8/8/R3K3 w Q - id \"white mates\";\n"+
+			"k7/8/1K6/8/8/8/8/7R b - - id \"black is mated\";\n"+
+			"r3k3/8/8/8/8/8/5PPP/6K1 b q - bm Kd7; id \"black mates\";\n"+
+			"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - dm 3; id \"start\";\n")
+	output := writeTestFile(t, "annotated.epd", "")
+
+	success, err := RunAnnotate(filename, output, AnnotateOptions{depth: 2})
+	assert.Nil(t, err)
+	assert.True(t, success)
+
+	lines, err := ParseEpdFile(output)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(lines))
+
+	for i, bm := range map[int]string{0: "Ra8#", 2: "Ra1#"} {
+		line := lines[i]
+		assert.Equal(t, bm, line.bestMove, line.name)
+		dm, ok := line.IntOperation("dm")
+		assert.True(t, ok)
+		assert.Equal(t, int64(1), dm)
+		ce, _ := line.IntOperation("ce")
+		assert.Greater(t, ce, int64(CHECKMATE_SCORE-100))
+	}
+
+	mated := lines[1]
+	assert.Equal(t, "Kb8", mated.bestMove)
+	dm, _ := mated.IntOperation("dm")
+	assert.Equal(t, int64(-1), dm)
+	ce, _ := mated.IntOperation("ce")
+	assert.Less(t, ce, int64(-CHECKMATE_SCORE+100))
+	pv, _ := mated.Operation("pv")
+	assert.Equal(t, []string{"Kb8", "Rh8#"}, pv)
+
+	start := lines[3]
+	assert.Equal(t, "start", start.name)
+	acd, ok := start.IntOperation("acd")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), acd)
+	acn, _ := start.IntOperation("acn")
+	assert.Greater(t, acn, int64(0))
+	_, ok = start.IntOperation("acs")
+	assert.True(t, ok)
+	pv, _ = start.Operation("pv")
+	assert.Equal(t, start.bestMove, pv[0])
+	// The search found no mate, so the one from the input is gone
+	_, ok = start.Operation("dm")
+	assert.False(t, ok)
+}
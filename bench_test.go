@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBenchPositions(t *testing.T) {
+	for _, fen := range benchPositions {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err, fen)
+		assert.NotEqual(t, 0, len(GenerateLegalMoves(&boardState)), fen)
+	}
+}
+
+func TestBenchIsDeterministic(t *testing.T) {
+	var nodes []uint64
+	result, err := Bench(3, func(index int, fen string, n uint64) {
+		assert.Equal(t, benchPositions[index], fen)
+		nodes = append(nodes, n)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(benchPositions), result.positions)
+	assert.Greater(t, result.nodes, uint64(0))
+
+	again, err := Bench(3, func(index int, fen string, n uint64) {
+		assert.Equal(t, nodes[index], n, fen)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, result.nodes, again.nodes)
+}
@@ -216,16 +216,6 @@ type BoardInfo struct {
 	lastMoveWasNullMove     bool
 }
 
-type RepetitionInfo struct {
-	// 3-fold repetition detection
-	occurredHashes [MAX_MOVES]uint64
-	// metadata on if the given move (to get to this position) changed the position
-	// so that we shouldn't look further back in the occurredHashes
-	pawnMoveOrCapture [MAX_MOVES]bool
-}
-
-var shouldAbort = false
-
 type BoardState struct {
 	board         []byte
 	bitboards     Bitboards
@@ -242,18 +232,18 @@ type BoardState struct {
 	pawnHashKey uint64
 
 	// Internal structures to allow unmaking moves
-	captureStack     byteStack
-	boardInfoHistory [MAX_MOVES]BoardInfo
-	wasCapture       [MAX_MOVES]bool
-	moveIndex        int // 0-based and increases after every move
+	captureStack byteStack
+	history      positionHistory
+	moveIndex    int // 0-based and increases after every move
+
+	// Evaluation weights
+	evalParams *EvalParams
 
 	// Zobrist hash indices
 	hashInfo *HashInfo
 	// Transposition table
 	transpositionTable map[uint64]uint64
 	pawnTable          map[uint64]*PawnTableEntry
-
-	repetitionInfo RepetitionInfo
 }
 
 func oppositeColorOffset(offset int) int {
@@ -267,10 +257,14 @@ func oppositeColorOffset(offset int) int {
 	panic("Impossible")
 }
 
+// CopyBoardState returns a copy that moves can be applied to independently of
+// the original.  The transposition and pawn tables are still shared.
 func CopyBoardState(boardState *BoardState) BoardState {
 	state := *boardState
 	state.board = make([]byte, 120)
 	copy(state.board, boardState.board)
+	state.captureStack.arr = append([]byte(nil), boardState.captureStack.arr...)
+	state.history.entries = append([]historyEntry(nil), boardState.history.entries...)
 	return state
 }
 
@@ -298,6 +292,7 @@ func CreateEmptyBoardState() BoardState {
 	b.halfmoveClock = 0
 	b.fullmoveNumber = 1
 	b.moveBitboards = moveBitboards
+	b.evalParams = evalParams
 	generateZobrishHashInfo(&b)
 	generateTranspositionTable(&b)
 
@@ -318,12 +313,13 @@ func generateZobrishHashInfo(boardState *BoardState) {
 	// info around to progressively change the hash key
 	boardState.hashKey = boardState.CreateHashKey(&hashInfo)
 	boardState.pawnHashKey = boardState.CreatePawnHashKey(&hashInfo)
-
-	boardState.repetitionInfo.occurredHashes[boardState.moveIndex] = boardState.hashKey
+	boardState.resetHistory()
 }
 
+const STARTING_FEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+
 func CreateInitialBoardState() BoardState {
-	boardState, err := CreateBoardStateFromFENString("rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1")
+	boardState, err := CreateBoardStateFromFENString(STARTING_FEN)
 	if err != nil {
 		panic(err)
 	}
@@ -333,15 +329,59 @@ func CreateInitialBoardState() BoardState {
 
 func CreateBoardStateFromFENString(s string) (BoardState, error) {
 	var boardState BoardState = CreateEmptyBoardState()
+	err := boardState.loadFENString(s)
+
+	return boardState, err
+}
+
+// ResetFromFENString replaces the position with the one described by the FEN
+// string.  The Zobrist hash info and the transposition/pawn tables are kept,
+// which makes this much cheaper than CreateBoardStateFromFENString when many
+// positions are processed one after another (e.g. tuning).
+func (boardState *BoardState) ResetFromFENString(fen string) error {
+	b := BoardState{
+		board:              boardState.board,
+		moveBitboards:      boardState.moveBitboards,
+		evalParams:         boardState.evalParams,
+		hashInfo:           boardState.hashInfo,
+		transpositionTable: boardState.transpositionTable,
+		pawnTable:          boardState.pawnTable,
+		captureStack:       byteStack{arr: boardState.captureStack.arr[:0]},
+		history:            positionHistory{entries: boardState.history.entries[:0]},
+		sideToMove:         WHITE_OFFSET,
+		fullmoveNumber:     1,
+	}
+	for i := range b.board {
+		b.board[i] = EMPTY_SQUARE
+	}
+
+	if err := b.loadFENString(fen); err != nil {
+		return err
+	}
+	*boardState = b
 
+	return nil
+}
+
+func (boardState *BoardState) loadFENString(s string) error {
 	// first split string into board part and non-board part
 	var splits = strings.SplitN(s, " ", 6)
+	if len(splits) < 4 {
+		return errors.New("FEN is missing fields: " + s)
+	}
 	boardStr := splits[0]
 	row := byte(7)
 
-	for _, rowStr := range strings.Split(boardStr, "/") {
+	rowStrs := strings.Split(boardStr, "/")
+	if len(rowStrs) != 8 {
+		return errors.New("FEN board should have 8 rows: " + boardStr)
+	}
+	for _, rowStr := range rowStrs {
 		col := byte(0)
 		for _, pStr := range strings.Split(rowStr, "") {
+			if col >= 8 {
+				return errors.New("FEN row is too long: " + rowStr)
+			}
 			sq := idx(col, row)
 			var p byte
 			switch pStr {
@@ -384,10 +424,10 @@ func CreateBoardStateFromFENString(s string) (BoardState, error) {
 			default:
 				num, err := strconv.ParseUint(pStr, 10, 8)
 				if err != nil {
-					return boardState, errors.New("Found unknown character parsing FEN: " + pStr)
+					return errors.New("Found unknown character parsing FEN: " + pStr)
 				}
-				if num > 8 {
-					return boardState, errors.New("Invalid FEN offset: " + pStr)
+				if num > 8 || col+byte(num) > 8 {
+					return errors.New("Invalid FEN offset: " + pStr)
 				}
 				col = col + byte(num)
 			}
@@ -399,13 +439,17 @@ func CreateBoardStateFromFENString(s string) (BoardState, error) {
 		row = row - 1
 	}
 
+	if err := validatePawnRanks(boardState); err != nil {
+		return err
+	}
+
 	switch splits[1] {
 	case "w":
 		boardState.sideToMove = WHITE_OFFSET
 	case "b":
 		boardState.sideToMove = BLACK_OFFSET
 	default:
-		return boardState, errors.New("Invalid side-to-move specification: " + splits[1])
+		return errors.New("Invalid side-to-move specification: " + splits[1])
 	}
 
 	if splits[2] != "-" {
@@ -428,28 +472,33 @@ func CreateBoardStateFromFENString(s string) (BoardState, error) {
 		sq, err := ParseAlgebraicSquare(splits[3])
 
 		if err != nil {
-			return boardState, err
+			return err
 		}
 
 		boardState.boardInfo.enPassantTargetSquare = sq
 	}
 
-	if len(splits) > 4 {
-		halfmoveClock, err := strconv.ParseUint(splits[4], 10, 8)
+	if len(splits) > 5 {
+		halfmoveClock, err := strconv.ParseUint(splits[4], 10, 32)
 		if err != nil {
-			return boardState, errors.New("Error parsing halfmove clock count: " + splits[4])
+			return errors.New("Error parsing halfmove clock count: " + splits[4])
 		}
 
-		fullmoveNumber, err := strconv.ParseUint(splits[5], 10, 8)
+		fullmoveNumber, err := strconv.ParseUint(splits[5], 10, 32)
 		if err != nil {
-			return boardState, errors.New("Error parsing fullmove number count: " + splits[4])
+			return errors.New("Error parsing fullmove number count: " + splits[5])
 		}
 
 		boardState.halfmoveClock = uint(halfmoveClock)
 		boardState.fullmoveNumber = uint(fullmoveNumber)
 	}
 
-	return boardState, nil
+	// Pieces were placed without updating the hash keys
+	boardState.hashKey = boardState.CreateHashKey(boardState.hashInfo)
+	boardState.pawnHashKey = boardState.CreatePawnHashKey(boardState.hashInfo)
+	boardState.resetHistory()
+
+	return nil
 }
 
 func CreateBoardStateFromFENStringWithVariation(fen string, variation string) (BoardState, error) {
@@ -473,43 +522,17 @@ func CreateBoardStateFromFENStringWithVariation(fen string, variation string) (B
 }
 
 func ParseAlgebraicSquare(sq string) (uint8, error) {
-	var col byte
-	var row byte
-	for index, runeValue := range sq {
-		if index == 0 {
-			switch runeValue {
-			case 'a':
-				col = byte(0)
-			case 'b':
-				col = byte(1)
-			case 'c':
-				col = byte(2)
-			case 'd':
-				col = byte(3)
-			case 'e':
-				col = byte(4)
-			case 'f':
-				col = byte(5)
-			case 'g':
-				col = byte(6)
-			case 'h':
-				col = byte(7)
-			default:
-				return 0, errors.New("Column out of range: " + sq)
-			}
-		} else if index == 1 {
-			rowUint, err := strconv.ParseUint(string(runeValue), 10, 8)
-			if err != nil {
-				return 0, errors.New("Row out of range: " + sq)
-			}
-			// Must subtract 1 because algebraic notation is 1-based
-			row = byte(rowUint - 1)
-		} else {
-			return 0, errors.New("Algebraic square was not two characters: " + sq)
-		}
+	if len(sq) != 2 {
+		return 0, errors.New("Algebraic square was not two characters: " + sq)
+	}
+	if sq[0] < 'a' || sq[0] > 'h' {
+		return 0, errors.New("Column out of range: " + sq)
+	}
+	if sq[1] < '1' || sq[1] > '8' {
+		return 0, errors.New("Row out of range: " + sq)
 	}
 
-	return idx(col, row), nil
+	return idx(sq[0]-'a', sq[1]-'1'), nil
 }
 
 func PieceToColorOffset(p byte) int {
@@ -589,8 +612,9 @@ func (boardState *BoardState) RepetitionCount(cutoff int) bool {
 	currentHash := boardState.hashKey
 	num := 1
 
-	for i := boardState.moveIndex - 1; i >= 0 && !boardState.repetitionInfo.pawnMoveOrCapture[i]; i-- {
-		if boardState.repetitionInfo.occurredHashes[i] == currentHash {
+	entries := boardState.history.entries
+	for i := boardState.moveIndex - 1; i >= 0 && !entries[i+1].irreversible; i-- {
+		if entries[i].hashKey == currentHash {
 			num++
 		}
 
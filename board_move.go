@@ -8,11 +8,12 @@ import (
 var errMoveUninitialized error = errors.New("Uninitialized move")
 
 func (boardState *BoardState) ApplyMove(move Move) {
-	boardState.boardInfoHistory[boardState.moveIndex] = boardState.boardInfo
+	oldBoardInfo := boardState.boardInfo
+	boardState.history.top().boardInfo = oldBoardInfo
+	boardState.history.top().halfmoveClock = boardState.halfmoveClock
 
 	capturedPiece := boardState.board[move.To()]
 	isCapture := capturedPiece != EMPTY_SQUARE
-	boardState.wasCapture[boardState.moveIndex+1] = isCapture
 	if isCapture {
 		boardState.captureStack.Push(capturedPiece)
 	}
@@ -179,6 +180,20 @@ func (boardState *BoardState) ApplyMove(move Move) {
 		}
 	}
 
+	// Capturing a rook on its starting square takes away its castling
+	if capturedPiece&0x0F == ROOK_MASK {
+		switch move.To() {
+		case SQUARE_A1:
+			boardState.boardInfo.whiteCanCastleQueenside = false
+		case SQUARE_H1:
+			boardState.boardInfo.whiteCanCastleKingside = false
+		case SQUARE_A8:
+			boardState.boardInfo.blackCanCastleQueenside = false
+		case SQUARE_H8:
+			boardState.boardInfo.blackCanCastleKingside = false
+		}
+	}
+
 	switch boardState.sideToMove {
 	case WHITE_OFFSET:
 		boardState.sideToMove = BLACK_OFFSET
@@ -186,30 +201,44 @@ func (boardState *BoardState) ApplyMove(move Move) {
 		boardState.sideToMove = WHITE_OFFSET
 	}
 
-	oldBoardInfo := boardState.boardInfoHistory[boardState.moveIndex]
 	boardState.moveIndex++
 
 	if boardState.sideToMove == WHITE_OFFSET {
 		boardState.fullmoveNumber++
 	}
 
+	irreversible := movePiece == PAWN_MASK || isCapture
+	if irreversible {
+		boardState.halfmoveClock = 0
+	} else {
+		boardState.halfmoveClock++
+	}
+
 	boardState.UpdateHashApplyMove(oldBoardInfo, move, isCapture)
-	boardState.repetitionInfo.occurredHashes[boardState.moveIndex] = boardState.hashKey
-	boardState.repetitionInfo.pawnMoveOrCapture[boardState.moveIndex] = movePiece == PAWN_MASK || capturedPiece != 0
+	boardState.history.push(historyEntry{
+		hashKey:      boardState.hashKey,
+		wasCapture:   capturedPiece != EMPTY_SQUARE,
+		irreversible: irreversible,
+	})
 }
 
 func (boardState *BoardState) ApplyNullMove() {
-	boardState.boardInfoHistory[boardState.moveIndex] = boardState.boardInfo
+	boardState.history.top().boardInfo = boardState.boardInfo
+	boardState.history.top().halfmoveClock = boardState.halfmoveClock
 	boardState.moveIndex++
+	boardState.halfmoveClock++
 	boardState.sideToMove = oppositeColorOffset(boardState.sideToMove)
 	boardState.boardInfo.lastMoveWasNullMove = true
 	boardState.boardInfo.enPassantTargetSquare = 0
 	boardState.hashKey ^= boardState.hashInfo.sideToMove
+	boardState.history.push(historyEntry{hashKey: boardState.hashKey, irreversible: true})
 }
 
 func (boardState *BoardState) UnapplyNullMove() {
+	boardState.history.pop()
 	boardState.moveIndex--
-	boardState.boardInfo = boardState.boardInfoHistory[boardState.moveIndex]
+	boardState.boardInfo = boardState.history.top().boardInfo
+	boardState.halfmoveClock = boardState.history.top().halfmoveClock
 	boardState.sideToMove = oppositeColorOffset(boardState.sideToMove)
 	boardState.hashKey ^= boardState.hashInfo.sideToMove
 }
@@ -272,14 +301,15 @@ func (boardState *BoardState) UnapplyMove(move Move) {
 		boardState.fullmoveNumber--
 	}
 	oldBoardInfo := boardState.boardInfo
+	isCapture := boardState.history.pop().wasCapture
 	boardState.moveIndex--
-	boardState.boardInfo = boardState.boardInfoHistory[boardState.moveIndex]
+	boardState.boardInfo = boardState.history.top().boardInfo
+	boardState.halfmoveClock = boardState.history.top().halfmoveClock
 
 	var p = boardState.board[move.To()]
 	var movePiece = p & 0x0F
 
 	var capturedPiece byte
-	isCapture := boardState.wasCapture[boardState.moveIndex+1]
 	if isCapture {
 		capturedPiece = boardState.captureStack.Pop()
 		boardState.board[move.To()] = capturedPiece
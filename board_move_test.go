@@ -570,3 +570,76 @@ func TestUnapplyPromotionCaptureToA1Square(t *testing.T) {
 
 	assert.Equal(t, ROOK_MASK|WHITE_MASK, testBoard.board[SQUARE_A1])
 }
+
+func TestCapturingRookTakesAwayCastling(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("r3k2r/8/8/8/8/8/6b1/R3K2R b KQkq - 0 1")
+	boardState.ApplyMove(CreateMove(SQUARE_G2, SQUARE_H1))
+	assert.Equal(t, "r3k2r/8/8/8/8/8/8/R3K2b w Qkq - 0 2", boardState.ToFENString())
+
+	boardState.UnapplyMove(CreateMove(SQUARE_G2, SQUARE_H1))
+	assert.Equal(t, "r3k2r/8/8/8/8/8/6b1/R3K2R b KQkq - 0 1", boardState.ToFENString())
+}
+
+// Every legal move is undone by UnapplyMove, and the hash keys kept up to date
+// match those computed from scratch.
+func FuzzApplyUnapplyMove(f *testing.F) {
+	f.Add(STARTING_FEN, []byte{12, 3, 40, 7})
+	f.Add("r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq -", []byte{0, 1, 2, 3, 4, 5, 6, 7})
+	f.Add("8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", []byte{200, 100, 50, 25})
+	f.Add("r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", []byte{9, 8, 7, 6, 5})
+	f.Add("P/////// w  -", []byte{0})
+
+	boardState := CreateInitialBoardState()
+	f.Fuzz(func(t *testing.T, fen string, choices []byte) {
+		if err := boardState.ResetFromFENString(fen); err != nil {
+			return
+		}
+		if len(choices) > 200 {
+			choices = choices[:200]
+		}
+
+		for _, choice := range choices {
+			moves := GenerateLegalMoves(&boardState)
+			if len(moves) == 0 {
+				return
+			}
+			move := moves[int(choice)%len(moves)]
+			fen := boardState.ToFENString()
+			hashKey, pawnHashKey := boardState.hashKey, boardState.pawnHashKey
+			bitboards := boardState.bitboards
+
+			boardState.ApplyMove(move)
+			if boardState.hashKey != boardState.CreateHashKey(boardState.hashInfo) ||
+				boardState.pawnHashKey != boardState.CreatePawnHashKey(boardState.hashInfo) {
+				t.Fatalf("hash keys after %s in %s", MoveToXboardString(move), fen)
+			}
+			boardState.UnapplyMove(move)
+			if boardState.ToFENString() != fen || boardState.hashKey != hashKey ||
+				boardState.pawnHashKey != pawnHashKey || boardState.bitboards != bitboards {
+				t.Fatalf("unapplying %s in %s gave %s", MoveToXboardString(move), fen, boardState.ToFENString())
+			}
+			boardState.ApplyMove(move)
+		}
+	})
+}
+
+func TestApplyMoveKeepsHalfmoveClock(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("r3k3/8/8/8/8/8/4P3/R3K3 w - - 7 30")
+	var moves []Move
+	for _, str := range []string{"Kd1", "Kd8", "e4", "Kc8", "Rxa8+"} {
+		move, err := ParsePrettyMove(str, &boardState)
+		assert.Nil(t, err)
+		boardState.ApplyMove(move)
+		moves = append(moves, move)
+	}
+	assert.Equal(t, "R1k5/8/8/8/4P3/8/8/3K4 b - - 0 32", boardState.ToFENString())
+
+	boardState.ApplyNullMove()
+	assert.Equal(t, uint(1), boardState.halfmoveClock)
+	boardState.UnapplyNullMove()
+
+	for i, expected := range []uint{1, 0, 9, 8, 7} {
+		boardState.UnapplyMove(moves[len(moves)-1-i])
+		assert.Equal(t, expected, boardState.halfmoveClock)
+	}
+}
@@ -93,6 +93,17 @@ func TestBoardWithEnPassantSquareAndCastling(t *testing.T) {
 	assert.Equal(t, s, boardState.ToFENString())
 }
 
+func TestBoardFromFENStringHashKeys(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	move, _ := ParsePrettyMove("Nf3", &boardState)
+	boardState.ApplyMove(move)
+
+	fenBoardState, err := CreateBoardStateFromFENString("rnbqkbnr/pppppppp/8/8/8/5N2/PPPPPPPP/RNBQKB1R b KQkq - 1 1")
+	assert.Nil(t, err)
+	assert.Equal(t, boardState.hashKey, fenBoardState.hashKey)
+	assert.Equal(t, boardState.pawnHashKey, fenBoardState.pawnHashKey)
+}
+
 func TestParseAlgebraicSquare(t *testing.T) {
 	var sq uint8
 	var err error
@@ -118,6 +129,28 @@ func TestParseAlgebraicSquare(t *testing.T) {
 	assert.Equal(t, uint8(0), sq)
 	assert.NotNil(t, err)
 	assert.Equal(t, "Algebraic square was not two characters: a12", err.Error())
+
+	for _, square := range []string{"", "a", "a0", "a9", "é1"} {
+		_, err = ParseAlgebraicSquare(square)
+		assert.NotNil(t, err, square)
+	}
+}
+
+func TestBoardFromFENStringWithBackRankPawn(t *testing.T) {
+	_, err := CreateBoardStateFromFENString("P7/8/8/8/8/8/8/K6k w - - 0 1")
+	assert.NotNil(t, err)
+	_, err = CreateBoardStateFromFENString("8/8/8/8/8/8/8/K5pk b - - 0 1")
+	assert.NotNil(t, err)
+}
+
+func TestBoardFromFENStringMoveCounters(t *testing.T) {
+	boardState, err := CreateBoardStateFromFENString("r1b1k1nr/8/8/8/8/8/8/R1B1K1NR w KQkq - 300 1000")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(300), boardState.halfmoveClock)
+	assert.Equal(t, uint(1000), boardState.fullmoveNumber)
+
+	_, err = CreateBoardStateFromFENString("r1b1k1nr/8/8/8/8/8/8/R1B1K1NR w KQkq - 0 x")
+	assert.EqualError(t, err, "Error parsing fullmove number count: x")
 }
 
 func TestThreefoldRepetition(t *testing.T) {
@@ -148,18 +181,81 @@ func TestPawnMovePreventsThreefoldRepetition(t *testing.T) {
 	boardState.SetPieceAtSquare(SQUARE_H8, KING_MASK|BLACK_MASK)
 	boardState.sideToMove = BLACK_OFFSET
 	boardState.SetPieceAtSquare(SQUARE_H6, PAWN_MASK|BLACK_MASK)
-	boardState.ApplyMove(CreateMove(SQUARE_H6, SQUARE_H5))
+	boardState.hashKey = boardState.CreateHashKey(boardState.hashInfo)
+	boardState.resetHistory()
 
 	for i := 0; i < 2; i++ {
-		assert.False(t, boardState.RepetitionCount(3))
-
-		boardState.ApplyMove(CreateMove(SQUARE_A1, SQUARE_B1))
 		boardState.ApplyMove(CreateMove(SQUARE_H8, SQUARE_H7))
-		assert.False(t, boardState.RepetitionCount(3))
-
-		boardState.ApplyMove(CreateMove(SQUARE_B1, SQUARE_A1))
+		boardState.ApplyMove(CreateMove(SQUARE_A1, SQUARE_B1))
 		boardState.ApplyMove(CreateMove(SQUARE_H7, SQUARE_H8))
+		boardState.ApplyMove(CreateMove(SQUARE_B1, SQUARE_A1))
 	}
+	assert.True(t, boardState.RepetitionCount(3))
 
+	boardState.ApplyMove(CreateMove(SQUARE_H6, SQUARE_H5))
+	assert.False(t, boardState.HasStateOccurred())
+
+	boardState.ApplyMove(CreateMove(SQUARE_A1, SQUARE_B1))
+	boardState.ApplyMove(CreateMove(SQUARE_H8, SQUARE_H7))
+	boardState.ApplyMove(CreateMove(SQUARE_B1, SQUARE_A1))
+	boardState.ApplyMove(CreateMove(SQUARE_H7, SQUARE_H8))
+	assert.True(t, boardState.HasStateOccurred())
 	assert.False(t, boardState.RepetitionCount(3))
+
+	// The position right after the pawn move can still repeat
+	boardState.ApplyMove(CreateMove(SQUARE_A1, SQUARE_B1))
+	boardState.ApplyMove(CreateMove(SQUARE_H8, SQUARE_H7))
+	boardState.ApplyMove(CreateMove(SQUARE_B1, SQUARE_A1))
+	boardState.ApplyMove(CreateMove(SQUARE_H7, SQUARE_H8))
+	assert.True(t, boardState.RepetitionCount(3))
+}
+
+func TestCopyBoardStateIsIndependent(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+	fen := boardState.ToFENString()
+	nxf7, _ := ParsePrettyMove("Nxf7", &boardState)
+	bxa6, _ := ParsePrettyMove("Bxa6", &boardState)
+
+	// Leave room in the capture stack, which the copy mustn't share
+	boardState.ApplyMove(bxa6)
+	boardState.UnapplyMove(bxa6)
+	copied := CopyBoardState(&boardState)
+
+	copied.ApplyMove(nxf7)
+	boardState.ApplyMove(bxa6)
+	copied.UnapplyMove(nxf7)
+	boardState.UnapplyMove(bxa6)
+	assert.Equal(t, fen, copied.ToFENString())
+	assert.Equal(t, fen, boardState.ToFENString())
+}
+
+func FuzzCreateBoardStateFromFENString(f *testing.F) {
+	f.Add(STARTING_FEN)
+	f.Add("r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq -")
+	f.Add("8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1")
+	f.Add("rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2")
+	f.Add("8/8/8/8/8/8/8/8 w - - 0 1")
+	f.Add("rnbqkbnr/pppppppp/9/8/8/8/PPPPPPPP/RNBQKBNR w KQkq a9 300 1")
+
+	// Creating boards is slow, so one is shared by every run
+	boardState := CreateInitialBoardState()
+	f.Fuzz(func(t *testing.T, fen string) {
+		if _, err := CreateBoardStateFromFENString(fen); err != nil {
+			return
+		}
+		if err := boardState.ResetFromFENString(fen); err != nil {
+			t.Fatalf("%s: %s", fen, err)
+		}
+
+		// Whatever was read can be written and read back the same way
+		written := boardState.ToFENString()
+		if err := boardState.ResetFromFENString(written); err != nil {
+			t.Fatalf("%s: %s", written, err)
+		}
+		if boardState.ToFENString() != written {
+			t.Fatalf("%s read back as %s", written, boardState.ToFENString())
+		}
+		GenerateLegalMoves(&boardState)
+		ValidatePosition(&boardState)
+	})
 }
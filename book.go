@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// Polyglot opening books (http://hgm.nubati.net/book_format.html).  A book is a
+// file of 16 byte entries sorted by position key: the key (Polyglot's own
+// Zobrist hash, not the engine's), the move, its weight and a learning value,
+// all big-endian.
+
+const POLYGLOT_ENTRY_SIZE = 16
+
+// DEFAULT_BOOK_DEPTH is the number of moves (per side) after which the book is no
+// longer used.
+const DEFAULT_BOOK_DEPTH = 20
+
+type PolyglotEntry struct {
+	key    uint64
+	move   uint16
+	weight uint16
+	learn  uint32
+}
+
+type OpeningBook struct {
+	filename string
+	entries  []PolyglotEntry
+}
+
+type BookMove struct {
+	move   Move
+	weight uint16
+}
+
+// openingBook is the book used by xboard, if one is loaded.
+var openingBook *OpeningBook
+
+var bookRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// PolyglotKey hashes the position with the Polyglot keys.  The en passant file is
+// only included if a pawn can make the capture.
+func PolyglotKey(boardState *BoardState) uint64 {
+	var key uint64
+	for sq := byte(0); sq < 64; sq++ {
+		piece := boardState.PieceAtSquare(sq)
+		if piece == EMPTY_SQUARE {
+			continue
+		}
+		kind := 2 * int(piece&0x0F-1)
+		if piece&WHITE_MASK != 0 {
+			kind++
+		}
+		key ^= polyglotRandom[64*kind+int(sq)]
+	}
+
+	castling := []bool{
+		boardState.boardInfo.whiteCanCastleKingside,
+		boardState.boardInfo.whiteCanCastleQueenside,
+		boardState.boardInfo.blackCanCastleKingside,
+		boardState.boardInfo.blackCanCastleQueenside,
+	}
+	for i, canCastle := range castling {
+		if canCastle {
+			key ^= polyglotRandom[768+i]
+		}
+	}
+
+	if target := boardState.boardInfo.enPassantTargetSquare; target != 0 {
+		pawn, sq := WHITE_MASK|PAWN_MASK, target-8
+		if boardState.sideToMove == BLACK_OFFSET {
+			pawn, sq = BLACK_MASK|PAWN_MASK, target+8
+		}
+		file := squareFile(target)
+		if (file > 0 && boardState.PieceAtSquare(sq-1) == pawn) ||
+			(file < 7 && boardState.PieceAtSquare(sq+1) == pawn) {
+			key ^= polyglotRandom[772+file]
+		}
+	}
+
+	if boardState.sideToMove == WHITE_OFFSET {
+		key ^= polyglotRandom[780]
+	}
+
+	return key
+}
+
+// polyglotMove encodes a move the way the book stores it: to file, to rank, from
+// file, from rank and promotion piece, three bits each.  Castling is stored as
+// the king capturing its own rook.
+func polyglotMove(move Move) uint16 {
+	from, to := move.From(), move.To()
+	if move.IsKingsideCastle() {
+		to = from + 3
+	} else if move.IsQueensideCastle() {
+		to = from - 4
+	}
+
+	var promotion uint16
+	if move.IsPromotion() {
+		promotion = uint16(move.GetPromotionPiece() - 1)
+	}
+
+	return uint16(squareFile(to)) | uint16(squareRank(to))<<3 |
+		uint16(squareFile(from))<<6 | uint16(squareRank(from))<<9 | promotion<<12
+}
+
+func LoadOpeningBook(filename string) (*OpeningBook, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%POLYGLOT_ENTRY_SIZE != 0 {
+		return nil, fmt.Errorf("%s: not a Polyglot book (size %d)", filename, len(data))
+	}
+
+	book := &OpeningBook{filename: filename, entries: make([]PolyglotEntry, len(data)/POLYGLOT_ENTRY_SIZE)}
+	for i := range book.entries {
+		entry := data[i*POLYGLOT_ENTRY_SIZE:]
+		book.entries[i] = PolyglotEntry{
+			key:    binary.BigEndian.Uint64(entry),
+			move:   binary.BigEndian.Uint16(entry[8:]),
+			weight: binary.BigEndian.Uint16(entry[10:]),
+			learn:  binary.BigEndian.Uint32(entry[12:]),
+		}
+	}
+
+	// Books should already be sorted, but lookups depend on it
+	sort.SliceStable(book.entries, func(i, j int) bool {
+		return book.entries[i].key < book.entries[j].key
+	})
+
+	return book, nil
+}
+
+// WriteOpeningBook writes the entries as a Polyglot book, sorted by key and then
+// by weight (highest first).
+func WriteOpeningBook(filename string, entries []PolyglotEntry) error {
+	sorted := append([]PolyglotEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].key != sorted[j].key {
+			return sorted[i].key < sorted[j].key
+		}
+		return sorted[i].weight > sorted[j].weight
+	})
+
+	data := make([]byte, 0, len(sorted)*POLYGLOT_ENTRY_SIZE)
+	for _, entry := range sorted {
+		data = binary.BigEndian.AppendUint64(data, entry.key)
+		data = binary.BigEndian.AppendUint16(data, entry.move)
+		data = binary.BigEndian.AppendUint16(data, entry.weight)
+		data = binary.BigEndian.AppendUint32(data, entry.learn)
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// SetOpeningBook loads the book used by xboard; an empty filename removes it.
+func SetOpeningBook(filename string) error {
+	if filename == "" {
+		openingBook = nil
+		return nil
+	}
+	book, err := LoadOpeningBook(filename)
+	if err != nil {
+		return err
+	}
+	openingBook = book
+	return nil
+}
+
+// Lookup returns the entries for the position key.
+func (book *OpeningBook) Lookup(key uint64) []PolyglotEntry {
+	start := sort.Search(len(book.entries), func(i int) bool {
+		return book.entries[i].key >= key
+	})
+	end := start
+	for end < len(book.entries) && book.entries[end].key == key {
+		end++
+	}
+	return book.entries[start:end]
+}
+
+// Moves returns the legal book moves for the position, in book order.  Entries
+// that don't match a legal move (or have no weight) are skipped.
+func (book *OpeningBook) Moves(boardState *BoardState) []BookMove {
+	entries := book.Lookup(PolyglotKey(boardState))
+	if len(entries) == 0 {
+		return nil
+	}
+
+	legalMoves := make(map[uint16]Move)
+	for _, move := range GenerateLegalMoves(boardState) {
+		legalMoves[polyglotMove(move)] = move
+	}
+
+	var moves []BookMove
+	for _, entry := range entries {
+		if move, ok := legalMoves[entry.move]; ok && entry.weight > 0 {
+			moves = append(moves, BookMove{move: move, weight: entry.weight})
+		}
+	}
+	return moves
+}
+
+// ChooseMove picks a book move for the position: at random in proportion to the
+// weights if random is set, otherwise the move with the highest weight.
+func (book *OpeningBook) ChooseMove(boardState *BoardState, random bool, rng *rand.Rand) (Move, bool) {
+	moves := book.Moves(boardState)
+	if len(moves) == 0 {
+		return 0, false
+	}
+
+	if !random {
+		best := moves[0]
+		for _, bookMove := range moves[1:] {
+			if bookMove.weight > best.weight {
+				best = bookMove
+			}
+		}
+		return best.move, true
+	}
+
+	total := 0
+	for _, bookMove := range moves {
+		total += int(bookMove.weight)
+	}
+	pick := rng.Intn(total)
+	for _, bookMove := range moves {
+		pick -= int(bookMove.weight)
+		if pick < 0 {
+			return bookMove.move, true
+		}
+	}
+	return moves[len(moves)-1].move, true
+}
+
+// gamePly is the number of plies played since the start of the game, from the
+// move number.
+func gamePly(boardState *BoardState) int {
+	return 2*(int(boardState.fullmoveNumber)-1) + boardState.sideToMove
+}
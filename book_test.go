@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestBook writes the entries to a book file for the test, and returns the
+// filename.  The xboard book is restored afterwards.
+func writeTestBook(t *testing.T, entries []PolyglotEntry) string {
+	previous := openingBook
+	t.Cleanup(func() {
+		openingBook = previous
+	})
+
+	var data []byte
+	for _, entry := range entries {
+		data = binary.BigEndian.AppendUint64(data, entry.key)
+		data = binary.BigEndian.AppendUint16(data, entry.move)
+		data = binary.BigEndian.AppendUint16(data, entry.weight)
+		data = binary.BigEndian.AppendUint32(data, entry.learn)
+	}
+	return writeTestFile(t, "book.bin", string(data))
+}
+
+func bookEntry(t *testing.T, fen string, move string, weight uint16) PolyglotEntry {
+	boardState, err := CreateBoardStateFromFENString(fen)
+	assert.Nil(t, err)
+	parsed, err := ParseXboardMove(move, &boardState)
+	assert.Nil(t, err)
+	return PolyglotEntry{key: PolyglotKey(&boardState), move: polyglotMove(parsed), weight: weight}
+}
+
+// The examples from the Polyglot book format description
+func TestPolyglotKey(t *testing.T) {
+	for fen, key := range map[string]uint64{
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1":      0x463b96181691fc9c,
+		"rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1":   0x823c9b50fd114196,
+		"rnbqkbnr/ppp1pppp/8/3p4/4P3/8/PPPP1PPP/RNBQKBNR w KQkq d6 0 2": 0x0756b94461c50fb0,
+		"rnbqkbnr/ppp1pppp/8/3pP3/8/8/PPPP1PPP/RNBQKBNR b KQkq - 0 2":   0x662fafb965db29d4,
+		"rnbqkbnr/ppp1p1pp/8/3pPp2/8/8/PPPP1PPP/RNBQKBNR w KQkq f6 0 3": 0x22a48b5a8e47ff78,
+		"rnbqkbnr/ppp1p1pp/8/3pPp2/8/8/PPPPKPPP/RNBQ1BNR b kq - 0 3":    0x652a607ca3f242c1,
+		"rnbq1bnr/ppp1pkpp/8/3pPp2/8/8/PPPPKPPP/RNBQ1BNR w - - 0 4":     0x00fdd303c946bdd9,
+		"rnbqkbnr/p1pppppp/8/8/PpP4P/8/1P1PPPP1/RNBQKBNR b KQkq c3 0 3": 0x3c8123ea7b067637,
+		"rnbqkbnr/p1pppppp/8/8/P6P/R1p5/1P1PPPP1/1NBQKBNR b Kkq - 0 4":  0x5c3f9b829b279560,
+	} {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err)
+		assert.Equal(t, key, PolyglotKey(&boardState), fen)
+	}
+}
+
+func TestPolyglotMove(t *testing.T) {
+	assert.Equal(t, uint16(SQUARE_E4)|uint16(SQUARE_E2)<<6, polyglotMove(CreateMove(SQUARE_E2, SQUARE_E4)))
+	assert.Equal(t, uint16(SQUARE_H1)|uint16(SQUARE_E1)<<6, polyglotMove(CreateKingsideCastle(SQUARE_E1, SQUARE_G1)))
+	assert.Equal(t, uint16(SQUARE_A8)|uint16(SQUARE_E8)<<6, polyglotMove(CreateQueensideCastle(SQUARE_E8, SQUARE_C8)))
+	assert.Equal(t, uint16(SQUARE_B8)|uint16(SQUARE_A7)<<6|4<<12, polyglotMove(CreatePromotionCapture(SQUARE_A7, SQUARE_B8, QUEEN_MASK)))
+	assert.Equal(t, uint16(SQUARE_A1)|uint16(SQUARE_A2)<<6|1<<12, polyglotMove(CreatePromotion(SQUARE_A2, SQUARE_A1, KNIGHT_MASK)))
+}
+
+func TestOpeningBookChooseMove(t *testing.T) {
+	fen := "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+	filename := writeTestBook(t, []PolyglotEntry{
+		bookEntry(t, "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1", "e7e5", 1),
+		bookEntry(t, fen, "d2d4", 1),
+		bookEntry(t, fen, "e2e4", 3),
+		bookEntry(t, fen, "g1f3", 0),
+		// Not a legal move
+		bookEntry(t, fen, "e2e5", 10),
+	})
+	book, err := LoadOpeningBook(filename)
+	assert.Nil(t, err)
+
+	boardState, _ := CreateBoardStateFromFENString(fen)
+	moves := book.Moves(&boardState)
+	assert.Equal(t, 2, len(moves))
+
+	move, ok := book.ChooseMove(&boardState, false, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "e2e4", MoveToXboardString(move))
+
+	// Picked in proportion to the weights
+	rng := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		move, _ := book.ChooseMove(&boardState, true, rng)
+		counts[MoveToXboardString(move)]++
+	}
+	assert.Equal(t, 2, len(counts))
+	assert.InDelta(t, 3000, counts["e2e4"], 150)
+
+	boardState.ApplyMove(move)
+	move, ok = book.ChooseMove(&boardState, false, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "e7e5", MoveToXboardString(move))
+
+	boardState.ApplyMove(move)
+	_, ok = book.ChooseMove(&boardState, true, rng)
+	assert.False(t, ok)
+}
+
+func TestOpeningBookCastling(t *testing.T) {
+	fen := "r3k2r/pppppppp/8/8/8/8/PPPPPPPP/R3K2R b KQkq - 0 1"
+	filename := writeTestBook(t, []PolyglotEntry{bookEntry(t, fen, "e8c8", 1)})
+	book, err := LoadOpeningBook(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(SQUARE_A8)|uint16(SQUARE_E8)<<6, book.entries[0].move)
+
+	boardState, _ := CreateBoardStateFromFENString(fen)
+	move, ok := book.ChooseMove(&boardState, false, nil)
+	assert.True(t, ok)
+	assert.True(t, move.IsQueensideCastle())
+}
+
+func TestLoadOpeningBook(t *testing.T) {
+	_, err := LoadOpeningBook(writeTestFile(t, "bad.bin", "not a book"))
+	assert.NotNil(t, err)
+	_, err = LoadOpeningBook("/nonexistent/book.bin")
+	assert.NotNil(t, err)
+
+	// Entries are sorted for lookups
+	book, err := LoadOpeningBook(writeTestBook(t, []PolyglotEntry{{key: 3, weight: 1}, {key: 1, weight: 2}, {key: 3, weight: 3}}))
+	assert.Nil(t, err)
+	assert.Equal(t, []PolyglotEntry{{key: 3, weight: 1}, {key: 3, weight: 3}}, book.Lookup(3))
+	assert.Equal(t, 1, len(book.Lookup(1)))
+	assert.Equal(t, 0, len(book.Lookup(2)))
+}
+
+func TestXboardBookOptions(t *testing.T) {
+	fen := "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+	filename := writeTestBook(t, []PolyglotEntry{bookEntry(t, fen, "c2c4", 1)})
+
+	state := XboardState{ownBook: true, bookDepth: DEFAULT_BOOK_DEPTH}
+	_, state = ProcessXboardCommand("new", state)
+	_, ok := state.bookMove()
+	assert.False(t, ok)
+
+	action, state := ProcessXboardCommand("option BookFile="+filename, state)
+	assert.NotEqual(t, ACTION_ERROR, action)
+	move, ok := state.bookMove()
+	assert.True(t, ok)
+	assert.Equal(t, "c2c4", MoveToXboardString(move))
+
+	_, state = ProcessXboardCommand("option OwnBook=0", state)
+	_, ok = state.bookMove()
+	assert.False(t, ok)
+	_, state = ProcessXboardCommand("option OwnBook=1", state)
+	_, ok = state.bookMove()
+	assert.True(t, ok)
+
+	// The book isn't used after the book depth
+	_, state = ProcessXboardCommand("option BookDepth=0", state)
+	_, ok = state.bookMove()
+	assert.False(t, ok)
+
+	action, _ = ProcessXboardCommand("option BookDepth=many", state)
+	assert.Equal(t, ACTION_ERROR, action)
+	action, _ = ProcessXboardCommand("option BookFile=/nonexistent/book.bin", state)
+	assert.Equal(t, ACTION_ERROR, action)
+}
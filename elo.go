@@ -0,0 +1,34 @@
+package main
+
+import "math"
+
+// Elo returns the rating difference that gives the expected score (0-1).
+func Elo(score float64) float64 {
+	return 400 * math.Log10(score/(1-score))
+}
+
+// EloEstimate returns the Elo difference for a match result, and the margin of
+// its 95% confidence interval.  A score of 0% or 100% is infinitely far off.
+func EloEstimate(wins int, draws int, losses int) (float64, float64) {
+	games := float64(wins + draws + losses)
+	if games == 0 {
+		return 0, math.Inf(1)
+	}
+	score := (float64(wins) + float64(draws)/2) / games
+	if score == 0 || score == 1 {
+		return Elo(score), math.Inf(1)
+	}
+	variance := (float64(wins)*(1-score)*(1-score) +
+		float64(draws)*(0.5-score)*(0.5-score) +
+		float64(losses)*score*score) / games
+	margin := 1.959964 * math.Sqrt(variance/games)
+
+	high := Elo(math.Min(score+margin, 1))
+	low := Elo(math.Max(score-margin, 0))
+	return Elo(score), (high - low) / 2
+}
+
+// ExpectedScore returns the score (0-1) expected for a rating difference.
+func ExpectedScore(elo float64) float64 {
+	return 1 / (1 + math.Pow(10, -elo/400))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEloEstimate(t *testing.T) {
+	elo, margin := EloEstimate(10, 20, 10)
+	assert.InDelta(t, 0, elo, 0.001)
+	assert.Greater(t, margin, 0.0)
+
+	elo, _ = EloEstimate(3, 0, 1)
+	assert.InDelta(t, 190.85, elo, 0.01)
+
+	// More games narrow the margin
+	_, smallMargin := EloEstimate(300, 0, 100)
+	_, largeMargin := EloEstimate(30, 0, 10)
+	assert.Less(t, smallMargin, largeMargin)
+
+	elo, margin = EloEstimate(2, 0, 0)
+	assert.True(t, math.IsInf(elo, 1))
+	assert.True(t, math.IsInf(margin, 1))
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Endgame knowledge.  Positions are classified by their material signature
+// (e.g. "KBNvK"): specialised evaluators are registered for a signature and
+// replace the normal evaluation, while scale factors recognise drawish patterns
+// (opposite-colored bishops, wrong rook pawn) and shrink the normal evaluation
+// towards zero.
+//
+// Evaluators score the position from the point of view of the strong side,
+// which is the side named first in the signature.
+
+const KNOWN_WIN_SCORE = 10000
+
+const SCALE_FACTOR_NORMAL = 64
+const SCALE_FACTOR_DRAW = 0
+
+// An EndgameEvaluator returns the score from the strong side's perspective.  ok
+// is false if it has no special knowledge of the position, in which case the
+// normal evaluation is used.
+type EndgameEvaluator func(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) (score int, ok bool)
+
+// An EndgameScaler returns a scale factor (out of SCALE_FACTOR_NORMAL) to apply to
+// the evaluation when strongSide is ahead.
+type EndgameScaler func(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) int
+
+type endgameEntry struct {
+	name       string
+	strongSide int
+	evaluate   EndgameEvaluator
+}
+
+type endgameScalerEntry struct {
+	name  string
+	scale EndgameScaler
+}
+
+var endgameEvaluators = createEndgameEvaluators()
+
+var endgameScalers = []endgameScalerEntry{
+	{"oppositeColoredBishops", scaleOppositeColoredBishops},
+	{"wrongRookPawn", scaleWrongRookPawn},
+}
+
+func createEndgameEvaluators() map[uint64]endgameEntry {
+	evaluators := make(map[uint64]endgameEntry)
+	for signature, evaluate := range map[string]EndgameEvaluator{
+		"KBNvK": evalKBNK,
+		"KPvK":  evalKPK,
+		"KRvKP": evalKRKP,
+		"KQvKP": evalKQKP,
+		"KNNvK": evalDrawish,
+	} {
+		if err := registerEndgame(evaluators, signature, evaluate); err != nil {
+			panic(err)
+		}
+	}
+
+	return evaluators
+}
+
+// RegisterEndgame adds an evaluator for the given material signature, for both
+// colorings of the material.
+func RegisterEndgame(signature string, evaluate EndgameEvaluator) error {
+	return registerEndgame(endgameEvaluators, signature, evaluate)
+}
+
+func registerEndgame(evaluators map[uint64]endgameEntry, signature string, evaluate EndgameEvaluator) error {
+	counts, err := ParseMaterialSignature(signature)
+	if err != nil {
+		return err
+	}
+
+	name := strings.Replace(signature, "v", "", 1)
+	evaluators[materialKeyFromCounts(counts)] = endgameEntry{name: name, strongSide: WHITE_OFFSET, evaluate: evaluate}
+	counts[WHITE_OFFSET], counts[BLACK_OFFSET] = counts[BLACK_OFFSET], counts[WHITE_OFFSET]
+	evaluators[materialKeyFromCounts(counts)] = endgameEntry{name: name, strongSide: BLACK_OFFSET, evaluate: evaluate}
+
+	return nil
+}
+
+// ParseMaterialSignature converts a signature like "KRvKP" into piece counts,
+// indexed by color offset and piece mask.  The first side is white.
+func ParseMaterialSignature(signature string) ([2][7]int, error) {
+	var counts [2][7]int
+	sides := strings.Split(signature, "v")
+	if len(sides) != 2 {
+		return counts, fmt.Errorf("Invalid material signature: %s", signature)
+	}
+
+	for offset, side := range sides {
+		if !strings.HasPrefix(side, "K") || strings.Count(side, "K") != 1 {
+			return counts, fmt.Errorf("Invalid material signature (each side needs one king): %s", signature)
+		}
+		for _, r := range side[1:] {
+			switch r {
+			case 'P':
+				counts[offset][PAWN_MASK]++
+			case 'N':
+				counts[offset][KNIGHT_MASK]++
+			case 'B':
+				counts[offset][BISHOP_MASK]++
+			case 'R':
+				counts[offset][ROOK_MASK]++
+			case 'Q':
+				counts[offset][QUEEN_MASK]++
+			default:
+				return counts, fmt.Errorf("Invalid piece %c in material signature: %s", r, signature)
+			}
+		}
+		counts[offset][KING_MASK] = 1
+	}
+
+	return counts, nil
+}
+
+// The material key packs the number of each (non-king) piece per side into 4
+// bits apiece.
+func materialKeyFromCounts(counts [2][7]int) uint64 {
+	var key uint64
+	for side := WHITE_OFFSET; side <= BLACK_OFFSET; side++ {
+		for piece := PAWN_MASK; piece <= QUEEN_MASK; piece++ {
+			key |= uint64(Min(counts[side][piece], 15)) << (4 * (side*5 + int(piece) - 1))
+		}
+	}
+	return key
+}
+
+func materialKey(pieceBoards *[2][7]uint64) uint64 {
+	var counts [2][7]int
+	for side := WHITE_OFFSET; side <= BLACK_OFFSET; side++ {
+		for piece := PAWN_MASK; piece <= KING_MASK; piece++ {
+			counts[side][piece] = bits.OnesCount64(pieceBoards[side][piece])
+		}
+	}
+	return materialKeyFromCounts(counts)
+}
+
+// evalEndgame returns the adjustment (from white's perspective) that the endgame
+// knowledge makes to score, along with the name of the evaluator or scale factor
+// that produced it.
+func evalEndgame(boardState *BoardState, pieceBoards *[2][7]uint64, score int) (int, string) {
+	if entry, ok := endgameEvaluators[materialKey(pieceBoards)]; ok {
+		if endgameScore, ok := entry.evaluate(boardState, *pieceBoards, entry.strongSide); ok {
+			if entry.strongSide == BLACK_OFFSET {
+				endgameScore = -endgameScore
+			}
+			return endgameScore - score, entry.name
+		}
+	} else if strongSide, ok := isKXK(pieceBoards); ok {
+		endgameScore, _ := evalKXK(boardState, pieceBoards, strongSide)
+		if strongSide == BLACK_OFFSET {
+			endgameScore = -endgameScore
+		}
+		return endgameScore - score, "KXK"
+	}
+
+	if score == 0 {
+		return 0, ""
+	}
+	strongSide := WHITE_OFFSET
+	if score < 0 {
+		strongSide = BLACK_OFFSET
+	}
+	for _, scaler := range endgameScalers {
+		if scale := scaler.scale(boardState, *pieceBoards, strongSide); scale < SCALE_FACTOR_NORMAL {
+			return score*scale/SCALE_FACTOR_NORMAL - score, scaler.name
+		}
+	}
+
+	return 0, ""
+}
+
+func squareFile(sq byte) int {
+	return int(sq % 8)
+}
+
+func squareRank(sq byte) int {
+	return int(sq / 8)
+}
+
+// squareDistance is the number of king moves between two squares.
+func squareDistance(sq1 byte, sq2 byte) int {
+	return Max(Abs(squareFile(sq1)-squareFile(sq2)), Abs(squareRank(sq1)-squareRank(sq2)))
+}
+
+func isDarkSquare(sq byte) bool {
+	return (squareFile(sq)+squareRank(sq))%2 == 0
+}
+
+// relativeSquare mirrors the square vertically for black, so evaluators can
+// reason as if the strong side were white.
+func relativeSquare(side int, sq byte) byte {
+	if side == BLACK_OFFSET {
+		return sq ^ 56
+	}
+	return sq
+}
+
+// pushToEdge rewards the weak king for being far from the center (0 in the
+// center, 120 in a corner).
+func pushToEdge(sq byte) int {
+	fileDistance := Max(3-squareFile(sq), squareFile(sq)-4)
+	rankDistance := Max(3-squareRank(sq), squareRank(sq)-4)
+	return 20 * (fileDistance + rankDistance)
+}
+
+// pushClose rewards the strong king for approaching the weak king.
+func pushClose(sq1 byte, sq2 byte) int {
+	return 140 - 20*squareDistance(sq1, sq2)
+}
+
+func kingSquare(pieceBoards *[2][7]uint64, side int) byte {
+	return byte(bits.TrailingZeros64(pieceBoards[side][KING_MASK]))
+}
+
+func pieceSquare(pieceBoards *[2][7]uint64, side int, piece byte) byte {
+	return byte(bits.TrailingZeros64(pieceBoards[side][piece]))
+}
+
+func nonPawnMaterial(boardState *BoardState, pieceBoards *[2][7]uint64, side int) int {
+	materialScore := boardState.evalParams.materialScore()
+	material := 0
+	for piece := KNIGHT_MASK; piece <= QUEEN_MASK; piece++ {
+		material += bits.OnesCount64(pieceBoards[side][piece]) * materialScore[piece]
+	}
+	return material
+}
+
+func hasOnlyKing(pieceBoards *[2][7]uint64, side int) bool {
+	for piece := PAWN_MASK; piece <= QUEEN_MASK; piece++ {
+		if pieceBoards[side][piece] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isKXK returns true if one side has a bare king and the other has enough
+// material to force mate.
+func isKXK(pieceBoards *[2][7]uint64) (int, bool) {
+	for _, side := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		if !hasOnlyKing(pieceBoards, oppositeColorOffset(side)) {
+			continue
+		}
+		pieces := &pieceBoards[side]
+		bishops := pieces[BISHOP_MASK]
+		if pieces[QUEEN_MASK] != 0 || pieces[ROOK_MASK] != 0 ||
+			(bishops != 0 && pieces[KNIGHT_MASK] != 0) ||
+			(bishops&darkSquares != 0 && bishops&^darkSquares != 0) {
+			return side, true
+		}
+	}
+	return 0, false
+}
+
+var darkSquares uint64 = 0xAA55AA55AA55AA55
+
+// evalKXK drives the weak king to the edge of the board and brings the strong
+// king closer, which is enough for the search to find mate with heavy pieces.
+func evalKXK(boardState *BoardState, pieceBoards *[2][7]uint64, strongSide int) (int, bool) {
+	strongKing := kingSquare(pieceBoards, strongSide)
+	weakKing := kingSquare(pieceBoards, oppositeColorOffset(strongSide))
+
+	score := KNOWN_WIN_SCORE +
+		nonPawnMaterial(boardState, pieceBoards, strongSide) +
+		bits.OnesCount64(pieceBoards[strongSide][PAWN_MASK])*boardState.evalParams.Pawn +
+		pushToEdge(weakKing) +
+		pushClose(strongKing, weakKing)
+
+	return score, true
+}
+
+// evalKBNK drives the weak king into a corner of the same color as the bishop,
+// the only corners where mate can be forced.
+func evalKBNK(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) (int, bool) {
+	strongKing := kingSquare(&pieceBoards, strongSide)
+	weakKing := kingSquare(&pieceBoards, oppositeColorOffset(strongSide))
+
+	corner1, corner2 := SQUARE_A8, SQUARE_H1
+	if isDarkSquare(pieceSquare(&pieceBoards, strongSide, BISHOP_MASK)) {
+		corner1, corner2 = SQUARE_A1, SQUARE_H8
+	}
+	cornerDistance := Min(squareDistance(weakKing, corner1), squareDistance(weakKing, corner2))
+
+	score := KNOWN_WIN_SCORE +
+		nonPawnMaterial(boardState, &pieceBoards, strongSide) +
+		30*(7-cornerDistance) +
+		pushToEdge(weakKing)/4 +
+		pushClose(strongKing, weakKing)
+
+	return score, true
+}
+
+// evalKPK looks the position up in the KPK bitbase, returning a known win or an
+// exact draw.
+func evalKPK(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) (int, bool) {
+	if kpkBitbase == nil {
+		return 0, false
+	}
+
+	weakSide := oppositeColorOffset(strongSide)
+	pawn := pieceSquare(&pieceBoards, strongSide, PAWN_MASK)
+	if rank := squareRank(pawn); rank == 0 || rank == 7 {
+		// Only possible in a position set up by hand; it isn't in the table
+		return 0, false
+	}
+	if !kpkBitbase.Probe(strongSide, kingSquare(&pieceBoards, strongSide), pawn,
+		kingSquare(&pieceBoards, weakSide), boardState.sideToMove) {
+		return 0, true
+	}
+
+	return KNOWN_WIN_SCORE + boardState.evalParams.Pawn + 20*squareRank(relativeSquare(strongSide, pawn)), true
+}
+
+// evalKRKP follows the classic rules for rook against pawn: the rook wins if its
+// king gets in front of the pawn or the defending king is too far away, and is
+// drawish against an advanced pawn supported by its king.
+func evalKRKP(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) (int, bool) {
+	weakSide := oppositeColorOffset(strongSide)
+	strongKing := relativeSquare(strongSide, kingSquare(&pieceBoards, strongSide))
+	weakKing := relativeSquare(strongSide, kingSquare(&pieceBoards, weakSide))
+	rook := relativeSquare(strongSide, pieceSquare(&pieceBoards, strongSide, ROOK_MASK))
+	pawn := relativeSquare(strongSide, pieceSquare(&pieceBoards, weakSide, PAWN_MASK))
+	rookValue := boardState.evalParams.Rook
+
+	// From the strong side's point of view the pawn moves down the board
+	queeningSquare := idx(byte(squareFile(pawn)), 0)
+	pushedPawn := pawn - 8
+
+	weakToMove := 0
+	strongToMove := 0
+	if boardState.sideToMove == weakSide {
+		weakToMove = 1
+	} else {
+		strongToMove = 1
+	}
+
+	if squareFile(strongKing) == squareFile(pawn) && squareRank(strongKing) < squareRank(pawn) {
+		return rookValue - squareDistance(strongKing, pawn), true
+	}
+
+	if squareDistance(weakKing, pawn) >= 3+weakToMove && squareDistance(weakKing, rook) >= 3 {
+		return rookValue - squareDistance(strongKing, pawn), true
+	}
+
+	if squareRank(weakKing) <= 2 && squareDistance(weakKing, pawn) == 1 &&
+		squareRank(strongKing) >= 3 && squareDistance(strongKing, pawn) > 2+strongToMove {
+		return 80 - 8*squareDistance(strongKing, pawn), true
+	}
+
+	return 200 - 8*(squareDistance(strongKing, pushedPawn)-
+		squareDistance(weakKing, pushedPawn)-
+		squareDistance(pawn, queeningSquare)), true
+}
+
+// evalKQKP is a win unless the pawn is on its seventh rank on a rook or bishop
+// file, supported by its king.
+func evalKQKP(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) (int, bool) {
+	weakSide := oppositeColorOffset(strongSide)
+	strongKing := kingSquare(&pieceBoards, strongSide)
+	weakKing := kingSquare(&pieceBoards, weakSide)
+	pawn := pieceSquare(&pieceBoards, weakSide, PAWN_MASK)
+
+	score := pushClose(strongKing, weakKing)
+	pawnFile := squareFile(pawn)
+	drawishFile := pawnFile == 0 || pawnFile == 2 || pawnFile == 5 || pawnFile == 7
+	if squareRank(relativeSquare(strongSide, pawn)) != 1 || squareDistance(weakKing, pawn) != 1 || !drawishFile {
+		score += boardState.evalParams.Queen - boardState.evalParams.Pawn
+	}
+
+	return score, true
+}
+
+// evalDrawish is used for material that can't force mate even though mate is
+// possible (e.g. two knights).
+func evalDrawish(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) (int, bool) {
+	return 0, true
+}
+
+// scaleOppositeColoredBishops halves the evaluation when the only pieces are
+// bishops on opposite colors, and more than that if the pawn difference is small.
+func scaleOppositeColoredBishops(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) int {
+	for _, side := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		pieces := &pieceBoards[side]
+		if bits.OnesCount64(pieces[BISHOP_MASK]) != 1 ||
+			pieces[KNIGHT_MASK] != 0 || pieces[ROOK_MASK] != 0 || pieces[QUEEN_MASK] != 0 {
+			return SCALE_FACTOR_NORMAL
+		}
+	}
+	whiteBishop := pieceSquare(&pieceBoards, WHITE_OFFSET, BISHOP_MASK)
+	blackBishop := pieceSquare(&pieceBoards, BLACK_OFFSET, BISHOP_MASK)
+	if isDarkSquare(whiteBishop) == isDarkSquare(blackBishop) {
+		return SCALE_FACTOR_NORMAL
+	}
+
+	pawnDifference := bits.OnesCount64(pieceBoards[strongSide][PAWN_MASK]) -
+		bits.OnesCount64(pieceBoards[oppositeColorOffset(strongSide)][PAWN_MASK])
+	if pawnDifference <= 1 {
+		return SCALE_FACTOR_NORMAL / 4
+	}
+	return SCALE_FACTOR_NORMAL / 2
+}
+
+// scaleWrongRookPawn recognises bishop and rook pawn(s) against a bare king when
+// the bishop doesn't control the queening square and the defending king has
+// reached it.
+func scaleWrongRookPawn(boardState *BoardState, pieceBoards [2][7]uint64, strongSide int) int {
+	weakSide := oppositeColorOffset(strongSide)
+	pieces := &pieceBoards[strongSide]
+	if !hasOnlyKing(&pieceBoards, weakSide) || pieces[BISHOP_MASK] == 0 || pieces[PAWN_MASK] == 0 ||
+		pieces[KNIGHT_MASK] != 0 || pieces[ROOK_MASK] != 0 || pieces[QUEEN_MASK] != 0 {
+		return SCALE_FACTOR_NORMAL
+	}
+
+	var fileA uint64 = 0x0101010101010101
+	var fileH uint64 = fileA << 7
+	var queeningSquare byte
+	switch {
+	case pieces[PAWN_MASK]&^fileA == 0:
+		queeningSquare = relativeSquare(strongSide, SQUARE_A8)
+	case pieces[PAWN_MASK]&^fileH == 0:
+		queeningSquare = relativeSquare(strongSide, SQUARE_H8)
+	default:
+		return SCALE_FACTOR_NORMAL
+	}
+
+	if isDarkSquare(queeningSquare) {
+		if pieces[BISHOP_MASK]&darkSquares != 0 {
+			return SCALE_FACTOR_NORMAL
+		}
+	} else if pieces[BISHOP_MASK]&^darkSquares != 0 {
+		return SCALE_FACTOR_NORMAL
+	}
+
+	if squareDistance(kingSquare(&pieceBoards, weakSide), queeningSquare) <= 1 {
+		return SCALE_FACTOR_DRAW
+	}
+	return SCALE_FACTOR_NORMAL
+}
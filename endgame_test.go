@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func evalFen(t *testing.T, fen string) BoardEval {
+	boardState, err := CreateBoardStateFromFENString(fen)
+	assert.Nil(t, err, fen)
+	return Eval(&boardState)
+}
+
+func TestParseMaterialSignature(t *testing.T) {
+	counts, err := ParseMaterialSignature("KRPvKBP")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, counts[WHITE_OFFSET][ROOK_MASK])
+	assert.Equal(t, 1, counts[WHITE_OFFSET][PAWN_MASK])
+	assert.Equal(t, 1, counts[BLACK_OFFSET][BISHOP_MASK])
+	assert.Equal(t, 1, counts[BLACK_OFFSET][PAWN_MASK])
+
+	for _, signature := range []string{"KRK", "RvK", "KXvK", "KKvK"} {
+		_, err := ParseMaterialSignature(signature)
+		assert.NotNil(t, err, signature)
+	}
+}
+
+func TestMaterialKeyMatchesSignature(t *testing.T) {
+	boardState, err := CreateBoardStateFromFENString("8/8/4k3/8/8/2B5/8/1N2K3 w - - 0 1")
+	assert.Nil(t, err)
+
+	counts, err := ParseMaterialSignature("KBNvK")
+	assert.Nil(t, err)
+
+	var pieceBoards [2][7]uint64
+	for piece := PAWN_MASK; piece <= KING_MASK; piece++ {
+		for side := WHITE_OFFSET; side <= BLACK_OFFSET; side++ {
+			pieceBoards[side][piece] = boardState.bitboards.piece[piece] & boardState.bitboards.color[side]
+		}
+	}
+	assert.Equal(t, materialKeyFromCounts(counts), materialKey(&pieceBoards))
+}
+
+func TestHasMatingMaterial(t *testing.T) {
+	assert.False(t, evalFen(t, "8/8/4k3/8/8/8/8/2B1K3 w - - 0 1").hasMatingMaterial)
+	assert.False(t, evalFen(t, "8/8/4k3/3n4/8/8/8/2B1K3 w - - 0 1").hasMatingMaterial)
+	assert.True(t, evalFen(t, "8/8/4k3/8/8/8/8/1NB1K3 w - - 0 1").hasMatingMaterial)
+	assert.True(t, evalFen(t, "8/8/4k3/8/8/8/8/R3K3 w - - 0 1").hasMatingMaterial)
+	assert.True(t, evalFen(t, "8/8/4k3/8/8/8/P7/4K3 w - - 0 1").hasMatingMaterial)
+}
+
+func TestEvalKXK(t *testing.T) {
+	// The kings are the same distance apart in each position
+	center := evalFen(t, "8/8/8/3k4/8/3K4/8/Q7 w - - 0 1")
+	edge := evalFen(t, "3k4/8/3K4/8/8/8/8/Q7 w - - 0 1")
+	corner := evalFen(t, "k7/8/1K6/8/8/8/8/Q7 w - - 0 1")
+
+	assert.Equal(t, "KXK", center.endgameName)
+	assert.True(t, center.value() > KNOWN_WIN_SCORE)
+	assert.True(t, edge.value() > center.value())
+	assert.True(t, corner.value() > edge.value())
+
+	// The weak side sees the same position as lost
+	black := evalFen(t, "k7/8/1K6/8/8/8/8/Q7 b - - 0 1")
+	assert.Equal(t, -corner.value(), black.value())
+}
+
+func TestEvalKBNKPrefersBishopCorner(t *testing.T) {
+	// Dark-squared bishop: mate can only be forced in a1 or h8
+	right := evalFen(t, "8/8/8/8/8/8/2K5/k1B1N3 w - - 0 1")
+	wrong := evalFen(t, "k2BN3/2K5/8/8/8/8/8/8 w - - 0 1")
+
+	assert.Equal(t, "KBNK", right.endgameName)
+	assert.True(t, right.value() > wrong.value())
+	assert.True(t, wrong.value() > KNOWN_WIN_SCORE)
+}
+
+func TestEvalKRKP(t *testing.T) {
+	// The rook's king is in front of the pawn
+	won := evalFen(t, "8/8/8/3p4/4k3/8/3K4/7R w - - 0 1")
+	assert.Equal(t, "KRKP", won.endgameName)
+	assert.True(t, won.value() > 400)
+
+	// Advanced pawn supported by its king, rook's king far away
+	drawish := evalFen(t, "K7/8/8/8/8/8/2kp4/7R w - - 0 1")
+	assert.True(t, drawish.value() < 100)
+}
+
+func TestEvalKQKP(t *testing.T) {
+	// A bishop pawn on the seventh supported by its king holds the draw
+	drawish := evalFen(t, "K7/8/8/8/8/8/1kp5/7Q w - - 0 1")
+	won := evalFen(t, "K7/8/8/8/8/8/2kp4/7Q w - - 0 1")
+
+	assert.Equal(t, "KQKP", drawish.endgameName)
+	assert.True(t, drawish.value() < 200)
+	assert.True(t, won.value() > 600)
+}
+
+func TestEvalKNNKIsDrawish(t *testing.T) {
+	assert.Equal(t, 0, evalFen(t, "8/8/4k3/8/8/8/8/1N2KN2 w - - 0 1").value())
+}
+
+func TestScaleOppositeColoredBishops(t *testing.T) {
+	opposite := evalFen(t, "4k3/4b3/8/8/3P4/8/2B1P3/4K3 w - - 0 1")
+	same := evalFen(t, "4k3/5b2/8/8/3P4/8/2B1P3/4K3 w - - 0 1")
+
+	assert.Equal(t, "oppositeColoredBishops", opposite.endgameName)
+	assert.True(t, opposite.value() > 0)
+	assert.True(t, opposite.value() < same.value())
+	assert.Equal(t, 0, same.endgame)
+}
+
+func TestScaleWrongRookPawn(t *testing.T) {
+	// h8 is a dark square, so only the dark-squared bishop can drive the king out
+	rightBishop := evalFen(t, "7k/8/8/8/7P/8/3B4/4K3 w - - 0 1")
+	wrongBishop := evalFen(t, "7k/8/8/8/7P/8/4B3/4K3 w - - 0 1")
+
+	assert.Equal(t, "wrongRookPawn", wrongBishop.endgameName)
+	assert.Equal(t, 0, wrongBishop.value())
+	assert.Equal(t, 0, rightBishop.endgame)
+	assert.True(t, rightBishop.value() > 0)
+}
+
+func TestEndgameTraceTotalMatchesEval(t *testing.T) {
+	for _, fen := range []string{
+		"k7/8/8/8/8/8/8/Q3K3 b - - 0 1",
+		"8/8/8/8/8/8/2K5/k1B1N3 w - - 0 1",
+		"4k3/4b3/8/8/3P4/8/2B1P3/4K3 w - - 0 1",
+	} {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err)
+
+		boardEval, trace := TraceEval(&boardState)
+		expected := boardEval.value()
+		if boardEval.sideToMove == BLACK_OFFSET {
+			expected = -expected
+		}
+		assert.Equal(t, expected, trace.Total(), fen)
+	}
+}
+
+func TestSearchKRKFindsMate(t *testing.T) {
+	boardState, err := CreateBoardStateFromFENString("k7/8/1K6/8/8/8/8/7R w - - 0 1")
+	assert.Nil(t, err)
+
+	result := Search(&boardState, 3, &SearchStats{}, &SearchMoveInfo{})
+
+	assert.Equal(t, CHECKMATE_FLAG, result.flags&CHECKMATE_FLAG)
+	assert.Equal(t, SQUARE_H8, result.move.To())
+}
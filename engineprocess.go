@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Engines run as subprocesses for the gauntlet, spoken to over the xboard or
+// UCI protocol.
+
+// EngineConfig describes how to start an engine, as read from the gauntlet's
+// JSON file.
+type EngineConfig struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// Working directory of the engine, the current directory if empty
+	Dir string `json:"dir"`
+	// "xboard" (the default) or "uci"
+	Protocol string `json:"protocol"`
+	// Engine options, sent with the xboard option or UCI setoption command
+	Options map[string]string `json:"options"`
+}
+
+var errEngineExited = errors.New("Engine exited")
+var errEngineTimeout = errors.New("Engine didn't reply in time")
+var errEngineResigned = errors.New("Engine resigned")
+
+// How long engines get to start up and to answer ping or isready
+const ENGINE_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// LoadEngineConfigs reads a JSON array of engine configurations, filling in the
+// name and protocol if they're missing.
+func LoadEngineConfigs(filename string) ([]EngineConfig, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var configs []EngineConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	for i := range configs {
+		config := &configs[i]
+		if config.Command == "" {
+			return nil, fmt.Errorf("%s: engine %d has no command", filename, i+1)
+		}
+		if config.Name == "" {
+			config.Name = filepath.Base(config.Command)
+		}
+		if config.Protocol == "" {
+			config.Protocol = "xboard"
+		}
+		if config.Protocol != "xboard" && config.Protocol != "uci" {
+			return nil, fmt.Errorf("%s: unknown protocol %s for %s", filename, config.Protocol, config.Name)
+		}
+	}
+	return configs, nil
+}
+
+// externalEngine is a running engine, playing one game at a time.
+type externalEngine interface {
+	// newGame sets up a game from the position with the time control
+	newGame(fen string, timeControl TimeControl, opponent string) error
+	// play sends the moves of the game so far and returns the engine's move,
+	// which must come before the deadline
+	play(moves []Move, clocks *gameClocks, deadline time.Time) (string, error)
+	gameOver(result string, reason string)
+	quit()
+}
+
+// startExternalEngine starts the engine process and goes through the protocol's
+// handshake.
+func startExternalEngine(config EngineConfig) (externalEngine, error) {
+	process, err := startEngineProcess(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var engine externalEngine
+	if config.Protocol == "uci" {
+		engine, err = newUCIEngine(process, config.Options)
+	} else {
+		engine, err = newXboardEngine(process, config.Options)
+	}
+	if err != nil {
+		process.close()
+		return nil, fmt.Errorf("%s: %w", config.Name, err)
+	}
+	return engine, nil
+}
+
+type engineProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// The engine's output, closed when it exits
+	lines  chan string
+	exited chan bool
+}
+
+func startEngineProcess(config EngineConfig) (*engineProcess, error) {
+	cmd := exec.Command(config.Command, config.Args...)
+	cmd.Dir = config.Dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %w", config.Name, err)
+	}
+
+	process := &engineProcess{cmd: cmd, stdin: stdin, lines: make(chan string, 1024), exited: make(chan bool)}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			process.lines <- scanner.Text()
+		}
+		close(process.lines)
+		cmd.Wait()
+		close(process.exited)
+	}()
+	return process, nil
+}
+
+func (process *engineProcess) send(format string, a ...interface{}) error {
+	if _, err := fmt.Fprintf(process.stdin, format+"\n", a...); err != nil {
+		return errEngineExited
+	}
+	return nil
+}
+
+// readUntil reads the engine's output until a line matches, skipping the rest.
+func (process *engineProcess) readUntil(deadline time.Time, match func(line string) bool) (string, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-process.lines:
+			if !ok {
+				return "", errEngineExited
+			}
+			if match(strings.TrimSpace(line)) {
+				return strings.TrimSpace(line), nil
+			}
+		case <-timer.C:
+			return "", errEngineTimeout
+		}
+	}
+}
+
+// close waits a moment for the engine to exit once its input is closed, and
+// kills it if it doesn't.
+func (process *engineProcess) close() {
+	process.stdin.Close()
+	select {
+	case <-process.exited:
+	case <-time.After(time.Second):
+		process.cmd.Process.Kill()
+		<-process.exited
+	}
+}
+
+type xboardEngine struct {
+	process  *engineProcess
+	features map[string]string
+	pings    int
+	// The number of moves of the game the engine has been told about
+	movesSent int
+}
+
+var xboardFeatureRegexp = regexp.MustCompile(`(\w+)=("[^"]*"|\S+)`)
+var xboardEngineMoveRegexp = regexp.MustCompile(`^(?:move\s+|My move is\s*:\s*)(\S+)$`)
+
+// parseXboardFeatures returns the features of a feature command, with the
+// quotes taken off string values.
+func parseXboardFeatures(line string) map[string]string {
+	features := make(map[string]string)
+	for _, arr := range xboardFeatureRegexp.FindAllStringSubmatch(strings.TrimPrefix(line, "feature "), -1) {
+		features[arr[1]] = strings.Trim(arr[2], "\"")
+	}
+	return features
+}
+
+func newXboardEngine(process *engineProcess, options map[string]string) (*xboardEngine, error) {
+	engine := &xboardEngine{process: process, features: make(map[string]string)}
+	if err := process.send("xboard\nprotover 2"); err != nil {
+		return nil, err
+	}
+
+	// Protocol 2 engines list their features until done=1, or ask for more time
+	// with done=0.  Older engines don't reply at all.
+	deadline := time.Now().Add(2 * time.Second)
+	for engine.features["done"] != "1" {
+		line, err := process.readUntil(deadline, func(line string) bool {
+			return strings.HasPrefix(line, "feature ")
+		})
+		if err == errEngineTimeout {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for name, value := range parseXboardFeatures(line) {
+			engine.features[name] = value
+			if name != "done" {
+				process.send("accepted %s", name)
+			}
+		}
+		if engine.features["done"] == "0" {
+			deadline = time.Now().Add(time.Hour)
+		}
+	}
+
+	for name, value := range options {
+		if err := process.send("option %s=%s", name, value); err != nil {
+			return nil, err
+		}
+	}
+	return engine, nil
+}
+
+func (engine *xboardEngine) newGame(fen string, timeControl TimeControl, opponent string) error {
+	engine.movesSent = 0
+	engine.process.send("new\nforce\neasy")
+	if fen != STARTING_FEN {
+		if engine.features["setboard"] != "1" {
+			return errors.New("Engine doesn't support setboard")
+		}
+		engine.process.send("setboard %s", fen)
+	}
+	engine.process.send("level %s", timeControl.xboardLevel())
+	if engine.features["name"] == "1" {
+		engine.process.send("name %s", opponent)
+	}
+	return engine.sync()
+}
+
+// sync waits for the engine to finish the commands sent so far, if it supports
+// ping.
+func (engine *xboardEngine) sync() error {
+	if engine.features["ping"] != "1" {
+		return nil
+	}
+	engine.pings++
+	pong := fmt.Sprintf("pong %d", engine.pings)
+	if err := engine.process.send("ping %d", engine.pings); err != nil {
+		return err
+	}
+	_, err := engine.process.readUntil(time.Now().Add(ENGINE_HANDSHAKE_TIMEOUT), func(line string) bool {
+		return line == pong
+	})
+	return err
+}
+
+// play keeps the engine in force mode between its moves, so it's told the
+// opponent's moves and asked to move with go.
+func (engine *xboardEngine) play(moves []Move, clocks *gameClocks, deadline time.Time) (string, error) {
+	prefix := ""
+	if engine.features["usermove"] == "1" {
+		prefix = "usermove "
+	}
+	for _, move := range moves[engine.movesSent:] {
+		engine.process.send("%s%s", prefix, MoveToXboardString(move))
+	}
+	side := clocks.sideToMove
+	engine.process.send("time %d", clocks.remaining[side].Milliseconds()/10)
+	engine.process.send("otim %d", clocks.remaining[oppositeColorOffset(side)].Milliseconds()/10)
+	if err := engine.process.send("go"); err != nil {
+		return "", err
+	}
+
+	line, err := engine.process.readUntil(deadline, func(line string) bool {
+		return xboardEngineMoveRegexp.MatchString(line) || strings.HasPrefix(line, "resign")
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "resign") {
+		return "", errEngineResigned
+	}
+
+	engine.process.send("force")
+	engine.movesSent = len(moves) + 1
+	return xboardEngineMoveRegexp.FindStringSubmatch(line)[1], nil
+}
+
+func (engine *xboardEngine) gameOver(result string, reason string) {
+	engine.process.send("result %s {%s}", result, reason)
+}
+
+func (engine *xboardEngine) quit() {
+	engine.process.send("quit")
+	engine.process.close()
+}
+
+type uciEngine struct {
+	process     *engineProcess
+	fen         string
+	timeControl TimeControl
+}
+
+var uciBestMoveRegexp = regexp.MustCompile(`^bestmove\s+(\S+)`)
+
+func newUCIEngine(process *engineProcess, options map[string]string) (*uciEngine, error) {
+	engine := &uciEngine{process: process}
+	if err := process.send("uci"); err != nil {
+		return nil, err
+	}
+	_, err := process.readUntil(time.Now().Add(ENGINE_HANDSHAKE_TIMEOUT), func(line string) bool {
+		return line == "uciok"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range options {
+		if err := process.send("setoption name %s value %s", name, value); err != nil {
+			return nil, err
+		}
+	}
+	return engine, engine.sync()
+}
+
+func (engine *uciEngine) sync() error {
+	if err := engine.process.send("isready"); err != nil {
+		return err
+	}
+	_, err := engine.process.readUntil(time.Now().Add(ENGINE_HANDSHAKE_TIMEOUT), func(line string) bool {
+		return line == "readyok"
+	})
+	return err
+}
+
+func (engine *uciEngine) newGame(fen string, timeControl TimeControl, opponent string) error {
+	engine.fen = fen
+	engine.timeControl = timeControl
+	if err := engine.process.send("ucinewgame"); err != nil {
+		return err
+	}
+	return engine.sync()
+}
+
+func (engine *uciEngine) play(moves []Move, clocks *gameClocks, deadline time.Time) (string, error) {
+	position := "position fen " + engine.fen
+	if engine.fen == STARTING_FEN {
+		position = "position startpos"
+	}
+	if len(moves) > 0 {
+		moveStrings := make([]string, len(moves))
+		for i, move := range moves {
+			moveStrings[i] = MoveToXboardString(move)
+		}
+		position += " moves " + strings.Join(moveStrings, " ")
+	}
+
+	goCommand := fmt.Sprintf("go wtime %d btime %d", clocks.remaining[WHITE_OFFSET].Milliseconds(),
+		clocks.remaining[BLACK_OFFSET].Milliseconds())
+	if increment := engine.timeControl.increment.Milliseconds(); increment > 0 {
+		goCommand += fmt.Sprintf(" winc %d binc %d", increment, increment)
+	}
+	if movesToGo := clocks.movesToGo(clocks.sideToMove); movesToGo > 0 {
+		goCommand += fmt.Sprintf(" movestogo %d", movesToGo)
+	}
+
+	engine.process.send(position)
+	if err := engine.process.send(goCommand); err != nil {
+		return "", err
+	}
+	line, err := engine.process.readUntil(deadline, uciBestMoveRegexp.MatchString)
+	if err != nil {
+		return "", err
+	}
+	return uciBestMoveRegexp.FindStringSubmatch(line)[1], nil
+}
+
+func (engine *uciEngine) gameOver(result string, reason string) {
+}
+
+func (engine *uciEngine) quit() {
+	engine.process.send("quit")
+	engine.process.close()
+}
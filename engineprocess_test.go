@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGauntletHelperEngine isn't a real test: the gauntlet tests run the test
+// binary as an engine, which ends up here.  The argument after -- picks the
+// engine: xboard runs our own xboard mode, uci plays the first legal move, and
+// crash, hang and illegal misbehave when asked to move.
+func TestGauntletHelperEngine(t *testing.T) {
+	if os.Getenv("RA_GAUNTLET_HELPER") != "1" {
+		return
+	}
+	defer os.Exit(0)
+	logger = log.New(io.Discard, "", 0)
+
+	mode := flag.Arg(0)
+	if mode == "xboard" {
+		RunXboard(bufio.NewScanner(os.Stdin), bufio.NewWriter(os.Stdout))
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	boardState := CreateInitialBoardState()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "uci":
+			fmt.Println("id name helper\nuciok")
+		case "isready":
+			fmt.Println("readyok")
+		case "position":
+			fen, moves := STARTING_FEN, fields[2:]
+			if fields[1] == "fen" {
+				fen, moves = strings.Join(fields[2:8], " "), fields[8:]
+			}
+			boardState.ResetFromFENString(fen)
+			for i := 1; i < len(moves); i++ {
+				move, _ := ParseXboardMove(moves[i], &boardState)
+				boardState.ApplyMove(move)
+			}
+		case "go":
+			switch mode {
+			case "crash":
+				os.Exit(1)
+			case "hang":
+			case "illegal":
+				fmt.Println("bestmove a1a1")
+			default:
+				fmt.Println("bestmove " + MoveToXboardString(GenerateLegalMoves(&boardState)[0]))
+			}
+		case "quit":
+			return
+		}
+	}
+}
+
+// helperEngineConfig returns the configuration of a helper engine.
+func helperEngineConfig(t *testing.T, name string, protocol string, mode string) EngineConfig {
+	t.Setenv("RA_GAUNTLET_HELPER", "1")
+	return EngineConfig{
+		Name:     name,
+		Command:  os.Args[0],
+		Args:     []string{"-test.run=^TestGauntletHelperEngine$", "--", mode},
+		Protocol: protocol,
+	}
+}
+
+func TestParseXboardFeatures(t *testing.T) {
+	features := parseXboardFeatures(`feature myname="ra v0.0.1" setboard=1 option="BookDepth -spin 20 0 500" done=1`)
+	assert.Equal(t, "ra v0.0.1", features["myname"])
+	assert.Equal(t, "1", features["setboard"])
+	assert.Equal(t, "BookDepth -spin 20 0 500", features["option"])
+	assert.Equal(t, "1", features["done"])
+}
+
+func TestLoadEngineConfigs(t *testing.T) {
+	filename := writeTestFile(t, "engines.json", `[
+		{"command": "/usr/local/bin/ra-chess-engine"},
+		{"name": "other", "command": "other", "protocol": "uci", "options": {"Hash": "16"}}
+	]`)
+	configs, err := LoadEngineConfigs(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(configs))
+	assert.Equal(t, "ra-chess-engine", configs[0].Name)
+	assert.Equal(t, "xboard", configs[0].Protocol)
+	assert.Equal(t, "uci", configs[1].Protocol)
+	assert.Equal(t, "16", configs[1].Options["Hash"])
+
+	filename = writeTestFile(t, "engines.json", `[{"command": "ra", "protocol": "cecp"}]`)
+	_, err = LoadEngineConfigs(filename)
+	assert.NotNil(t, err)
+}
+
+func TestExternalEngineXboard(t *testing.T) {
+	engine, err := startExternalEngine(helperEngineConfig(t, "ra", "xboard", "xboard"))
+	assert.Nil(t, err)
+	defer engine.quit()
+	assert.Equal(t, "1", engine.(*xboardEngine).features["ping"])
+
+	timeControl := TimeControl{base: 2 * time.Second}
+	assert.Nil(t, engine.newGame("6k1/8/8/8/8/8/8/4K2Q w - - 0 1", timeControl, "bob"))
+	clocks := newGameClocks(timeControl, WHITE_OFFSET)
+	reply, err := engine.play(nil, clocks, time.Now().Add(clocks.remaining[WHITE_OFFSET]))
+	assert.Nil(t, err)
+	assert.Regexp(t, "^[a-h][1-8][a-h][1-8]$", reply)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -13,13 +15,54 @@ type EpdLine struct {
 	bestMove  string
 	avoidMove string
 	name      string
+	// game result from the c9 opcode ("1-0", "0-1", "1/2-1/2"), used for tuning
+	result string
+
+	// every operation on the line, in order
+	operations []EpdOperation
+}
+
+type EpdOperation struct {
+	opcode   string
+	operands []string
+}
+
+var epdOpcodeRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,14}$`)
+
+// Opcodes whose operand is a single integer
+var epdIntegerOpcodeRegexp = regexp.MustCompile(`^(ce|acd|acn|acs|dm|fmvn|hmvc|D[0-9]+)$`)
+
+// Opcodes whose operand is a string, which is always quoted when written
+var epdStringOpcodeRegexp = regexp.MustCompile(`^(id|c[0-9])$`)
+
+var epdStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// EpdLineErrors holds an error for each line of an EPD file that couldn't be
+// parsed.
+type EpdLineErrors []error
+
+func (errs EpdLineErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func (errs EpdLineErrors) Unwrap() []error {
+	return errs
 }
 
 // ParseAndFilterEpdFile parses a slice of EpdLine objects from a passed in filename.
 // The slice is then filtered down to only only objects with a name that match the regex.
+// Lines that can't be parsed are printed and skipped.
 func ParseAndFilterEpdFile(epdFile string, regex string) ([]EpdLine, error) {
 	lines, err := ParseEpdFile(epdFile)
-	if err != nil {
+	var lineErrors EpdLineErrors
+	if errors.As(err, &lineErrors) {
+		fmt.Println(lineErrors)
+		fmt.Printf("Skipped %d invalid lines of %s\n", len(lineErrors), epdFile)
+	} else if err != nil {
 		return lines, err
 	}
 
@@ -40,11 +83,21 @@ func ParseAndFilterEpdFile(epdFile string, regex string) ([]EpdLine, error) {
 // r5r1/pQ5p/1qp2R2/2k1p3/4P3/2PP4/P1P3PP/6K1 w - - bm Rxc6; id "testWac126";
 // 4r3/p1p1rpbk/b1n3p1/1N1p1q1p/3P1B1P/1PN2PP1/P5Q1/2RR2K1 w - - am Nxc7; id "arasan6.12";
 //
+// Positions labelled with a game result (for tuning) use the c9 opcode:
+// rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq - c9 "1/2-1/2";
+//
+// Perft suites give the node counts with D1..Dn, and may include the move
+// counters after the position:
+// rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1 ;D1 20 ;D2 400
+//
 // It's also legal to not specify a bm/am or an id, for example:
 // 4rk2/2p1n1bQ/1p2Bpp1/1q2B1N1/p1b1PP2/6P1/P1P5/3r1RK1 w - -
 //
-// How the last case is handled is different for perft/tactics/eval.  Tactics will assume
-// that the desired move is checkmate for determining correctness.
+// How the last case is handled is different for perft/tactics/eval.  Tactics reports the
+// position as unscorable unless it has a dm opcode for the expected mate.
+//
+// Lines that can't be parsed are left out, and reported together in an
+// EpdLineErrors after the good lines have been read.
 func ParseEpdFile(epdFile string) ([]EpdLine, error) {
 	lines := make([]EpdLine, 0)
 	file, err := os.Open(epdFile)
@@ -55,50 +108,287 @@ func ParseEpdFile(epdFile string) ([]EpdLine, error) {
 	scanner := bufio.NewScanner(file)
 	defer file.Close()
 
-	totalPositions := 0
-
+	var lineErrors EpdLineErrors
+	lineNumber := 0
 	for scanner.Scan() {
-		totalPositions++
-
-		line := strings.Split(scanner.Text(), ";")
-		var fen string
-		var bestMove string
-		var avoidMove string
-		var name string
-
-		if len(line) == 1 {
-			// no answers, just run stuff
-			fen = line[0]
-			name = fmt.Sprintf("position-%d", (totalPositions + 1))
-		} else {
-			fenWithMove, nameWithID := line[0], line[1]
-			arr := strings.Split(fenWithMove, "bm")
-			if len(arr) == 2 {
-				fen, bestMove = strings.Trim(arr[0], " "), strings.Trim(arr[1], " ")
-				arr2 := strings.Split(nameWithID, "id ")
-				if len(arr2) == 1 {
-					name = fmt.Sprintf("Position%d", totalPositions)
-				} else {
-					name = strings.Trim(arr2[1], "\"")
+		lineNumber++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		line, err := ParseEpdLine(text)
+		if err != nil {
+			lineErrors = append(lineErrors, fmt.Errorf("%s:%d: %s", epdFile, lineNumber, err))
+			continue
+		}
+		if line.name == "" {
+			line.name = fmt.Sprintf("position-%d", lineNumber)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, err
+	}
+	if len(lineErrors) > 0 {
+		return lines, lineErrors
+	}
+
+	return lines, nil
+}
+
+// ParseEpdLine parses the position and operations of a single EPD record.
+func ParseEpdLine(str string) (EpdLine, error) {
+	var line EpdLine
+
+	fields := strings.Fields(str)
+	if len(fields) < 4 {
+		return line, fmt.Errorf("EPD record is missing position fields: %s", str)
+	}
+	position := fields[:4]
+	if strings.Contains(strings.Join(position, " "), ";") {
+		return line, fmt.Errorf("EPD record is missing position fields: %s", str)
+	}
+
+	// Skip past the position fields to the operations
+	rest := str
+	for i := 0; i < 4; i++ {
+		rest = strings.TrimLeft(rest, " \t")
+		rest = rest[len(fields[i]):]
+	}
+
+	// Some files (perft suites in particular) keep the FEN move counters
+	if len(fields) >= 6 && isEpdInteger(fields[4]) && isEpdInteger(fields[5]) {
+		position = fields[:6]
+		for i := 4; i < 6; i++ {
+			rest = strings.TrimLeft(rest, " \t")
+			rest = rest[len(fields[i]):]
+		}
+	}
+	line.fen = strings.Join(position, " ")
+
+	operations, err := parseEpdOperations(rest)
+	if err != nil {
+		return line, err
+	}
+	for _, operation := range operations {
+		line.setOperation(operation)
+	}
+
+	return line, nil
+}
+
+func isEpdInteger(str string) bool {
+	_, err := strconv.ParseInt(str, 10, 64)
+	return err == nil
+}
+
+// parseEpdOperations tokenizes "opcode operand ...;" operations.  Operands are
+// either quoted strings or runs of non-space characters.
+func parseEpdOperations(str string) ([]EpdOperation, error) {
+	var operations []EpdOperation
+	var operation *EpdOperation
+
+	for i := 0; i < len(str); {
+		c := str[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == ';':
+			if operation != nil {
+				operations = append(operations, *operation)
+				operation = nil
+			}
+			i++
+		case c == '"':
+			operand, length, ok := parseEpdString(str[i:])
+			if !ok {
+				return nil, fmt.Errorf("Unterminated string in EPD operations: %s", str)
+			}
+			if operation == nil {
+				return nil, fmt.Errorf("EPD operand without an opcode: %s", str)
+			}
+			operation.operands = append(operation.operands, operand)
+			i += length
+		default:
+			end := strings.IndexAny(str[i:], " \t;")
+			if end < 0 {
+				end = len(str) - i
+			}
+			token := str[i : i+end]
+			i += end
+
+			if operation == nil {
+				if !epdOpcodeRegexp.MatchString(token) {
+					return nil, fmt.Errorf("Invalid EPD opcode %s", token)
 				}
+				operation = &EpdOperation{opcode: token}
 			} else {
-				arr = strings.Split(fenWithMove, "am")
-				// TODO: handle no bm or no am here (I have a file for perft positions with ;D1 ;D2)
-				fen, avoidMove = strings.Trim(arr[0], " "), strings.Trim(arr[1], " ")
-				arr2 := strings.Split(nameWithID, "id ")
-				name = strings.Trim(arr2[1], "\"")
+				operation.operands = append(operation.operands, token)
 			}
 		}
+	}
+	if operation != nil {
+		// The last ';' is often left out
+		operations = append(operations, *operation)
+	}
 
-		lines = append(lines, EpdLine{
-			name:      name,
-			fen:       fen,
-			bestMove:  bestMove,
-			avoidMove: avoidMove,
-		})
+	for _, operation := range operations {
+		if epdIntegerOpcodeRegexp.MatchString(operation.opcode) &&
+			(len(operation.operands) != 1 || !isEpdInteger(operation.operands[0])) {
+			return nil, fmt.Errorf("EPD opcode %s needs an integer operand", operation.opcode)
+		}
 	}
 
-	return lines, nil
+	return operations, nil
+}
+
+// parseEpdString reads the quoted string at the start of str, returning its
+// value and the number of characters read.  A backslash escapes a quote or
+// another backslash; any other backslash is kept as it is.
+func parseEpdString(str string) (string, int, bool) {
+	var sb strings.Builder
+	for i := 1; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '"':
+			return sb.String(), i + 1, true
+		case c == '\\' && i+1 < len(str) && (str[i+1] == '"' || str[i+1] == '\\'):
+			sb.WriteByte(str[i+1])
+			i++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", 0, false
+}
+
+// setOperation adds or replaces an operation, keeping the fields used by
+// tactics and tuning up to date.
+func (line *EpdLine) setOperation(operation EpdOperation) {
+	replaced := false
+	for i := range line.operations {
+		if line.operations[i].opcode == operation.opcode {
+			line.operations[i] = operation
+			replaced = true
+		}
+	}
+	if !replaced {
+		line.operations = append(line.operations, operation)
+	}
+
+	value := strings.Join(operation.operands, " ")
+	switch operation.opcode {
+	case "bm":
+		line.bestMove = value
+	case "am":
+		line.avoidMove = value
+	case "id":
+		line.name = value
+	case "c9":
+		line.result = value
+	}
+}
+
+// SetOperation sets the operands of an opcode, replacing any existing ones.
+func (line *EpdLine) SetOperation(opcode string, operands ...string) {
+	line.setOperation(EpdOperation{opcode: opcode, operands: operands})
+}
+
+// RemoveOperation removes an opcode and its operands, if the line has it.
+func (line *EpdLine) RemoveOperation(opcode string) {
+	operations := line.operations[:0]
+	for _, operation := range line.operations {
+		if operation.opcode != opcode {
+			operations = append(operations, operation)
+		}
+	}
+	line.operations = operations
+
+	switch opcode {
+	case "bm":
+		line.bestMove = ""
+	case "am":
+		line.avoidMove = ""
+	case "id":
+		line.name = ""
+	case "c9":
+		line.result = ""
+	}
+}
+
+// Operation returns the operands of an opcode.
+func (line *EpdLine) Operation(opcode string) ([]string, bool) {
+	for _, operation := range line.operations {
+		if operation.opcode == opcode {
+			return operation.operands, true
+		}
+	}
+	return nil, false
+}
+
+// IntOperation returns the operand of an integer opcode (ce, acd, acn, acs,
+// dm, Dn).
+func (line *EpdLine) IntOperation(opcode string) (int64, bool) {
+	operands, ok := line.Operation(opcode)
+	if !ok || len(operands) != 1 {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(operands[0], 10, 64)
+	return value, err == nil
+}
+
+// PerftCounts returns the node counts from the D1..Dn opcodes, by depth.
+func (line *EpdLine) PerftCounts() map[uint]uint64 {
+	counts := make(map[uint]uint64)
+	for _, operation := range line.operations {
+		if len(operation.opcode) < 2 || operation.opcode[0] != 'D' {
+			continue
+		}
+		depth, err := strconv.ParseUint(operation.opcode[1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		if nodes, ok := line.IntOperation(operation.opcode); ok {
+			counts[uint(depth)] = uint64(nodes)
+		}
+	}
+	return counts
+}
+
+// String writes the line as an EPD record.  String opcodes (id, c0-c9) and
+// operands containing spaces, semicolons or quotes are quoted, with a
+// backslash before any quote or backslash inside them.
+func (line *EpdLine) String() string {
+	var sb strings.Builder
+	sb.WriteString(line.fen)
+	for _, operation := range line.operations {
+		sb.WriteString(" " + operation.opcode)
+		for _, operand := range operation.operands {
+			if epdStringOpcodeRegexp.MatchString(operation.opcode) || operand == "" ||
+				strings.ContainsAny(operand, " \t;\"") {
+				operand = "\"" + epdStringEscaper.Replace(operand) + "\""
+			}
+			sb.WriteString(" " + operand)
+		}
+		sb.WriteString(";")
+	}
+	return sb.String()
+}
+
+// CreateEpdLine returns a record for the position with no operations.  The
+// move counters aren't part of an EPD position.
+func CreateEpdLine(boardState *BoardState) EpdLine {
+	fields := strings.Fields(boardState.ToFENString())
+	return EpdLine{fen: strings.Join(fields[:4], " ")}
+}
+
+// WriteEpdFile writes the lines as an EPD file.
+func WriteEpdFile(filename string, lines []EpdLine) error {
+	var sb strings.Builder
+	for i := range lines {
+		sb.WriteString(lines[i].String() + "\n")
+	}
+	return os.WriteFile(filename, []byte(sb.String()), 0644)
 }
 
 // FilterEpdLines returns an epd slice with only epds that have a name matching the given regex.
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEpdLine(t *testing.T) {
+	// "bm" and "am" inside the position used to confuse the parser
+	line, err := ParseEpdLine(`rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR b KQkq - bm Nf6 e5; am a5; id "Opening; test"; c0 "a b"; ce -35; acd 12; pv Nf6 Nf3;`)
+	assert.Nil(t, err)
+	assert.Equal(t, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR b KQkq -", line.fen)
+	assert.Equal(t, "Nf6 e5", line.bestMove)
+	assert.Equal(t, "a5", line.avoidMove)
+	assert.Equal(t, "Opening; test", line.name)
+
+	pv, ok := line.Operation("pv")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"Nf6", "Nf3"}, pv)
+	ce, ok := line.IntOperation("ce")
+	assert.True(t, ok)
+	assert.Equal(t, int64(-35), ce)
+	_, ok = line.Operation("dm")
+	assert.False(t, ok)
+
+	// Perft suites keep the move counters, and the last ';' may be missing
+	line, err = ParseEpdLine("4k3/8/8/8/8/8/8/4K2R w K - 0 1 ;D1 15 ;D2 66")
+	assert.Nil(t, err)
+	assert.Equal(t, "4k3/8/8/8/8/8/8/4K2R w K - 0 1", line.fen)
+	assert.Equal(t, map[uint]uint64{1: 15, 2: 66}, line.PerftCounts())
+
+	line, err = ParseEpdLine("8/8/4k3/8/8/3QK3/8/8 b - -")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(line.operations))
+
+	for _, str := range []string{
+		"8/8/4k3/8/8/3QK3/8/8 b -",
+		`8/8/4k3/8/8/3QK3/8/8 b - - id "unterminated;`,
+		"8/8/4k3/8/8/3QK3/8/8 b - - ce high;",
+		"8/8/4k3/8/8/3QK3/8/8 b - - D1 1 2;",
+		"8/8/4k3/8/8/3QK3/8/8 b - - 1bad;",
+	} {
+		_, err = ParseEpdLine(str)
+		assert.NotNil(t, err, str)
+	}
+}
+
+func TestEpdLineString(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("8/8/4k3/8/8/3QK3/8/8 b - - 4 40")
+	line := CreateEpdLine(&boardState)
+	line.SetOperation("bm", "Kd6", "Ke5")
+	line.SetOperation("id", "test")
+	line.SetOperation("c0", "two words")
+	line.SetOperation("acd", "10")
+	line.SetOperation("bm", "Kf5")
+
+	str := line.String()
+	assert.Equal(t, `8/8/4k3/8/8/3QK3/8/8 b - - bm Kf5; id "test"; c0 "two words"; acd 10;`, str)
+
+	parsed, err := ParseEpdLine(str)
+	assert.Nil(t, err)
+	assert.Equal(t, line, parsed)
+}
+
+func TestEpdFiles(t *testing.T) {
+	filename := writeTestFile(t, "suite.epd", "# comment\n\n"+
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1 ;D1 20 ;D2 400 ;D3 8902\n"+
+		"8/8/8/2k5/2pP4/8/B7/4K3 b - d3 5 3 ;D1 8\n")
+	lines, err := ParseEpdFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "position-3", lines[0].name)
+
+	success, err := RunPerftEpd(filename, 2, PerftOptions{})
+	assert.Nil(t, err)
+	assert.True(t, success)
+
+	lines[1].SetOperation("D1", "9")
+	assert.Nil(t, WriteEpdFile(filename, lines))
+	success, err = RunPerftEpd(filename, 3, PerftOptions{})
+	assert.Nil(t, err)
+	assert.False(t, success)
+
+	_, err = ParseEpdFile(writeTestFile(t, "bad.epd", "not a position\n"))
+	assert.NotNil(t, err)
+}
+
+func TestEpdFileKeepsGoodLines(t *testing.T) {
+	filename := writeTestFile(t, "mixed.epd", "not a position\n"+
+		"8/8/4k3/8/8/3QK3/8/8 b - - id \"first\";\n"+
+		"8/8/4k3/8/8/3QK3/8/8 b - - ce high;\n"+
+		"8/8/4k3/8/8/3QK3/8/8 w - - id \"second\";\n")
+	lines, err := ParseEpdFile(filename)
+	var lineErrors EpdLineErrors
+	if assert.ErrorAs(t, err, &lineErrors) {
+		assert.Equal(t, 2, len(lineErrors))
+		assert.Contains(t, lineErrors[0].Error(), "mixed.epd:1:")
+		assert.Contains(t, lineErrors[1].Error(), "mixed.epd:3:")
+	}
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Equal(t, "first", lines[0].name)
+		assert.Equal(t, "second", lines[1].name)
+	}
+
+	lines, err = ParseAndFilterEpdFile(filename, "sec")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(lines))
+}
+
+func TestEpdLineRemoveOperation(t *testing.T) {
+	line, err := ParseEpdLine(`8/8/4k3/8/8/3QK3/8/8 b - - bm Kf5; dm 3; id "test";`)
+	assert.Nil(t, err)
+
+	line.RemoveOperation("dm")
+	line.RemoveOperation("bm")
+	line.RemoveOperation("am")
+	assert.Equal(t, "", line.bestMove)
+	assert.Equal(t, `8/8/4k3/8/8/3QK3/8/8 b - - id "test";`, line.String())
+}
+
+func TestEpdLineStringEscapesQuotes(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("8/8/4k3/8/8/3QK3/8/8 b - - 4 40")
+	line := CreateEpdLine(&boardState)
+	line.SetOperation("c0", `the "best" move`)
+	line.SetOperation("c1", `C:\suite\`)
+	line.SetOperation("c2", `say"what`)
+
+	str := line.String()
+	assert.Equal(t, `8/8/4k3/8/8/3QK3/8/8 b - - c0 "the \"best\" move"; c1 "C:\\suite\\"; c2 "say\"what";`, str)
+
+	parsed, err := ParseEpdLine(str)
+	assert.Nil(t, err)
+	assert.Equal(t, line, parsed)
+
+	// Other backslashes are read as they are
+	parsed, err = ParseEpdLine(`8/8/4k3/8/8/3QK3/8/8 b - - c0 "a\b";`)
+	assert.Nil(t, err)
+	operands, _ := parsed.Operation("c0")
+	assert.Equal(t, []string{`a\b`}, operands)
+}
@@ -6,9 +6,14 @@ import (
 )
 
 type EvalOptions struct {
-	epdRegex string
+	epdRegex    string
+	trace       bool
+	traceFormat string
 }
 
+// The constants below are the compiled-in defaults for EvalParams (see
+// eval_params.go); Eval itself reads the weights from boardState.evalParams.
+
 const ENDGAME_MATERIAL_THRESHOLD = 1200
 
 const QUEEN_EVAL_SCORE = 800
@@ -53,6 +58,9 @@ type BoardEval struct {
 	kingPosition      int
 	whiteKingPosition int
 	blackKingPosition int
+	// adjustment (from white's perspective) made by the endgame knowledge in endgame.go
+	endgame           int
+	endgameName       string
 	hasMatingMaterial bool
 }
 
@@ -85,6 +93,15 @@ var edges uint64 = 0xFF818181818181FF
 var nextToEdges uint64 = 0x007E424242427E00
 
 func Eval(boardState *BoardState) BoardEval {
+	return evalWithTrace(boardState, nil)
+}
+
+// evalWithTrace evaluates the board, recording every individual contribution in
+// trace when it is non-nil (see eval_trace.go).
+func evalWithTrace(boardState *BoardState, trace *EvalTrace) BoardEval {
+	params := boardState.evalParams
+	materialScore := params.materialScore()
+
 	boardPhase := PHASE_OPENING
 	if boardState.fullmoveNumber > 8 {
 		boardPhase = PHASE_MIDDLEGAME
@@ -112,8 +129,8 @@ func Eval(boardState *BoardState) BoardEval {
 		pieceBoards[WHITE_OFFSET][pieceMask] = whitePieceBoard
 		pieceBoards[BLACK_OFFSET][pieceMask] = blackPieceBoard
 
-		whitePieceMaterial := bits.OnesCount64(whitePieceBoard) * MATERIAL_SCORE[pieceMask]
-		blackPieceMaterial := bits.OnesCount64(blackPieceBoard) * MATERIAL_SCORE[pieceMask]
+		whitePieceMaterial := bits.OnesCount64(whitePieceBoard) * materialScore[pieceMask]
+		blackPieceMaterial := bits.OnesCount64(blackPieceBoard) * materialScore[pieceMask]
 
 		whiteMaterial += whitePieceMaterial
 		blackMaterial += blackPieceMaterial
@@ -129,22 +146,29 @@ func Eval(boardState *BoardState) BoardEval {
 			whitePawnMaterial = whitePieceMaterial
 			blackPawnMaterial = blackPieceMaterial
 		}
+
+		trace.addBitboard(TERM_MATERIAL, WHITE_OFFSET, whitePieceBoard, materialScore[pieceMask])
+		trace.addBitboard(TERM_MATERIAL, BLACK_OFFSET, blackPieceBoard, materialScore[pieceMask])
 	}
 
-	// This isn't correct, bitboards will make this easier
+	// Without pawns, a side needs a rook or two minor pieces to mate
 	if !IsBitboardSet(whitePieceBitboard, PAWN_MASK) &&
 		!IsBitboardSet(blackPieceBitboard, PAWN_MASK) &&
-		blackMaterial <= KNIGHT_EVAL_SCORE &&
-		whiteMaterial <= KNIGHT_EVAL_SCORE {
+		!hasMatingPieces(&pieceBoards, WHITE_OFFSET) &&
+		!hasMatingPieces(&pieceBoards, BLACK_OFFSET) {
 		hasMatingMaterial = false
 	}
 
-	if blackMaterial-blackPawnMaterial < ENDGAME_MATERIAL_THRESHOLD &&
-		whiteMaterial-whitePawnMaterial < ENDGAME_MATERIAL_THRESHOLD {
+	if blackMaterial-blackPawnMaterial < params.EndgameMaterialThreshold &&
+		whiteMaterial-whitePawnMaterial < params.EndgameMaterialThreshold {
 		boardPhase = PHASE_ENDGAME
 	}
 
-	whitePawnScore, blackPawnScore := evalPawnStructure(boardState, boardPhase)
+	if trace != nil {
+		trace.phase = boardPhase
+	}
+
+	whitePawnScore, blackPawnScore := evalPawnStructure(boardState, boardPhase, trace)
 
 	// TODO - endgame: determine passed pawns and prioritize them
 
@@ -166,41 +190,50 @@ func Eval(boardState *BoardState) BoardEval {
 		for _, sq := range [4]byte{SQUARE_D4, SQUARE_E4, SQUARE_D5, SQUARE_E5} {
 			squareAttackBoard := boardState.GetSquareAttackersBoard(allOccupancies, sq)
 
-			centerControl += (PIECE_ATTACKS_CENTER_EVAL_SCORE * bits.OnesCount64(squareAttackBoard&whiteOccupancy))
-			centerControl -= (PIECE_ATTACKS_CENTER_EVAL_SCORE * bits.OnesCount64(squareAttackBoard&blackOccupancy))
+			whiteAttacks := params.PieceAttacksCenter * bits.OnesCount64(squareAttackBoard&whiteOccupancy)
+			blackAttacks := params.PieceAttacksCenter * bits.OnesCount64(squareAttackBoard&blackOccupancy)
+			centerControl += whiteAttacks
+			centerControl -= blackAttacks
+			trace.add(TERM_CENTER_ATTACKS, WHITE_OFFSET, int(sq), whiteAttacks)
+			trace.add(TERM_CENTER_ATTACKS, BLACK_OFFSET, int(sq), blackAttacks)
 
 			p := boardState.PieceAtSquare(sq)
 			if p != 0x00 {
 				isBlack := isPieceBlack(p)
 				pieceScore := 0
 				if isPawn(p) {
-					pieceScore = PAWN_IN_CENTER_EVAL_SCORE
+					pieceScore = params.PawnInCenter
 				} else {
-					pieceScore = PIECE_IN_CENTER_EVAL_SCORE
+					pieceScore = params.PieceInCenter
 				}
 				if isBlack {
 					centerControl -= pieceScore
 				} else {
 					centerControl += pieceScore
 				}
+				trace.add(TERM_CENTER_OCCUPATION, PieceToColorOffset(p), int(sq), pieceScore)
 			}
 		}
 
 		// Penalize pieces on original squares
-		whiteDevelopment, blackDevelopment = evalDevelopment(boardState, boardPhase, &pieceBoards)
+		whiteDevelopment, blackDevelopment = evalDevelopment(boardState, boardPhase, &pieceBoards, trace)
 
 		// penalize king position
 		if blackKingSq > SQUARE_C8 && blackKingSq < SQUARE_G8 {
-			blackKingPosition += KING_IN_CENTER_EVAL_SCORE
+			blackKingPosition += params.KingInCenter
+			trace.add(TERM_KING_IN_CENTER, BLACK_OFFSET, int(blackKingSq), params.KingInCenter)
 		}
 		if whiteKingSq > SQUARE_C1 && whiteKingSq < SQUARE_G1 {
-			whiteKingPosition += KING_IN_CENTER_EVAL_SCORE
+			whiteKingPosition += params.KingInCenter
+			trace.add(TERM_KING_IN_CENTER, WHITE_OFFSET, int(whiteKingSq), params.KingInCenter)
 		}
 		if !boardState.boardInfo.whiteHasCastled && !boardState.boardInfo.whiteCanCastleKingside && !boardState.boardInfo.whiteCanCastleQueenside {
-			whiteKingPosition += KING_CANNOT_CASTLE_EVAL_SCORE
+			whiteKingPosition += params.KingCannotCastle
+			trace.add(TERM_KING_CANNOT_CASTLE, WHITE_OFFSET, int(whiteKingSq), params.KingCannotCastle)
 		}
 		if !boardState.boardInfo.blackHasCastled && !boardState.boardInfo.blackCanCastleKingside && !boardState.boardInfo.blackCanCastleQueenside {
-			blackKingPosition += KING_CANNOT_CASTLE_EVAL_SCORE
+			blackKingPosition += params.KingCannotCastle
+			trace.add(TERM_KING_CANNOT_CASTLE, BLACK_OFFSET, int(blackKingSq), params.KingCannotCastle)
 		}
 
 		if whiteKingSq == SQUARE_G1 || whiteKingSq == SQUARE_C1 || whiteKingSq == SQUARE_B1 {
@@ -209,27 +242,33 @@ func Eval(boardState *BoardState) BoardEval {
 					pawnProtectionBoard[WHITE_OFFSET] &
 					boardState.bitboards.piece[PAWN_MASK] &
 					boardState.bitboards.color[WHITE_OFFSET])
-			whiteKingPosition += pawns * KING_PAWN_COVER_EVAL_SCORE
+			whiteKingPosition += pawns * params.KingPawnCover
+			trace.add(TERM_KING_PAWN_COVER, WHITE_OFFSET, int(whiteKingSq), pawns*params.KingPawnCover)
 		}
 		if blackKingSq == SQUARE_G8 || blackKingSq == SQUARE_C8 || blackKingSq == SQUARE_B8 {
 			pawns := bits.OnesCount64(boardState.moveBitboards.kingAttacks[blackKingSq].board &
 				pawnProtectionBoard[BLACK_OFFSET] &
 				boardState.bitboards.piece[PAWN_MASK] &
 				boardState.bitboards.color[BLACK_OFFSET])
-			blackKingPosition += pawns * KING_PAWN_COVER_EVAL_SCORE
+			blackKingPosition += pawns * params.KingPawnCover
+			trace.add(TERM_KING_PAWN_COVER, BLACK_OFFSET, int(blackKingSq), pawns*params.KingPawnCover)
 		}
 	} else {
 		// prioritize king position
 		if IsBitboardSet(edges, whiteKingSq) {
-			whiteKingPosition += ENDGAME_KING_ON_EDGE_SCORE
+			whiteKingPosition += params.EndgameKingOnEdge
+			trace.add(TERM_KING_ON_EDGE, WHITE_OFFSET, int(whiteKingSq), params.EndgameKingOnEdge)
 		} else if IsBitboardSet(nextToEdges, whiteKingSq) {
-			whiteKingPosition += ENDGAME_KING_NEAR_EDGE_SCORE
+			whiteKingPosition += params.EndgameKingNearEdge
+			trace.add(TERM_KING_NEAR_EDGE, WHITE_OFFSET, int(whiteKingSq), params.EndgameKingNearEdge)
 		}
 
 		if IsBitboardSet(edges, blackKingSq) {
-			blackKingPosition += ENDGAME_KING_ON_EDGE_SCORE
+			blackKingPosition += params.EndgameKingOnEdge
+			trace.add(TERM_KING_ON_EDGE, BLACK_OFFSET, int(blackKingSq), params.EndgameKingOnEdge)
 		} else if IsBitboardSet(nextToEdges, blackKingSq) {
-			blackKingPosition += ENDGAME_KING_NEAR_EDGE_SCORE
+			blackKingPosition += params.EndgameKingNearEdge
+			trace.add(TERM_KING_NEAR_EDGE, BLACK_OFFSET, int(blackKingSq), params.EndgameKingNearEdge)
 		}
 
 		// if you have a queen and enemy doesn't that's a good thing
@@ -237,12 +276,31 @@ func Eval(boardState *BoardState) BoardEval {
 		whiteHasQueen := IsBitboardSet(whitePieceBitboard, QUEEN_MASK)
 
 		if whiteHasQueen && !blackHasQueen {
-			whiteMaterial += ENDGAME_QUEEN_BONUS_SCORE
+			whiteMaterial += params.EndgameQueenBonus
+			trace.add(TERM_ENDGAME_QUEEN_BONUS, WHITE_OFFSET, NO_SQUARE, params.EndgameQueenBonus)
 		} else if blackHasQueen && !whiteHasQueen {
-			blackMaterial += ENDGAME_QUEEN_BONUS_SCORE
+			blackMaterial += params.EndgameQueenBonus
+			trace.add(TERM_ENDGAME_QUEEN_BONUS, BLACK_OFFSET, NO_SQUARE, params.EndgameQueenBonus)
+		}
+	}
+
+	var endgame int
+	var endgameName string
+	if boardPhase == PHASE_ENDGAME && hasMatingMaterial {
+		score := whiteMaterial - blackMaterial + whiteKingPosition - blackKingPosition +
+			centerControl + whitePawnScore - blackPawnScore + whiteDevelopment - blackDevelopment
+		endgame, endgameName = evalEndgame(boardState, &pieceBoards, score)
+		if endgame > 0 {
+			trace.addEndgame(endgameName, WHITE_OFFSET, endgame)
+		} else {
+			trace.addEndgame(endgameName, BLACK_OFFSET, -endgame)
 		}
 	}
 
+	if trace != nil {
+		trace.hasMatingMaterial = hasMatingMaterial
+	}
+
 	return BoardEval{
 		sideToMove:        boardState.sideToMove,
 		phase:             boardPhase,
@@ -259,11 +317,22 @@ func Eval(boardState *BoardState) BoardEval {
 		whiteDevelopment:  whiteDevelopment,
 		blackDevelopment:  blackDevelopment,
 		centerControl:     centerControl,
+		endgame:           endgame,
+		endgameName:       endgameName,
 		hasMatingMaterial: hasMatingMaterial,
 	}
 }
 
-func evalPawnStructure(boardState *BoardState, boardPhase int) (int, int) {
+// hasMatingPieces returns true if the side has a rook, queen, or at least
+// two minor pieces.
+func hasMatingPieces(pieceBoards *[2][7]uint64, side int) bool {
+	pieces := &pieceBoards[side]
+	return pieces[ROOK_MASK] != 0 || pieces[QUEEN_MASK] != 0 ||
+		bits.OnesCount64(pieces[KNIGHT_MASK]|pieces[BISHOP_MASK]) > 1
+}
+
+func evalPawnStructure(boardState *BoardState, boardPhase int, trace *EvalTrace) (int, int) {
+	params := boardState.evalParams
 	pawnEntry := GetPawnTableEntry(boardState)
 	whitePawnScore := 0
 	blackPawnScore := 0
@@ -274,58 +343,75 @@ func evalPawnStructure(boardState *BoardState, boardPhase int) (int, int) {
 	for _, rank := range []byte{RANK_5, RANK_6, RANK_7} {
 		rankWhitePawns := pawnEntry.pawnsPerRank[WHITE_OFFSET][rank]
 		rankBlackPawns := pawnEntry.pawnsPerRank[BLACK_OFFSET][8-rank+1]
-		whitePawnScore += passedPawnByRankScore[rank] * bits.OnesCount64(whitePassers&rankWhitePawns)
-		blackPawnScore += passedPawnByRankScore[rank] * bits.OnesCount64(blackPassers&rankBlackPawns)
+		whitePawnScore += params.PassedPawnByRank[rank] * bits.OnesCount64(whitePassers&rankWhitePawns)
+		blackPawnScore += params.PassedPawnByRank[rank] * bits.OnesCount64(blackPassers&rankBlackPawns)
+		trace.addBitboard(TERM_PASSED_PAWN, WHITE_OFFSET, whitePassers&rankWhitePawns, params.PassedPawnByRank[rank])
+		trace.addBitboard(TERM_PASSED_PAWN, BLACK_OFFSET, blackPassers&rankBlackPawns, params.PassedPawnByRank[rank])
 	}
 
-	whitePawnScore += DOUBLED_PAWN_SCORE * pawnEntry.doubledPawnCount[WHITE_OFFSET]
-	blackPawnScore += DOUBLED_PAWN_SCORE * pawnEntry.doubledPawnCount[BLACK_OFFSET]
+	whitePawnScore += params.DoubledPawn * pawnEntry.doubledPawnCount[WHITE_OFFSET]
+	blackPawnScore += params.DoubledPawn * pawnEntry.doubledPawnCount[BLACK_OFFSET]
+	trace.addBitboard(TERM_DOUBLED_PAWN, WHITE_OFFSET, pawnEntry.doubledPawnBoard[WHITE_OFFSET], params.DoubledPawn)
+	trace.addBitboard(TERM_DOUBLED_PAWN, BLACK_OFFSET, pawnEntry.doubledPawnBoard[BLACK_OFFSET], params.DoubledPawn)
 
 	if boardPhase != PHASE_ENDGAME {
-		whitePawnScore += ISOLATED_PAWN_SCORE * pawnEntry.isolatedPawnCount[WHITE_OFFSET]
-		blackPawnScore += ISOLATED_PAWN_SCORE * pawnEntry.isolatedPawnCount[BLACK_OFFSET]
+		whitePawnScore += params.IsolatedPawn * pawnEntry.isolatedPawnCount[WHITE_OFFSET]
+		blackPawnScore += params.IsolatedPawn * pawnEntry.isolatedPawnCount[BLACK_OFFSET]
+		trace.addBitboard(TERM_ISOLATED_PAWN, WHITE_OFFSET, pawnEntry.isolatedPawnBoard[WHITE_OFFSET], params.IsolatedPawn)
+		trace.addBitboard(TERM_ISOLATED_PAWN, BLACK_OFFSET, pawnEntry.isolatedPawnBoard[BLACK_OFFSET], params.IsolatedPawn)
 	}
 
 	return whitePawnScore, blackPawnScore
 }
 
-func evalDevelopment(boardState *BoardState, boardPhase int, pieceBoards *[2][7]uint64) (int, int) {
+func evalDevelopment(boardState *BoardState, boardPhase int, pieceBoards *[2][7]uint64, trace *EvalTrace) (int, int) {
+	params := boardState.evalParams
 	whiteDevelopment := 0
 	blackDevelopment := 0
 
 	if boardState.board[SQUARE_B1] == KNIGHT_MASK|WHITE_MASK {
-		whiteDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		whiteDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, WHITE_OFFSET, int(SQUARE_B1), params.LackOfDevelopment)
 	}
 	if boardState.board[SQUARE_C1] == BISHOP_MASK|WHITE_MASK {
-		whiteDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		whiteDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, WHITE_OFFSET, int(SQUARE_C1), params.LackOfDevelopment)
 	}
 	if boardState.board[SQUARE_F1] == BISHOP_MASK|WHITE_MASK {
-		whiteDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		whiteDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, WHITE_OFFSET, int(SQUARE_F1), params.LackOfDevelopment)
 	}
 	if boardState.board[SQUARE_G1] == KNIGHT_MASK|WHITE_MASK {
-		whiteDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		whiteDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, WHITE_OFFSET, int(SQUARE_G1), params.LackOfDevelopment)
 	}
 
 	// Now black
 	if boardState.board[SQUARE_B8] == KNIGHT_MASK|BLACK_MASK {
-		blackDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		blackDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, BLACK_OFFSET, int(SQUARE_B8), params.LackOfDevelopment)
 	}
 	if boardState.board[SQUARE_C8] == BISHOP_MASK|BLACK_MASK {
-		blackDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		blackDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, BLACK_OFFSET, int(SQUARE_C8), params.LackOfDevelopment)
 	}
 	if boardState.board[SQUARE_F8] == BISHOP_MASK|BLACK_MASK {
-		blackDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		blackDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, BLACK_OFFSET, int(SQUARE_F8), params.LackOfDevelopment)
 	}
 	if boardState.board[SQUARE_G8] == KNIGHT_MASK|BLACK_MASK {
-		blackDevelopment += LACK_OF_DEVELOPMENT_SCORE
+		blackDevelopment += params.LackOfDevelopment
+		trace.add(TERM_DEVELOPMENT, BLACK_OFFSET, int(SQUARE_G8), params.LackOfDevelopment)
 	}
 
 	if boardPhase == PHASE_MIDDLEGAME {
 		if boardState.board[SQUARE_D1] == QUEEN_MASK|WHITE_MASK {
-			whiteDevelopment += LACK_OF_DEVELOPMENT_SCORE
+			whiteDevelopment += params.LackOfDevelopment
+			trace.add(TERM_DEVELOPMENT, WHITE_OFFSET, int(SQUARE_D1), params.LackOfDevelopment)
 		}
 		if boardState.board[SQUARE_D8] == QUEEN_MASK|BLACK_MASK {
-			blackDevelopment += LACK_OF_DEVELOPMENT_SCORE
+			blackDevelopment += params.LackOfDevelopment
+			trace.add(TERM_DEVELOPMENT, BLACK_OFFSET, int(SQUARE_D8), params.LackOfDevelopment)
 		}
 	}
 
@@ -333,7 +419,7 @@ func evalDevelopment(boardState *BoardState, boardPhase int, pieceBoards *[2][7]
 }
 
 func (eval BoardEval) value() int {
-	score := eval.material + eval.kingPosition + eval.centerControl + eval.pawnScore + eval.developmentScore
+	score := eval.material + eval.kingPosition + eval.centerControl + eval.pawnScore + eval.developmentScore + eval.endgame
 	if eval.sideToMove == BLACK_OFFSET {
 		return -score
 	}
@@ -351,7 +437,7 @@ func BoardEvalToString(eval BoardEval) string {
 		phaseString = "opening"
 	}
 
-	return fmt.Sprintf("VALUE: %d\n\tphase=%s\n\tmaterial=%d (white: %d, black: %d)\n\tpawns=%d (white: %d, black: %d)\n\tkingPosition=%d (white: %d, black: %d)\n\tdevelopment=%d (white: %d, black: %d)\n\tcenterControl=%d",
+	return fmt.Sprintf("VALUE: %d\n\tphase=%s\n\tmaterial=%d (white: %d, black: %d)\n\tpawns=%d (white: %d, black: %d)\n\tkingPosition=%d (white: %d, black: %d)\n\tdevelopment=%d (white: %d, black: %d)\n\tcenterControl=%d\n\tendgame=%d %s",
 		eval.value(),
 		phaseString,
 		eval.material,
@@ -366,7 +452,9 @@ func BoardEvalToString(eval BoardEval) string {
 		eval.developmentScore,
 		eval.whiteDevelopment,
 		eval.blackDevelopment,
-		eval.centerControl)
+		eval.centerControl,
+		eval.endgame,
+		eval.endgameName)
 }
 
 func RunEvalFile(epdFile string, variation string, options EvalOptions) (bool, error) {
@@ -380,26 +468,40 @@ func RunEvalFile(epdFile string, variation string, options EvalOptions) (bool, e
 	}
 
 	for _, line := range lines {
-		boardEval, err := RunEvalFen(line.fen, variation, options)
+		boardEval, trace, err := RunEvalFen(line.fen, variation, options)
 		if err != nil {
 			return false, err
 		}
 
-		fmt.Println(BoardEvalToString(boardEval))
+		str, err := EvalResultToString(boardEval, trace, options)
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(str)
 	}
 
 	return true, nil
 }
 
-func RunEvalFen(fen string, variation string, options EvalOptions) (BoardEval, error) {
+func RunEvalFen(fen string, variation string, options EvalOptions) (BoardEval, EvalTrace, error) {
 	boardState, err := CreateBoardStateFromFENStringWithVariation(fen, variation)
 	if err != nil {
-		return BoardEval{}, nil
+		return BoardEval{}, EvalTrace{}, err
 	}
 
 	fmt.Println(boardState.String())
 
-	return Eval(&boardState), nil
+	boardEval, trace := TraceEval(&boardState)
+	return boardEval, trace, nil
+}
+
+// EvalResultToString renders the evaluation summary, or the full trace if the
+// options ask for it.
+func EvalResultToString(eval BoardEval, trace EvalTrace, options EvalOptions) (string, error) {
+	if options.trace {
+		return formatEvalTrace(trace, options.traceFormat)
+	}
+	return BoardEvalToString(eval), nil
 }
 
 // TODO: incrementally update evaluation as a result of a move
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// EvalParams holds every tunable weight used by Eval.  The compiled-in defaults
+// (DefaultEvalParams) reproduce the constants in eval.go exactly; a JSON file
+// only needs to list the fields it wants to override.
+type EvalParams struct {
+	EndgameMaterialThreshold int `json:"endgameMaterialThreshold"`
+
+	Pawn   int `json:"pawn"`
+	Knight int `json:"knight"`
+	Bishop int `json:"bishop"`
+	Rook   int `json:"rook"`
+	Queen  int `json:"queen"`
+
+	KingInCenter        int `json:"kingInCenter"`
+	KingPawnCover       int `json:"kingPawnCover"`
+	KingCannotCastle    int `json:"kingCannotCastle"`
+	EndgameKingOnEdge   int `json:"endgameKingOnEdge"`
+	EndgameKingNearEdge int `json:"endgameKingNearEdge"`
+	EndgameQueenBonus   int `json:"endgameQueenBonus"`
+
+	PawnInCenter       int `json:"pawnInCenter"`
+	PieceInCenter      int `json:"pieceInCenter"`
+	PieceAttacksCenter int `json:"pieceAttacksCenter"`
+
+	IsolatedPawn      int    `json:"isolatedPawn"`
+	DoubledPawn       int    `json:"doubledPawn"`
+	PassedPawnByRank  [8]int `json:"passedPawnByRank"`
+	LackOfDevelopment int    `json:"lackOfDevelopment"`
+}
+
+var defaultEvalParams = EvalParams{
+	EndgameMaterialThreshold: ENDGAME_MATERIAL_THRESHOLD,
+
+	Pawn:   PAWN_EVAL_SCORE,
+	Knight: KNIGHT_EVAL_SCORE,
+	Bishop: BISHOP_EVAL_SCORE,
+	Rook:   ROOK_EVAL_SCORE,
+	Queen:  QUEEN_EVAL_SCORE,
+
+	KingInCenter:        KING_IN_CENTER_EVAL_SCORE,
+	KingPawnCover:       KING_PAWN_COVER_EVAL_SCORE,
+	KingCannotCastle:    KING_CANNOT_CASTLE_EVAL_SCORE,
+	EndgameKingOnEdge:   ENDGAME_KING_ON_EDGE_SCORE,
+	EndgameKingNearEdge: ENDGAME_KING_NEAR_EDGE_SCORE,
+	EndgameQueenBonus:   ENDGAME_QUEEN_BONUS_SCORE,
+
+	PawnInCenter:       PAWN_IN_CENTER_EVAL_SCORE,
+	PieceInCenter:      PIECE_IN_CENTER_EVAL_SCORE,
+	PieceAttacksCenter: PIECE_ATTACKS_CENTER_EVAL_SCORE,
+
+	IsolatedPawn:      ISOLATED_PAWN_SCORE,
+	DoubledPawn:       DOUBLED_PAWN_SCORE,
+	PassedPawnByRank:  passedPawnByRankScore,
+	LackOfDevelopment: LACK_OF_DEVELOPMENT_SCORE,
+}
+
+// evalParams is the parameter set given to newly created board states.  It is
+// replaced (never mutated) by SetEvalParams so boards holding the old pointer
+// keep a consistent view.
+var evalParams *EvalParams = &defaultEvalParams
+
+// DefaultEvalParams returns a copy of the compiled-in evaluation parameters.
+func DefaultEvalParams() EvalParams {
+	return defaultEvalParams
+}
+
+// SetEvalParams makes params the parameter set used by boards created from now on.
+func SetEvalParams(params EvalParams) {
+	evalParams = &params
+}
+
+func (params *EvalParams) materialScore() [7]int {
+	return [7]int{0, params.Pawn, params.Knight, params.Bishop, params.Rook, params.Queen, 0}
+}
+
+// ParseEvalParams reads a JSON parameter set.  Fields that are not present keep
+// their default values; unknown fields are an error so typos don't go unnoticed.
+func ParseEvalParams(b []byte) (EvalParams, error) {
+	params := DefaultEvalParams()
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&params); err != nil {
+		return params, fmt.Errorf("Unable to parse evaluation parameters: %s", err)
+	}
+
+	return params, nil
+}
+
+func LoadEvalParams(filename string) (EvalParams, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return DefaultEvalParams(), err
+	}
+
+	return ParseEvalParams(b)
+}
+
+func EvalParamsToJSON(params EvalParams) (string, error) {
+	b, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func WriteEvalParams(filename string, params EvalParams) error {
+	str, err := EvalParamsToJSON(params)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, []byte(str+"\n"), 0644)
+}
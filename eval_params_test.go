@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalParamsDefaultsMatchConstants(t *testing.T) {
+	params := DefaultEvalParams()
+
+	assert.Equal(t, MATERIAL_SCORE, params.materialScore())
+	assert.Equal(t, passedPawnByRankScore, params.PassedPawnByRank)
+	assert.Equal(t, ISOLATED_PAWN_SCORE, params.IsolatedPawn)
+	assert.Equal(t, ENDGAME_MATERIAL_THRESHOLD, params.EndgameMaterialThreshold)
+}
+
+func TestParseEvalParamsPartialOverride(t *testing.T) {
+	params, err := ParseEvalParams([]byte(`{"queen": 900, "isolatedPawn": -5}`))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 900, params.Queen)
+	assert.Equal(t, -5, params.IsolatedPawn)
+	assert.Equal(t, ROOK_EVAL_SCORE, params.Rook)
+}
+
+func TestParseEvalParamsUnknownField(t *testing.T) {
+	_, err := ParseEvalParams([]byte(`{"qeen": 900}`))
+
+	assert.NotNil(t, err)
+}
+
+func TestEvalParamsJSONRoundTrip(t *testing.T) {
+	str, err := EvalParamsToJSON(DefaultEvalParams())
+	assert.Nil(t, err)
+
+	params, err := ParseEvalParams([]byte(str))
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultEvalParams(), params)
+}
+
+func TestEvalUsesBoardEvalParams(t *testing.T) {
+	testBoard := CreateEmptyBoardState()
+	testBoard.SetPieceAtSquare(SQUARE_A3, WHITE_MASK|BISHOP_MASK)
+
+	params := DefaultEvalParams()
+	params.Bishop = 350
+	testBoard.evalParams = &params
+
+	assert.Equal(t, 350, Eval(&testBoard).material)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// An EvalTrace records every individual contribution made by Eval: which term
+// produced it, for which side, on which square (if the term is tied to one) and
+// its value.  The evaluation isn't tapered, so each value is the one used for
+// the position's phase, which is recorded alongside the entries.
+//
+// Summing the white entries and subtracting the black ones gives the same score
+// as BoardEval.value() from white's perspective.
+
+const (
+	TERM_MATERIAL            = "material"
+	TERM_ENDGAME_QUEEN_BONUS = "endgameQueenBonus"
+	TERM_CENTER_ATTACKS      = "centerAttacks"
+	TERM_CENTER_OCCUPATION   = "centerOccupation"
+	TERM_DEVELOPMENT         = "development"
+	TERM_KING_IN_CENTER      = "kingInCenter"
+	TERM_KING_CANNOT_CASTLE  = "kingCannotCastle"
+	TERM_KING_PAWN_COVER     = "kingPawnCover"
+	TERM_KING_ON_EDGE        = "kingOnEdge"
+	TERM_KING_NEAR_EDGE      = "kingNearEdge"
+	TERM_PASSED_PAWN         = "passedPawn"
+	TERM_DOUBLED_PAWN        = "doubledPawn"
+	TERM_ISOLATED_PAWN       = "isolatedPawn"
+	// The endgame term is the adjustment made by endgame knowledge; the name of the
+	// evaluator or scale factor is appended in parentheses.
+	TERM_ENDGAME = "endgame"
+)
+
+// NO_SQUARE is used for contributions that aren't tied to a square.
+const NO_SQUARE = -1
+
+type EvalTraceEntry struct {
+	term   string
+	side   int
+	square int
+	value  int
+}
+
+type EvalTrace struct {
+	phase             int
+	hasMatingMaterial bool
+	entries           []EvalTraceEntry
+}
+
+// add and the other add methods are safe to call on a nil trace, and return
+// before doing any work, so the evaluation calls them without checking and the
+// untraced path stays cheap.
+func (trace *EvalTrace) add(term string, side int, square int, value int) {
+	if trace == nil || value == 0 {
+		return
+	}
+	trace.entries = append(trace.entries, EvalTraceEntry{term: term, side: side, square: square, value: value})
+}
+
+// addBitboard adds a contribution of value for every square set in the bitboard.
+func (trace *EvalTrace) addBitboard(term string, side int, bitboard uint64, value int) {
+	if trace == nil {
+		return
+	}
+	for bitboard != 0 {
+		sq := bits.TrailingZeros64(bitboard)
+		trace.add(term, side, sq, value)
+		bitboard ^= 1 << sq
+	}
+}
+
+// addEndgame adds the score of a specialised endgame evaluator, naming it in the
+// term.
+func (trace *EvalTrace) addEndgame(name string, side int, value int) {
+	if trace == nil {
+		return
+	}
+	trace.add(TERM_ENDGAME+"("+name+")", side, NO_SQUARE, value)
+}
+
+// TraceEval evaluates the board and returns the evaluation along with the trace
+// of every contribution.
+func TraceEval(boardState *BoardState) (BoardEval, EvalTrace) {
+	trace := EvalTrace{}
+	eval := evalWithTrace(boardState, &trace)
+
+	return eval, trace
+}
+
+// Total is the traced score from white's perspective.
+func (trace *EvalTrace) Total() int {
+	total := 0
+	for _, entry := range trace.entries {
+		total += entry.signedValue()
+	}
+	return total
+}
+
+func (entry EvalTraceEntry) signedValue() int {
+	if entry.side == BLACK_OFFSET {
+		return -entry.value
+	}
+	return entry.value
+}
+
+func sideToString(side int) string {
+	if side == BLACK_OFFSET {
+		return "black"
+	}
+	return "white"
+}
+
+func traceSquareToString(square int) string {
+	if square == NO_SQUARE {
+		return "-"
+	}
+	return SquareToAlgebraicString(byte(square))
+}
+
+func phaseToString(phase int) string {
+	switch phase {
+	case PHASE_ENDGAME:
+		return "endgame"
+	case PHASE_MIDDLEGAME:
+		return "middlegame"
+	default:
+		return "opening"
+	}
+}
+
+type evalTraceTermTotal struct {
+	term  string
+	side  int
+	value int
+}
+
+// termTotals sums the entries by term and side, keeping the order in which terms
+// were first recorded.
+func (trace *EvalTrace) termTotals() []evalTraceTermTotal {
+	totals := make([]evalTraceTermTotal, 0)
+	index := make(map[string]int)
+	for _, entry := range trace.entries {
+		key := entry.term + "/" + sideToString(entry.side)
+		i, ok := index[key]
+		if !ok {
+			i = len(totals)
+			index[key] = i
+			totals = append(totals, evalTraceTermTotal{term: entry.term, side: entry.side})
+		}
+		totals[i].value += entry.value
+	}
+	return totals
+}
+
+func EvalTraceToTable(trace EvalTrace) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "phase=%s", phaseToString(trace.phase))
+	if !trace.hasMatingMaterial {
+		sb.WriteString(" (no mating material, searched as a draw)")
+	}
+	sb.WriteString("\n")
+
+	fmt.Fprintf(&sb, "%-20s %-6s %-6s %7s\n", "term", "side", "square", "value")
+	for _, entry := range trace.entries {
+		fmt.Fprintf(&sb, "%-20s %-6s %-6s %7d\n",
+			entry.term, sideToString(entry.side), traceSquareToString(entry.square), entry.value)
+	}
+
+	sb.WriteString("\ntotals by term:\n")
+	for _, total := range trace.termTotals() {
+		fmt.Fprintf(&sb, "%-20s %-6s %14d\n", total.term, sideToString(total.side), total.value)
+	}
+	fmt.Fprintf(&sb, "total (white's perspective): %d", trace.Total())
+
+	return sb.String()
+}
+
+type evalTraceEntryJSON struct {
+	Term   string `json:"term"`
+	Side   string `json:"side"`
+	Square string `json:"square"`
+	Value  int    `json:"value"`
+}
+
+type evalTraceJSON struct {
+	Phase             string               `json:"phase"`
+	HasMatingMaterial bool                 `json:"hasMatingMaterial"`
+	Total             int                  `json:"total"`
+	Entries           []evalTraceEntryJSON `json:"entries"`
+}
+
+func EvalTraceToJSON(trace EvalTrace) (string, error) {
+	out := evalTraceJSON{
+		Phase:             phaseToString(trace.phase),
+		HasMatingMaterial: trace.hasMatingMaterial,
+		Total:             trace.Total(),
+		Entries:           make([]evalTraceEntryJSON, 0, len(trace.entries)),
+	}
+	for _, entry := range trace.entries {
+		out.Entries = append(out.Entries, evalTraceEntryJSON{
+			Term:   entry.term,
+			Side:   sideToString(entry.side),
+			Square: traceSquareToString(entry.square),
+			Value:  entry.value,
+		})
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// EvalTraceDiff is the difference of a single (term, side, square) contribution
+// between two traces.
+type EvalTraceDiff struct {
+	term   string
+	side   int
+	square int
+	before int
+	after  int
+}
+
+func (diff EvalTraceDiff) delta() int {
+	return diff.after - diff.before
+}
+
+// DiffEvalTraces compares two traces contribution by contribution, returning
+// only the contributions that changed, largest change first.
+func DiffEvalTraces(before EvalTrace, after EvalTrace) []EvalTraceDiff {
+	type key struct {
+		term   string
+		side   int
+		square int
+	}
+	diffs := make([]EvalTraceDiff, 0)
+	index := make(map[key]int)
+	for i, trace := range []EvalTrace{before, after} {
+		for _, entry := range trace.entries {
+			k := key{entry.term, entry.side, entry.square}
+			j, ok := index[k]
+			if !ok {
+				j = len(diffs)
+				index[k] = j
+				diffs = append(diffs, EvalTraceDiff{term: entry.term, side: entry.side, square: entry.square})
+			}
+			if i == 0 {
+				diffs[j].before += entry.value
+			} else {
+				diffs[j].after += entry.value
+			}
+		}
+	}
+
+	changed := make([]EvalTraceDiff, 0)
+	for _, diff := range diffs {
+		if diff.delta() != 0 {
+			changed = append(changed, diff)
+		}
+	}
+	sort.SliceStable(changed, func(i, j int) bool {
+		return Abs(changed[i].delta()) > Abs(changed[j].delta())
+	})
+
+	return changed
+}
+
+func EvalTraceDiffToTable(before EvalTrace, after EvalTrace) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "phase: %s -> %s\n", phaseToString(before.phase), phaseToString(after.phase))
+	fmt.Fprintf(&sb, "%-20s %-6s %-6s %7s %7s %7s\n", "term", "side", "square", "before", "after", "delta")
+	for _, diff := range DiffEvalTraces(before, after) {
+		fmt.Fprintf(&sb, "%-20s %-6s %-6s %7d %7d %+7d\n",
+			diff.term, sideToString(diff.side), traceSquareToString(diff.square),
+			diff.before, diff.after, diff.delta())
+	}
+	fmt.Fprintf(&sb, "total (white's perspective): %d -> %d (%+d)",
+		before.Total(), after.Total(), after.Total()-before.Total())
+
+	return sb.String()
+}
+
+func formatEvalTrace(trace EvalTrace, format string) (string, error) {
+	switch format {
+	case "", "table":
+		return EvalTraceToTable(trace), nil
+	case "json":
+		return EvalTraceToJSON(trace)
+	default:
+		return "", fmt.Errorf("Unknown trace format: %s (expected table or json)", format)
+	}
+}
+
+// RunEvalDiff compares the evaluation of a position against either a second
+// position (otherFen) or the same position under a second parameter set
+// (otherParamsFile).
+func RunEvalDiff(fen string, variation string, otherFen string, otherParamsFile string) (bool, error) {
+	boardState, err := CreateBoardStateFromFENStringWithVariation(fen, variation)
+	if err != nil {
+		return false, err
+	}
+	_, before := TraceEval(&boardState)
+
+	var after EvalTrace
+	if otherFen != "" {
+		otherBoardState, err := CreateBoardStateFromFENString(otherFen)
+		if err != nil {
+			return false, err
+		}
+		_, after = TraceEval(&otherBoardState)
+	} else if otherParamsFile != "" {
+		params, err := LoadEvalParams(otherParamsFile)
+		if err != nil {
+			return false, err
+		}
+		boardState.evalParams = &params
+		_, after = TraceEval(&boardState)
+	} else {
+		return false, fmt.Errorf("Must specify a position or a parameter file to compare against")
+	}
+
+	fmt.Println(EvalTraceDiffToTable(before, after))
+
+	return true, nil
+}
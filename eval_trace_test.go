@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var traceTestFens = []string{
+	"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+	"r1bqk2r/pp2bppp/2n1pn2/3p4/2PP4/2N2N2/PP3PPP/R1BQKB1R w KQkq - 2 11",
+	"6k1/5ppp/8/1P6/8/P7/5PPP/3Q2K1 b - - 0 40",
+	"8/2p5/1p1p4/3P4/1P4k1/8/6K1/8 w - - 0 50",
+	"r4rk1/1pp2ppp/p1n5/4p3/4P3/2N5/PPP2PPP/2KR3R b - - 4 14",
+}
+
+func TestEvalTraceTotalMatchesEval(t *testing.T) {
+	for _, fen := range traceTestFens {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err)
+
+		boardEval, trace := TraceEval(&boardState)
+		assert.Equal(t, Eval(&boardState), boardEval, fen)
+
+		expected := boardEval.value()
+		if boardEval.sideToMove == BLACK_OFFSET {
+			expected = -expected
+		}
+		assert.Equal(t, expected, trace.Total(), fen)
+	}
+}
+
+func TestEvalTraceRecordsSquares(t *testing.T) {
+	testBoard := CreateEmptyBoardState()
+	testBoard.SetPieceAtSquare(SQUARE_A2, WHITE_MASK|PAWN_MASK)
+	testBoard.SetPieceAtSquare(SQUARE_A3, BLACK_MASK|BISHOP_MASK)
+
+	_, trace := TraceEval(&testBoard)
+
+	assert.Contains(t, trace.entries, EvalTraceEntry{term: TERM_MATERIAL, side: WHITE_OFFSET, square: int(SQUARE_A2), value: 100})
+	assert.Contains(t, trace.entries, EvalTraceEntry{term: TERM_MATERIAL, side: BLACK_OFFSET, square: int(SQUARE_A3), value: 320})
+}
+
+func TestEvalWithoutTraceDoesNotAllocate(t *testing.T) {
+	// The KRvKP endgame evaluator names its trace term
+	for _, fen := range append(traceTestFens, "8/8/8/3k4/3p4/8/8/R3K3 w - - 0 1") {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err)
+		Eval(&boardState)
+
+		allocs := testing.AllocsPerRun(10, func() {
+			Eval(&boardState)
+		})
+		assert.Equal(t, float64(0), allocs, fen)
+	}
+}
+
+func TestEvalTraceToJSON(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	_, trace := TraceEval(&boardState)
+
+	str, err := EvalTraceToJSON(trace)
+	assert.Nil(t, err)
+
+	var decoded evalTraceJSON
+	assert.Nil(t, json.Unmarshal([]byte(str), &decoded))
+	assert.Equal(t, "opening", decoded.Phase)
+	assert.Equal(t, len(trace.entries), len(decoded.Entries))
+	assert.Equal(t, trace.Total(), decoded.Total)
+}
+
+func TestDiffEvalTracesSameTrace(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	_, trace := TraceEval(&boardState)
+
+	assert.Empty(t, DiffEvalTraces(trace, trace))
+}
+
+func TestDiffEvalTracesParams(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	_, before := TraceEval(&boardState)
+
+	params := DefaultEvalParams()
+	params.Knight = 310
+	boardState.evalParams = &params
+	_, after := TraceEval(&boardState)
+
+	diffs := DiffEvalTraces(before, after)
+	assert.Equal(t, 4, len(diffs))
+	for _, diff := range diffs {
+		assert.Equal(t, TERM_MATERIAL, diff.term)
+		assert.Equal(t, 10, diff.delta())
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A gauntlet of games between engine binaries, run as subprocesses.  The
+// first engine plays every other engine, or with a round robin every engine
+// plays every other.  Games are played one at a time so the engines don't
+// compete for the CPU, with a clock for each side.
+
+type GauntletOptions struct {
+	timeControl TimeControl
+	// Games between each pair of engines, with the colours alternating
+	games      uint
+	roundRobin bool
+	pgnFile    string
+}
+
+type Gauntlet struct {
+	engines  []EngineConfig
+	openings []string
+	options  GauntletOptions
+	// Points and games of each engine against each other engine
+	points [][]float64
+	games  [][]int
+}
+
+// TimeControl is moves/base+increment, where moves is 0 when the base time is
+// for the whole game.
+type TimeControl struct {
+	moves     int
+	base      time.Duration
+	increment time.Duration
+}
+
+var timeControlRegexp = regexp.MustCompile(`^(?:(\d+)/)?(\d+(?:\.\d+)?)(?:\+(\d+(?:\.\d+)?))?$`)
+
+// ParseTimeControl parses a time control in seconds: 40/60 for 40 moves in a
+// minute, 10+0.1 for ten seconds a game and a tenth of a second a move.
+func ParseTimeControl(str string) (TimeControl, error) {
+	arr := timeControlRegexp.FindStringSubmatch(str)
+	if arr == nil {
+		return TimeControl{}, fmt.Errorf("Invalid time control %s", str)
+	}
+
+	var timeControl TimeControl
+	if arr[1] != "" {
+		timeControl.moves, _ = strconv.Atoi(arr[1])
+	}
+	base, _ := strconv.ParseFloat(arr[2], 64)
+	timeControl.base = time.Duration(base * float64(time.Second))
+	if arr[3] != "" {
+		increment, _ := strconv.ParseFloat(arr[3], 64)
+		timeControl.increment = time.Duration(increment * float64(time.Second))
+	}
+	if timeControl.base <= 0 {
+		return TimeControl{}, fmt.Errorf("Invalid time control %s", str)
+	}
+	return timeControl, nil
+}
+
+// String returns the time control as in the PGN TimeControl tag.
+func (timeControl TimeControl) String() string {
+	str := strconv.FormatFloat(timeControl.base.Seconds(), 'f', -1, 64)
+	if timeControl.moves > 0 {
+		str = fmt.Sprintf("%d/%s", timeControl.moves, str)
+	}
+	if timeControl.increment > 0 {
+		str += "+" + strconv.FormatFloat(timeControl.increment.Seconds(), 'f', -1, 64)
+	}
+	return str
+}
+
+// xboardLevel returns the arguments of the xboard level command, which has the
+// base time in minutes:seconds.
+func (timeControl TimeControl) xboardLevel() string {
+	seconds := int(math.Ceil(timeControl.base.Seconds()))
+	return fmt.Sprintf("%d %d:%02d %s", timeControl.moves, seconds/60, seconds%60,
+		strconv.FormatFloat(timeControl.increment.Seconds(), 'f', -1, 64))
+}
+
+// gameClocks are the time left for each side, indexed by WHITE_OFFSET and
+// BLACK_OFFSET.
+type gameClocks struct {
+	timeControl TimeControl
+	remaining   [2]time.Duration
+	// Moves played by each side
+	moves      [2]int
+	sideToMove int
+}
+
+func newGameClocks(timeControl TimeControl, sideToMove int) *gameClocks {
+	return &gameClocks{
+		timeControl: timeControl,
+		remaining:   [2]time.Duration{timeControl.base, timeControl.base},
+		sideToMove:  sideToMove,
+	}
+}
+
+// movesToGo returns the moves left to play in the side's session, or 0 if the
+// time is for the whole game.
+func (clocks *gameClocks) movesToGo(side int) int {
+	if clocks.timeControl.moves == 0 {
+		return 0
+	}
+	return clocks.timeControl.moves - clocks.moves[side]%clocks.timeControl.moves
+}
+
+// punch takes the time of the side to move's move off its clock and passes the
+// move to the other side.  It returns false if the flag fell.
+func (clocks *gameClocks) punch(elapsed time.Duration) bool {
+	side := clocks.sideToMove
+	clocks.remaining[side] -= elapsed
+	if clocks.remaining[side] < 0 {
+		return false
+	}
+
+	clocks.remaining[side] += clocks.timeControl.increment
+	clocks.moves[side]++
+	if clocks.timeControl.moves > 0 && clocks.moves[side]%clocks.timeControl.moves == 0 {
+		clocks.remaining[side] += clocks.timeControl.base
+	}
+	clocks.sideToMove = oppositeColorOffset(side)
+	return true
+}
+
+// NewGauntlet reads the engines and the openings, the start position if there's
+// no openings file.
+func NewGauntlet(enginesFile string, openingsFile string, epdRegex string, options GauntletOptions) (*Gauntlet, error) {
+	engines, err := LoadEngineConfigs(enginesFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(engines) < 2 {
+		return nil, errors.New("A gauntlet needs at least two engines")
+	}
+
+	gauntlet := &Gauntlet{engines: engines, options: options, openings: []string{STARTING_FEN}}
+	if openingsFile != "" {
+		match, err := NewSelfPlayMatch(openingsFile, epdRegex, SelfPlayEngine{}, SelfPlayEngine{}, SelfPlayOptions{})
+		if err != nil {
+			return nil, err
+		}
+		gauntlet.openings = match.openings
+	}
+
+	gauntlet.points = make([][]float64, len(engines))
+	gauntlet.games = make([][]int, len(engines))
+	for i := range engines {
+		gauntlet.points[i] = make([]float64, len(engines))
+		gauntlet.games[i] = make([]int, len(engines))
+	}
+	return gauntlet, nil
+}
+
+// pairings returns the pairs of engines that play each other.
+func (gauntlet *Gauntlet) pairings() [][2]int {
+	var pairings [][2]int
+	for i := range gauntlet.engines {
+		for j := i + 1; j < len(gauntlet.engines); j++ {
+			if i == 0 || gauntlet.options.roundRobin {
+				pairings = append(pairings, [2]int{i, j})
+			}
+		}
+	}
+	return pairings
+}
+
+// Play plays every game, calling onGame after each.  An error means an engine
+// couldn't be started.
+func (gauntlet *Gauntlet) Play(onGame func(game *Game) error) error {
+	for p, pairing := range gauntlet.pairings() {
+		for i := 0; i < int(gauntlet.options.games); i++ {
+			// Each opening is played twice, with the colours reversed
+			white, black := pairing[0], pairing[1]
+			if i%2 == 1 {
+				white, black = black, white
+			}
+			opening := gauntlet.openings[(i/2)%len(gauntlet.openings)]
+
+			game, err := gauntlet.playGame(white, black, opening)
+			if err != nil {
+				return err
+			}
+			game.tags["Round"] = fmt.Sprintf("%d.%d", p+1, i+1)
+
+			score, _ := ParseResultString(game.result)
+			gauntlet.points[white][black] += score
+			gauntlet.points[black][white] += 1 - score
+			gauntlet.games[white][black]++
+			gauntlet.games[black][white]++
+			if err := onGame(game); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// playGame plays a game until it's decided by the rules, or an engine crashes,
+// plays an illegal move, resigns or runs out of time.
+func (gauntlet *Gauntlet) playGame(white int, black int, fen string) (*Game, error) {
+	configs := [2]EngineConfig{gauntlet.engines[white], gauntlet.engines[black]}
+	game := &Game{
+		tags: map[string]string{
+			"Event":       "Gauntlet",
+			"Site":        "?",
+			"Date":        time.Now().Format("2006.01.02"),
+			"White":       configs[WHITE_OFFSET].Name,
+			"Black":       configs[BLACK_OFFSET].Name,
+			"TimeControl": gauntlet.options.timeControl.String(),
+			"Termination": "normal",
+		},
+		initialFEN: fen,
+	}
+
+	var engines [2]externalEngine
+	defer func() {
+		for _, engine := range engines {
+			if engine != nil {
+				engine.quit()
+			}
+		}
+	}()
+
+	// forfeit ends the game with a loss for the side
+	forfeit := func(side int, termination string, format string, a ...interface{}) (*Game, error) {
+		game.result = "0-1"
+		if side == BLACK_OFFSET {
+			game.result = "1-0"
+		}
+		game.resultComment = configs[side].Name + " " + fmt.Sprintf(format, a...)
+		game.tags["Termination"] = termination
+		for _, engine := range engines {
+			if engine != nil {
+				engine.gameOver(game.result, game.resultComment)
+			}
+		}
+		return game, nil
+	}
+
+	for side := range engines {
+		engine, err := startExternalEngine(configs[side])
+		if err != nil {
+			return nil, err
+		}
+		engines[side] = engine
+		if err := engine.newGame(fen, gauntlet.options.timeControl, configs[oppositeColorOffset(side)].Name); err != nil {
+			return forfeit(side, "abandoned", "failed to start the game (%v)", err)
+		}
+	}
+
+	gameBoard := CreateInitialBoardState()
+	if err := gameBoard.ResetFromFENString(fen); err != nil {
+		return nil, err
+	}
+	clocks := newGameClocks(gauntlet.options.timeControl, gameBoard.sideToMove)
+
+	for {
+		legalMoves := GenerateLegalMoves(&gameBoard)
+		if result, reason := adjudicateSelfPlayGame(&gameBoard, legalMoves); result != "" {
+			game.result = result
+			game.resultComment = reason
+			break
+		}
+
+		side := gameBoard.sideToMove
+		start := time.Now()
+		reply, err := engines[side].play(game.moves, clocks, start.Add(clocks.remaining[side]))
+		elapsed := time.Since(start)
+		switch {
+		case err == errEngineTimeout:
+			return forfeit(side, "time forfeit", "loses on time")
+		case err == errEngineResigned:
+			return forfeit(side, "normal", "resigns")
+		case err != nil:
+			return forfeit(side, "abandoned", "crashed (%v)", err)
+		case !clocks.punch(elapsed):
+			return forfeit(side, "time forfeit", "loses on time")
+		}
+
+		move, ok := parseEngineMove(reply, &gameBoard, legalMoves)
+		if !ok {
+			return forfeit(side, "rules infraction", "played an illegal move %s", reply)
+		}
+		game.moves = append(game.moves, move)
+		game.comments = append(game.comments, fmt.Sprintf("%.2fs", elapsed.Seconds()))
+
+		gameBoard.ApplyMove(move)
+	}
+
+	for _, engine := range engines {
+		engine.gameOver(game.result, game.resultComment)
+	}
+	return game, nil
+}
+
+// parseEngineMove finds the legal move an engine sent, in coordinate notation
+// or SAN.
+func parseEngineMove(reply string, boardState *BoardState, legalMoves []Move) (Move, bool) {
+	move, err := ParseXboardMove(reply, boardState)
+	if err != nil {
+		if move, err = ParsePrettyMove(reply, boardState); err != nil {
+			return 0, false
+		}
+	}
+	for _, legalMove := range legalMoves {
+		if containsTacticsMove([]Move{legalMove}, move) {
+			return legalMove, true
+		}
+	}
+	return 0, false
+}
+
+// Crosstable returns the engines' scores against each other, best first.
+func (gauntlet *Gauntlet) Crosstable() string {
+	engines := gauntlet.engines
+	totals := make([]float64, len(engines))
+	totalGames := make([]int, len(engines))
+	order := make([]int, len(engines))
+	nameWidth := len("Engine")
+	for i := range engines {
+		order[i] = i
+		for j := range engines {
+			totals[i] += gauntlet.points[i][j]
+			totalGames[i] += gauntlet.games[i][j]
+		}
+		if len(engines[i].Name) > nameWidth {
+			nameWidth = len(engines[i].Name)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return totals[order[a]] > totals[order[b]] })
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%4s  %-*s %9s", "Rank", nameWidth, "Engine", "Score")
+	for rank := range order {
+		fmt.Fprintf(&sb, " %9d", rank+1)
+	}
+	sb.WriteString("\n")
+	for rank, i := range order {
+		fmt.Fprintf(&sb, "%4d  %-*s %9s", rank+1, nameWidth, engines[i].Name, crosstableScore(totals[i], totalGames[i]))
+		for _, j := range order {
+			cell := "-"
+			if gauntlet.games[i][j] > 0 {
+				cell = crosstableScore(gauntlet.points[i][j], gauntlet.games[i][j])
+			}
+			fmt.Fprintf(&sb, " %9s", cell)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func crosstableScore(points float64, games int) string {
+	return fmt.Sprintf("%.1f/%d", points, games)
+}
+
+// RunGauntlet plays the gauntlet, writing the games to the PGN file, and prints
+// the crosstable.
+func RunGauntlet(enginesFile string, openingsFile string, epdRegex string, options GauntletOptions) (bool, error) {
+	gauntlet, err := NewGauntlet(enginesFile, openingsFile, epdRegex, options)
+	if err != nil {
+		return false, err
+	}
+	if options.pgnFile != "" {
+		if err := os.WriteFile(options.pgnFile, nil, 0644); err != nil {
+			return false, err
+		}
+	}
+
+	err = gauntlet.Play(func(game *Game) error {
+		fmt.Printf("Game %s: %s - %s %s {%s}\n", game.tags["Round"], game.tags["White"], game.tags["Black"],
+			game.result, game.resultComment)
+		if options.pgnFile != "" {
+			return AppendPGNFile(options.pgnFile, game)
+		}
+		return nil
+	})
+	fmt.Println()
+	fmt.Print(gauntlet.Crosstable())
+	if err != nil {
+		return false, err
+	}
+
+	if options.pgnFile != "" {
+		fmt.Printf("Games written to %s\n", options.pgnFile)
+	}
+	return true, nil
+}
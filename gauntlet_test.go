@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimeControl(t *testing.T) {
+	timeControl, err := ParseTimeControl("40/60")
+	assert.Nil(t, err)
+	assert.Equal(t, TimeControl{moves: 40, base: time.Minute}, timeControl)
+	assert.Equal(t, "40/60", timeControl.String())
+	assert.Equal(t, "40 1:00 0", timeControl.xboardLevel())
+
+	timeControl, err = ParseTimeControl("10+0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, TimeControl{base: 10 * time.Second, increment: 100 * time.Millisecond}, timeControl)
+	assert.Equal(t, "10+0.1", timeControl.String())
+	assert.Equal(t, "0 0:10 0.1", timeControl.xboardLevel())
+
+	for _, str := range []string{"", "0", "40/", "1:00", "10+"} {
+		_, err = ParseTimeControl(str)
+		assert.NotNil(t, err, str)
+	}
+}
+
+func TestGameClocks(t *testing.T) {
+	clocks := newGameClocks(TimeControl{moves: 2, base: time.Second, increment: 100 * time.Millisecond}, BLACK_OFFSET)
+	assert.Equal(t, 2, clocks.movesToGo(BLACK_OFFSET))
+
+	assert.True(t, clocks.punch(300*time.Millisecond))
+	assert.Equal(t, 800*time.Millisecond, clocks.remaining[BLACK_OFFSET])
+	assert.Equal(t, 1, clocks.movesToGo(BLACK_OFFSET))
+	assert.Equal(t, WHITE_OFFSET, clocks.sideToMove)
+
+	assert.True(t, clocks.punch(0))
+	assert.True(t, clocks.punch(300*time.Millisecond))
+	// The second session's time is added after two moves
+	assert.Equal(t, 1600*time.Millisecond, clocks.remaining[BLACK_OFFSET])
+	assert.Equal(t, 2, clocks.movesToGo(BLACK_OFFSET))
+
+	assert.False(t, clocks.punch(2*time.Second))
+}
+
+func writeGauntletEngines(t *testing.T, configs ...EngineConfig) string {
+	b, err := json.Marshal(configs)
+	assert.Nil(t, err)
+	return writeTestFile(t, "engines.json", string(b))
+}
+
+func TestRunGauntlet(t *testing.T) {
+	enginesFile := writeGauntletEngines(t,
+		helperEngineConfig(t, "ra", "xboard", "xboard"),
+		helperEngineConfig(t, "ra2", "xboard", "xboard"),
+		helperEngineConfig(t, "first", "uci", "uci"))
+	openingsFile := writeTestFile(t, "openings.epd", "6k1/8/8/8/8/8/8/4K2Q w - - 0 1 id \"kqk\";\n")
+	timeControl, _ := ParseTimeControl("5+0.05")
+	options := GauntletOptions{
+		timeControl: timeControl,
+		games:       2,
+		roundRobin:  true,
+		pgnFile:     filepath.Join(t.TempDir(), "gauntlet.pgn"),
+	}
+
+	gauntlet, err := NewGauntlet(enginesFile, openingsFile, "", options)
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]int{{0, 1}, {0, 2}, {1, 2}}, gauntlet.pairings())
+
+	success, err := RunGauntlet(enginesFile, openingsFile, "", options)
+	assert.Nil(t, err)
+	assert.True(t, success)
+
+	file, err := os.Open(options.pgnFile)
+	assert.Nil(t, err)
+	defer file.Close()
+	games, err := ReadPGNGames(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(games))
+	for _, game := range games[:2] {
+		// Our engine mates with the queen
+		assert.Equal(t, "1-0", game.result)
+	}
+	assert.Equal(t, "ra2", games[1].tags["White"])
+	assert.Equal(t, "5+0.05", games[0].tags["TimeControl"])
+	for _, game := range games {
+		assert.Equal(t, "normal", game.tags["Termination"])
+	}
+}
+
+func TestGauntletForfeits(t *testing.T) {
+	enginesFile := writeGauntletEngines(t,
+		helperEngineConfig(t, "ra", "xboard", "xboard"),
+		helperEngineConfig(t, "crash", "uci", "crash"),
+		helperEngineConfig(t, "illegal", "uci", "illegal"),
+		helperEngineConfig(t, "hang", "uci", "hang"))
+	timeControl, _ := ParseTimeControl("1")
+	gauntlet, err := NewGauntlet(enginesFile, "", "", GauntletOptions{timeControl: timeControl, games: 1})
+	assert.Nil(t, err)
+
+	var games []*Game
+	err = gauntlet.Play(func(game *Game) error {
+		games = append(games, game)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(games))
+	for _, game := range games {
+		assert.Equal(t, "1-0", game.result)
+		assert.Equal(t, 1, len(game.moves))
+	}
+	assert.True(t, strings.HasPrefix(games[0].resultComment, "crash crashed"), games[0].resultComment)
+	assert.Equal(t, "abandoned", games[0].tags["Termination"])
+	assert.Equal(t, "illegal played an illegal move a1a1", games[1].resultComment)
+	assert.Equal(t, "rules infraction", games[1].tags["Termination"])
+	assert.Equal(t, "hang loses on time", games[2].resultComment)
+	assert.Equal(t, "time forfeit", games[2].tags["Termination"])
+
+	assert.Equal(t, 3.0, gauntlet.points[0][1]+gauntlet.points[0][2]+gauntlet.points[0][3])
+	assert.Contains(t, gauntlet.Crosstable(), "   1  ra          3.0/3")
+}
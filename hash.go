@@ -35,11 +35,12 @@ func CreateHashInfo(r *rand.Rand) HashInfo {
 		}
 	}
 	for i := byte(0); i < 8; i++ {
-		hashInfo.enpassant[idx(i, 3)] = r.Uint64()
-		hashInfo.enpassant[idx(i, 6)] = r.Uint64()
+		hashInfo.enpassant[idx(i, 2)] = r.Uint64()
+		hashInfo.enpassant[idx(i, 5)] = r.Uint64()
 	}
-	// target square 0 is used for a 'clear' EP target
-	hashInfo.enpassant[0] = r.Uint64()
+	// target square 0 is used for a 'clear' EP target, which leaves the key as
+	// CreateHashKey has it (the number is still drawn to keep the other keys)
+	r.Uint64()
 	hashInfo.sideToMove = r.Uint64()
 	hashInfo.whiteCanCastleKingside = r.Uint64()
 	hashInfo.whiteCanCastleQueenside = r.Uint64()
@@ -159,12 +160,6 @@ func (boardState *BoardState) UpdateHashApplyMove(oldBoardInfo BoardInfo, move M
 			key ^= info.content[SQUARE_A1][WHITE_MASK|ROOK_MASK]
 			key ^= info.content[SQUARE_D1][WHITE_MASK|ROOK_MASK]
 		}
-		if oldBoardInfo.whiteCanCastleKingside != boardState.boardInfo.whiteCanCastleKingside {
-			key ^= info.whiteCanCastleKingside
-		}
-		if oldBoardInfo.whiteCanCastleQueenside != boardState.boardInfo.whiteCanCastleQueenside {
-			key ^= info.whiteCanCastleQueenside
-		}
 	} else {
 		if move.IsKingsideCastle() {
 			key ^= info.content[SQUARE_H8][BLACK_MASK|ROOK_MASK]
@@ -173,14 +168,10 @@ func (boardState *BoardState) UpdateHashApplyMove(oldBoardInfo BoardInfo, move M
 			key ^= info.content[SQUARE_A8][BLACK_MASK|ROOK_MASK]
 			key ^= info.content[SQUARE_D8][BLACK_MASK|ROOK_MASK]
 		}
-
-		if oldBoardInfo.blackCanCastleKingside != boardState.boardInfo.blackCanCastleKingside {
-			key ^= info.blackCanCastleKingside
-		}
-		if oldBoardInfo.blackCanCastleQueenside != boardState.boardInfo.blackCanCastleQueenside {
-			key ^= info.blackCanCastleQueenside
-		}
 	}
+
+	// Either side's castling can change, the other side's when its rook is captured
+	key ^= castlingRightsKey(info, oldBoardInfo, boardState.boardInfo)
 	if oldBoardInfo.enPassantTargetSquare != boardState.boardInfo.enPassantTargetSquare {
 		key ^= info.enpassant[oldBoardInfo.enPassantTargetSquare]
 		key ^= info.enpassant[boardState.boardInfo.enPassantTargetSquare]
@@ -250,12 +241,6 @@ func (boardState *BoardState) UpdateHashUnapplyMove(oldBoardInfo BoardInfo, move
 			key ^= info.content[SQUARE_A1][WHITE_MASK|ROOK_MASK]
 			key ^= info.content[SQUARE_D1][WHITE_MASK|ROOK_MASK]
 		}
-		if oldBoardInfo.whiteCanCastleKingside != boardState.boardInfo.whiteCanCastleKingside {
-			key ^= info.whiteCanCastleKingside
-		}
-		if oldBoardInfo.whiteCanCastleQueenside != boardState.boardInfo.whiteCanCastleQueenside {
-			key ^= info.whiteCanCastleQueenside
-		}
 	} else {
 		if move.IsKingsideCastle() {
 			key ^= info.content[SQUARE_H8][BLACK_MASK|ROOK_MASK]
@@ -264,15 +249,10 @@ func (boardState *BoardState) UpdateHashUnapplyMove(oldBoardInfo BoardInfo, move
 			key ^= info.content[SQUARE_A8][BLACK_MASK|ROOK_MASK]
 			key ^= info.content[SQUARE_D8][BLACK_MASK|ROOK_MASK]
 		}
-
-		if oldBoardInfo.blackCanCastleKingside != boardState.boardInfo.blackCanCastleKingside {
-			key ^= info.blackCanCastleKingside
-		}
-		if oldBoardInfo.blackCanCastleQueenside != boardState.boardInfo.blackCanCastleQueenside {
-			key ^= info.blackCanCastleQueenside
-		}
 	}
 
+	// Either side's castling can change, the other side's when its rook is captured
+	key ^= castlingRightsKey(info, oldBoardInfo, boardState.boardInfo)
 	if oldBoardInfo.enPassantTargetSquare != boardState.boardInfo.enPassantTargetSquare {
 		key ^= info.enpassant[oldBoardInfo.enPassantTargetSquare]
 		key ^= info.enpassant[boardState.boardInfo.enPassantTargetSquare]
@@ -281,3 +261,22 @@ func (boardState *BoardState) UpdateHashUnapplyMove(oldBoardInfo BoardInfo, move
 	boardState.hashKey = key
 	boardState.pawnHashKey = pawnKey
 }
+
+// castlingRightsKey returns the change to the hash key between the castling
+// rights of the board infos.
+func castlingRightsKey(info *HashInfo, boardInfo1 BoardInfo, boardInfo2 BoardInfo) uint64 {
+	var key uint64
+	if boardInfo1.whiteCanCastleKingside != boardInfo2.whiteCanCastleKingside {
+		key ^= info.whiteCanCastleKingside
+	}
+	if boardInfo1.whiteCanCastleQueenside != boardInfo2.whiteCanCastleQueenside {
+		key ^= info.whiteCanCastleQueenside
+	}
+	if boardInfo1.blackCanCastleKingside != boardInfo2.blackCanCastleKingside {
+		key ^= info.blackCanCastleKingside
+	}
+	if boardInfo1.blackCanCastleQueenside != boardInfo2.blackCanCastleQueenside {
+		key ^= info.blackCanCastleQueenside
+	}
+	return key
+}
@@ -20,3 +20,41 @@ func TestGenerateZobristHash(t *testing.T) {
 	var expectedKey uint64 = 0x2b07719fcf903b72
 	assert.Equal(t, expectedKey, key)
 }
+
+func TestHashKeyIncludesEnPassantSquare(t *testing.T) {
+	withEnPassant, _ := CreateBoardStateFromFENString("8/2p5/3p4/KP4kr/1R2PpP1/8/8/8 b - e3 0 2")
+	withoutEnPassant, _ := CreateBoardStateFromFENString("8/2p5/3p4/KP4kr/1R2PpP1/8/8/8 b - - 0 2")
+	assert.NotEqual(t, withEnPassant.hashKey, withoutEnPassant.hashKey)
+
+	// The same position after the knights have moved out and back, when the
+	// en passant square has gone
+	boardState := CreateInitialBoardState()
+	boardState.ApplyMove(CreateMove(SQUARE_E2, SQUARE_E4))
+	doublePush := boardState.hashKey
+	for _, move := range []Move{
+		CreateMove(SQUARE_G8, SQUARE_F6), CreateMove(SQUARE_G1, SQUARE_F3),
+		CreateMove(SQUARE_F6, SQUARE_G8), CreateMove(SQUARE_F3, SQUARE_G1),
+	} {
+		boardState.ApplyMove(move)
+	}
+	assert.NotEqual(t, doublePush, boardState.hashKey)
+}
+
+func TestPerftHashWithEnPassant(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1")
+	info := PerftPosition(&boardState, 5, PerftOptions{hash: NewPerftHash(16)})
+	assert.Equal(t, uint(674624), info.nodes)
+}
+
+// The incremental updates give the hash key computed from scratch
+func TestHashKeyUpdatesMatchCreateHashKey(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	boardState.ApplyMove(CreateMove(SQUARE_E2, SQUARE_E4))
+	assert.Equal(t, boardState.CreateHashKey(boardState.hashInfo), boardState.hashKey)
+
+	boardState, _ = CreateBoardStateFromFENString("r3k2r/8/8/8/8/8/6b1/R3K2R b KQkq - 0 1")
+	boardState.ApplyMove(CreateMove(SQUARE_G2, SQUARE_H1))
+	assert.Equal(t, boardState.CreateHashKey(boardState.hashInfo), boardState.hashKey)
+	boardState.UnapplyMove(CreateMove(SQUARE_G2, SQUARE_H1))
+	assert.Equal(t, boardState.CreateHashKey(boardState.hashInfo), boardState.hashKey)
+}
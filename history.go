@@ -0,0 +1,90 @@
+package main
+
+// historyEntry is what's kept for each position of the game and search, to
+// take back the move that left it and to find repetitions.
+type historyEntry struct {
+	// Castling rights, en passant square and halfmove clock, saved when a move
+	// is made from the position and restored when it's taken back
+	boardInfo     BoardInfo
+	halfmoveClock uint
+	hashKey       uint64
+	// whether the move to the position captured a piece (not en passant, where
+	// the captured pawn isn't on the destination square)
+	wasCapture bool
+	// a pawn move, capture or null move led to the position, so no position
+	// before it can repeat
+	irreversible bool
+}
+
+// positionHistory is a stack with an entry for every position from the start
+// of the game to the current one, so moveIndex is always one less than its
+// length.  It grows as needed, so games of any length can be played and
+// searched.  Entries below searchRoot are the game history; the ones above it
+// only exist during a search, and are pushed and popped as it moves between
+// lines.
+type positionHistory struct {
+	entries    []historyEntry
+	searchRoot int
+}
+
+func (history *positionHistory) push(entry historyEntry) {
+	history.entries = append(history.entries, entry)
+}
+
+func (history *positionHistory) pop() historyEntry {
+	l := len(history.entries)
+	entry := history.entries[l-1]
+	history.entries = history.entries[:l-1]
+
+	return entry
+}
+
+// top returns the entry of the current position.
+func (history *positionHistory) top() *historyEntry {
+	return &history.entries[len(history.entries)-1]
+}
+
+// resetHistory makes the current position the first one of the game.
+func (boardState *BoardState) resetHistory() {
+	boardState.moveIndex = 0
+	boardState.history.entries = append(boardState.history.entries[:0], historyEntry{
+		boardInfo: boardState.boardInfo,
+		hashKey:   boardState.hashKey,
+	})
+	boardState.history.searchRoot = 0
+}
+
+// startSearch marks the current position as the root of a search, and makes
+// room for the positions of the search so that it doesn't need to grow the
+// stack.
+func (boardState *BoardState) startSearch() {
+	boardState.history.searchRoot = boardState.moveIndex
+	if needed := len(boardState.history.entries) + MAX_SEARCH_PLY; cap(boardState.history.entries) < needed {
+		entries := make([]historyEntry, len(boardState.history.entries), needed)
+		copy(entries, boardState.history.entries)
+		boardState.history.entries = entries
+	}
+}
+
+// IsSearchRepetition returns true if the search should score the position as
+// a draw by repetition: it repeats a position since the search root, which the
+// side that could have avoided it is happy with, or one from the game that has
+// already occurred twice.
+func (boardState *BoardState) IsSearchRepetition() bool {
+	entries := boardState.history.entries
+	gameRepetitions := 0
+	for i := boardState.moveIndex - 1; i >= 0 && !entries[i+1].irreversible; i-- {
+		if entries[i].hashKey != boardState.hashKey {
+			continue
+		}
+		if i >= boardState.history.searchRoot {
+			return true
+		}
+		gameRepetitions++
+		if gameRepetitions >= 2 {
+			return true
+		}
+	}
+
+	return false
+}
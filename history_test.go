@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Kings and pieces but no pawns, so a game of quiet moves never makes an
+// irreversible move and every earlier position counts for repetitions.
+const longGameFEN = "r1b1k1nr/8/8/8/8/8/8/R1B1K1NR w KQkq - 0 1"
+
+// randomQuietMove picks one of the legal moves that neither captures nor
+// gives check, so that the game can't end or run out of quiet moves.
+func randomQuietMove(t *testing.T, boardState *BoardState, r *rand.Rand) Move {
+	var quiet []Move
+	for _, move := range GenerateLegalMoves(boardState) {
+		if move.IsCapture(boardState) {
+			continue
+		}
+		boardState.ApplyMove(move)
+		if !boardState.IsInCheck(boardState.sideToMove) {
+			quiet = append(quiet, move)
+		}
+		boardState.UnapplyMove(move)
+	}
+	if len(quiet) == 0 {
+		t.Fatalf("No quiet moves in %s", boardState.ToFENString())
+	}
+	return quiet[r.Intn(len(quiet))]
+}
+
+// playLongGame makes random quiet moves, returning them.
+func playLongGame(t *testing.T, boardState *BoardState, plies int) []Move {
+	r := rand.New(rand.NewSource(50))
+	var moves []Move
+	for len(moves) < plies {
+		move := randomQuietMove(t, boardState, r)
+		boardState.ApplyMove(move)
+		moves = append(moves, move)
+	}
+	return moves
+}
+
+func TestLongGameHistory(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString(longGameFEN)
+	r := rand.New(rand.NewSource(50))
+
+	fens := []string{boardState.ToFENString()}
+	hashes := []uint64{boardState.CreateHashKey(boardState.hashInfo)}
+	var moves []Move
+	for ply := 1; ply <= 1200; ply++ {
+		move := randomQuietMove(t, &boardState, r)
+		boardState.ApplyMove(move)
+		moves = append(moves, move)
+
+		// Count the earlier occurrences from scratch
+		hash := boardState.CreateHashKey(boardState.hashInfo)
+		occurrences := 0
+		for _, earlier := range hashes {
+			if earlier == hash {
+				occurrences++
+			}
+		}
+		fens = append(fens, boardState.ToFENString())
+		hashes = append(hashes, hash)
+
+		assert.Equal(t, hash, boardState.hashKey, "ply %d", ply)
+		assert.Equal(t, occurrences >= 1, boardState.HasStateOccurred(), "ply %d", ply)
+		assert.Equal(t, occurrences >= 2, boardState.RepetitionCount(3), "ply %d", ply)
+	}
+	assert.Equal(t, 1200, boardState.moveIndex)
+	assert.Equal(t, uint(601), boardState.fullmoveNumber)
+
+	// Every position can be read back, including the ones past move 255.
+	// Creating boards is slow, so one is reused for the rest.
+	loaded, err := CreateBoardStateFromFENString(fens[len(fens)-1])
+	assert.Nil(t, err)
+	for ply, fen := range fens {
+		if !assert.Nil(t, loaded.ResetFromFENString(fen), "ply %d", ply) {
+			break
+		}
+		assert.Equal(t, fen, loaded.ToFENString(), "ply %d", ply)
+		assert.Equal(t, hashes[ply], loaded.hashKey, "ply %d", ply)
+	}
+	assert.Equal(t, 1201, len(boardState.history.entries))
+
+	for ply := len(moves) - 1; ply >= 0; ply-- {
+		boardState.UnapplyMove(moves[ply])
+		if !assert.Equal(t, fens[ply], boardState.ToFENString(), "ply %d", ply) ||
+			!assert.Equal(t, hashes[ply], boardState.hashKey, "ply %d", ply) {
+			break
+		}
+	}
+	assert.Equal(t, 0, boardState.moveIndex)
+	assert.Equal(t, 1, len(boardState.history.entries))
+}
+
+// kingMove finds a legal quiet king move, or the one between the squares if
+// from isn't 64.
+func kingMove(t *testing.T, boardState *BoardState, from byte, to byte) Move {
+	for _, move := range GenerateLegalMoves(boardState) {
+		if !isKing(boardState.PieceAtSquare(move.From())) || move.IsCapture(boardState) || move.IsCastle() {
+			continue
+		}
+		if from == 64 || (move.From() == from && move.To() == to) {
+			return move
+		}
+	}
+	t.Fatalf("No king move in %s", boardState.ToFENString())
+	return 0
+}
+
+func TestThreefoldRepetitionAfterLongGame(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString(longGameFEN)
+	playLongGame(t, &boardState, 1000)
+	assert.False(t, boardState.RepetitionCount(3))
+
+	// Both kings step away and back, twice
+	for i := 1; i <= 2; i++ {
+		white := kingMove(t, &boardState, 64, 64)
+		boardState.ApplyMove(white)
+		black := kingMove(t, &boardState, 64, 64)
+		boardState.ApplyMove(black)
+		boardState.ApplyMove(kingMove(t, &boardState, white.To(), white.From()))
+		boardState.ApplyMove(kingMove(t, &boardState, black.To(), black.From()))
+
+		assert.True(t, boardState.HasStateOccurred())
+		assert.Equal(t, i == 2, boardState.RepetitionCount(3))
+	}
+	assert.Equal(t, 1008, boardState.moveIndex)
+}
+
+func TestSearchOnTopOfLongGame(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString(longGameFEN)
+	playLongGame(t, &boardState, 1000)
+	fen := boardState.ToFENString()
+
+	result := Search(&boardState, 3, &SearchStats{}, &SearchMoveInfo{})
+	assert.NotEqual(t, Move(0), result.move)
+	assert.Equal(t, fen, boardState.ToFENString())
+	assert.Equal(t, 1000, boardState.moveIndex)
+	assert.Equal(t, 1001, len(boardState.history.entries))
+	assert.Equal(t, 1000, boardState.history.searchRoot)
+}
+
+func TestSearchRepetition(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("6k1/8/8/8/8/8/8/1N4K1 w - - 0 1")
+	play := func(moves ...string) {
+		for _, str := range moves {
+			move, err := ParsePrettyMove(str, &boardState)
+			assert.Nil(t, err)
+			boardState.ApplyMove(move)
+		}
+	}
+
+	// Once is enough for a position reached during the search
+	boardState.startSearch()
+	play("Nc3", "Kf8")
+	assert.False(t, boardState.IsSearchRepetition())
+	play("Nb1", "Kg8")
+	assert.True(t, boardState.IsSearchRepetition())
+
+	// A position from before the search needs to occur three times
+	boardState.startSearch()
+	play("Nc3", "Kf8")
+	assert.True(t, boardState.HasStateOccurred())
+	assert.False(t, boardState.IsSearchRepetition())
+	play("Nb1", "Kg8", "Nc3", "Kf8")
+	boardState.startSearch()
+	play("Nb1", "Kg8")
+	assert.True(t, boardState.IsSearchRepetition())
+}
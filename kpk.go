@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math/bits"
+)
+
+// KPK bitbase: every king and pawn versus king position is classified as a win or
+// a draw by retrograde analysis.  Positions are normalised so that the pawn is
+// white and on files a-d, giving 2 (side to move) * 64 * 64 (kings) * 24 (pawn)
+// entries, one bit each.
+//
+// The table is built by marking the positions whose result is immediately known
+// (the pawn promotes safely, stalemate, the pawn is captured) and then repeatedly
+// classifying the remaining positions from the results of their successors until
+// nothing changes.  Anything still unknown at that point is a draw.  Generation
+// takes a few tens of milliseconds, so the table is simply built at startup.
+
+const KPK_SIZE = 2 * 64 * 64 * 24
+
+const (
+	KPK_INVALID = 0
+	KPK_UNKNOWN = 1
+	KPK_DRAW    = 2
+	KPK_WIN     = 4
+)
+
+type KPKBitbase struct {
+	wins [KPK_SIZE / 64]uint64
+}
+
+var kpkBitbase *KPKBitbase
+
+func InitializeKPKBitbase() {
+	kpkBitbase = GenerateKPKBitbase()
+}
+
+func kpkIndex(sideToMove int, blackKing byte, whiteKing byte, pawn byte) int {
+	return sideToMove |
+		int(blackKing)<<1 |
+		int(whiteKing)<<7 |
+		squareFile(pawn)<<13 |
+		(6-squareRank(pawn))<<15
+}
+
+func kingAttacks(sq byte) uint64 {
+	return moveBitboards.kingAttacks[sq].board
+}
+
+// whitePawnAttacks returns the squares attacked by a white pawn.
+func whitePawnAttacks(sq byte) uint64 {
+	var attacks uint64
+	if squareFile(sq) > 0 {
+		attacks |= 1 << (sq + 7)
+	}
+	if squareFile(sq) < 7 {
+		attacks |= 1 << (sq + 9)
+	}
+	return attacks
+}
+
+func GenerateKPKBitbase() *KPKBitbase {
+	results := make([]byte, KPK_SIZE)
+
+	for sideToMove := WHITE_OFFSET; sideToMove <= BLACK_OFFSET; sideToMove++ {
+		for pawnFile := byte(0); pawnFile < 4; pawnFile++ {
+			for pawnRank := byte(1); pawnRank <= 6; pawnRank++ {
+				pawn := idx(pawnFile, pawnRank)
+				for whiteKing := byte(0); whiteKing < 64; whiteKing++ {
+					for blackKing := byte(0); blackKing < 64; blackKing++ {
+						results[kpkIndex(sideToMove, blackKing, whiteKing, pawn)] =
+							kpkInitialResult(sideToMove, blackKing, whiteKing, pawn)
+					}
+				}
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := range results {
+			if results[i] != KPK_UNKNOWN {
+				continue
+			}
+			sideToMove := i & 1
+			blackKing := byte(i>>1) & 63
+			whiteKing := byte(i>>7) & 63
+			pawn := idx(byte(i>>13)&3, byte(6-(i>>15)))
+
+			if result := kpkClassify(results, sideToMove, blackKing, whiteKing, pawn); result != KPK_UNKNOWN {
+				results[i] = result
+				changed = true
+			}
+		}
+	}
+
+	bitbase := &KPKBitbase{}
+	for i, result := range results {
+		if result == KPK_WIN {
+			bitbase.wins[i/64] |= 1 << uint(i%64)
+		}
+	}
+
+	return bitbase
+}
+
+func kpkInitialResult(sideToMove int, blackKing byte, whiteKing byte, pawn byte) byte {
+	if whiteKing == blackKing || whiteKing == pawn || blackKing == pawn ||
+		squareDistance(whiteKing, blackKing) <= 1 ||
+		(sideToMove == WHITE_OFFSET && whitePawnAttacks(pawn)&(1<<blackKing) != 0) {
+		return KPK_INVALID
+	}
+
+	queeningSquare := pawn + 8
+	if sideToMove == WHITE_OFFSET && squareRank(pawn) == 6 &&
+		whiteKing != queeningSquare && blackKing != queeningSquare &&
+		(squareDistance(blackKing, queeningSquare) > 1 || squareDistance(whiteKing, queeningSquare) == 1) {
+		return KPK_WIN
+	}
+
+	if sideToMove == BLACK_OFFSET {
+		// Stalemate, or the pawn is undefended and can be taken
+		if kingAttacks(blackKing)&^(kingAttacks(whiteKing)|whitePawnAttacks(pawn)) == 0 ||
+			(squareDistance(blackKing, pawn) == 1 && squareDistance(whiteKing, pawn) > 1) {
+			return KPK_DRAW
+		}
+	}
+
+	return KPK_UNKNOWN
+}
+
+// kpkClassify combines the results of every move from the position.  White needs
+// one winning move to win; black needs one drawing move to draw.  Moves into an
+// illegal position have an INVALID result, which doesn't contribute.
+func kpkClassify(results []byte, sideToMove int, blackKing byte, whiteKing byte, pawn byte) byte {
+	var combined byte
+	good, bad := byte(KPK_DRAW), byte(KPK_WIN)
+	if sideToMove == WHITE_OFFSET {
+		good, bad = KPK_WIN, KPK_DRAW
+
+		moves := kingAttacks(whiteKing)
+		for moves != 0 {
+			to := byte(bits.TrailingZeros64(moves))
+			moves &= moves - 1
+			combined |= results[kpkIndex(BLACK_OFFSET, blackKing, to, pawn)]
+		}
+
+		if squareRank(pawn) < 6 {
+			push := pawn + 8
+			if push != whiteKing && push != blackKing {
+				combined |= results[kpkIndex(BLACK_OFFSET, blackKing, whiteKing, push)]
+
+				doublePush := push + 8
+				if squareRank(pawn) == 1 && doublePush != whiteKing && doublePush != blackKing {
+					combined |= results[kpkIndex(BLACK_OFFSET, blackKing, whiteKing, doublePush)]
+				}
+			}
+		}
+	} else {
+		moves := kingAttacks(blackKing)
+		for moves != 0 {
+			to := byte(bits.TrailingZeros64(moves))
+			moves &= moves - 1
+			combined |= results[kpkIndex(WHITE_OFFSET, to, whiteKing, pawn)]
+		}
+	}
+
+	if combined&good != 0 {
+		return good
+	}
+	if combined&KPK_UNKNOWN != 0 {
+		return KPK_UNKNOWN
+	}
+	return bad
+}
+
+// Probe returns true if the side with the pawn wins.  Squares are given as they
+// are on the board; strongSide is the color of the pawn.
+func (bitbase *KPKBitbase) Probe(strongSide int, strongKing byte, pawn byte, weakKing byte, sideToMove int) bool {
+	if strongSide == BLACK_OFFSET {
+		strongKing, pawn, weakKing = strongKing^56, pawn^56, weakKing^56
+		sideToMove = oppositeColorOffset(sideToMove)
+	}
+	if squareFile(pawn) >= 4 {
+		strongKing, pawn, weakKing = strongKing^7, pawn^7, weakKing^7
+	}
+
+	i := kpkIndex(sideToMove, weakKing, strongKing, pawn)
+	return bitbase.wins[i/64]&(1<<uint(i%64)) != 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// kpkFen builds a FEN for a white king and pawn against the black king.
+func kpkFen(whiteKing byte, pawn byte, blackKing byte, sideToMove int) string {
+	var board [64]byte
+	board[whiteKing] = 'K'
+	board[pawn] = 'P'
+	board[blackKing] = 'k'
+
+	var sb strings.Builder
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			piece := board[rank*8+file]
+			if piece == 0 {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				fmt.Fprintf(&sb, "%d", empty)
+				empty = 0
+			}
+			sb.WriteByte(piece)
+		}
+		if empty > 0 {
+			fmt.Fprintf(&sb, "%d", empty)
+		}
+		if rank > 0 {
+			sb.WriteByte('/')
+		}
+	}
+	if sideToMove == WHITE_OFFSET {
+		sb.WriteString(" w - - 0 1")
+	} else {
+		sb.WriteString(" b - - 0 1")
+	}
+
+	return sb.String()
+}
+
+func TestKPKKnownPositions(t *testing.T) {
+	tests := []struct {
+		name       string
+		whiteKing  byte
+		pawn       byte
+		blackKing  byte
+		sideToMove int
+		win        bool
+	}{
+		{"opposition, white to move", SQUARE_D5, SQUARE_D4, SQUARE_D7, WHITE_OFFSET, false},
+		{"opposition, black to move", SQUARE_D5, SQUARE_D4, SQUARE_D7, BLACK_OFFSET, true},
+		{"king on the sixth in front of the pawn", SQUARE_D6, SQUARE_D5, SQUARE_D8, WHITE_OFFSET, true},
+		{"king on the sixth in front of the pawn, black to move", SQUARE_D6, SQUARE_D5, SQUARE_D8, BLACK_OFFSET, true},
+		{"defending king blockades", SQUARE_D3, SQUARE_D5, SQUARE_D6, WHITE_OFFSET, false},
+		{"key square", SQUARE_C6, SQUARE_D4, SQUARE_F8, BLACK_OFFSET, true},
+		{"king in front of pawn on the second rank", SQUARE_E3, SQUARE_E2, SQUARE_E5, WHITE_OFFSET, false},
+		{"king two squares in front of pawn, opposition", SQUARE_E4, SQUARE_E2, SQUARE_E6, BLACK_OFFSET, true},
+		{"promotes from b7", SQUARE_B5, SQUARE_B7, SQUARE_B8, WHITE_OFFSET, true},
+		{"stalemate", SQUARE_E6, SQUARE_E7, SQUARE_E8, BLACK_OFFSET, false},
+		{"undefended pawn is taken", SQUARE_H1, SQUARE_E4, SQUARE_E5, BLACK_OFFSET, false},
+		{"rook pawn, defending king in the corner", SQUARE_B6, SQUARE_A5, SQUARE_A8, WHITE_OFFSET, false},
+		{"rook pawn, defending king in the corner, far pawn", SQUARE_E4, SQUARE_A4, SQUARE_A8, BLACK_OFFSET, false},
+		{"rook pawn, defending king next to the corner", SQUARE_A6, SQUARE_A5, SQUARE_B8, WHITE_OFFSET, false},
+		{"rook pawn, defending king shut out", SQUARE_B7, SQUARE_A4, SQUARE_D7, BLACK_OFFSET, true},
+		{"rule of the square, white to move", SQUARE_H1, SQUARE_A4, SQUARE_F4, WHITE_OFFSET, true},
+		{"rule of the square, black to move", SQUARE_H1, SQUARE_A4, SQUARE_F4, BLACK_OFFSET, false},
+		{"double push escapes the square", SQUARE_H1, SQUARE_A2, SQUARE_G5, WHITE_OFFSET, true},
+		{"rule of the square from the third rank, black to move", SQUARE_H1, SQUARE_A3, SQUARE_G5, BLACK_OFFSET, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.win,
+			kpkBitbase.Probe(WHITE_OFFSET, test.whiteKing, test.pawn, test.blackKing, test.sideToMove), test.name)
+
+		// The same position with colors reversed
+		assert.Equal(t, test.win,
+			kpkBitbase.Probe(BLACK_OFFSET, test.whiteKing^56, test.pawn^56, test.blackKing^56,
+				oppositeColorOffset(test.sideToMove)), test.name)
+	}
+}
+
+func TestKPKSymmetry(t *testing.T) {
+	for sideToMove := WHITE_OFFSET; sideToMove <= BLACK_OFFSET; sideToMove++ {
+		for pawn := SQUARE_A2; pawn <= SQUARE_H7; pawn++ {
+			for whiteKing := byte(0); whiteKing < 64; whiteKing++ {
+				for blackKing := byte(0); blackKing < 64; blackKing++ {
+					win := kpkBitbase.Probe(WHITE_OFFSET, whiteKing, pawn, blackKing, sideToMove)
+					assert.Equal(t, win, kpkBitbase.Probe(WHITE_OFFSET, whiteKing^7, pawn^7, blackKing^7, sideToMove))
+					assert.Equal(t, win, kpkBitbase.Probe(BLACK_OFFSET, whiteKing^56, pawn^56, blackKing^56,
+						oppositeColorOffset(sideToMove)))
+				}
+			}
+		}
+	}
+}
+
+// TestKPKMatchesMoveGeneration checks every legal position with the pawn below
+// the seventh rank against the engine's own move generator: white wins if it has
+// a move to a won position, and black loses if every move leads to one.
+func TestKPKMatchesMoveGeneration(t *testing.T) {
+	boardState := CreateEmptyBoardState()
+	moves := make([]Move, 256)
+	checked := 0
+
+	for sideToMove := WHITE_OFFSET; sideToMove <= BLACK_OFFSET; sideToMove++ {
+		for pawn := SQUARE_A2; pawn <= SQUARE_D6; pawn++ {
+			if squareFile(pawn) >= 4 {
+				continue
+			}
+			for whiteKing := byte(0); whiteKing < 64; whiteKing++ {
+				for blackKing := byte(0); blackKing < 64; blackKing++ {
+					if whiteKing == pawn || blackKing == pawn || squareDistance(whiteKing, blackKing) <= 1 ||
+						(sideToMove == WHITE_OFFSET && whitePawnAttacks(pawn)&(1<<blackKing) != 0) {
+						continue
+					}
+
+					fen := kpkFen(whiteKing, pawn, blackKing, sideToMove)
+					assert.Nil(t, boardState.ResetFromFENString(fen))
+					win := kpkBitbase.Probe(WHITE_OFFSET, whiteKing, pawn, blackKing, sideToMove)
+
+					anyWin := false
+					allWin := true
+					legalMoves := 0
+					moveCount := GenerateMoves(&boardState, moves, 0)
+					for _, move := range moves[:moveCount] {
+						boardState.ApplyMove(move)
+						if !boardState.IsInCheck(sideToMove) {
+							legalMoves++
+							successorWins := move.Flags()&CAPTURE_MASK == 0 &&
+								kpkBitbase.Probe(WHITE_OFFSET, kingOf(&boardState, WHITE_OFFSET),
+									pawnOf(&boardState), kingOf(&boardState, BLACK_OFFSET),
+									boardState.sideToMove)
+							anyWin = anyWin || successorWins
+							allWin = allWin && successorWins
+						}
+						boardState.UnapplyMove(move)
+					}
+
+					if sideToMove == WHITE_OFFSET {
+						assert.Equal(t, anyWin, win, fen)
+					} else {
+						assert.Equal(t, legalMoves > 0 && allWin, win, fen)
+					}
+					checked++
+				}
+			}
+		}
+	}
+
+	assert.True(t, checked > 100000)
+}
+
+func kingOf(boardState *BoardState, side int) byte {
+	return byte(bits.TrailingZeros64(boardState.bitboards.piece[KING_MASK] & boardState.bitboards.color[side]))
+}
+
+func pawnOf(boardState *BoardState) byte {
+	return byte(bits.TrailingZeros64(boardState.bitboards.piece[PAWN_MASK]))
+}
+
+func TestEvalKPKUsesBitbase(t *testing.T) {
+	won := evalFen(t, "3k4/8/3K4/3P4/8/8/8/8 w - - 0 1")
+	assert.Equal(t, "KPK", won.endgameName)
+	assert.True(t, won.value() > KNOWN_WIN_SCORE)
+
+	drawn := evalFen(t, "8/3k4/8/3K4/3P4/8/8/8 w - - 0 1")
+	assert.Equal(t, 0, drawn.value())
+
+	black := evalFen(t, "8/8/8/8/3p4/3k4/8/3K4 b - - 0 1")
+	assert.True(t, black.value() > KNOWN_WIN_SCORE)
+}
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"strings"
 	"time"
 )
 
@@ -37,19 +39,77 @@ func main() {
 	perftJSONFile := flag.String("perftjson", "", "JSON specification")
 	perftPrintMoves := flag.Bool("printmoves", false, "Perft: print all generates moves at final depth")
 	perftDivide := flag.Bool("perftdivide", false, "Perft: print divide of all moves at top depth")
+	perftDivideDiff := flag.String("perftdividediff", "", "Perft: reference divide file (e.g. Stockfish's go perft output) to find the first move path whose count differs")
+	perftThreads := flag.Uint("perftthreads", uint(runtime.NumCPU()), "Perft: number of goroutines the root moves are split between")
+	perftHash := flag.Uint("perfthash", 0, "Perft: size of the hash table of subtree counts in MB (0 to count every subtree)")
+	isValidate := flag.Bool("validate", false, "Check that every position of an EPD file is legal and print the ones that aren't (pair with --epd)")
 	isTactics := flag.Bool("tactics", false, "Tactics mode")
 	tacticsThinkingTime := flag.Uint("tacticsthinkingtime", 1500, "Time to think per position (ms)")
 	tacticsDebug := flag.String("tacticsdebug", "", "Output more information during tactics if the move matches the string")
 	tacticsDepth := flag.Uint("tacticsdepth", 0, "Only run tactics search for the given depth")
 	tacticsHashVariation := flag.String("tacticshashvariation", "", "Output transposition table information for given variation")
+	tacticsThreads := flag.Uint("tacticsthreads", uint(runtime.NumCPU()), "Tactics: number of positions searched at the same time")
+	tacticsJSON := flag.String("tacticsjson", "", "Tactics: file to write the results to as JSON")
+	tacticsJUnit := flag.String("tacticsjunit", "", "Tactics: file to write the results to as JUnit XML")
 	isMagic := flag.Bool("magic", false, "Generate magic bitboard constants (write to rook-magics.json and bishop-magics.json)")
 	isEval := flag.Bool("eval", false, "Run evaluation on the specified position or positions (no search)")
+	evalTrace := flag.Bool("evaltrace", false, "Eval: print every contribution to the evaluation (term, side, square, value)")
+	evalTraceFormat := flag.String("evaltraceformat", "table", "Eval: format of --evaltrace output (table or json)")
+	evalDiffFen := flag.String("evaldifffen", "", "Eval: compare the evaluation of --fen against this position")
+	evalDiffParams := flag.String("evaldiffparams", "", "Eval: compare the evaluation of --fen under this parameter file")
+	evalParamsFile := flag.String("evalparams", "", "JSON file of evaluation parameters (defaults to the compiled-in values)")
+	isTune := flag.Bool("tune", false, "Tune evaluation parameters against labelled positions (pair with --tunedata)")
+	tuneData := flag.String("tunedata", "", "Tuning: positions with game results (EPD with c9 opcode, or FEN + result per line)")
+	tuneOutput := flag.String("tuneoutput", "evalparams-tuned.json", "Tuning: file the tuned parameters are written to after every iteration")
+	tuneIterations := flag.Uint("tuneiterations", 0, "Tuning: maximum number of iterations (0 = until no improvement)")
+	tuneThreads := flag.Uint("tunethreads", uint(runtime.NumCPU()), "Tuning: number of goroutines used to compute the error")
+	tuneK := flag.Float64("tunek", 0, "Tuning: sigmoid scaling constant (0 = fit to the data)")
+	isDumpEvalParams := flag.Bool("dumpevalparams", false, "Print the current evaluation parameters as JSON")
+	genTablebase := flag.String("gentb", "", "Generate and verify the endgame tablebase for a material signature (e.g. KQvKR) and the tables it depends on")
+	tablebasePath := flag.String("tbpath", "", "Directory of endgame tablebases generated with --gentb")
+	syzygyPath := flag.String("syzygypath", "", "Directories of Syzygy tablebases (.rtbw/.rtbz), separated like $PATH")
+	bookFile := flag.String("book", "", "Polyglot opening book (.bin) used in xboard mode")
+	isAnnotate := flag.Bool("annotate", false, "Search every position of an EPD file and write it with the results (pair with --epd)")
+	annotateOutput := flag.String("annotateoutput", "annotated.epd", "Annotate: file the annotated positions are written to")
+	annotateTime := flag.Uint("annotatetime", 1000, "Annotate: time to search each position (ms)")
+	annotateDepth := flag.Uint("annotatedepth", 0, "Annotate: search each position to this depth instead of for a fixed time")
+	isSelfPlay := flag.Bool("selfplay", false, "Play games between two configurations of the engine from opening positions (pair with --epd)")
+	selfPlayGames := flag.Uint("selfplaygames", 100, "Self-play: number of games, played in pairs with the colours reversed")
+	selfPlayTime := flag.Uint("selfplaytime", 100, "Self-play: time to think per move (ms)")
+	selfPlayDepth := flag.Uint("selfplaydepth", 0, "Self-play: search every move to this depth instead of for a fixed time")
+	selfPlayThreads := flag.Uint("selfplaythreads", uint(runtime.NumCPU()), "Self-play: number of games played at the same time")
+	selfPlayParams := flag.String("selfplayparams", "", "Self-play: evaluation parameters of the test engine (the base engine uses --evalparams)")
+	selfPlaySearch := flag.String("selfplaysearch", "", "Self-play: search features turned off in the test engine, comma separated (nonullmove, nopromotionextension)")
+	selfPlayPGN := flag.String("selfplaypgn", "selfplay.pgn", "Self-play: file the games are written to")
+	isBench := flag.Bool("bench", false, "Search a fixed set of positions to a fixed depth and print the nodes searched, a signature of the search")
+	benchDepth := flag.Uint("benchdepth", BENCH_DEPTH, "Bench: depth to search each position")
+	gauntletEngines := flag.String("gauntlet", "", "Play games between engine binaries listed in this JSON file (name, command, args, dir, protocol xboard or uci, options), with openings from --epd")
+	gauntletTimeControl := flag.String("gauntlettc", "10+0.1", "Gauntlet: time control in seconds (40/60 for 40 moves in a minute, 10+0.1 with an increment)")
+	gauntletGames := flag.Uint("gauntletgames", 2, "Gauntlet: number of games between each pair of engines, with the colours alternating")
+	gauntletRoundRobin := flag.Bool("gauntletroundrobin", false, "Gauntlet: every engine plays every other, instead of the first engine playing the rest")
+	gauntletPGN := flag.String("gauntletpgn", "gauntlet.pgn", "Gauntlet: file the games are written to")
+	isSPRT := flag.Bool("sprt", false, "Play self-play game pairs until an SPRT accepts or rejects the test engine, uses the --selfplay flags "+
+		"(exit status 0 if H1 is accepted, 1 if H0 is, 2 if --sprtmaxgames is reached first and 3 on an error)")
+	sprtElo0 := flag.Float64("sprtelo0", 0, "SPRT: Elo gain of the null hypothesis")
+	sprtElo1 := flag.Float64("sprtelo1", 5, "SPRT: Elo gain of the alternative hypothesis")
+	sprtAlpha := flag.Float64("sprtalpha", 0.05, "SPRT: probability of accepting a change that doesn't gain elo1")
+	sprtBeta := flag.Float64("sprtbeta", 0.05, "SPRT: probability of rejecting a change that gains elo1")
+	sprtMaxGames := flag.Uint("sprtmaxgames", 0, "SPRT: stop without a result after this many games (0 for no limit)")
+	sprtReport := flag.Uint("sprtreport", 10, "SPRT: number of game pairs between progress reports")
+	isMakeBook := flag.Bool("makebook", false, "Build a Polyglot opening book from PGN games (pair with --pgn)")
+	pgnFiles := flag.String("pgn", "", "PGN files, comma separated")
+	makeBookOutput := flag.String("makebookoutput", "book.bin", "Makebook: file the book is written to")
+	makeBookPlies := flag.Uint("makebookplies", 2*DEFAULT_BOOK_DEPTH, "Makebook: number of plies of each game to include")
+	makeBookMinGames := flag.Uint("makebookmingames", 3, "Makebook: minimum number of games a move must be played in")
+	makeBookMinScore := flag.Float64("makebookminscore", 0, "Makebook: minimum score (0-1) of a move for the side playing it")
 
 	flag.Parse()
 
 	InitializeLogger()
 	InitializeMoveBitboards()
+	InitializeKPKBitbase()
 	var success = true
+	var sprtResult SPRTResult
 	var err error
 
 	defer func() {
@@ -71,20 +131,146 @@ func main() {
 		}
 	}
 
-	if *isPerft || *perftJSONFile != "" {
+	if *evalParamsFile != "" {
+		params, err := LoadEvalParams(*evalParamsFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		SetEvalParams(params)
+	}
+
+	if *tablebasePath != "" {
+		if _, err := os.Stat(*tablebasePath); err == nil {
+			if _, err := LoadTablebases(*tablebasePath); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *syzygyPath != "" {
+		if _, err := LoadSyzygyTables(*syzygyPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *bookFile != "" {
+		if err := SetOpeningBook(*bookFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *genTablebase != "" {
+		start := time.Now()
+		success, err = RunGenerateTablebase(*genTablebase, *tablebasePath)
+		fmt.Printf("Total time: %s\n", time.Since(start))
+	} else if *isAnnotate {
+		var options AnnotateOptions
+		options.epdRegex = *epdRegex
+		options.thinkingTimeMs = *annotateTime
+		options.depth = *annotateDepth
+
+		start := time.Now()
+		if *epdFile == "" {
+			err = errors.New("Must specify an EPD file to annotate (--epd)")
+		} else {
+			success, err = RunAnnotate(*epdFile, *annotateOutput, options)
+		}
+		fmt.Printf("Total time: %s\n", time.Since(start))
+	} else if *isValidate {
+		if *epdFile == "" {
+			err = errors.New("Must specify an EPD file to validate (--epd)")
+		} else {
+			success, err = RunValidateEpd(*epdFile)
+		}
+	} else if *isBench {
+		success, err = RunBench(*benchDepth)
+	} else if *gauntletEngines != "" {
+		var options GauntletOptions
+		options.games = *gauntletGames
+		options.roundRobin = *gauntletRoundRobin
+		options.pgnFile = *gauntletPGN
+		options.timeControl, err = ParseTimeControl(*gauntletTimeControl)
+
+		start := time.Now()
+		if err == nil {
+			success, err = RunGauntlet(*gauntletEngines, *epdFile, *epdRegex, options)
+		}
+		fmt.Printf("Total time: %s\n", time.Since(start))
+	} else if *isSelfPlay || *isSPRT {
+		var options SelfPlayOptions
+		options.games = *selfPlayGames
+		options.thinkingTimeMs = *selfPlayTime
+		options.depth = *selfPlayDepth
+		options.threads = *selfPlayThreads
+		options.pgnFile = *selfPlayPGN
+
+		base := SelfPlayEngine{name: "base", evalParams: evalParams}
+		test := SelfPlayEngine{name: "test", evalParams: evalParams}
+		test.features, err = ParseSearchFeatures(*selfPlaySearch)
+		if err == nil && *selfPlayParams != "" {
+			var params EvalParams
+			params, err = LoadEvalParams(*selfPlayParams)
+			test.evalParams = &params
+		}
+
+		start := time.Now()
+		if err == nil && *epdFile == "" {
+			err = errors.New("Must specify an EPD file of opening positions (--epd)")
+		} else if err == nil && *isSPRT {
+			var sprtOptions SPRTOptions
+			sprtOptions.elo0 = *sprtElo0
+			sprtOptions.elo1 = *sprtElo1
+			sprtOptions.alpha = *sprtAlpha
+			sprtOptions.beta = *sprtBeta
+			sprtOptions.maxPairs = int(*sprtMaxGames+1) / 2
+			sprtOptions.reportInterval = int(*sprtReport)
+			sprtResult, err = RunSPRT(*epdFile, *epdRegex, base, test, options, sprtOptions)
+		} else if err == nil {
+			success, err = RunSelfPlay(*epdFile, *epdRegex, base, test, options)
+		}
+		fmt.Printf("Total time: %s\n", time.Since(start))
+	} else if *isMakeBook {
+		var options MakeBookOptions
+		options.outputFile = *makeBookOutput
+		options.maxPly = int(*makeBookPlies)
+		options.minGames = int(*makeBookMinGames)
+		options.minScore = *makeBookMinScore
+
+		var files []string
+		if *pgnFiles != "" {
+			files = strings.Split(*pgnFiles, ",")
+		}
+		success, err = RunMakeBook(files, options)
+	} else if *isPerft || *perftJSONFile != "" || *perftDivideDiff != "" {
 		var options PerftOptions
 		options.checks = *perftChecks
 		options.sanityCheck = *perftSanityCheck
 		options.perftPrintMoves = *perftPrintMoves
 		options.divide = *perftDivide
+		options.threads = *perftThreads
+		if *perftHash > 0 {
+			options.hash = NewPerftHash(*perftHash)
+		}
 		options.depth = *perftDepth
 
 		start := time.Now()
 		if *perftJSONFile != "" {
 			success, err = RunPerftJson(*perftJSONFile, options)
+		} else if *epdFile != "" {
+			options.epdRegex = *epdRegex
+			success, err = RunPerftEpd(*epdFile, *perftDepth, options)
+		} else if *perftDivideDiff != "" {
+			if *startingFen == "" {
+				*startingFen = STARTING_FEN
+			}
+			success, err = RunPerftDivideDiff(*startingFen, *variation, *perftDepth, *perftDivideDiff, options)
 		} else {
 			if *startingFen == "" {
-				*startingFen = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+				*startingFen = STARTING_FEN
 			}
 			success, err = RunPerft(*startingFen, *variation, *perftDepth, options)
 		}
@@ -97,6 +283,9 @@ func main() {
 		options.tacticsDebug = *tacticsDebug
 		options.tacticsDepth = *tacticsDepth
 		options.tacticsHashVariation = *tacticsHashVariation
+		options.threads = *tacticsThreads
+		options.jsonFile = *tacticsJSON
+		options.junitFile = *tacticsJUnit
 
 		if *epdFile != "" {
 			success, err = RunTacticsFile(*epdFile, *variation, options)
@@ -108,18 +297,45 @@ func main() {
 		} else {
 			err = errors.New("Must specify either an EPD file or a fen argument")
 		}
+	} else if *isTune {
+		var options TuneOptions
+		options.outputFile = *tuneOutput
+		options.iterations = *tuneIterations
+		options.threads = *tuneThreads
+		options.k = *tuneK
+
+		if *tuneData != "" {
+			success, err = RunTuneFile(*tuneData, options)
+		} else {
+			err = errors.New("Must specify a --tunedata file")
+		}
+	} else if *isDumpEvalParams {
+		var str string
+		str, err = EvalParamsToJSON(*evalParams)
+		if err == nil {
+			fmt.Println(str)
+		}
 	} else if *isMagic {
 		GenerateMagicBitboards()
 	} else if *isEval {
 		var options EvalOptions
 		options.epdRegex = *epdRegex
+		options.trace = *evalTrace
+		options.traceFormat = *evalTraceFormat
 
-		if *epdFile != "" {
+		if *startingFen != "" && (*evalDiffFen != "" || *evalDiffParams != "") {
+			success, err = RunEvalDiff(*startingFen, *variation, *evalDiffFen, *evalDiffParams)
+		} else if *epdFile != "" {
 			success, err = RunEvalFile(*epdFile, *variation, options)
 		} else if *startingFen != "" {
 			var eval BoardEval
-			eval, err = RunEvalFen(*startingFen, *variation, options)
-			fmt.Println(BoardEvalToString(eval))
+			var trace EvalTrace
+			eval, trace, err = RunEvalFen(*startingFen, *variation, options)
+			if err == nil {
+				var str string
+				str, err = EvalResultToString(eval, trace, options)
+				fmt.Println(str)
+			}
 		} else {
 			err = errors.New("Must specify either an EPD file or a fen argument")
 		}
@@ -149,6 +365,13 @@ func main() {
 		}
 	}
 
+	if *isSPRT && err != nil {
+		fmt.Println(err)
+		os.Exit(SPRT_EXIT_ERROR)
+	} else if *isSPRT {
+		os.Exit(int(sprtResult))
+	}
+
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
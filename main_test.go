@@ -9,5 +9,6 @@ import (
 func TestMain(m *testing.M) {
 	logger = log.New(os.Stdout, "", log.LstdFlags)
 	InitializeMoveBitboards()
+	InitializeKPKBitbase()
 	os.Exit(m.Run())
 }
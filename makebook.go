@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Building Polyglot books from PGN games.  Every position reached in the first
+// plies of a game records the move played along with the result, and the moves
+// that were played often enough and scored well enough are written out.
+
+type MakeBookOptions struct {
+	outputFile string
+	maxPly     int
+	minGames   int
+	// The minimum score (0-1) for the side playing the move
+	minScore float64
+}
+
+// bookMoveStats are the results of a move, from the point of view of the side
+// that played it.
+type bookMoveStats struct {
+	games  int
+	wins   int
+	draws  int
+	losses int
+}
+
+func (stats *bookMoveStats) Score() float64 {
+	return (float64(stats.wins) + float64(stats.draws)/2) / float64(stats.games)
+}
+
+type BookBuilder struct {
+	options    MakeBookOptions
+	positions  map[uint64]map[uint16]*bookMoveStats
+	boardState BoardState
+
+	games        int
+	skippedGames int
+	badMoves     int
+}
+
+func NewBookBuilder(options MakeBookOptions) *BookBuilder {
+	return &BookBuilder{
+		options:    options,
+		positions:  make(map[uint64]map[uint16]*bookMoveStats),
+		boardState: CreateInitialBoardState(),
+	}
+}
+
+// AddGame records the moves of the game up to the ply limit.  Games without a
+// result or with a starting position that can't be read are skipped.
+func (builder *BookBuilder) AddGame(game *Game) {
+	whiteScore, err := ParseResultString(game.result)
+	if err != nil {
+		builder.skippedGames++
+		return
+	}
+	boardState := &builder.boardState
+	if err := boardState.ResetFromFENString(game.initialFEN); err != nil {
+		builder.skippedGames++
+		return
+	}
+	builder.games++
+
+	for ply, move := range game.moves {
+		if ply >= builder.options.maxPly {
+			break
+		}
+
+		key := PolyglotKey(boardState)
+		moveStats, ok := builder.positions[key]
+		if !ok {
+			moveStats = make(map[uint16]*bookMoveStats)
+			builder.positions[key] = moveStats
+		}
+		stats, ok := moveStats[polyglotMove(move)]
+		if !ok {
+			stats = &bookMoveStats{}
+			moveStats[polyglotMove(move)] = stats
+		}
+
+		score := whiteScore
+		if boardState.sideToMove == BLACK_OFFSET {
+			score = 1 - whiteScore
+		}
+		stats.games++
+		switch score {
+		case 1:
+			stats.wins++
+		case 0:
+			stats.losses++
+		default:
+			stats.draws++
+		}
+
+		boardState.ApplyMove(move)
+	}
+}
+
+// AddPGN adds every game in the PGN stream.  A game with an illegal or
+// unparsable move is used up to that move.
+func (builder *BookBuilder) AddPGN(r io.Reader) error {
+	scanner := NewPGNScanner(r)
+	for scanner.Scan() {
+		game, err := scanner.Game()
+		if game == nil {
+			builder.skippedGames++
+			continue
+		}
+		if err != nil {
+			builder.badMoves++
+		}
+		builder.AddGame(game)
+	}
+	return scanner.Err()
+}
+
+// Entries returns the book entries for the moves passing the filters.  The weight
+// is two points for a win and one for a draw, scaled down for each position if
+// needed to fit.
+func (builder *BookBuilder) Entries() []PolyglotEntry {
+	var entries []PolyglotEntry
+	for key, moveStats := range builder.positions {
+		weights := make(map[uint16]int)
+		maxWeight := 0
+		for move, stats := range moveStats {
+			if stats.games < builder.options.minGames || stats.Score() < builder.options.minScore {
+				continue
+			}
+			weight := 2*stats.wins + stats.draws
+			if weight == 0 {
+				continue
+			}
+			weights[move] = weight
+			if weight > maxWeight {
+				maxWeight = weight
+			}
+		}
+
+		for move, weight := range weights {
+			if maxWeight > 0xFFFF {
+				weight = weight * 0xFFFF / maxWeight
+				if weight == 0 {
+					weight = 1
+				}
+			}
+			entries = append(entries, PolyglotEntry{key: key, move: move, weight: uint16(weight)})
+		}
+	}
+	return entries
+}
+
+func RunMakeBook(pgnFiles []string, options MakeBookOptions) (bool, error) {
+	if len(pgnFiles) == 0 {
+		return false, errors.New("Must specify PGN files for the book (--pgn)")
+	}
+
+	builder := NewBookBuilder(options)
+	for _, filename := range pgnFiles {
+		file, err := os.Open(filename)
+		if err != nil {
+			return false, err
+		}
+		err = builder.AddPGN(file)
+		file.Close()
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	entries := builder.Entries()
+	if err := WriteOpeningBook(options.outputFile, entries); err != nil {
+		return false, err
+	}
+
+	fmt.Printf("%d games (%d skipped, %d stopped at an unparsable move), %d positions\n",
+		builder.games, builder.skippedGames, builder.badMoves, len(builder.positions))
+	fmt.Printf("Wrote %d entries to %s\n", len(entries), options.outputFile)
+
+	return true, nil
+}
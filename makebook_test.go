@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const makeBookTestPGN = `[Result "1-0"]
+
+1. e4 e5 2. Nf3 1-0
+
+[Result "0-1"]
+
+1. e4 c5 2. Nf3 0-1
+
+[Result "1/2-1/2"]
+
+1. e4 e5 2. Nc3 1/2-1/2
+
+[Result "1-0"]
+
+1. d4 d5 1-0
+
+[Result "*"]
+
+1. c4 *
+
+[Result "1-0"]
+
+1. Nf3 Ke7?? 2. Qxe7 1-0
+`
+
+func makeTestBook(t *testing.T, options MakeBookOptions) (*BookBuilder, *OpeningBook) {
+	builder := NewBookBuilder(options)
+	assert.Nil(t, builder.AddPGN(strings.NewReader(makeBookTestPGN)))
+
+	filename := writeTestFile(t, "book.bin", "")
+	assert.Nil(t, WriteOpeningBook(filename, builder.Entries()))
+	book, err := LoadOpeningBook(filename)
+	assert.Nil(t, err)
+	return builder, book
+}
+
+func bookWeights(book *OpeningBook, boardState *BoardState) map[string]uint16 {
+	weights := make(map[string]uint16)
+	for _, bookMove := range book.Moves(boardState) {
+		weights[MoveToXboardString(bookMove.move)] = bookMove.weight
+	}
+	return weights
+}
+
+func TestMakeBook(t *testing.T) {
+	builder, book := makeTestBook(t, MakeBookOptions{maxPly: 2, minGames: 1})
+	assert.Equal(t, 5, builder.games)
+	assert.Equal(t, 1, builder.skippedGames)
+	assert.Equal(t, 1, builder.badMoves)
+
+	// Two points for a win and one for a draw.  e2e4 scored 1.5/3, and the losses
+	// for d2d4 and g1f3 leave no weight
+	boardState := CreateInitialBoardState()
+	assert.Equal(t, map[string]uint16{"e2e4": 3, "d2d4": 2, "g1f3": 2}, bookWeights(book, &boardState))
+
+	move, ok := book.ChooseMove(&boardState, false, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "e2e4", MoveToXboardString(move))
+
+	boardState.ApplyMove(move)
+	assert.Equal(t, map[string]uint16{"c7c5": 2, "e7e5": 1}, bookWeights(book, &boardState))
+
+	// Past the ply limit
+	boardState.ApplyMove(CreateMove(SQUARE_E7, SQUARE_E5))
+	assert.Equal(t, 0, len(book.Moves(&boardState)))
+}
+
+func TestMakeBookSkipsBadStartingPosition(t *testing.T) {
+	builder := NewBookBuilder(MakeBookOptions{maxPly: 2, minGames: 1})
+	builder.AddGame(&Game{initialFEN: "not a position", result: "1-0", moves: []Move{CreateMove(SQUARE_E2, SQUARE_E4)}})
+	assert.Equal(t, 0, builder.games)
+	assert.Equal(t, 1, builder.skippedGames)
+	assert.Equal(t, 0, len(builder.positions))
+}
+
+func TestMakeBookFilters(t *testing.T) {
+	_, book := makeTestBook(t, MakeBookOptions{maxPly: 40, minGames: 2})
+	boardState := CreateInitialBoardState()
+	assert.Equal(t, map[string]uint16{"e2e4": 3}, bookWeights(book, &boardState))
+
+	_, book = makeTestBook(t, MakeBookOptions{maxPly: 40, minGames: 1, minScore: 0.6})
+	assert.Equal(t, map[string]uint16{"d2d4": 2, "g1f3": 2}, bookWeights(book, &boardState))
+
+	boardState.ApplyMove(CreateMove(SQUARE_E2, SQUARE_E4))
+	boardState.ApplyMove(CreateMove(SQUARE_E7, SQUARE_E5))
+	assert.Equal(t, map[string]uint16{"g1f3": 2}, bookWeights(book, &boardState))
+}
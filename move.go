@@ -162,40 +162,79 @@ func MoveToString(move Move, boardState *BoardState) string {
 	return s
 }
 
+// MoveToPrettyString returns the move in SAN: the piece, the from file and/or
+// rank when another piece of the same kind could also reach the square, and a
+// check or mate marker.
 func MoveToPrettyString(move Move, boardState *BoardState) string {
+	var s string
 	if move.Flags()&SPECIAL1_MASK == SPECIAL1_MASK && !move.IsCapture(boardState) {
 		if move.Flags()&SPECIAL2_MASK == SPECIAL2_MASK {
-			return "O-O-O"
+			s = "O-O-O"
+		} else {
+			s = "O-O"
 		}
-		return "O-O"
+		return s + checkSuffix(move, boardState)
 	}
 
 	var p byte = boardState.board[move.From()]
 	if p&0x0F == PAWN_MASK {
 		if move.IsCapture(boardState) {
-			return ColumnToAlgebraicNotation(move.From()%8+1) + "x" + SquareToAlgebraicString(move.To())
+			s = ColumnToAlgebraicNotation(move.From()%8+1) + "x"
 		}
-
-		s := SquareToAlgebraicString(move.To())
+		s += SquareToAlgebraicString(move.To())
 		if move.IsPromotion() {
-			s += "=" + string(pieceToString(move.Flags()|WHITE_MASK))
+			s += "=" + string(pieceToString(move.GetPromotionPiece()|WHITE_MASK))
 		}
-		return s
+		return s + checkSuffix(move, boardState)
 	}
 
-	// TODO: handle ambiguity if there's another piece of that type that
-	// has a valid legal move here
-
-	var s string
 	s += string(pieceToString((p & 0x0F) | WHITE_MASK))
 
+	if p&0x0F != KING_MASK {
+		sameFile, sameRank, ambiguous := false, false, false
+		for _, other := range GenerateLegalMoves(boardState) {
+			if other.To() != move.To() || other.From() == move.From() ||
+				boardState.board[other.From()] != p {
+				continue
+			}
+			ambiguous = true
+			sameFile = sameFile || squareFile(other.From()) == squareFile(move.From())
+			sameRank = sameRank || squareRank(other.From()) == squareRank(move.From())
+		}
+		if ambiguous {
+			if !sameFile {
+				s += ColumnToAlgebraicNotation(move.From()%8 + 1)
+			} else if !sameRank {
+				s += string(rune('1' + squareRank(move.From())))
+			} else {
+				s += SquareToAlgebraicString(move.From())
+			}
+		}
+	}
+
 	if move.IsCapture(boardState) {
 		s += "x"
 	}
 
 	s += SquareToAlgebraicString(move.To())
 
-	return s
+	return s + checkSuffix(move, boardState)
+}
+
+// checkSuffix returns "+" if the move gives check and "#" if it mates.
+func checkSuffix(move Move, boardState *BoardState) string {
+	boardState.ApplyMove(move)
+	defer boardState.UnapplyMove(move)
+
+	// IsInCheck treats a missing king as in check
+	kings := boardState.bitboards.color[boardState.sideToMove] & boardState.bitboards.piece[KING_MASK]
+	if kings == 0 || !boardState.IsInCheck(boardState.sideToMove) {
+		return ""
+	}
+	if boardState.IsCheckmate() {
+		return "#"
+	}
+	return "+"
 }
 
 func MoveArrayToPrettyString(moveArr []Move, boardState *BoardState) (string, error) {
@@ -210,10 +249,6 @@ func MoveArrayToPrettyString(moveArr []Move, boardState *BoardState) (string, er
 		s += MoveToPrettyString(m, boardState) + " "
 		boardState.ApplyMove(m)
 		moves = append(moves, m)
-
-		if boardState.IsCheckmate() {
-			s = strings.Trim(s, " ") + "#"
-		}
 	}
 
 	for i := len(moves) - 1; i >= 0; i-- {
@@ -235,6 +270,9 @@ func ParsePrettyMove(moveStr string, boardState *BoardState) (Move, error) {
 	var promotionPiece byte
 	var piece byte
 
+	// check, mate and annotation suffixes (Nf3+, Qxf7#, e4!?)
+	moveStr = strings.TrimRight(moveStr, "+#!?")
+
 	// capture
 	captureSplits := strings.Split(moveStr, "x")
 	if len(captureSplits) == 2 {
@@ -247,47 +285,80 @@ func ParsePrettyMove(moveStr string, boardState *BoardState) (Move, error) {
 	// promotion
 	promotionSplits := strings.Split(moveStr, "=")
 	if len(promotionSplits) == 2 {
+		if len(promotionSplits[1]) != 1 || !strings.ContainsAny(promotionSplits[1], "NBRQ") {
+			return move, fmt.Errorf("Invalid promotion piece in %s", moveStr)
+		}
 		isPromotion = true
 		moveStr = promotionSplits[0]
 		promotionPiece = CharToPieceMask(promotionSplits[1][0])
 	}
 
-	if moveStr == "O-O" {
+	if !isPromotion && len(moveStr) > 2 && strings.IndexByte("NBRQ", moveStr[len(moveStr)-1]) >= 0 {
+		// Promotion without the '=' (e8Q)
+		isPromotion = true
+		promotionPiece = CharToPieceMask(moveStr[len(moveStr)-1])
+		moveStr = moveStr[:len(moveStr)-1]
+	}
+
+	fromFile, fromRank := -1, -1
+	if moveStr == "O-O" || moveStr == "0-0" {
 		piece = KING_MASK
 		isKingsideCastle = true
-	} else if moveStr == "O-O-O" {
+	} else if moveStr == "O-O-O" || moveStr == "0-0-0" {
 		piece = KING_MASK
 		isQueensideCastle = true
-	} else if len(moveStr) == 2 {
-		piece = PAWN_MASK
-		toSquare, err = ParseAlgebraicSquare(moveStr)
+	} else if len(moveStr) >= 2 {
+		toSquare, err = ParseAlgebraicSquare(moveStr[len(moveStr)-2:])
 		if err != nil {
 			return move, err
 		}
-	} else {
-		piece = CharToPieceMask(moveStr[0])
-		// TODO: handle disambiguating moves (Nbd2 R1f7 etc)
 
-		toSquare, err = ParseAlgebraicSquare(moveStr[1:])
-		if err != nil {
-			return move, err
+		prefix := moveStr[:len(moveStr)-2]
+		piece = PAWN_MASK
+		if len(prefix) > 0 && strings.IndexByte("NBRQK", prefix[0]) >= 0 {
+			piece = CharToPieceMask(prefix[0])
+			prefix = prefix[1:]
+		}
+
+		// Disambiguation by file and/or rank (Nbd2, R1f7, Qh4e1), which is
+		// also how pawn captures name the file the pawn comes from (exd5)
+		if len(prefix) > 2 {
+			return move, fmt.Errorf("Could not parse move %s", moveStr)
+		}
+		for i := 0; i < len(prefix); i++ {
+			if prefix[i] >= 'a' && prefix[i] <= 'h' && fromFile < 0 && i == 0 {
+				fromFile = int(prefix[i] - 'a')
+			} else if prefix[i] >= '1' && prefix[i] <= '8' && fromRank < 0 {
+				fromRank = int(prefix[i] - '1')
+			} else {
+				return move, fmt.Errorf("Could not parse move %s", moveStr)
+			}
 		}
+	} else {
+		return move, fmt.Errorf("Could not parse move %s", moveStr)
 	}
 
-	moves := make([]Move, 256)
-	end := GenerateMoves(boardState, moves[:], 0)
-	for _, candidateMove := range moves[0:end] {
+	found := false
+	for _, candidateMove := range GenerateLegalMoves(boardState) {
 		p := boardState.PieceAtSquare(candidateMove.From()) & 0x0F
 		if (candidateMove.To() == toSquare || isKingsideCastle || isQueensideCastle) &&
 			p == piece &&
+			(fromFile < 0 || squareFile(candidateMove.From()) == fromFile) &&
+			(fromRank < 0 || squareRank(candidateMove.From()) == fromRank) &&
 			isCapture == candidateMove.IsCapture(boardState) &&
 			isPromotion == candidateMove.IsPromotion() &&
 			isKingsideCastle == candidateMove.IsKingsideCastle() &&
 			isQueensideCastle == candidateMove.IsQueensideCastle() &&
 			(!isPromotion || candidateMove.GetPromotionPiece() == promotionPiece) {
-			return candidateMove, nil
+			if found {
+				return Move(0), fmt.Errorf("Move %s is ambiguous", moveStr)
+			}
+			move, found = candidateMove, true
 		}
 	}
+	if found {
+		return move, nil
+	}
 
 	return move, fmt.Errorf("Could not find move %s in list of generated moves", moveStr)
 }
@@ -316,6 +316,26 @@ func generatePrecomputedInfo(boardState *BoardState) *PrecomputedInfo {
 	return &precomputedInfo
 }
 
+// GenerateLegalMoves returns the legal moves of the position, in generation
+// order.  It is slower than GenerateMoves: every move is made to check it.
+func GenerateLegalMoves(boardState *BoardState) []Move {
+	moves := make([]Move, 256)
+	end := GenerateMoves(boardState, moves, 0)
+	legal := moves[:0]
+	sideToMove := boardState.sideToMove
+	for _, move := range moves[:end] {
+		if move.IsCastle() && !boardState.TestCastleLegality(move) {
+			continue
+		}
+		boardState.ApplyMove(move)
+		if !boardState.IsInCheck(sideToMove) {
+			legal = append(legal, move)
+		}
+		boardState.UnapplyMove(move)
+	}
+	return legal
+}
+
 func GenerateMovesFromSquare(
 	boardState *BoardState,
 	sq byte,
@@ -351,6 +371,9 @@ func generatePieceMoves(
 	moveBitboards := boardState.moveBitboards
 
 	var pieceMoves []Move
+	// The precomputed move lists are shared by every board, so the queen's
+	// moves are joined in a buffer of its own rather than appended to them
+	var queenMoves [27]Move
 
 	switch pieceType {
 	case KING_MASK:
@@ -367,8 +390,8 @@ func generatePieceMoves(
 		pieceMoves = moveBitboards.rookAttacks[sq][key].moves
 	case QUEEN_MASK:
 		bishopKey := hashKey(precomputedInfo.allOccupancy, moveBitboards.bishopMagics[sq])
-		pieceMoves = moveBitboards.bishopAttacks[sq][bishopKey].moves
 		rookKey := hashKey(precomputedInfo.allOccupancy, moveBitboards.rookMagics[sq])
+		pieceMoves = append(queenMoves[:0], moveBitboards.bishopAttacks[sq][bishopKey].moves...)
 		pieceMoves = append(pieceMoves, moveBitboards.rookAttacks[sq][rookKey].moves...)
 	}
 
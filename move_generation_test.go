@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"math/bits"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -79,6 +84,25 @@ func TestMoveGenerationFromQueen(t *testing.T) {
 	assert.Equal(t, 21, len(moves))
 }
 
+func TestConcurrentQueenMoveGeneration(t *testing.T) {
+	var wg sync.WaitGroup
+	counts := make([]int, 4)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			testBoard := CreateEmptyBoardState()
+			testBoard.SetPieceAtSquare(SQUARE_D4, WHITE_MASK|QUEEN_MASK)
+			for j := 0; j < 100; j++ {
+				counts[i] = len(generateMovesFromBoard(&testBoard))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []int{27, 27, 27, 27}, counts)
+}
+
 func TestMoveGenerationFromBishop(t *testing.T) {
 	var testBoard BoardState = CreateEmptyBoardState()
 	testBoard.SetPieceAtSquare(SQUARE_D2, WHITE_MASK|BISHOP_MASK)
@@ -226,3 +250,161 @@ func TestGenerateQuiescentMoves(t *testing.T) {
 	assert.Equal(t, CreateMoveWithFlags(SQUARE_A5, SQUARE_A1, CAPTURE_MASK), moves[1])
 	assert.Equal(t, CreateMoveWithFlags(SQUARE_A5, SQUARE_B5, CAPTURE_MASK), moves[2])
 }
+
+// differentialGame plays the same moves on a board and the reference
+// positions of reference_move_generation_test.go, comparing them at every ply.
+type differentialGame struct {
+	boardState BoardState
+	reference  refPosition
+}
+
+func newDifferentialGame(fen string) (*differentialGame, error) {
+	boardState, err := CreateBoardStateFromFENString(fen)
+	if err != nil {
+		return nil, err
+	}
+	return &differentialGame{boardState: boardState, reference: refParseFEN(fen)}, nil
+}
+
+// check compares the legal moves, FEN and hash keys, returning the discrepancy
+// if there is one.
+func (game *differentialGame) check() string {
+	boardState := &game.boardState
+	var moves []string
+	for _, move := range GenerateLegalMoves(boardState) {
+		moves = append(moves, MoveToXboardString(move))
+	}
+	sort.Strings(moves)
+	if referenceMoves := game.reference.refLegalMoves(); strings.Join(moves, " ") != strings.Join(referenceMoves, " ") {
+		return fmt.Sprintf("legal moves %v, reference %v", moves, referenceMoves)
+	}
+	if fen, referenceFEN := boardState.ToFENString(), game.reference.fen(); fen != referenceFEN {
+		return fmt.Sprintf("FEN %s, reference %s", fen, referenceFEN)
+	}
+	if key := boardState.CreateHashKey(boardState.hashInfo); boardState.hashKey != key {
+		return fmt.Sprintf("hash key %d, from scratch %d", boardState.hashKey, key)
+	}
+	if key := boardState.CreatePawnHashKey(boardState.hashInfo); boardState.pawnHashKey != key {
+		return fmt.Sprintf("pawn hash key %d, from scratch %d", boardState.pawnHashKey, key)
+	}
+	return ""
+}
+
+// play makes the move, which must be legal, checking that unapplying it gives
+// back the position before it.
+func (game *differentialGame) play(s string) string {
+	boardState := &game.boardState
+	move, err := ParseXboardMove(s, boardState)
+	if err != nil {
+		return err.Error()
+	}
+	before := *boardState
+	board := append([]byte{}, boardState.board...)
+	fen := boardState.ToFENString()
+
+	boardState.ApplyMove(move)
+	boardState.UnapplyMove(move)
+	if boardState.ToFENString() != fen || !bytes.Equal(boardState.board, board) || boardState.bitboards != before.bitboards ||
+		boardState.boardInfo != before.boardInfo || boardState.hashKey != before.hashKey ||
+		boardState.pawnHashKey != before.pawnHashKey || boardState.moveIndex != before.moveIndex {
+		return fmt.Sprintf("unapplying %s gave %s", s, boardState.ToFENString())
+	}
+
+	boardState.ApplyMove(move)
+	referenceMove, _ := game.reference.refParseMove(s)
+	game.reference = game.reference.refMake(referenceMove)
+	return ""
+}
+
+// replayDifferentialGame plays the moves from the position, returning the
+// first discrepancy and the number of moves played before it.  A move the
+// reference finds illegal ends the game without one.
+func replayDifferentialGame(fen string, moves []string) (string, int) {
+	game, err := newDifferentialGame(fen)
+	if err != nil {
+		return err.Error(), 0
+	}
+	if discrepancy := game.check(); discrepancy != "" {
+		return discrepancy, 0
+	}
+	for i, move := range moves {
+		legal := false
+		for _, referenceMove := range game.reference.refLegalMoves() {
+			legal = legal || referenceMove == move
+		}
+		if !legal {
+			return "", i
+		}
+		discrepancy := game.play(move)
+		if discrepancy == "" {
+			discrepancy = game.check()
+		}
+		if discrepancy != "" {
+			return discrepancy, i + 1
+		}
+	}
+	return "", len(moves)
+}
+
+// shrinkDifferentialGame drops runs of moves, longest first, from a failing
+// game for as long as it still fails, to give a short sequence that reproduces
+// the discrepancy.
+func shrinkDifferentialGame(fen string, moves []string) []string {
+	for shrunk := true; shrunk; {
+		shrunk = false
+		for n := len(moves) / 2; n >= 1; n /= 2 {
+			for i := 0; i+n <= len(moves); {
+				candidate := append(append([]string{}, moves[:i]...), moves[i+n:]...)
+				if discrepancy, plies := replayDifferentialGame(fen, candidate); discrepancy != "" {
+					moves, shrunk = candidate[:plies], true
+				} else {
+					i++
+				}
+			}
+		}
+	}
+	return moves
+}
+
+// Random games, the same ones every run, checked move by move against the
+// reference move generator.
+func TestDifferentialMoveGeneration(t *testing.T) {
+	positions := []string{
+		STARTING_FEN,
+		"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+		"r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1",
+		"rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+		"r4rk1/1pp1qppp/p1np1n2/2b1p1B1/2B1P1b1/P1NP1N2/1PP1QPPP/R4RK1 w - - 0 10",
+	}
+	games := 20
+	if testing.Short() {
+		games = 5
+	}
+
+	r := rand.New(rand.NewSource(47))
+	for _, fen := range positions {
+		for i := 0; i < games; i++ {
+			game, err := newDifferentialGame(fen)
+			assert.Nil(t, err)
+			discrepancy := game.check()
+			var moves []string
+			for ply := 0; ply < 200 && discrepancy == ""; ply++ {
+				legalMoves := game.reference.refLegalMoves()
+				if len(legalMoves) == 0 {
+					break
+				}
+				moves = append(moves, legalMoves[r.Intn(len(legalMoves))])
+				discrepancy = game.play(moves[len(moves)-1])
+				if discrepancy == "" {
+					discrepancy = game.check()
+				}
+			}
+			if discrepancy != "" {
+				moves = shrinkDifferentialGame(fen, moves)
+				discrepancy, _ = replayDifferentialGame(fen, moves)
+				t.Fatalf("%s after %s %s", discrepancy, fen, strings.Join(moves, " "))
+			}
+		}
+	}
+}
@@ -31,8 +31,6 @@ func (s MoveSort) Swap(i, j int) {
 	s.moveScores[i], s.moveScores[j] = s.moveScores[j], s.moveScores[i]
 }
 
-var moveSort MoveSort
-
 func SortMoves(
 	boardState *BoardState,
 	moveInfo *SearchMoveInfo,
@@ -67,15 +65,10 @@ func SortMoves(
 		moveScores[i] = score
 	}
 
-	moveSort.moves = moves[start:end]
-	moveSort.moveScores = moveScores[start:end]
-	sort.Sort(&moveSort)
+	sort.Sort(MoveSort{moves: moves[start:end], moveScores: moveScores[start:end]})
 }
 
 func SortQuiescentMoves(boardState *BoardState, moves []Move, moveScores []int16, start int, end int) {
-	moveSort.moves = moves[start:end]
-	moveSort.moveScores = moveScores[start:end]
-
 	for i := start; i < end; i++ {
 		capture := moves[i]
 		fromPiece := boardState.PieceAtSquare(capture.From())
@@ -83,7 +76,7 @@ func SortQuiescentMoves(boardState *BoardState, moves []Move, moveScores []int16
 		priority := mvvPriority[fromPiece&0x0F][toPiece&0x0F]
 		moveScores[i] = priority
 	}
-	sort.Sort(&moveSort)
+	sort.Sort(MoveSort{moves: moves[start:end], moveScores: moveScores[start:end]})
 }
 
 func SortMovesFirstPly(
@@ -93,7 +86,5 @@ func SortMovesFirstPly(
 	start int,
 	end int,
 ) {
-	moveSort.moves = moves[start:end]
-	moveSort.moveScores = moveInfo.firstPlyScores[start:end]
-	sort.Sort(&moveSort)
+	sort.Sort(MoveSort{moves: moves[start:end], moveScores: moveInfo.firstPlyScores[start:end]})
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"testing"
 	"unsafe"
 
@@ -92,3 +94,111 @@ func TestParsePrettyMoveCastle(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, move.IsQueensideCastle())
 }
+
+func TestParsePrettyMoveSuffixesAndCaptures(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("rnbqkbnr/ppp1pppp/8/3p4/2P1P3/8/PP1P1PPP/RNBQKBNR w KQkq d6 0 2")
+
+	// Both pawns can take on d5; the file says which
+	move, err := ParsePrettyMove("exd5", &boardState)
+	assert.Nil(t, err)
+	assert.Equal(t, SQUARE_E4, move.From())
+	move, err = ParsePrettyMove("cxd5!?", &boardState)
+	assert.Nil(t, err)
+	assert.Equal(t, SQUARE_C4, move.From())
+
+	move, err = ParsePrettyMove("Qh5+", &boardState)
+	assert.Nil(t, err)
+	assert.Equal(t, CreateMove(SQUARE_D1, SQUARE_H5), move)
+
+	_, err = ParsePrettyMove("", &boardState)
+	assert.NotNil(t, err)
+
+	boardState, _ = CreateBoardStateFromFENString("8/1P6/8/8/8/8/k7/4K3 w - - 0 1")
+	move, err = ParsePrettyMove("b8=N#", &boardState)
+	assert.Nil(t, err)
+	assert.Equal(t, CreatePromotion(SQUARE_B7, SQUARE_B8, KNIGHT_MASK), move)
+	_, err = ParsePrettyMove("b8=K", &boardState)
+	assert.NotNil(t, err)
+}
+
+func TestMoveToPrettyStringSAN(t *testing.T) {
+	for fen, moves := range map[string]map[string]string{
+		// Disambiguation by file, rank and square
+		"4k3/8/8/R7/8/8/8/RN1K1N2 w - - 0 1": {"b1d2": "Nbd2", "f1d2": "Nfd2", "a1a3": "R1a3", "a5a3": "R5a3", "f1e3": "Ne3"},
+		"4k3/8/8/8/8/Q7/8/Q1Q1K3 w - - 0 1":  {"a1b2": "Qa1b2", "a3b3": "Qb3", "c1c3": "Qcc3"},
+		// Promotions, checks and mates
+		"r3k3/1P6/8/8/8/8/8/4K3 w - - 0 1":    {"b7a8q": "bxa8=Q+", "b7b8n": "b8=N", "b7b8r": "b8=R+"},
+		"6k1/5ppp/8/8/8/8/8/R3K2R w KQ - 0 1": {"a1a8": "Ra8#", "e1g1": "O-O", "e1c1": "O-O-O"},
+		"5k2/8/8/8/8/8/8/4K2R w K - 0 1":      {"e1g1": "O-O+", "h1h8": "Rh8+"},
+		"8/8/8/2k5/2pP4/8/B7/4K3 b - d3 0 3":  {"c4d3": "cxd3", "c5d4": "Kxd4"},
+	} {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err)
+		for xboardMove, san := range moves {
+			move, err := ParseXboardMove(xboardMove, &boardState)
+			assert.Nil(t, err)
+			assert.Equal(t, san, MoveToPrettyString(move, &boardState), fen)
+		}
+	}
+}
+
+// Every legal move (and reply) in the perft positions is written as a unique
+// SAN string which parses back to the same move.
+func TestPrettyMoveRoundTrip(t *testing.T) {
+	var specs []PerftSpecification
+	for _, filename := range []string{"perft-test-positions.json", "perft-starting-position.json"} {
+		data, err := os.ReadFile(filename)
+		assert.Nil(t, err)
+		var fileSpecs []PerftSpecification
+		assert.Nil(t, json.Unmarshal(data, &fileSpecs))
+		specs = append(specs, fileSpecs...)
+	}
+
+	var checkMoves func(boardState *BoardState, depth int)
+	checkMoves = func(boardState *BoardState, depth int) {
+		seen := make(map[string]bool)
+		for _, move := range GenerateLegalMoves(boardState) {
+			san := MoveToPrettyString(move, boardState)
+			assert.False(t, seen[san], san)
+			seen[san] = true
+
+			parsed, err := ParsePrettyMove(san, boardState)
+			assert.Nil(t, err, san)
+			assert.Equal(t, move, parsed, san)
+
+			if depth > 1 {
+				boardState.ApplyMove(move)
+				checkMoves(boardState, depth-1)
+				boardState.UnapplyMove(move)
+			}
+		}
+	}
+
+	boardState := CreateInitialBoardState()
+	for _, spec := range specs {
+		assert.Nil(t, boardState.ResetFromFENString(spec.Fen))
+		checkMoves(&boardState, 2)
+	}
+}
+
+func FuzzParsePrettyMove(f *testing.F) {
+	f.Add(STARTING_FEN, "Nf3")
+	f.Add(STARTING_FEN, "exd5")
+	f.Add("r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq -", "O-O-O")
+	f.Add("r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 b kq - 0 1", "bxa1=Q+")
+	f.Add(STARTING_FEN, "Qh4e1=")
+
+	boardState := CreateInitialBoardState()
+	f.Fuzz(func(t *testing.T, fen string, san string) {
+		if err := boardState.ResetFromFENString(fen); err != nil {
+			return
+		}
+		move, err := ParsePrettyMove(san, &boardState)
+		if err != nil {
+			return
+		}
+		if !containsTacticsMove(GenerateLegalMoves(&boardState), move) {
+			t.Fatalf("%s parsed as illegal move %s in %s", san, MoveToXboardString(move), fen)
+		}
+	})
+}
@@ -4,23 +4,74 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/bits"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unsafe"
 )
 
 type PerftSpecification struct {
-	Depth uint   `json:depth`
-	Nodes uint   `json:nodes`
-	Fen   string `json:fen`
+	Depth uint   `json:"depth"`
+	Nodes uint   `json:"nodes"`
+	Fen   string `json:"fen"`
+	// Expected counts of the other columns, only compared if they're given
+	Captures        *uint `json:"captures,omitempty"`
+	EnPassants      *uint `json:"enpassants,omitempty"`
+	Castles         *uint `json:"castles,omitempty"`
+	Promotions      *uint `json:"promotions,omitempty"`
+	Checks          *uint `json:"checks,omitempty"`
+	DiscoveryChecks *uint `json:"discoverychecks,omitempty"`
+	DoubleChecks    *uint `json:"doublechecks,omitempty"`
+	Checkmates      *uint `json:"checkmates,omitempty"`
+}
+
+// columns pairs the expected counts of the specification with the perft result.
+func (spec PerftSpecification) columns(info PerftInfo) []perftColumn {
+	return []perftColumn{
+		{"nodes", &spec.Nodes, info.nodes},
+		{"captures", spec.Captures, info.captures},
+		{"enpassants", spec.EnPassants, info.enPassants},
+		{"castles", spec.Castles, info.castles},
+		{"promotions", spec.Promotions, info.promotions},
+		{"checks", spec.Checks, info.checks},
+		{"discoverychecks", spec.DiscoveryChecks, info.discoveryChecks},
+		{"doublechecks", spec.DoubleChecks, info.doubleChecks},
+		{"checkmates", spec.Checkmates, info.checkmates},
+	}
+}
+
+// needsChecks returns whether any of the check columns are expected.
+func (spec PerftSpecification) needsChecks() bool {
+	return spec.Checks != nil || spec.DiscoveryChecks != nil || spec.DoubleChecks != nil || spec.Checkmates != nil
+}
+
+type perftColumn struct {
+	name     string
+	expected *uint
+	actual   uint
 }
 
 var _ = fmt.Println
 
+// PerftInfo has the columns of the perft results on the chessprogramming wiki.
+// Apart from the nodes, they count the moves of the last ply.  The checks,
+// discovered checks, double checks and checkmates are only counted with
+// options.checks.
 type PerftInfo struct {
-	nodes      uint
-	captures   uint
-	castles    uint
-	promotions uint
-	checks     uint
+	nodes           uint
+	captures        uint
+	enPassants      uint
+	castles         uint
+	promotions      uint
+	checks          uint
+	discoveryChecks uint
+	doubleChecks    uint
+	checkmates      uint
 }
 
 type PerftOptions struct {
@@ -29,6 +80,58 @@ type PerftOptions struct {
 	perftPrintMoves bool
 	depth           uint
 	divide          bool
+	epdRegex        string
+	// Number of goroutines the root moves are split between
+	threads uint
+	// Counts of subtrees already visited, shared between the goroutines (nil to
+	// count every subtree)
+	hash *PerftHash
+}
+
+type perftHashEntry struct {
+	key   uint64
+	depth uint
+	info  PerftInfo
+}
+
+// PerftHash stores the counts of subtrees by the Zobrist key of their position
+// and their depth, so transposed subtrees are only counted once.  Entries are
+// always replaced.
+type PerftHash struct {
+	entries []perftHashEntry
+	locks   [256]sync.Mutex
+}
+
+func NewPerftHash(sizeMB uint) *PerftHash {
+	size := sizeMB * 1024 * 1024 / uint(unsafe.Sizeof(perftHashEntry{}))
+	if size == 0 {
+		size = 1
+	}
+	return &PerftHash{entries: make([]perftHashEntry, size)}
+}
+
+func (hash *PerftHash) index(key uint64, depth uint) uint64 {
+	return (key ^ uint64(depth)*0x9E3779B97F4A7C15) % uint64(len(hash.entries))
+}
+
+func (hash *PerftHash) probe(key uint64, depth uint) (PerftInfo, bool) {
+	index := hash.index(key, depth)
+	lock := &hash.locks[index%uint64(len(hash.locks))]
+	lock.Lock()
+	entry := hash.entries[index]
+	lock.Unlock()
+	if entry.key == key && entry.depth == depth {
+		return entry.info, true
+	}
+	return PerftInfo{}, false
+}
+
+func (hash *PerftHash) store(key uint64, depth uint, info PerftInfo) {
+	index := hash.index(key, depth)
+	lock := &hash.locks[index%uint64(len(hash.locks))]
+	lock.Lock()
+	hash.entries[index] = perftHashEntry{key: key, depth: depth, info: info}
+	lock.Unlock()
 }
 
 func RunPerftJson(perftJsonFile string, options PerftOptions) (bool, error) {
@@ -42,24 +145,8 @@ func RunPerftJson(perftJsonFile string, options PerftOptions) (bool, error) {
 
 	allSuccess := true
 	for _, spec := range specs {
-		board, err := CreateBoardStateFromFENString(spec.Fen)
-		if err != nil {
-			fmt.Println("Unable to parse FEN " + spec.Fen + ", continuing")
-			fmt.Println(err)
-			continue
-		}
-		options.depth = spec.Depth
-
-		start := time.Now()
-		moves := make([]Move, 13824)
-		var moveStart [64]int
-		perftResult := Perft(&board, spec.Depth, options, moves[:], moveStart[:])
-		elapsed := time.Since(start)
-		if perftResult.nodes != spec.Nodes {
-			fmt.Printf("NOT OK: %s (depth=%d, expected nodes=%d, actual nodes=%d; duration=%s)\n", spec.Fen, spec.Depth, spec.Nodes, perftResult.nodes, elapsed)
+		if !runPerftSpecification(spec, options) {
 			allSuccess = false
-		} else {
-			fmt.Printf("OK: %s (depth=%d, nodes=%d; duration=%s)\n", spec.Fen, spec.Depth, spec.Nodes, elapsed)
 		}
 	}
 
@@ -70,6 +157,61 @@ func RunPerftJson(perftJsonFile string, options PerftOptions) (bool, error) {
 	return false, nil
 }
 
+// RunPerftEpd checks the D1..Dn node counts of every position in an EPD perft
+// suite, up to the given depth.
+func RunPerftEpd(epdFile string, maxDepth uint, options PerftOptions) (bool, error) {
+	lines, err := ParseAndFilterEpdFile(epdFile, options.epdRegex)
+	if err != nil {
+		return false, err
+	}
+
+	allSuccess := true
+	for _, line := range lines {
+		counts := line.PerftCounts()
+		for depth := uint(1); depth <= maxDepth; depth++ {
+			nodes, ok := counts[depth]
+			if !ok {
+				continue
+			}
+			if !runPerftSpecification(PerftSpecification{Depth: depth, Nodes: uint(nodes), Fen: line.fen}, options) {
+				allSuccess = false
+			}
+		}
+	}
+
+	return allSuccess, nil
+}
+
+// runPerftSpecification runs perft on the position and prints whether the
+// expected counts matched.
+func runPerftSpecification(spec PerftSpecification, options PerftOptions) bool {
+	board, err := CreateBoardStateFromFENString(spec.Fen)
+	if err != nil {
+		fmt.Println("Unable to parse FEN " + spec.Fen + ", continuing")
+		fmt.Println(err)
+		return true
+	}
+	options.depth = spec.Depth
+	options.checks = options.checks || spec.needsChecks()
+
+	start := time.Now()
+	perftResult := PerftPosition(&board, spec.Depth, options)
+	elapsed := time.Since(start)
+
+	var mismatches []string
+	for _, column := range spec.columns(perftResult) {
+		if column.expected != nil && *column.expected != column.actual {
+			mismatches = append(mismatches, fmt.Sprintf("expected %s=%d, actual %s=%d", column.name, *column.expected, column.name, column.actual))
+		}
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("NOT OK: %s (depth=%d, %s; duration=%s)\n", spec.Fen, spec.Depth, strings.Join(mismatches, ", "), elapsed)
+		return false
+	}
+	fmt.Printf("OK: %s (depth=%d, nodes=%d; duration=%s)\n", spec.Fen, spec.Depth, spec.Nodes, elapsed)
+	return true
+}
+
 func RunPerft(fen string, variation string, depth uint, options PerftOptions) (bool, error) {
 	for i := uint(0); i <= depth; i++ {
 		boardState, err := CreateBoardStateFromFENStringWithVariation(fen, variation)
@@ -84,9 +226,7 @@ func RunPerft(fen string, variation string, depth uint, options PerftOptions) (b
 		if err == nil {
 			options.depth = i
 			start := time.Now()
-			moves := make([]Move, 13824)
-			var moveStart [64]int
-			result := Perft(&boardState, i, options, moves[:], moveStart[:])
+			result := PerftPosition(&boardState, i, options)
 			fmt.Printf("%d\t%10d\t%s\n", i, result.nodes, time.Since(start))
 		} else {
 			fmt.Println(err)
@@ -96,11 +236,219 @@ func RunPerft(fen string, variation string, depth uint, options PerftOptions) (b
 	return true, nil
 }
 
+// PerftDivideReference has the divide counts of a reference perft, keyed by the
+// coordinate moves from the root separated by spaces.
+type PerftDivideReference map[string]uint
+
+// Lines like "e2e4: 20", as printed by Stockfish's go perft, or "e2e4 e7e5 30"
+// for the counts below a deeper position
+var perftDivideLineRegexp = regexp.MustCompile(`^((?:[a-h][1-8][a-h][1-8][qrbn]?\s+)*[a-h][1-8][a-h][1-8][qrbn]?):?\s+(\d+)$`)
+
+// LoadPerftDivideReference reads the divide lines of a reference file, skipping
+// any other lines.
+func LoadPerftDivideReference(filename string) (PerftDivideReference, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	reference := make(PerftDivideReference)
+	for _, line := range strings.Split(string(b), "\n") {
+		arr := perftDivideLineRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if arr == nil {
+			continue
+		}
+		nodes, err := strconv.ParseUint(arr[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		reference[strings.Join(strings.Fields(arr[1]), " ")] = uint(nodes)
+	}
+	return reference, nil
+}
+
+// PerftDivideDifference is where our divide first differs from the reference.
+// A move we don't generate has no nodes, as does a move missing from the
+// reference.
+type PerftDivideDifference struct {
+	fen       string
+	path      []string
+	nodes     uint
+	reference uint
+}
+
+func (difference PerftDivideDifference) String() string {
+	counts := fmt.Sprintf("nodes=%d, reference=%d", difference.nodes, difference.reference)
+	if difference.nodes == 0 {
+		counts = "move not generated"
+	} else if difference.reference == 0 {
+		counts = "move not in reference"
+	}
+	return fmt.Sprintf("%s (%s) in %s", strings.Join(difference.path, " "), counts, difference.fen)
+}
+
+// children returns the reference counts of the moves after the path, keyed by
+// the move.
+func (reference PerftDivideReference) children(path []string) map[string]uint {
+	prefix := strings.Join(append(path, ""), " ")
+	children := make(map[string]uint)
+	for key, nodes := range reference {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], " ") {
+			children[key[len(prefix):]] = nodes
+		}
+	}
+	return children
+}
+
+// PerftDivideDiff compares our divide against the reference, starting at the
+// root.  A missing or extra move is reported straight away, otherwise it
+// follows the first move whose count differs for as long as the reference has
+// counts below it.  It returns false if every count matched.
+func PerftDivideDiff(boardState *BoardState, depth uint, reference PerftDivideReference, options PerftOptions) (PerftDivideDifference, bool) {
+	state := CopyBoardState(boardState)
+	options.divide = false
+	var difference PerftDivideDifference
+	found := false
+
+	for path := []string{}; depth > 0; depth-- {
+		referenceNodes := reference.children(path)
+		if len(referenceNodes) == 0 {
+			break
+		}
+
+		nodes := make(map[string]uint)
+		moves := make(map[string]Move)
+		for _, move := range GenerateLegalMoves(&state) {
+			key := MoveToXboardString(move)
+			state.ApplyMove(move)
+			nodes[key] = PerftPosition(&state, depth-1, options).nodes
+			state.UnapplyMove(move)
+			moves[key] = move
+		}
+
+		var keys []string
+		for key := range nodes {
+			keys = append(keys, key)
+		}
+		for key := range referenceNodes {
+			if _, ok := nodes[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		next := ""
+		for _, key := range keys {
+			if nodes[key] == referenceNodes[key] {
+				continue
+			}
+			if next == "" || nodes[key] == 0 || referenceNodes[key] == 0 {
+				next = key
+			}
+			if nodes[key] == 0 || referenceNodes[key] == 0 {
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+
+		path = append(path, next)
+		found = true
+		difference = PerftDivideDifference{fen: state.ToFENString(), path: path, nodes: nodes[next], reference: referenceNodes[next]}
+		if nodes[next] == 0 || referenceNodes[next] == 0 {
+			break
+		}
+		state.ApplyMove(moves[next])
+	}
+	return difference, found
+}
+
+// RunPerftDivideDiff prints where our divide of the position first differs
+// from the reference file.
+func RunPerftDivideDiff(fen string, variation string, depth uint, referenceFile string, options PerftOptions) (bool, error) {
+	reference, err := LoadPerftDivideReference(referenceFile)
+	if err != nil {
+		return false, err
+	}
+	boardState, err := CreateBoardStateFromFENStringWithVariation(fen, variation)
+	if err != nil {
+		return false, err
+	}
+
+	difference, found := PerftDivideDiff(&boardState, depth, reference, options)
+	if !found {
+		fmt.Printf("OK: divide matches %s (depth=%d)\n", referenceFile, depth)
+		return true, nil
+	}
+	fmt.Printf("NOT OK: first difference at %s\n", difference)
+	return false, nil
+}
+
+// PerftPosition counts the moves to the depth, splitting the root moves between
+// options.threads goroutines if there's more than one.
+func PerftPosition(boardState *BoardState, depth uint, options PerftOptions) PerftInfo {
+	options.depth = depth
+	if options.threads <= 1 || depth == 0 || options.perftPrintMoves {
+		moves := make([]Move, 13824)
+		var moveStart [64]int
+		return Perft(boardState, depth, options, moves[:], moveStart[:])
+	}
+
+	var perftInfo PerftInfo
+	rootMoves := GenerateLegalMoves(boardState)
+	infos := make([]PerftInfo, len(rootMoves))
+	childOptions := options
+	childOptions.depth = depth - 1
+	childOptions.divide = false
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for t := uint(0); t < options.threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state := CopyBoardState(boardState)
+			moves := make([]Move, 13824)
+			var moveStart [64]int
+			for i := range jobs {
+				move := rootMoves[i]
+				state.ApplyMove(move)
+				infos[i] = perftAfterMove(&state, move, depth, childOptions, moves[:], moveStart[:])
+				state.UnapplyMove(move)
+			}
+		}()
+	}
+	for i := range rootMoves {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, move := range rootMoves {
+		if options.divide {
+			fmt.Printf("%s %d\n", MoveToString(move, boardState), infos[i].nodes)
+		}
+		addPerftInfo(&perftInfo, infos[i])
+	}
+	return perftInfo
+}
+
 func Perft(boardState *BoardState, depth uint, options PerftOptions, moves []Move, moveStart []int) PerftInfo {
 	var perftInfo PerftInfo
 
-	if options.checks && boardState.IsInCheck(boardState.sideToMove) {
-		perftInfo.checks += 1
+	// The divided root moves, the moves printed at depth 1 and the sanity
+	// checks all need the whole tree
+	useHash := options.hash != nil && depth > 1 && !options.sanityCheck && !options.perftPrintMoves &&
+		!(options.divide && depth == options.depth)
+	// Counts without the check columns are kept apart from those with them
+	hashKey := boardState.hashKey
+	if options.checks {
+		hashKey = ^hashKey
+	}
+	if useHash {
+		if info, ok := options.hash.probe(hashKey, depth); ok {
+			return info
+		}
 	}
 
 	if depth == 0 {
@@ -112,9 +460,6 @@ func Perft(boardState *BoardState, depth uint, options PerftOptions, moves []Mov
 	start := moveStart[currentDepth]
 	end := GenerateMoves(boardState, moves, start)
 	moveStart[currentDepth+1] = end
-	captures := uint(0)
-	castles := uint(0)
-	promotions := uint(0)
 
 	for i := start; i < end; i++ {
 		move := moves[i]
@@ -147,17 +492,7 @@ func Perft(boardState *BoardState, depth uint, options PerftOptions, moves []Mov
 		}
 
 		wasValid = true
-		if boardState.wasCapture[boardState.moveIndex-1] {
-			captures++
-		}
-		if move.IsCastle() {
-			castles++
-		}
-		if move.IsPromotion() {
-			promotions++
-		}
-
-		info := Perft(boardState, depth-1, options, moves, moveStart)
+		info := perftAfterMove(boardState, move, depth, options, moves, moveStart)
 		boardState.UnapplyMove(move)
 
 		if options.divide && depth == options.depth {
@@ -188,19 +523,85 @@ func Perft(boardState *BoardState, depth uint, options PerftOptions, moves []Mov
 		}
 	}
 
-	perftInfo.captures += captures
-	perftInfo.castles += castles
-	perftInfo.promotions += promotions
-
+	if useHash {
+		options.hash.store(hashKey, depth, perftInfo)
+	}
 	return perftInfo
 }
 
+// perftAfterMove counts the subtree after a legal move from a position at the
+// given depth, classifying the move if it's at the last ply.
+func perftAfterMove(boardState *BoardState, move Move, depth uint, options PerftOptions, moves []Move, moveStart []int) PerftInfo {
+	if depth > 1 {
+		return Perft(boardState, depth-1, options, moves, moveStart)
+	}
+
+	info := PerftInfo{nodes: 1}
+	if boardState.history.top().wasCapture || move.IsEnPassantCapture() {
+		info.captures++
+	}
+	if move.IsEnPassantCapture() {
+		info.enPassants++
+	}
+	if move.IsCastle() {
+		info.castles++
+	}
+	if move.IsPromotion() {
+		info.promotions++
+	}
+	if !options.checks {
+		return info
+	}
+
+	checkers := perftCheckers(boardState)
+	if checkers == 0 {
+		return info
+	}
+	info.checks++
+
+	// A check by any piece but the one that moved (the rook when castling) was
+	// discovered
+	moved := SetBitboard(0, move.To())
+	if move.IsKingsideCastle() {
+		moved = SetBitboard(0, move.To()-1)
+	} else if move.IsQueensideCastle() {
+		moved = SetBitboard(0, move.To()+1)
+	}
+	if bits.OnesCount64(checkers) > 1 {
+		info.doubleChecks++
+	} else if checkers&^moved != 0 {
+		info.discoveryChecks++
+	}
+	if len(GenerateLegalMoves(boardState)) == 0 {
+		info.checkmates++
+	}
+	return info
+}
+
+// perftCheckers returns the pieces giving check to the side to move.
+func perftCheckers(boardState *BoardState) uint64 {
+	us := boardState.sideToMove
+	them := oppositeColorOffset(us)
+	kingSq := byte(bits.TrailingZeros64(boardState.bitboards.color[us] & boardState.bitboards.piece[KING_MASK]))
+	allOccupancies := boardState.bitboards.color[WHITE_OFFSET] | boardState.bitboards.color[BLACK_OFFSET]
+	pawns := boardState.bitboards.piece[PAWN_MASK]
+
+	// Only pawns of the other side on the squares our pawn would attack give check
+	attackers := boardState.GetSquareAttackersBoard(allOccupancies, kingSq) &^ pawns
+	attackers |= boardState.moveBitboards.pawnAttacks[us][kingSq] & pawns
+	return attackers & boardState.bitboards.color[them]
+}
+
 func addPerftInfo(info1 *PerftInfo, info2 PerftInfo) {
 	info1.nodes += info2.nodes
 	info1.captures += info2.captures
+	info1.enPassants += info2.enPassants
 	info1.castles += info2.castles
 	info1.promotions += info2.promotions
 	info1.checks += info2.checks
+	info1.discoveryChecks += info2.discoveryChecks
+	info1.doubleChecks += info2.doubleChecks
+	info1.checkmates += info2.checkmates
 }
 
 func testMoveLegality(boardState *BoardState, move Move) {
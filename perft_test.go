@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func perftTestPosition(t *testing.T, fen string, depth uint, options PerftOptions) PerftInfo {
+	boardState, err := CreateBoardStateFromFENString(fen)
+	assert.Nil(t, err)
+	info := PerftPosition(&boardState, depth, options)
+	assert.Equal(t, fen, boardState.ToFENString())
+	return info
+}
+
+func TestPerftHashAndThreadsMatch(t *testing.T) {
+	positions := []struct {
+		fen   string
+		depth uint
+		nodes uint
+	}{
+		{"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", 3, 97862},
+		{"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", 4, 43238},
+		{"r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", 3, 9467},
+	}
+	hash := NewPerftHash(1)
+	for _, position := range positions {
+		expected := perftTestPosition(t, position.fen, position.depth, PerftOptions{checks: true})
+		assert.Equal(t, position.nodes, expected.nodes, position.fen)
+
+		for _, options := range []PerftOptions{
+			{checks: true, hash: hash},
+			{checks: true, threads: 3},
+			{checks: true, threads: 3, hash: hash},
+		} {
+			assert.Equal(t, expected, perftTestPosition(t, position.fen, position.depth, options), position.fen)
+		}
+	}
+}
+
+func TestPerftHash(t *testing.T) {
+	hash := NewPerftHash(1)
+	_, ok := hash.probe(12345, 3)
+	assert.False(t, ok)
+
+	hash.store(12345, 3, PerftInfo{nodes: 97862, captures: 1})
+	info, ok := hash.probe(12345, 3)
+	assert.True(t, ok)
+	assert.Equal(t, PerftInfo{nodes: 97862, captures: 1}, info)
+
+	// The same position at another depth is a different subtree
+	_, ok = hash.probe(12345, 2)
+	assert.False(t, ok)
+}
+
+func TestPerftColumns(t *testing.T) {
+	info := perftTestPosition(t, "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", 3, PerftOptions{checks: true})
+	assert.Equal(t, PerftInfo{nodes: 97862, captures: 17102, enPassants: 45, castles: 3162, checks: 993, checkmates: 1}, info)
+
+	info = perftTestPosition(t, "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", 4, PerftOptions{checks: true})
+	assert.Equal(t, PerftInfo{nodes: 43238, captures: 3348, enPassants: 123, checks: 1680, discoveryChecks: 106, checkmates: 17}, info)
+
+	info = perftTestPosition(t, "r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", 2, PerftOptions{checks: true})
+	assert.Equal(t, PerftInfo{nodes: 264, captures: 87, castles: 6, promotions: 48, checks: 10}, info)
+
+	// Without options.checks the check columns are left at zero
+	info = perftTestPosition(t, "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", 4, PerftOptions{})
+	assert.Equal(t, PerftInfo{nodes: 43238, captures: 3348, enPassants: 123}, info)
+}
+
+func TestRunPerftSpecificationColumns(t *testing.T) {
+	captures, checks := uint(1), uint(2)
+	spec := PerftSpecification{Depth: 1, Nodes: 14, Fen: "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", Captures: &captures, Checks: &checks}
+	assert.True(t, spec.needsChecks())
+	assert.True(t, runPerftSpecification(spec, PerftOptions{}))
+
+	checks = 3
+	assert.False(t, runPerftSpecification(spec, PerftOptions{}))
+
+	var specs []PerftSpecification
+	assert.Nil(t, json.Unmarshal([]byte(`[{"depth": 1, "nodes": 14, "fen": "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", "doublechecks": 0}]`), &specs))
+	assert.Nil(t, specs[0].Captures)
+	assert.Equal(t, uint(0), *specs[0].DoubleChecks)
+	assert.True(t, specs[0].needsChecks())
+}
+
+func TestLoadPerftDivideReference(t *testing.T) {
+	filename := writeTestFile(t, "divide.txt", "position startpos\ngo perft 2\ne2e4: 20\nb1c3 a7a6 1\ne7e8q: 3\n\nNodes searched: 400\n")
+	reference, err := LoadPerftDivideReference(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, PerftDivideReference{"e2e4": 20, "b1c3 a7a6": 1, "e7e8q": 3}, reference)
+	assert.Equal(t, map[string]uint{"a7a6": 1}, reference.children([]string{"b1c3"}))
+}
+
+func TestPerftDivideDiff(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	reference := make(PerftDivideReference)
+	for _, move := range GenerateLegalMoves(&boardState) {
+		reference[MoveToXboardString(move)] = 20
+	}
+	_, found := PerftDivideDiff(&boardState, 2, reference, PerftOptions{})
+	assert.False(t, found)
+
+	// A count that differs is followed down to a move missing from the
+	// reference
+	reference["b1c3"] = 19
+	boardState.ApplyMove(CreateMove(SQUARE_B1, SQUARE_C3))
+	for _, move := range GenerateLegalMoves(&boardState) {
+		if MoveToXboardString(move) != "a7a6" {
+			reference["b1c3 "+MoveToXboardString(move)] = 1
+		}
+	}
+	boardState.UnapplyMove(CreateMove(SQUARE_B1, SQUARE_C3))
+	difference, found := PerftDivideDiff(&boardState, 2, reference, PerftOptions{threads: 2})
+	assert.True(t, found)
+	assert.Equal(t, []string{"b1c3", "a7a6"}, difference.path)
+	assert.Equal(t, uint(1), difference.nodes)
+	assert.Equal(t, uint(0), difference.reference)
+	assert.Equal(t, "rnbqkbnr/pppppppp/8/8/8/2N5/PPPPPPPP/R1BQKBNR b KQkq - 1 1", difference.fen)
+	assert.Equal(t, STARTING_FEN, boardState.ToFENString())
+
+	// A move we don't generate is reported before counts that differ
+	reference["e1e2"] = 20
+	difference, found = PerftDivideDiff(&boardState, 2, reference, PerftOptions{})
+	assert.True(t, found)
+	assert.Equal(t, []string{"e1e2"}, difference.path)
+	assert.Equal(t, uint(0), difference.nodes)
+	assert.Equal(t, uint(20), difference.reference)
+}
+
+func TestPerftHashKeepsCheckColumnsApart(t *testing.T) {
+	hash := NewPerftHash(1)
+	fen := "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1"
+	assert.Equal(t, uint(0), perftTestPosition(t, fen, 3, PerftOptions{hash: hash}).checks)
+	assert.Equal(t, uint(267), perftTestPosition(t, fen, 3, PerftOptions{checks: true, hash: hash}).checks)
+}
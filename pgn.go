@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PGNScanner reads games from a PGN stream one at a time, so large databases
+// don't have to be loaded into memory.  The games keep the comments and NAGs of
+// the main line, but variations are dropped.
+type PGNScanner struct {
+	scanner  *bufio.Scanner
+	tags     map[string]string
+	movetext strings.Builder
+
+	// A tag line read while finishing the previous game
+	pending    string
+	hasPending bool
+	inComment  bool
+
+	// Used to replay games
+	boardState *BoardState
+}
+
+var pgnTagRegexp = regexp.MustCompile(`^\[\s*(\w+)\s+"((?:[^"\\]|\\.)*)"\s*\]`)
+
+func NewPGNScanner(r io.Reader) *PGNScanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &PGNScanner{scanner: scanner}
+}
+
+// Scan advances to the next game, returning false at the end of the input or on
+// a read error.
+func (s *PGNScanner) Scan() bool {
+	s.tags = make(map[string]string)
+	s.movetext.Reset()
+	s.inComment = false
+
+	found := false
+	for {
+		var line string
+		if s.hasPending {
+			line, s.hasPending = s.pending, false
+		} else if s.scanner.Scan() {
+			line = s.scanner.Text()
+		} else {
+			return found
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if !s.inComment && strings.HasPrefix(trimmed, "[") {
+			if s.movetext.Len() > 0 {
+				// The start of the next game
+				s.pending, s.hasPending = line, true
+				return true
+			}
+			if match := pgnTagRegexp.FindStringSubmatch(trimmed); match != nil {
+				s.tags[match[1]] = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(match[2])
+				found = true
+			}
+		} else if strings.HasPrefix(line, "%") || (trimmed == "" && !s.inComment) {
+			// Escaped lines and blank lines are ignored
+		} else {
+			s.movetext.WriteString(line)
+			s.movetext.WriteByte('\n')
+			s.updateComment(line)
+			found = true
+		}
+	}
+}
+
+// updateComment tracks whether a {comment} continues past the end of the line.
+// A ';' comment runs to the end of the line, so it can't hide a '{'.
+func (s *PGNScanner) updateComment(line string) {
+	for _, c := range line {
+		if s.inComment {
+			if c == '}' {
+				s.inComment = false
+			}
+		} else if c == '{' {
+			s.inComment = true
+		} else if c == ';' {
+			return
+		}
+	}
+}
+
+func (s *PGNScanner) Tags() map[string]string {
+	return s.tags
+}
+
+// Movetext returns the game's movetext, including comments and variations.
+func (s *PGNScanner) Movetext() string {
+	return s.movetext.String()
+}
+
+func (s *PGNScanner) Err() error {
+	return s.scanner.Err()
+}
+
+// pgnMovetextMove is a move of the main line with the NAGs and comments that
+// follow it.
+type pgnMovetextMove struct {
+	san     string
+	nags    []int
+	comment string
+}
+
+// The suffix annotations a move can carry instead of a NAG
+var pgnSuffixNags = map[string]int{"!": 1, "?": 2, "!!": 3, "??": 4, "!?": 5, "?!": 6}
+
+// parsePGNMovetext returns the moves of the main line, any comment before the
+// first move and the game termination marker, if there is one.  Comments and
+// NAGs are kept with the move they follow (suffix annotations such as "!?"
+// become NAGs), and a move with several comments gets them joined by spaces.
+// Variations, along with their comments and NAGs, and move numbers are dropped.
+func parsePGNMovetext(movetext string) (moves []pgnMovetextMove, initialComment string, result string, err error) {
+	depth := 0
+	var token strings.Builder
+	addComment := func(comment string) {
+		comment = strings.Join(strings.Fields(comment), " ")
+		if depth > 0 || comment == "" {
+			return
+		}
+		target := &initialComment
+		if len(moves) > 0 {
+			target = &moves[len(moves)-1].comment
+		}
+		if *target != "" {
+			*target += " "
+		}
+		*target += comment
+	}
+	endToken := func() {
+		if token.Len() == 0 {
+			return
+		}
+		str := token.String()
+		token.Reset()
+		if depth > 0 {
+			return
+		}
+
+		if str == "1-0" || str == "0-1" || str == "1/2-1/2" || str == "*" {
+			result = str
+			return
+		}
+
+		// Move numbers, possibly attached to the move ("1.e4", "3...Nf6"), and
+		// en passant markers (exd6 e.p.)
+		digits := len(str) - len(strings.TrimLeft(str, "0123456789"))
+		if digits > 0 && (digits == len(str) || str[digits] == '.') {
+			str = strings.TrimLeft(str[digits:], ".")
+		}
+		if str == "" || str == "e.p." {
+			return
+		}
+
+		if str[0] == '$' {
+			nag, err := strconv.Atoi(str[1:])
+			if err == nil && len(moves) > 0 {
+				moves[len(moves)-1].nags = append(moves[len(moves)-1].nags, nag)
+			}
+			return
+		}
+		san := strings.TrimRight(str, "!?")
+		nag, isNag := pgnSuffixNags[str[len(san):]]
+		if san != "" {
+			moves = append(moves, pgnMovetextMove{san: san})
+		}
+		if isNag && len(moves) > 0 {
+			moves[len(moves)-1].nags = append(moves[len(moves)-1].nags, nag)
+		}
+	}
+
+	for i := 0; i < len(movetext); i++ {
+		c := movetext[i]
+		switch {
+		case c == '{':
+			endToken()
+			end := strings.IndexByte(movetext[i:], '}')
+			if end < 0 {
+				return moves, initialComment, result, errors.New("Unterminated comment in movetext")
+			}
+			addComment(movetext[i+1 : i+end])
+			i += end
+		case c == ';':
+			endToken()
+			end := strings.IndexByte(movetext[i:], '\n')
+			if end < 0 {
+				end = len(movetext) - i
+			}
+			addComment(movetext[i+1 : i+end])
+			i += end
+		case c == '(':
+			endToken()
+			depth++
+		case c == ')':
+			endToken()
+			if depth == 0 {
+				return moves, initialComment, result, errors.New("Unbalanced ')' in movetext")
+			}
+			depth--
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			endToken()
+		case c == '$' && token.Len() > 0:
+			// A NAG directly after the move
+			endToken()
+			token.WriteByte(c)
+		default:
+			token.WriteByte(c)
+		}
+	}
+	endToken()
+
+	if depth > 0 {
+		return moves, initialComment, result, errors.New("Unterminated variation in movetext")
+	}
+	return moves, initialComment, result, nil
+}
+
+// Game is a game read from or written to PGN: the tags, the starting position
+// and the main line.  Variations aren't kept.
+type Game struct {
+	tags       map[string]string
+	initialFEN string
+	moves      []Move
+	result     string
+
+	// Written after the corresponding move (and before the result), if set
+	nags          [][]int
+	comments      []string
+	resultComment string
+	// Written before the first move
+	initialComment string
+}
+
+// ParseGame replays the main line of the movetext from the starting position,
+// which is the FEN tag if there is one.  boardState is reused for the replay and
+// is left at the last position reached.  On an illegal or unparsable move the
+// game up to that move is returned along with the error.
+func ParseGame(tags map[string]string, movetext string, boardState *BoardState) (*Game, error) {
+	game := &Game{tags: tags, initialFEN: tags["FEN"], result: tags["Result"]}
+	if game.initialFEN == "" {
+		game.initialFEN = STARTING_FEN
+	}
+	if err := boardState.ResetFromFENString(game.initialFEN); err != nil {
+		return nil, err
+	}
+
+	movetextMoves, initialComment, result, err := parsePGNMovetext(movetext)
+	if err != nil {
+		return nil, err
+	}
+	if game.result == "" {
+		game.result = result
+	}
+	game.initialComment = initialComment
+
+	for _, movetextMove := range movetextMoves {
+		move, err := ParsePrettyMove(movetextMove.san, boardState)
+		if err == nil {
+			_, err = boardState.IsMoveLegal(move)
+		}
+		if err != nil {
+			return game, fmt.Errorf("Move %d (%s): %w", boardState.fullmoveNumber, movetextMove.san, err)
+		}
+
+		game.moves = append(game.moves, move)
+		game.nags = append(game.nags, movetextMove.nags)
+		game.comments = append(game.comments, movetextMove.comment)
+		boardState.ApplyMove(move)
+	}
+
+	return game, nil
+}
+
+// Game parses the current game, see ParseGame.
+func (s *PGNScanner) Game() (*Game, error) {
+	if s.boardState == nil {
+		boardState := CreateInitialBoardState()
+		s.boardState = &boardState
+	}
+	return ParseGame(s.tags, s.Movetext(), s.boardState)
+}
+
+// ReadPGNGames parses every game in the PGN stream, stopping at the first error.
+func ReadPGNGames(r io.Reader) ([]*Game, error) {
+	var games []*Game
+	scanner := NewPGNScanner(r)
+	for scanner.Scan() {
+		game, err := scanner.Game()
+		if err != nil {
+			return games, fmt.Errorf("Game %d: %w", len(games)+1, err)
+		}
+		games = append(games, game)
+	}
+	return games, scanner.Err()
+}
+
+// The Seven Tag Roster, which PGN requires in this order before any other tags
+var pgnSevenTagRoster = []string{"Event", "Site", "Date", "Round", "White", "Black", "Result"}
+
+var pgnTagDefaults = map[string]string{"Date": "????.??.??", "Round": "-", "Result": "*"}
+
+const PGN_LINE_LENGTH = 79
+
+// WritePGN writes the game in PGN export format.  Missing Seven Tag Roster tags
+// are written as unknown, and SetUp/FEN are added when the game doesn't start
+// from the initial position.
+func (game *Game) WritePGN(w io.Writer) error {
+	boardState, err := CreateBoardStateFromFENString(game.initialFEN)
+	if err != nil {
+		return err
+	}
+
+	result := game.result
+	if result == "" {
+		result = "*"
+	}
+
+	tags := make(map[string]string)
+	for name, value := range game.tags {
+		tags[name] = value
+	}
+	tags["Result"] = result
+	delete(tags, "SetUp")
+	delete(tags, "FEN")
+
+	var sb strings.Builder
+	writeTag := func(name string, value string) {
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+		fmt.Fprintf(&sb, "[%s \"%s\"]\n", name, value)
+	}
+	for _, name := range pgnSevenTagRoster {
+		value, ok := tags[name]
+		if !ok {
+			value, ok = pgnTagDefaults[name]
+			if !ok {
+				value = "?"
+			}
+		}
+		writeTag(name, value)
+		delete(tags, name)
+	}
+	if boardState.ToFENString() != STARTING_FEN {
+		writeTag("SetUp", "1")
+		writeTag("FEN", game.initialFEN)
+	}
+	var names []string
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeTag(name, tags[name])
+	}
+	sb.WriteString("\n")
+
+	var tokens []string
+	if game.initialComment != "" {
+		tokens = append(tokens, pgnCommentTokens(game.initialComment)...)
+	}
+	needMoveNumber := true
+	for i, move := range game.moves {
+		if boardState.sideToMove == WHITE_OFFSET {
+			tokens = append(tokens, fmt.Sprintf("%d.", boardState.fullmoveNumber))
+		} else if needMoveNumber {
+			tokens = append(tokens, fmt.Sprintf("%d...", boardState.fullmoveNumber))
+		}
+		needMoveNumber = false
+
+		tokens = append(tokens, MoveToPrettyString(move, &boardState))
+		boardState.ApplyMove(move)
+
+		if i < len(game.nags) {
+			for _, nag := range game.nags[i] {
+				tokens = append(tokens, fmt.Sprintf("$%d", nag))
+			}
+		}
+		if i < len(game.comments) && game.comments[i] != "" {
+			tokens = append(tokens, pgnCommentTokens(game.comments[i])...)
+			needMoveNumber = true
+		}
+	}
+	if game.resultComment != "" {
+		tokens = append(tokens, pgnCommentTokens(game.resultComment)...)
+	}
+	tokens = append(tokens, result)
+
+	lineLength := 0
+	for _, token := range tokens {
+		if lineLength > 0 && lineLength+1+len(token) > PGN_LINE_LENGTH {
+			sb.WriteString("\n")
+			lineLength = 0
+		} else if lineLength > 0 {
+			sb.WriteString(" ")
+			lineLength++
+		}
+		sb.WriteString(token)
+		lineLength += len(token)
+	}
+	sb.WriteString("\n\n")
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// pgnCommentTokens splits a comment into words so it can be wrapped.  Braces
+// can't be escaped inside a comment, so closing braces are dropped.
+func pgnCommentTokens(comment string) []string {
+	words := strings.Fields(strings.ReplaceAll(comment, "}", ""))
+	if len(words) == 0 {
+		return nil
+	}
+	words[0] = "{" + words[0]
+	words[len(words)-1] += "}"
+	return words
+}
+
+// AppendPGNFile adds the game to the end of a PGN file, creating it if needed.
+func AppendPGNFile(filename string, game *Game) error {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := game.WritePGN(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
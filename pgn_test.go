@@ -0,0 +1,262 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPGNScanner(t *testing.T) {
+	pgn := `[Event "Test \"one\""]
+[Result "1-0"]
+
+1. e4 e5 2. Nf3 {A comment
+[%clk 0:01:00] over two lines} Nc6 1-0
+
+[Event "Two"]
+[Result "*"]
+% An escaped line
+1. d4 *
+1. c4
+`
+	scanner := NewPGNScanner(strings.NewReader(pgn))
+
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, `Test "one"`, scanner.Tags()["Event"])
+	moves, _, result, err := parsePGNMovetext(scanner.Movetext())
+	assert.Nil(t, err)
+	assert.Equal(t, []pgnMovetextMove{
+		{san: "e4"}, {san: "e5"}, {san: "Nf3", comment: "A comment [%clk 0:01:00] over two lines"}, {san: "Nc6"},
+	}, moves)
+	assert.Equal(t, "1-0", result)
+
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "Two", scanner.Tags()["Event"])
+	moves, _, result, err = parsePGNMovetext(scanner.Movetext())
+	assert.Nil(t, err)
+	assert.Equal(t, []pgnMovetextMove{{san: "d4"}, {san: "c4"}}, moves)
+	assert.Equal(t, "*", result)
+
+	assert.False(t, scanner.Scan())
+	assert.Nil(t, scanner.Err())
+}
+
+func TestPGNMainlineMoves(t *testing.T) {
+	moves, initialComment, result, err := parsePGNMovetext("{Start} 1.e4 $1 e5!? (1...c5 {Sicilian} 2. Nf3 (2. c3) d6) " +
+		"2.Nf3 ; to the end\n 2...Nc6$2 {first} {second} 3. Bb5 a6 1/2-1/2")
+	assert.Equal(t, []pgnMovetextMove{
+		{san: "e4", nags: []int{1}},
+		{san: "e5", nags: []int{5}},
+		{san: "Nf3", comment: "to the end"},
+		{san: "Nc6", nags: []int{2}, comment: "first second"},
+		{san: "Bb5"},
+		{san: "a6"},
+	}, moves)
+	assert.Equal(t, "Start", initialComment)
+	assert.Equal(t, "1/2-1/2", result)
+	assert.Nil(t, err)
+
+	moves, initialComment, result, err = parsePGNMovetext("")
+	assert.Equal(t, 0, len(moves))
+	assert.Equal(t, "", initialComment)
+	assert.Equal(t, "", result)
+	assert.Nil(t, err)
+
+	for _, movetext := range []string{"1. e4 {unterminated", "1. e4 (1. d4", "1. e4 ) e5"} {
+		_, _, _, err = parsePGNMovetext(movetext)
+		assert.NotNil(t, err, movetext)
+	}
+}
+
+func TestParseGameKeepsCommentsAndNags(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	game, err := ParseGame(map[string]string{}, "{Opening} 1. e4 {Best by test} e5?! $14 (1... c5) 2. Nf3 *", &boardState)
+	assert.Nil(t, err)
+	assert.Equal(t, "Opening", game.initialComment)
+	assert.Equal(t, [][]int{nil, {6, 14}, nil}, game.nags)
+	assert.Equal(t, []string{"Best by test", "", ""}, game.comments)
+
+	var sb strings.Builder
+	assert.Nil(t, game.WritePGN(&sb))
+	assert.True(t, strings.HasSuffix(sb.String(), "\n{Opening} 1. e4 {Best by test} 1... e5 $6 $14 2. Nf3 *\n\n"), sb.String())
+}
+
+func TestReadPGNGamesCorpus(t *testing.T) {
+	file, err := os.Open("testdata/pgn/corpus.pgn")
+	assert.Nil(t, err)
+	defer file.Close()
+
+	games, err := ReadPGNGames(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, len(games))
+
+	finalFEN := func(game *Game) string {
+		boardState, err := CreateBoardStateFromFENString(game.initialFEN)
+		assert.Nil(t, err)
+		for _, move := range game.moves {
+			boardState.ApplyMove(move)
+		}
+		return boardState.ToFENString()
+	}
+
+	promotion := games[0]
+	assert.Equal(t, "r3k3/1P6/8/8/8/8/8/4K3 w - - 0 1", promotion.initialFEN)
+	assert.Equal(t, "*", promotion.result)
+	assert.Equal(t, "b7a8q", MoveToXboardString(promotion.moves[0]))
+	assert.Equal(t, 5, len(promotion.moves))
+
+	enPassant := games[1]
+	assert.True(t, enPassant.moves[4].IsEnPassantCapture())
+	assert.Equal(t, "1-0", enPassant.result)
+	assert.Equal(t, "rnbk1b1r/pp3ppp/5n2/2p5/8/8/PPP2PPP/RNB1KBNR w KQ - 0 7", finalFEN(enPassant))
+
+	assert.True(t, games[2].moves[0].IsKingsideCastle())
+	assert.True(t, games[3].moves[0].IsQueensideCastle())
+
+	disambiguation := games[4]
+	assert.Equal(t, CreateMove(SQUARE_A1, SQUARE_B2), disambiguation.moves[0])
+	assert.Equal(t, CreateMove(SQUARE_A3, SQUARE_A2), disambiguation.moves[2])
+	assert.Equal(t, CreateMove(SQUARE_C1, SQUARE_C2), disambiguation.moves[4])
+
+	annotated := games[5]
+	assert.Equal(t, `Annotations and "variations"`, annotated.tags["Event"])
+	assert.Equal(t, 4, len(annotated.moves))
+	assert.Equal(t, "0-1", annotated.result)
+
+	assert.Equal(t, 11, len(games[6].moves))
+}
+
+func TestReadPGNGamesErrors(t *testing.T) {
+	for _, pgn := range []string{
+		// Illegal move
+		"1. e4 e5 2. Ke3 *",
+		// Ambiguous
+		"[FEN \"4k3/8/8/8/8/8/8/1N1K1N2 w - - 0 1\"]\n\n1. Nd2 *",
+		"1. e4 (1. d4 *",
+		"[FEN \"not a position\"]\n\n1. e4 *",
+	} {
+		_, err := ReadPGNGames(strings.NewReader(pgn))
+		assert.NotNil(t, err, pgn)
+	}
+
+	// The game is returned up to the bad move (Nf7 is a capture)
+	scanner := NewPGNScanner(strings.NewReader("1. e4 e5 2. Nf3 Nf6 3. Ng5 Ke7 4. Nf7 *"))
+	assert.True(t, scanner.Scan())
+	game, err := scanner.Game()
+	assert.NotNil(t, err)
+	assert.Equal(t, 6, len(game.moves))
+}
+
+func FuzzPGNScanner(f *testing.F) {
+	corpus, err := os.ReadFile("testdata/pgn/corpus.pgn")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(string(corpus))
+	f.Add("1. e4 e5 2. Nf3 {comment} (2. f4 exf4) 2... Nc6 $1 1-0")
+	f.Add("[FEN \"8/P7/8/8/8/8/8/k1K5 w - - 0 1\"]\n\n1. a8=Q+ Ka2 2. Qa4+ *")
+	f.Add("1. e4 { unterminated")
+
+	// Creating boards is slow, so one is shared by every run
+	boardState := CreateInitialBoardState()
+	f.Fuzz(func(t *testing.T, pgn string) {
+		scanner := NewPGNScanner(strings.NewReader(pgn))
+		scanner.boardState = &boardState
+		for scanner.Scan() {
+			game, _ := scanner.Game()
+			if game == nil {
+				continue
+			}
+
+			// Whatever was read replays legally
+			if err := boardState.ResetFromFENString(game.initialFEN); err != nil {
+				t.Fatal(err)
+			}
+			for _, move := range game.moves {
+				if _, err := boardState.IsMoveLegal(move); err != nil {
+					t.Fatal(err)
+				}
+				boardState.ApplyMove(move)
+			}
+		}
+	})
+}
+
+func TestWritePGN(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("4k3/8/8/8/8/8/4P3/4K3 b - - 0 10")
+	game := &Game{
+		tags:          map[string]string{"Event": `Test "quoted"`, "Annotator": "ra", "FEN": "ignored"},
+		initialFEN:    boardState.ToFENString(),
+		result:        "1/2-1/2",
+		comments:      []string{"+0.00/1 0.0s"},
+		resultComment: "Agreed} early",
+	}
+	for _, moveStr := range []string{"Kd7", "e4", "Ke6"} {
+		move, err := ParsePrettyMove(moveStr, &boardState)
+		assert.Nil(t, err)
+		game.moves = append(game.moves, move)
+		boardState.ApplyMove(move)
+	}
+
+	var sb strings.Builder
+	assert.Nil(t, game.WritePGN(&sb))
+	assert.Equal(t, `[Event "Test \"quoted\""]
+[Site "?"]
+[Date "????.??.??"]
+[Round "-"]
+[White "?"]
+[Black "?"]
+[Result "1/2-1/2"]
+[SetUp "1"]
+[FEN "4k3/8/8/8/8/8/4P3/4K3 b - - 0 10"]
+[Annotator "ra"]
+
+10... Kd7 {+0.00/1 0.0s} 11. e4 Ke6 {Agreed early} 1/2-1/2
+
+`, sb.String())
+}
+
+func TestWritePGNRoundTrip(t *testing.T) {
+	file, err := os.Open("testdata/pgn/corpus.pgn")
+	assert.Nil(t, err)
+	defer file.Close()
+	games, err := ReadPGNGames(file)
+	assert.Nil(t, err)
+
+	// Long enough to wrap
+	var sb strings.Builder
+	opening := &Game{initialFEN: STARTING_FEN, result: "*"}
+	boardState := CreateInitialBoardState()
+	for i := 0; i < 15; i++ {
+		for _, moveStr := range []string{"Nf3", "Nf6", "Ng1", "Ng8"} {
+			move, _ := ParsePrettyMove(moveStr, &boardState)
+			opening.moves = append(opening.moves, move)
+			opening.comments = append(opening.comments, "")
+			boardState.ApplyMove(move)
+		}
+	}
+
+	written := append(games, opening)
+	for _, game := range written {
+		assert.Nil(t, game.WritePGN(&sb))
+	}
+	for _, line := range strings.Split(sb.String(), "\n") {
+		assert.LessOrEqual(t, len(line), PGN_LINE_LENGTH, line)
+	}
+
+	readGames, err := ReadPGNGames(strings.NewReader(sb.String()))
+	assert.Nil(t, err)
+	assert.Equal(t, len(written), len(readGames))
+	for i, game := range readGames {
+		assert.Equal(t, written[i].initialFEN, game.initialFEN)
+		assert.Equal(t, written[i].moves, game.moves)
+		assert.Equal(t, written[i].result, game.result)
+		if i < len(games) {
+			assert.Equal(t, written[i].initialComment, game.initialComment)
+			assert.Equal(t, written[i].nags, game.nags)
+			assert.Equal(t, written[i].comments, game.comments)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A deliberately simple and slow move generator on an 8x8 mailbox, sharing no
+// code with the engine, for differential tests of GenerateMoves and ApplyMove.
+// Pieces are FEN letters and squares are file + 8*rank, so a1 is 0 and h8 63.
+
+type refPosition struct {
+	board       [64]byte
+	whiteToMove bool
+	// Some of "KQkq" in that order
+	castling string
+	// The en passant target square or -1
+	enPassant int
+	halfmove  int
+	fullmove  int
+}
+
+type refMove struct {
+	from, to  int
+	promotion byte
+}
+
+func (move refMove) String() string {
+	s := refSquareString(move.from) + refSquareString(move.to)
+	if move.promotion != 0 {
+		s += string(move.promotion)
+	}
+	return s
+}
+
+func refSquareString(sq int) string {
+	return string([]byte{byte('a' + sq%8), byte('1' + sq/8)})
+}
+
+func refParseSquare(s string) int {
+	return int(s[0]-'a') + 8*int(s[1]-'1')
+}
+
+func refParseFEN(fen string) refPosition {
+	fields := strings.Fields(fen)
+	var p refPosition
+	rank, file := 7, 0
+	for _, c := range fields[0] {
+		switch {
+		case c == '/':
+			rank, file = rank-1, 0
+		case c >= '1' && c <= '8':
+			file += int(c - '0')
+		default:
+			p.board[rank*8+file] = byte(c)
+			file++
+		}
+	}
+	p.whiteToMove = fields[1] == "w"
+	if fields[2] != "-" {
+		p.castling = fields[2]
+	}
+	p.enPassant = -1
+	if fields[3] != "-" {
+		p.enPassant = refParseSquare(fields[3])
+	}
+	p.halfmove, p.fullmove = 0, 1
+	if len(fields) >= 6 {
+		p.halfmove, _ = strconv.Atoi(fields[4])
+		p.fullmove, _ = strconv.Atoi(fields[5])
+	}
+	return p
+}
+
+func (p refPosition) fen() string {
+	var s strings.Builder
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			c := p.board[rank*8+file]
+			if c == 0 {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				s.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			s.WriteByte(c)
+		}
+		if empty > 0 {
+			s.WriteString(strconv.Itoa(empty))
+		}
+		if rank > 0 {
+			s.WriteByte('/')
+		}
+	}
+
+	side, castling, enPassant := "b", p.castling, "-"
+	if p.whiteToMove {
+		side = "w"
+	}
+	if castling == "" {
+		castling = "-"
+	}
+	if p.enPassant >= 0 {
+		enPassant = refSquareString(p.enPassant)
+	}
+	return fmt.Sprintf("%s %s %s %s %d %d", s.String(), side, castling, enPassant, p.halfmove, p.fullmove)
+}
+
+func refIsWhite(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+func refIsOwn(c byte, white bool) bool {
+	return c != 0 && refIsWhite(c) == white
+}
+
+func refLower(c byte) byte {
+	if refIsWhite(c) {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// refStep returns the square a (file, rank) step away, or -1 off the board.
+func refStep(sq int, df int, dr int) int {
+	file, rank := sq%8+df, sq/8+dr
+	if file < 0 || file > 7 || rank < 0 || rank > 7 {
+		return -1
+	}
+	return rank*8 + file
+}
+
+var refKnightSteps = [][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}}
+var refKingSteps = [][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}}
+var refRookSteps = [][2]int{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+var refBishopSteps = [][2]int{{1, 1}, {-1, 1}, {-1, -1}, {1, -1}}
+
+// refAttacked returns whether a piece of the colour attacks the square, by
+// looking outwards from it for each kind of piece.
+func (p refPosition) refAttacked(sq int, byWhite bool) bool {
+	is := func(target int, piece byte) bool {
+		if target < 0 || !refIsOwn(p.board[target], byWhite) {
+			return false
+		}
+		return refLower(p.board[target]) == piece
+	}
+
+	pawnRank := -1
+	if !byWhite {
+		pawnRank = 1
+	}
+	if is(refStep(sq, -1, pawnRank), 'p') || is(refStep(sq, 1, pawnRank), 'p') {
+		return true
+	}
+	for _, step := range refKnightSteps {
+		if is(refStep(sq, step[0], step[1]), 'n') {
+			return true
+		}
+	}
+	for _, step := range refKingSteps {
+		if is(refStep(sq, step[0], step[1]), 'k') {
+			return true
+		}
+	}
+	slide := func(steps [][2]int, pieces string) bool {
+		for _, step := range steps {
+			for target := refStep(sq, step[0], step[1]); target >= 0; target = refStep(target, step[0], step[1]) {
+				if p.board[target] == 0 {
+					continue
+				}
+				if refIsOwn(p.board[target], byWhite) && strings.IndexByte(pieces, refLower(p.board[target])) >= 0 {
+					return true
+				}
+				break
+			}
+		}
+		return false
+	}
+	return slide(refRookSteps, "rq") || slide(refBishopSteps, "bq")
+}
+
+func (p refPosition) refInCheck(white bool) bool {
+	king := byte('k')
+	if white {
+		king = 'K'
+	}
+	for sq, c := range p.board {
+		if c == king {
+			return p.refAttacked(sq, !white)
+		}
+	}
+	return false
+}
+
+func (p refPosition) refPseudoMoves() []refMove {
+	var moves []refMove
+	white := p.whiteToMove
+	add := func(from int, to int) {
+		if to >= 0 && !refIsOwn(p.board[to], white) {
+			moves = append(moves, refMove{from: from, to: to})
+		}
+	}
+
+	for from, c := range p.board {
+		if !refIsOwn(c, white) {
+			continue
+		}
+		switch refLower(c) {
+		case 'p':
+			dir, startRank, lastRank := 1, 1, 7
+			if !white {
+				dir, startRank, lastRank = -1, 6, 0
+			}
+			var targets []int
+			if one := refStep(from, 0, dir); one >= 0 && p.board[one] == 0 {
+				targets = append(targets, one)
+				if two := refStep(from, 0, 2*dir); from/8 == startRank && p.board[two] == 0 {
+					targets = append(targets, two)
+				}
+			}
+			for _, df := range []int{-1, 1} {
+				to := refStep(from, df, dir)
+				if to >= 0 && (to == p.enPassant || (p.board[to] != 0 && !refIsOwn(p.board[to], white))) {
+					targets = append(targets, to)
+				}
+			}
+			for _, to := range targets {
+				if to/8 != lastRank {
+					moves = append(moves, refMove{from: from, to: to})
+					continue
+				}
+				for _, promotion := range []byte("qrbn") {
+					moves = append(moves, refMove{from: from, to: to, promotion: promotion})
+				}
+			}
+		case 'n':
+			for _, step := range refKnightSteps {
+				add(from, refStep(from, step[0], step[1]))
+			}
+		case 'k':
+			for _, step := range refKingSteps {
+				add(from, refStep(from, step[0], step[1]))
+			}
+		default:
+			var steps [][2]int
+			switch refLower(c) {
+			case 'r':
+				steps = refRookSteps
+			case 'b':
+				steps = refBishopSteps
+			case 'q':
+				steps = append(append(steps, refRookSteps...), refBishopSteps...)
+			}
+			for _, step := range steps {
+				for to := refStep(from, step[0], step[1]); to >= 0; to = refStep(to, step[0], step[1]) {
+					add(from, to)
+					if p.board[to] != 0 {
+						break
+					}
+				}
+			}
+		}
+	}
+
+	// Castling needs the right, the empty squares between king and rook, and a
+	// king that isn't in check and doesn't pass through an attacked square
+	rank, rights, king, rook := 0, "KQ", byte('K'), byte('R')
+	if !white {
+		rank, rights, king, rook = 56, "kq", 'k', 'r'
+	}
+	if p.board[rank+4] == king && !p.refAttacked(rank+4, !white) {
+		if strings.IndexByte(p.castling, rights[0]) >= 0 && p.board[rank+7] == rook &&
+			p.board[rank+5] == 0 && p.board[rank+6] == 0 && !p.refAttacked(rank+5, !white) {
+			moves = append(moves, refMove{from: rank + 4, to: rank + 6})
+		}
+		if strings.IndexByte(p.castling, rights[1]) >= 0 && p.board[rank] == rook && p.board[rank+3] == 0 &&
+			p.board[rank+2] == 0 && p.board[rank+1] == 0 && !p.refAttacked(rank+3, !white) {
+			moves = append(moves, refMove{from: rank + 4, to: rank + 2})
+		}
+	}
+	return moves
+}
+
+// refMake returns the position after the move, which must be pseudo-legal.
+func (p refPosition) refMake(move refMove) refPosition {
+	c := p.board[move.from]
+	captured := p.board[move.to]
+	p.board[move.from] = 0
+	p.board[move.to] = c
+
+	if refLower(c) == 'p' && move.to == p.enPassant {
+		if p.whiteToMove {
+			p.board[move.to-8] = 0
+		} else {
+			p.board[move.to+8] = 0
+		}
+		captured = 'p'
+	}
+	if move.promotion != 0 {
+		p.board[move.to] = move.promotion
+		if p.whiteToMove {
+			p.board[move.to] = move.promotion + 'A' - 'a'
+		}
+	}
+	if refLower(c) == 'k' && (move.to-move.from == 2 || move.from-move.to == 2) {
+		rookFrom, rookTo := move.from+3, move.from+1
+		if move.to < move.from {
+			rookFrom, rookTo = move.from-4, move.from-1
+		}
+		p.board[rookTo] = p.board[rookFrom]
+		p.board[rookFrom] = 0
+	}
+
+	// A right goes when the king or rook moves away or the rook is captured
+	for sq, right := range map[int]string{4: "KQ", 0: "Q", 7: "K", 60: "kq", 56: "q", 63: "k"} {
+		if move.from == sq || move.to == sq {
+			for _, r := range right {
+				p.castling = strings.ReplaceAll(p.castling, string(r), "")
+			}
+		}
+	}
+
+	p.enPassant = -1
+	if refLower(c) == 'p' && (move.to-move.from == 16 || move.from-move.to == 16) {
+		p.enPassant = (move.from + move.to) / 2
+	}
+	p.halfmove++
+	if refLower(c) == 'p' || captured != 0 {
+		p.halfmove = 0
+	}
+	if !p.whiteToMove {
+		p.fullmove++
+	}
+	p.whiteToMove = !p.whiteToMove
+	return p
+}
+
+// refLegalMoves returns the legal moves in coordinate notation, sorted.
+func (p refPosition) refLegalMoves() []string {
+	var moves []string
+	for _, move := range p.refPseudoMoves() {
+		if !p.refMake(move).refInCheck(p.whiteToMove) {
+			moves = append(moves, move.String())
+		}
+	}
+	sort.Strings(moves)
+	return moves
+}
+
+// refParseMove finds the pseudo-legal move in coordinate notation.
+func (p refPosition) refParseMove(s string) (refMove, bool) {
+	for _, move := range p.refPseudoMoves() {
+		if move.String() == s {
+			return move, true
+		}
+	}
+	return refMove{}, false
+}
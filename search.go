@@ -5,6 +5,7 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +16,9 @@ var THREEFOLD_REP_FLAG byte = 0x10
 
 const MAX_DEPTH uint = 32
 
+// Longest line the search can follow, including quiescent search
+const MAX_SEARCH_PLY = 64
+
 type SearchStats struct {
 	leafnodes         uint64
 	branchnodes       uint64
@@ -27,6 +31,7 @@ type SearchStats struct {
 	nullcutoffs       uint64
 	qcapturesfiltered uint64
 	tthits            uint64
+	tbhits            uint64
 }
 
 type SearchResult struct {
@@ -45,6 +50,10 @@ type ThinkingOutput struct {
 	time  int64
 	nodes uint64
 	pv    string
+
+	// The first move of the pv, and its score for the side to move
+	move  Move
+	value int16
 }
 
 func (result *SearchResult) IsCheckmate() bool {
@@ -61,12 +70,47 @@ type SearchConfig struct {
 	debugMoves    string
 	startingDepth uint
 	startTime     time.Time
+	abort         *atomic.Bool
+	features      SearchFeatures
+}
+
+// aborted returns true once the search has been told to stop.
+func (config *SearchConfig) aborted() bool {
+	return config.abort != nil && config.abort.Load()
 }
 
 type ExternalSearchConfig struct {
 	isDebug       bool
 	debugMoves    string
 	searchToDepth uint
+	// Stops the search when set, so independent searches can run at the same time
+	abort    *atomic.Bool
+	features SearchFeatures
+}
+
+// SearchFeatures turns off parts of the search, to measure what they're worth
+// in self-play.
+type SearchFeatures struct {
+	noNullMove           bool
+	noPromotionExtension bool
+}
+
+// ParseSearchFeatures parses a comma separated list of the features to turn off:
+// nonullmove, nopromotionextension.
+func ParseSearchFeatures(str string) (SearchFeatures, error) {
+	var features SearchFeatures
+	for _, name := range strings.Split(str, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "nonullmove":
+			features.noNullMove = true
+		case "nopromotionextension":
+			features.noPromotionExtension = true
+		default:
+			return features, fmt.Errorf("Unknown search feature %s", name)
+		}
+	}
+	return features, nil
 }
 
 type SearchMoveInfo struct {
@@ -101,11 +145,14 @@ func SearchWithConfig(
 		debugMoves:    config.debugMoves,
 		startingDepth: depth,
 		startTime:     startTime,
+		abort:         config.abort,
+		features:      config.features,
 	}
-	moves := make([]Move, 64*256)
+	moves := make([]Move, MAX_SEARCH_PLY*256)
 	scores := make([]int16, len(moves))
 
-	var moveStart [64]int
+	boardState.startSearch()
+	var moveStart [MAX_SEARCH_PLY]int
 	score := searchAlphaBeta(boardState, stats, moveInfo,
 		thinkingChan,
 		int8(depth),
@@ -143,10 +190,6 @@ func SearchWithConfig(
 	result.stats = *stats
 	result.depth = depth
 
-	if shouldAbort {
-		close(thinkingChan)
-	}
-
 	return result
 }
 
@@ -203,13 +246,24 @@ func searchAlphaBeta(
 		}
 	}
 
-	if shouldAbort || currentDepth >= MAX_DEPTH {
+	if searchConfig.aborted() || currentDepth >= MAX_DEPTH {
 		score := getLeafResult(boardState, searchStats)
 		StoreTranspositionTable(boardState, 0, score, TT_EXACT, depthLeft)
 
 		return score
 	}
 
+	if currentDepth == 0 {
+		if move, score, ok := probeRootTables(boardState, moves, moveStart[0]); ok {
+			searchStats.tbhits++
+			StoreTranspositionTable(boardState, move, score, TT_EXACT, depthLeft)
+			if thinkingChan != nil && !searchConfig.aborted() {
+				sendToThinkingChannel(move, boardState, searchStats, thinkingChan, searchConfig, score, depthLeft)
+			}
+			return score
+		}
+	}
+
 	inCheck := boardState.IsInCheck(boardState.sideToMove)
 	if inCheck {
 		depthLeft++
@@ -219,11 +273,25 @@ func searchAlphaBeta(
 		return searchQuiescent(boardState, searchStats, depthLeft, currentDepth, alpha, beta, searchConfig, moves, moveScores, moveStart)
 	}
 
-	if boardState.HasStateOccurred() {
+	// The root always needs a move, even in a position that has occurred before
+	if currentDepth > 0 && boardState.IsSearchRepetition() {
 		// TODO - contempt value
 		return 0
 	}
 
+	// After the repetition check, since a table's result assumes the game goes on
+	// from here, but a repetition is already a draw
+	if currentDepth > 0 {
+		if score, ok := probeTablebaseScore(boardState, currentDepth); ok {
+			searchStats.tbhits++
+			return score
+		}
+		if score, ok := probeSyzygyScore(boardState, currentDepth); ok {
+			searchStats.tbhits++
+			return score
+		}
+	}
+
 	searchStats.branchnodes++
 
 	// We'll generate the other moves after we test the hash move
@@ -258,7 +326,8 @@ func searchAlphaBeta(
 		nonPawnBitboard ^= boardState.bitboards.piece[PAWN_MASK]
 		nonPawnBitboard ^= boardState.bitboards.piece[KING_MASK]
 
-		if i == 1 && !inCheck && nonPawnBitboard != 0 && !boardState.boardInfo.lastMoveWasNullMove {
+		if i == 1 && !searchConfig.features.noNullMove && !inCheck && nonPawnBitboard != 0 &&
+			!boardState.boardInfo.lastMoveWasNullMove {
 			// null move logic here
 			boardState.ApplyNullMove()
 
@@ -322,7 +391,7 @@ func searchAlphaBeta(
 			searchConfig.isDebug = false
 
 			var D int8 = 0
-			if IsPawnNearPromotion(boardState, move) {
+			if !searchConfig.features.noPromotionExtension && IsPawnNearPromotion(boardState, move) {
 				D = 1
 			}
 
@@ -384,7 +453,7 @@ func searchAlphaBeta(
 				bestMove = move
 				if bestScore > alpha {
 					currentAlpha = score
-					if currentDepth == 0 && thinkingChan != nil && !shouldAbort {
+					if currentDepth == 0 && thinkingChan != nil && !searchConfig.aborted() {
 						sendToThinkingChannel(bestMove, boardState, searchStats, thinkingChan, searchConfig, bestScore, depthLeft)
 					}
 				}
@@ -457,7 +526,7 @@ func searchQuiescent(
 		bestScore = score
 		alpha = score
 	}
-	if shouldAbort {
+	if searchConfig.aborted() {
 		return score
 	}
 
@@ -532,6 +601,17 @@ func (result *SearchResult) String() string {
 		result.pv)
 }
 
+// MateInMoves converts a mate score to the number of moves to mate, negative
+// when the side is getting mated.  A mate found at ply n scores
+// CHECKMATE_SCORE - n + 1.
+func MateInMoves(score int) int {
+	plies := CHECKMATE_SCORE - Abs(score) + 1
+	if score < 0 {
+		return -(plies + 1) / 2
+	}
+	return (plies + 1) / 2
+}
+
 func SearchValueToString(result SearchResult) string {
 	if result.IsCheckmate() {
 		score := result.value
@@ -561,11 +641,12 @@ func (result *SearchStats) add(stats SearchStats) {
 	result.nullcutoffs += stats.nullcutoffs
 	result.qcapturesfiltered += stats.qcapturesfiltered
 	result.tthits += stats.tthits
+	result.tbhits += stats.tbhits
 }
 
 func (stats *SearchStats) String() string {
 	return fmt.Sprintf(
-		"[nodes=%d, leafnodes=%d, branchnodes=%d, qbranchnodes=%d, tthits=%d, cutoffs=%d, "+
+		"[nodes=%d, leafnodes=%d, branchnodes=%d, qbranchnodes=%d, tthits=%d, tbhits=%d, cutoffs=%d, "+
 			"hash cutoffs=%d, null cutoffs=%d, killer cutoffs={1: %d, 2: %d}, "+
 			"qcutoffs=%d, qcapturesfiltered=%d]",
 		stats.Nodes(),
@@ -573,6 +654,7 @@ func (stats *SearchStats) String() string {
 		stats.branchnodes,
 		stats.qbranchnodes,
 		stats.tthits,
+		stats.tbhits,
 		stats.cutoffs,
 		stats.hashcutoffs,
 		stats.nullcutoffs,
@@ -635,6 +717,8 @@ func sendToThinkingChannel(
 		time:  int64(float32(timeNanos) * 1e-7),
 		nodes: searchStats.Nodes(),
 		pv:    pv,
+		move:  move,
+		value: score,
 	}
 }
 
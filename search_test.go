@@ -26,6 +26,33 @@ func TestSearchStartingPosition(t *testing.T) {
 	assert.Equal(t, originalKey, boardState.hashKey)
 }
 
+func TestSearchRepeatedPositionReturnsMove(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	moves, err := VariationToMoveList("Nf3 Nf6 Ng1 Ng8", &boardState)
+	assert.Nil(t, err)
+	for _, move := range moves {
+		boardState.ApplyMove(move)
+	}
+	assert.True(t, boardState.HasStateOccurred())
+
+	result := Search(&boardState, 2, &SearchStats{}, &SearchMoveInfo{})
+	assert.NotEqual(t, Move(0), result.move)
+}
+
+func TestParseSearchFeatures(t *testing.T) {
+	features, err := ParseSearchFeatures("nonullmove, nopromotionextension")
+	assert.Nil(t, err)
+	assert.True(t, features.noNullMove)
+	assert.True(t, features.noPromotionExtension)
+
+	features, err = ParseSearchFeatures("")
+	assert.Nil(t, err)
+	assert.Equal(t, SearchFeatures{}, features)
+
+	_, err = ParseSearchFeatures("nonullmove,nolmr")
+	assert.NotNil(t, err)
+}
+
 func TestSearchMateInOne(t *testing.T) {
 	boardState := CreateMateInOneBoard()
 
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Self-play matches between two configurations of the engine, to measure
+// whether a change gains Elo.  Each opening is played twice with the colours
+// reversed, which cancels out most of the bias of the opening.
+
+const (
+	SELF_PLAY_BASE = 0
+	SELF_PLAY_TEST = 1
+)
+
+type SelfPlayEngine struct {
+	name       string
+	evalParams *EvalParams
+	features   SearchFeatures
+}
+
+type SelfPlayOptions struct {
+	games          uint
+	thinkingTimeMs uint
+	// Search every move to this depth instead of for the thinking time, if set
+	depth uint
+	// Number of games played at the same time
+	threads uint
+	pgnFile string
+}
+
+type SelfPlayMatch struct {
+	// Indexed by SELF_PLAY_BASE and SELF_PLAY_TEST
+	engines  [2]SelfPlayEngine
+	openings []string
+	options  SelfPlayOptions
+}
+
+// SelfPlayPair is the two games played from an opening, the first with the test
+// engine as white.
+type SelfPlayPair struct {
+	index int
+	games [2]*Game
+	// Points of the test engine in each game
+	scores [2]float64
+	err    error
+}
+
+// Score returns the points of the test engine over both games (0-2).
+func (pair *SelfPlayPair) Score() float64 {
+	return pair.scores[0] + pair.scores[1]
+}
+
+// selfPlayWorker plays games on its own boards.  Each engine searches on a
+// separate board, so they don't share a transposition table.
+type selfPlayWorker struct {
+	match        *SelfPlayMatch
+	gameBoard    BoardState
+	engineBoards [2]BoardState
+}
+
+// NewSelfPlayMatch reads the openings from the EPD file (the positions matching
+// the regex, if one is given).
+func NewSelfPlayMatch(openingsFile string, epdRegex string, base SelfPlayEngine, test SelfPlayEngine,
+	options SelfPlayOptions) (*SelfPlayMatch, error) {
+	lines, err := ParseAndFilterEpdFile(openingsFile, epdRegex)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("No opening positions for self-play")
+	}
+
+	match := &SelfPlayMatch{engines: [2]SelfPlayEngine{base, test}, options: options}
+	boardState := CreateInitialBoardState()
+	for _, line := range lines {
+		if err := boardState.ResetFromFENString(line.fen); err != nil {
+			return nil, fmt.Errorf("%s: %w", line.name, err)
+		}
+		match.openings = append(match.openings, boardState.ToFENString())
+	}
+	return match, nil
+}
+
+// Play plays pairs of games on options.threads goroutines, using the openings in
+// turn, until maxPairs have been played (0 for no limit) or onPair returns
+// false.  onPair is called on the calling goroutine as each pair finishes.
+func (match *SelfPlayMatch) Play(maxPairs int, onPair func(pair *SelfPlayPair) bool) {
+	threads := match.options.threads
+	if threads == 0 {
+		threads = 1
+	}
+
+	jobs := make(chan int)
+	done := make(chan *SelfPlayPair)
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for i := uint(0); i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker := newSelfPlayWorker(match)
+			for index := range jobs {
+				done <- worker.playPair(index)
+			}
+		}()
+	}
+	go func() {
+	Jobs:
+		for index := 0; maxPairs == 0 || index < maxPairs; index++ {
+			select {
+			case jobs <- index:
+			case <-stop:
+				break Jobs
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+	}()
+
+	// Pairs already being played when onPair asks to stop are discarded
+	stopped := false
+	for pair := range done {
+		if !stopped && !onPair(pair) {
+			stopped = true
+			close(stop)
+		}
+	}
+}
+
+func newSelfPlayWorker(match *SelfPlayMatch) *selfPlayWorker {
+	worker := &selfPlayWorker{match: match, gameBoard: CreateInitialBoardState()}
+	for i := range worker.engineBoards {
+		worker.engineBoards[i] = CreateInitialBoardState()
+		if match.engines[i].evalParams != nil {
+			worker.engineBoards[i].evalParams = match.engines[i].evalParams
+		}
+	}
+	return worker
+}
+
+func (worker *selfPlayWorker) playPair(index int) *SelfPlayPair {
+	pair := &SelfPlayPair{index: index}
+	opening := worker.match.openings[index%len(worker.match.openings)]
+	for i := range pair.games {
+		white, black := SELF_PLAY_TEST, SELF_PLAY_BASE
+		if i == 1 {
+			white, black = black, white
+		}
+
+		game, err := worker.playGame(white, black, opening)
+		if err != nil {
+			pair.err = fmt.Errorf("Game %d.%d: %w", index+1, i+1, err)
+			return pair
+		}
+		game.tags["Round"] = fmt.Sprintf("%d.%d", index+1, i+1)
+		pair.games[i] = game
+
+		score, _ := ParseResultString(game.result)
+		if white != SELF_PLAY_TEST {
+			score = 1 - score
+		}
+		pair.scores[i] = score
+	}
+	return pair
+}
+
+// playGame plays a game between the engines until it's decided by the rules.
+// An error means an engine failed to play a legal move.
+func (worker *selfPlayWorker) playGame(white int, black int, fen string) (*Game, error) {
+	engines := &worker.match.engines
+	game := &Game{
+		tags: map[string]string{
+			"Event": "Self-play",
+			"Site":  "?",
+			"Date":  time.Now().Format("2006.01.02"),
+			"White": engines[white].name,
+			"Black": engines[black].name,
+		},
+		initialFEN: fen,
+	}
+
+	// Each engine searches a board of its own, with its evaluation parameters
+	gameBoard := &worker.gameBoard
+	if err := gameBoard.ResetFromFENString(fen); err != nil {
+		return nil, err
+	}
+	for i := range worker.engineBoards {
+		if err := worker.engineBoards[i].ResetFromFENString(fen); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		legalMoves := GenerateLegalMoves(gameBoard)
+		if result, reason := adjudicateSelfPlayGame(gameBoard, legalMoves); result != "" {
+			game.result = result
+			game.resultComment = reason
+			return game, nil
+		}
+
+		engine := white
+		if gameBoard.sideToMove == BLACK_OFFSET {
+			engine = black
+		}
+		result := worker.search(&worker.engineBoards[engine], &engines[engine])
+		move := result.move
+		isLegal := false
+		for _, legalMove := range legalMoves {
+			isLegal = isLegal || legalMove == move
+		}
+		if !isLegal {
+			return game, fmt.Errorf("%s played an illegal move %s in %s", engines[engine].name,
+				MoveToXboardString(move), gameBoard.ToFENString())
+		}
+
+		game.moves = append(game.moves, move)
+		game.comments = append(game.comments, searchResultComment(result, gameBoard.sideToMove))
+
+		gameBoard.ApplyMove(move)
+		for i := range worker.engineBoards {
+			worker.engineBoards[i].ApplyMove(move)
+		}
+	}
+}
+
+func (worker *selfPlayWorker) search(boardState *BoardState, engine *SelfPlayEngine) SearchResult {
+	options := worker.match.options
+	config := ExternalSearchConfig{searchToDepth: options.depth, features: engine.features}
+	thinkingTimeMs := options.thinkingTimeMs
+	if options.depth != 0 {
+		thinkingTimeMs = NO_TIME_LIMIT
+	}
+
+	result := thinkAndWait(boardState, thinkingTimeMs, config, func(ThinkingOutput) {})
+	if result.move == 0 {
+		// The time ran out before the first iteration finished
+		stats := SearchStats{}
+		result = SearchWithConfig(boardState, 1, &stats, &SearchMoveInfo{}, config, nil)
+	}
+	return result
+}
+
+// adjudicateSelfPlayGame returns the result and the reason when the game is over
+// by checkmate, stalemate, threefold repetition, the fifty-move rule or
+// insufficient material, and "" otherwise.
+func adjudicateSelfPlayGame(boardState *BoardState, legalMoves []Move) (string, string) {
+	if len(legalMoves) == 0 {
+		if !boardState.IsInCheck(boardState.sideToMove) {
+			return "1/2-1/2", "Stalemate"
+		} else if boardState.sideToMove == WHITE_OFFSET {
+			return "0-1", "Black mates"
+		}
+		return "1-0", "White mates"
+	}
+	if boardState.RepetitionCount(3) {
+		return "1/2-1/2", "Threefold repetition"
+	}
+	if boardState.halfmoveClock >= 100 {
+		return "1/2-1/2", "Fifty-move rule"
+	}
+	if hasInsufficientMaterial(boardState) {
+		return "1/2-1/2", "Insufficient material"
+	}
+	return "", ""
+}
+
+// hasInsufficientMaterial returns true when neither side can mate: a king and at
+// most one minor piece against a king, or only bishops on squares of one colour.
+func hasInsufficientMaterial(boardState *BoardState) bool {
+	if isTriviallyDrawn(boardCounts(boardState)) {
+		return true
+	}
+
+	pieces := &boardState.bitboards.piece
+	if pieces[PAWN_MASK]|pieces[KNIGHT_MASK]|pieces[ROOK_MASK]|pieces[QUEEN_MASK] != 0 {
+		return false
+	}
+	bishops := pieces[BISHOP_MASK]
+	return bishops&darkSquares == 0 || bishops&^darkSquares == 0
+}
+
+// SelfPlayScore is the W/D/L of the test engine.
+type SelfPlayScore struct {
+	wins   int
+	draws  int
+	losses int
+}
+
+func (score *SelfPlayScore) Add(pair *SelfPlayPair) {
+	for _, points := range pair.scores {
+		switch points {
+		case 1:
+			score.wins++
+		case 0:
+			score.losses++
+		default:
+			score.draws++
+		}
+	}
+}
+
+func (score *SelfPlayScore) String() string {
+	elo, margin := EloEstimate(score.wins, score.draws, score.losses)
+	return fmt.Sprintf("%d/%d/%d (W/D/L)  Elo %.1f +/- %.1f", score.wins, score.draws, score.losses, elo, margin)
+}
+
+// createSelfPlayPGN empties the PGN file, if one is set, for the games of a new
+// match.
+func createSelfPlayPGN(pgnFile string) error {
+	if pgnFile == "" {
+		return nil
+	}
+	return os.WriteFile(pgnFile, nil, 0644)
+}
+
+func appendSelfPlayPGN(pgnFile string, pair *SelfPlayPair) error {
+	if pgnFile == "" {
+		return nil
+	}
+	for _, game := range pair.games {
+		if err := AppendPGNFile(pgnFile, game); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunSelfPlay plays the match, writing every game to the PGN file and printing
+// the score of the test engine as the games finish.
+func RunSelfPlay(openingsFile string, epdRegex string, base SelfPlayEngine, test SelfPlayEngine,
+	options SelfPlayOptions) (bool, error) {
+	match, err := NewSelfPlayMatch(openingsFile, epdRegex, base, test, options)
+	if err != nil {
+		return false, err
+	}
+	if err := createSelfPlayPGN(options.pgnFile); err != nil {
+		return false, err
+	}
+
+	var score SelfPlayScore
+	var playErr error
+	match.Play(int(options.games+1)/2, func(pair *SelfPlayPair) bool {
+		if pair.err != nil {
+			playErr = pair.err
+			return false
+		}
+		if playErr = appendSelfPlayPGN(options.pgnFile, pair); playErr != nil {
+			return false
+		}
+
+		for _, game := range pair.games {
+			fmt.Printf("Game %s: %s - %s %s {%s}\n", game.tags["Round"], game.tags["White"], game.tags["Black"],
+				game.result, game.resultComment)
+		}
+		score.Add(pair)
+		fmt.Printf("Score of %s vs %s: %s\n", test.name, base.name, score.String())
+		return true
+	})
+	if playErr != nil {
+		return false, playErr
+	}
+
+	if options.pgnFile != "" {
+		fmt.Printf("Games written to %s\n", options.pgnFile)
+	}
+	return true, nil
+}
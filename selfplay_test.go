@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdjudicateSelfPlayGame(t *testing.T) {
+	for fen, expected := range map[string][2]string{
+		"7k/5Q2/6K1/8/8/8/8/8 b - -":                           {"1/2-1/2", "Stalemate"},
+		"R5k1/5ppp/8/8/8/8/8/4K3 b - -":                        {"1-0", "White mates"},
+		"8/8/8/4k3/8/8/8/R3K3 w - - 100 80":                    {"1/2-1/2", "Fifty-move rule"},
+		"8/8/8/4k3/8/8/8/2B1K3 w - -":                          {"1/2-1/2", "Insufficient material"},
+		"5b2/8/8/4k3/8/8/8/2B1K3 w - -":                        {"1/2-1/2", "Insufficient material"},
+		"4b3/8/8/4k3/8/8/8/2B1K3 w - -":                        {"", ""},
+		"8/8/8/4k3/8/8/8/R3K3 w - - 99 80":                     {"", ""},
+		"6k1/5ppp/8/8/8/8/8/R3K3 w - - 0 1":                    {"", ""},
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq -": {"", ""},
+	} {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err)
+		result, reason := adjudicateSelfPlayGame(&boardState, GenerateLegalMoves(&boardState))
+		assert.Equal(t, expected, [2]string{result, reason}, fen)
+	}
+
+	boardState := CreateInitialBoardState()
+	moves, err := VariationToMoveList("Nf3 Nf6 Ng1 Ng8 Nf3 Nf6 Ng1 Ng8", &boardState)
+	assert.Nil(t, err)
+	for i, move := range moves {
+		result, _ := adjudicateSelfPlayGame(&boardState, GenerateLegalMoves(&boardState))
+		assert.Equal(t, "", result, i)
+		boardState.ApplyMove(move)
+	}
+	result, reason := adjudicateSelfPlayGame(&boardState, GenerateLegalMoves(&boardState))
+	assert.Equal(t, "1/2-1/2", result)
+	assert.Equal(t, "Threefold repetition", reason)
+}
+
+func TestRunSelfPlay(t *testing.T) {
+	openings := writeTestFile(t, "openings.epd",
+		"6k1/5ppp/8/8/8/8/8/R3K3 w - - id \"mate in one\";\n"+
+			"8/8/8/4k3/8/8/8/2B1K3 w - - id \"drawn\";\n")
+	pgnFile := filepath.Join(t.TempDir(), "games.pgn")
+	base := SelfPlayEngine{name: "base", evalParams: evalParams}
+	test := SelfPlayEngine{name: "test", evalParams: evalParams, features: SearchFeatures{noNullMove: true}}
+	options := SelfPlayOptions{games: 4, depth: 2, threads: 2, pgnFile: pgnFile}
+
+	success, err := RunSelfPlay(openings, "", base, test, options)
+	assert.Nil(t, err)
+	assert.True(t, success)
+
+	file, err := os.Open(pgnFile)
+	assert.Nil(t, err)
+	defer file.Close()
+	games, err := ReadPGNGames(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(games))
+
+	// The first opening is won by whoever has white, the second is drawn
+	byRound := make(map[string]*Game)
+	for _, game := range games {
+		byRound[game.tags["Round"]] = game
+	}
+	assert.Equal(t, "test", byRound["1.1"].tags["White"])
+	assert.Equal(t, "1-0", byRound["1.1"].result)
+	assert.Equal(t, 1, len(byRound["1.1"].moves))
+	assert.Equal(t, "base", byRound["1.2"].tags["White"])
+	assert.Equal(t, "1-0", byRound["1.2"].result)
+	assert.Equal(t, "1/2-1/2", byRound["2.1"].result)
+	assert.Equal(t, 0, len(byRound["2.2"].moves))
+}
+
+func TestSelfPlayMatchStops(t *testing.T) {
+	openings := writeTestFile(t, "openings.epd", "8/8/8/4k3/8/8/8/2B1K3 w - -\n")
+	base := SelfPlayEngine{name: "base"}
+	match, err := NewSelfPlayMatch(openings, "", base, base, SelfPlayOptions{depth: 1, threads: 3})
+	assert.Nil(t, err)
+
+	pairs := 0
+	match.Play(0, func(pair *SelfPlayPair) bool {
+		assert.Nil(t, pair.err)
+		assert.Equal(t, 1.0, pair.Score())
+		pairs++
+		return pairs < 5
+	})
+	assert.Equal(t, 5, pairs)
+}
+
+func TestSelfPlaySearchToDepth(t *testing.T) {
+	openings := writeTestFile(t, "openings.epd", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq -\n")
+	base := SelfPlayEngine{name: "base"}
+	match, err := NewSelfPlayMatch(openings, "", base, base, SelfPlayOptions{depth: 5})
+	assert.Nil(t, err)
+
+	worker := newSelfPlayWorker(match)
+	boardState := CreateInitialBoardState()
+	result := worker.search(&boardState, &base)
+	assert.Equal(t, uint(5), result.depth)
+	assert.NotEqual(t, Move(0), result.move)
+}
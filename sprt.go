@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Sequential probability ratio test between two engine configurations.  Game
+// pairs are played until the log-likelihood ratio of H1 (the test engine is
+// elo1 better) against H0 (it's elo0 better) crosses one of the bounds given by
+// the error rates alpha and beta.
+
+// SPRTResult is the outcome of a test, and the exit status of --sprt.  An error
+// exits with SPRT_EXIT_ERROR.
+type SPRTResult int
+
+const (
+	SPRT_H1_ACCEPTED SPRTResult = iota
+	SPRT_H0_ACCEPTED
+	// Stopped at maxPairs before either bound was crossed
+	SPRT_UNDECIDED
+)
+
+const SPRT_EXIT_ERROR = 3
+
+type SPRTOptions struct {
+	elo0  float64
+	elo1  float64
+	alpha float64
+	beta  float64
+	// Stop without a result after this many pairs (0 for no limit)
+	maxPairs int
+	// Pairs between progress reports
+	reportInterval int
+}
+
+// Pentanomial counts game pairs by the test engine's points over both games:
+// 0, 0.5, 1, 1.5 or 2.  Counting pairs rather than games accounts for the
+// correlation between the two games of an opening.
+type Pentanomial [5]int
+
+func (pentanomial *Pentanomial) Add(pairScore float64) {
+	pentanomial[int(math.Round(pairScore*2))]++
+}
+
+func (pentanomial *Pentanomial) Pairs() int {
+	pairs := 0
+	for _, count := range pentanomial {
+		pairs += count
+	}
+	return pairs
+}
+
+// LLR returns the log-likelihood ratio of elo1 against elo0, using the normal
+// approximation of the generalized SPRT.  Until the pair scores vary there's
+// nothing to go on, and the LLR is 0.
+func (pentanomial *Pentanomial) LLR(elo0 float64, elo1 float64) float64 {
+	pairs := float64(pentanomial.Pairs())
+	if pairs == 0 {
+		return 0
+	}
+
+	var mean float64
+	for i, count := range pentanomial {
+		mean += float64(count) * float64(i) / 4
+	}
+	mean /= pairs
+	var variance float64
+	for i, count := range pentanomial {
+		deviation := float64(i)/4 - mean
+		variance += float64(count) * deviation * deviation
+	}
+	variance /= pairs
+	if variance == 0 {
+		return 0
+	}
+
+	score0 := ExpectedScore(elo0)
+	score1 := ExpectedScore(elo1)
+	return pairs * (score1 - score0) * (2*mean - score0 - score1) / (2 * variance)
+}
+
+// SPRTBounds returns the LLR below which H0 is accepted and above which H1 is.
+func SPRTBounds(alpha float64, beta float64) (float64, float64) {
+	return math.Log(beta / (1 - alpha)), math.Log((1 - beta) / alpha)
+}
+
+// sprtDecision returns the result for the LLR between the bounds.
+func sprtDecision(llr float64, lower float64, upper float64) SPRTResult {
+	switch {
+	case llr >= upper:
+		return SPRT_H1_ACCEPTED
+	case llr <= lower:
+		return SPRT_H0_ACCEPTED
+	default:
+		return SPRT_UNDECIDED
+	}
+}
+
+// RunSPRT plays the test until it finishes, and returns which hypothesis was
+// accepted, so the exit status can gate a change.
+func RunSPRT(openingsFile string, epdRegex string, base SelfPlayEngine, test SelfPlayEngine,
+	options SelfPlayOptions, sprtOptions SPRTOptions) (SPRTResult, error) {
+	if sprtOptions.elo1 <= sprtOptions.elo0 {
+		return SPRT_UNDECIDED, errors.New("SPRT elo1 must be greater than elo0")
+	}
+	if sprtOptions.alpha <= 0 || sprtOptions.alpha >= 1 || sprtOptions.beta <= 0 || sprtOptions.beta >= 1 {
+		return SPRT_UNDECIDED, errors.New("SPRT alpha and beta must be between 0 and 1")
+	}
+	match, err := NewSelfPlayMatch(openingsFile, epdRegex, base, test, options)
+	if err != nil {
+		return SPRT_UNDECIDED, err
+	}
+	if err := createSelfPlayPGN(options.pgnFile); err != nil {
+		return SPRT_UNDECIDED, err
+	}
+
+	lower, upper := SPRTBounds(sprtOptions.alpha, sprtOptions.beta)
+	reportInterval := sprtOptions.reportInterval
+	if reportInterval <= 0 {
+		reportInterval = 1
+	}
+	fmt.Printf("SPRT %s vs %s: elo0=%.1f elo1=%.1f alpha=%.3f beta=%.3f, LLR bounds (%.2f, %.2f)\n",
+		test.name, base.name, sprtOptions.elo0, sprtOptions.elo1, sprtOptions.alpha, sprtOptions.beta, lower, upper)
+
+	var pentanomial Pentanomial
+	var score SelfPlayScore
+	var llr float64
+	var playErr error
+	match.Play(sprtOptions.maxPairs, func(pair *SelfPlayPair) bool {
+		if pair.err != nil {
+			playErr = pair.err
+			return false
+		}
+		if playErr = appendSelfPlayPGN(options.pgnFile, pair); playErr != nil {
+			return false
+		}
+
+		pentanomial.Add(pair.Score())
+		score.Add(pair)
+		llr = pentanomial.LLR(sprtOptions.elo0, sprtOptions.elo1)
+		finished := sprtDecision(llr, lower, upper) != SPRT_UNDECIDED
+		if finished || pentanomial.Pairs()%reportInterval == 0 {
+			fmt.Printf("Pairs %d: %s  pentanomial %v  LLR %.2f (%.2f, %.2f)\n",
+				pentanomial.Pairs(), score.String(), pentanomial, llr, lower, upper)
+		}
+		return !finished
+	})
+	if playErr != nil {
+		return SPRT_UNDECIDED, playErr
+	}
+
+	result := sprtDecision(llr, lower, upper)
+	switch result {
+	case SPRT_H1_ACCEPTED:
+		fmt.Printf("H1 accepted: %s gains at least %.1f Elo\n", test.name, sprtOptions.elo1)
+	case SPRT_H0_ACCEPTED:
+		fmt.Printf("H0 accepted: %s gains at most %.1f Elo\n", test.name, sprtOptions.elo0)
+	default:
+		fmt.Printf("No result after %d pairs\n", pentanomial.Pairs())
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPentanomial(t *testing.T) {
+	var pentanomial Pentanomial
+	for _, score := range []float64{0, 0.5, 1, 1, 1.5, 2} {
+		pentanomial.Add(score)
+	}
+	assert.Equal(t, Pentanomial{1, 1, 2, 1, 1}, pentanomial)
+	assert.Equal(t, 6, pentanomial.Pairs())
+
+	// Identical pair scores give no variance to go on
+	assert.Equal(t, 0.0, (&Pentanomial{0, 0, 50, 0, 0}).LLR(0, 5))
+
+	even := Pentanomial{10, 20, 40, 20, 10}
+	variance := (10*0.25 + 20*0.0625 + 20*0.0625 + 10*0.25) / 100
+	score1 := ExpectedScore(5)
+	expected := 100 * (score1 - 0.5) * (1 - 0.5 - score1) / (2 * variance)
+	assert.InDelta(t, expected, even.LLR(0, 5), 1e-9)
+	assert.Less(t, even.LLR(0, 5), 0.0)
+
+	strong := Pentanomial{0, 5, 20, 40, 35}
+	assert.Greater(t, strong.LLR(0, 5), 2.95)
+	weak := Pentanomial{35, 40, 20, 5, 0}
+	assert.Less(t, weak.LLR(0, 5), -2.95)
+}
+
+func TestSPRTBounds(t *testing.T) {
+	lower, upper := SPRTBounds(0.05, 0.05)
+	assert.InDelta(t, -math.Log(19), lower, 1e-9)
+	assert.InDelta(t, math.Log(19), upper, 1e-9)
+}
+
+func TestSPRTDecision(t *testing.T) {
+	lower, upper := SPRTBounds(0.05, 0.05)
+	assert.Equal(t, SPRT_H1_ACCEPTED, sprtDecision(upper, lower, upper))
+	assert.Equal(t, SPRT_H0_ACCEPTED, sprtDecision(lower-0.1, lower, upper))
+	assert.Equal(t, SPRT_UNDECIDED, sprtDecision(0, lower, upper))
+
+	// The exit statuses of --sprt
+	assert.Equal(t, 0, int(SPRT_H1_ACCEPTED))
+	assert.Equal(t, 1, int(SPRT_H0_ACCEPTED))
+	assert.Equal(t, 2, int(SPRT_UNDECIDED))
+	assert.Equal(t, 3, SPRT_EXIT_ERROR)
+}
+
+func TestRunSPRT(t *testing.T) {
+	openings := writeTestFile(t, "openings.epd", "8/8/8/4k3/8/8/8/2B1K3 w - -\n")
+	base := SelfPlayEngine{name: "base", evalParams: evalParams}
+	options := SelfPlayOptions{depth: 1, threads: 2}
+
+	// Drawn games can't decide anything, so it stops at the limit
+	result, err := RunSPRT(openings, "", base, base, options,
+		SPRTOptions{elo0: 0, elo1: 5, alpha: 0.05, beta: 0.05, maxPairs: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, SPRT_UNDECIDED, result)
+
+	_, err = RunSPRT(openings, "", base, base, options, SPRTOptions{elo0: 5, elo1: 0, alpha: 0.05, beta: 0.05})
+	assert.NotNil(t, err)
+	_, err = RunSPRT(openings, "", base, base, options, SPRTOptions{elo0: 0, elo1: 5, alpha: 0, beta: 0.05})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,1262 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Probing of Syzygy endgame tablebases.  Each table has two files: the .rtbw file
+// holds the win/draw/loss (WDL) result of every position, and the .rtbz file the
+// distance to zeroing (DTZ): the number of plies to the next capture or pawn move
+// (or mate) with best play, which is what's needed to convert a win without
+// running into the fifty-move rule.
+//
+// The file layout, indexing and decompression follow the reference prober (as
+// used by Stockfish and Fathom):
+//
+//   - The pieces are split into groups.  The leading group (the first three
+//     unique pieces, both kings, or the pawns of one color) is encoded with the
+//     board's symmetry taken out; the remaining groups are placed on the squares
+//     left over, identical pieces together, as binomial coefficients.
+//   - The values are Huffman-coded symbols, each of which expands into a run of
+//     values through "recursive pairing", packed into fixed-size blocks.  A sparse
+//     index points into the blocks every few thousand positions.
+//
+// Tables are registered when the directory is scanned and only read from disk
+// the first time they're probed.
+//
+// The tables don't store positions with castling rights, and only resolve en
+// passant and captures through a small search, so every probe goes through
+// syzygySearch rather than straight to the table.
+
+const SYZYGY_MAX_PIECES = 7
+const SYZYGY_WDL_EXTENSION = ".rtbw"
+const SYZYGY_DTZ_EXTENSION = ".rtbz"
+
+// WDL results, from the side to move's point of view.  A cursed win is a win that
+// takes too long to reach a capture or pawn move, so is a draw under the
+// fifty-move rule; a blessed loss is the other side of one.
+const (
+	SYZYGY_LOSS         = -2
+	SYZYGY_BLESSED_LOSS = -1
+	SYZYGY_DRAW         = 0
+	SYZYGY_CURSED_WIN   = 1
+	SYZYGY_WIN          = 2
+)
+
+// SYZYGY_WIN_SCORE is the search score of a tablebase win: above anything the
+// evaluation returns, below the mate scores.
+const SYZYGY_WIN_SCORE = CHECKMATE_SCORE - 1000
+
+// SYZYGY_MAX_DTZ ranks the root moves; it's larger than any DTZ in the tables.
+const SYZYGY_MAX_DTZ = 1 << 18
+
+var syzygyWDLMagic = []byte{0x71, 0xE8, 0x23, 0x5D}
+var syzygyDTZMagic = []byte{0xD7, 0x66, 0x0C, 0xA5}
+
+// Flags stored in the first byte of a file
+const (
+	syzygySplit    = 1
+	syzygyHasPawns = 2
+)
+
+// Flags stored with each block of compressed data
+const (
+	syzygyFlagSTM         = 1
+	syzygyFlagMapped      = 2
+	syzygyFlagWinPlies    = 4
+	syzygyFlagLossPlies   = 8
+	syzygyFlagWide        = 16
+	syzygyFlagSingleValue = 128
+)
+
+type syzygyState int
+
+const (
+	syzygyFail syzygyState = iota
+	syzygyOK
+	// The DTZ table only stores the other side to move
+	syzygyChangeSTM
+	// The best move is a capture or pawn move, so the table value can't be used
+	syzygyZeroingBestMove
+)
+
+// syzygyPairsData is the compressed data (and the piece order) of one table:
+// one side to move, and one file of the leading pawn for tables with pawns.
+type syzygyPairsData struct {
+	flags    byte
+	pieces   [SYZYGY_MAX_PIECES]byte
+	groupLen [SYZYGY_MAX_PIECES + 1]int
+	groupIdx [SYZYGY_MAX_PIECES + 1]uint64
+
+	blockSize       int
+	span            uint64
+	numBlocks       int
+	minSymLen       int
+	lowestSym       []byte
+	base64          []uint64
+	symlen          []uint8
+	btree           []byte
+	sparseIndex     []byte
+	sparseIndexSize int
+	blockLength     []byte
+	blockLengthSize int
+	data            []byte
+
+	// Offsets into the file of the DTZ value maps, by WDL result
+	mapIdx [4]int
+}
+
+type syzygyFile struct {
+	filename string
+	once     sync.Once
+	err      error
+	data     []byte
+	sides    int
+	items    [2][4]syzygyPairsData
+}
+
+type syzygyTable struct {
+	signature       string
+	key             uint64
+	key2            uint64
+	pieceCount      int
+	hasPawns        bool
+	hasUniquePieces bool
+	// Pawns of the leading color, then of the other color
+	pawnCount [2]int
+	wdl       syzygyFile
+	dtz       syzygyFile
+}
+
+// syzygyTables holds every table found on the SyzygyPath, keyed by the material
+// key of both colorings.
+var syzygyTables = make(map[uint64]*syzygyTable)
+var syzygyMaxPieces = 0
+
+type syzygyEncodingTables struct {
+	binomial      [SYZYGY_MAX_PIECES][64]uint64
+	mapA1D1D4     [64]int
+	mapB1H1H7     [64]int
+	mapKK         [10][64]int
+	mapPawns      [64]int
+	leadPawnIdx   [SYZYGY_MAX_PIECES][64]uint64
+	leadPawnsSize [SYZYGY_MAX_PIECES][4]uint64
+}
+
+var syzygyEncoding = createSyzygyEncodingTables()
+
+func createSyzygyEncodingTables() *syzygyEncodingTables {
+	tables := &syzygyEncodingTables{}
+
+	for n := 0; n < 64; n++ {
+		tables.binomial[0][n] = 1
+		for k := 1; k < SYZYGY_MAX_PIECES && k <= n; k++ {
+			tables.binomial[k][n] = tables.binomial[k-1][n-1] + tables.binomial[k][n-1]
+		}
+	}
+
+	// The squares below the a1-h8 diagonal map to 0..27
+	code := 0
+	for sq := byte(0); sq < 64; sq++ {
+		if syzygyOffDiagonal(sq) < 0 {
+			tables.mapB1H1H7[sq] = code
+			code++
+		}
+	}
+
+	// The b1-d1-d3 triangle maps to 0..5, then the a1-d4 diagonal to 6..9
+	code = 0
+	var diagonal []byte
+	for sq := SQUARE_A1; sq <= SQUARE_D4; sq++ {
+		if squareFile(sq) > 3 {
+			continue
+		}
+		if syzygyOffDiagonal(sq) < 0 {
+			tables.mapA1D1D4[sq] = code
+			code++
+		} else if syzygyOffDiagonal(sq) == 0 {
+			diagonal = append(diagonal, sq)
+		}
+	}
+	for _, sq := range diagonal {
+		tables.mapA1D1D4[sq] = code
+		code++
+	}
+
+	// The 462 legal placements of two kings with the first in the a1-d1-d4
+	// triangle (and the second not above the diagonal when the first is on it).
+	// Placements with both kings on the diagonal come last.
+	type kingPair struct {
+		index int
+		sq    byte
+	}
+	var bothOnDiagonal []kingPair
+	code = 0
+	for index := 0; index < 10; index++ {
+		for first := SQUARE_A1; first <= SQUARE_D4; first++ {
+			if squareFile(first) > 3 || syzygyOffDiagonal(first) > 0 || tables.mapA1D1D4[first] != index {
+				continue
+			}
+			for second := byte(0); second < 64; second++ {
+				switch {
+				case squareDistance(first, second) <= 1:
+				case syzygyOffDiagonal(first) == 0 && syzygyOffDiagonal(second) > 0:
+				case syzygyOffDiagonal(first) == 0 && syzygyOffDiagonal(second) == 0:
+					bothOnDiagonal = append(bothOnDiagonal, kingPair{index, second})
+				default:
+					tables.mapKK[index][second] = code
+					code++
+				}
+			}
+		}
+	}
+	for _, pair := range bothOnDiagonal {
+		tables.mapKK[pair.index][pair.sq] = code
+		code++
+	}
+
+	// The leading pawn is the one nearest the edge, then nearest the second rank.  The other leading pawns can't be placed below it or closer to
+	// the edge, which leaves 47 squares for a pawn on a2, 45 on a3 and so on.
+	available := 47
+	for count := 1; count < SYZYGY_MAX_PIECES; count++ {
+		for file := byte(0); file < 4; file++ {
+			var index uint64
+			for rank := byte(1); rank <= 6; rank++ {
+				sq := idx(file, rank)
+				if count == 1 {
+					tables.mapPawns[sq] = available
+					available--
+					tables.mapPawns[sq^7] = available
+					available--
+				}
+				tables.leadPawnIdx[count][sq] = index
+				index += tables.binomial[count-1][tables.mapPawns[sq]]
+			}
+			tables.leadPawnsSize[count][file] = index
+		}
+	}
+
+	return tables
+}
+
+// syzygyOffDiagonal is positive above the a1-h8 diagonal, negative below it.
+func syzygyOffDiagonal(sq byte) int {
+	return int(squareRank(sq)) - int(squareFile(sq))
+}
+
+func syzygyEdgeDistance(file int) int {
+	return Min(file, 7-file)
+}
+
+func syzygySign(value int) int {
+	switch {
+	case value > 0:
+		return 1
+	case value < 0:
+		return -1
+	}
+	return 0
+}
+
+// LoadSyzygyTables registers the tables in path, a list of directories separated
+// like $PATH.  An empty path unloads the tables.
+func LoadSyzygyTables(path string) (int, error) {
+	tables := make(map[uint64]*syzygyTable)
+	maxPieces := 0
+	count := 0
+
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return 0, err
+		}
+		filenames, err := filepath.Glob(filepath.Join(dir, "*"+SYZYGY_WDL_EXTENSION))
+		if err != nil {
+			return 0, err
+		}
+		for _, filename := range filenames {
+			signature := strings.TrimSuffix(filepath.Base(filename), SYZYGY_WDL_EXTENSION)
+			table, err := newSyzygyTable(signature, dir)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %s", filename, err)
+			}
+			if _, ok := tables[table.key]; ok {
+				continue
+			}
+			tables[table.key] = table
+			tables[table.key2] = table
+			maxPieces = Max(maxPieces, table.pieceCount)
+			count++
+		}
+	}
+
+	syzygyTables = tables
+	syzygyMaxPieces = maxPieces
+	return count, nil
+}
+
+func newSyzygyTable(signature string, dir string) (*syzygyTable, error) {
+	counts, err := ParseMaterialSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &syzygyTable{
+		signature: signature,
+		key:       materialKeyFromCounts(counts),
+		key2:      materialKeyFromCounts(flipCounts(counts)),
+	}
+	table.wdl.filename = filepath.Join(dir, signature+SYZYGY_WDL_EXTENSION)
+	table.dtz.filename = filepath.Join(dir, signature+SYZYGY_DTZ_EXTENSION)
+
+	for _, side := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		for piece := PAWN_MASK; piece <= KING_MASK; piece++ {
+			table.pieceCount += counts[side][piece]
+			if piece != KING_MASK && counts[side][piece] == 1 {
+				table.hasUniquePieces = true
+			}
+		}
+	}
+	if table.pieceCount > SYZYGY_MAX_PIECES {
+		return nil, fmt.Errorf("Syzygy tables are limited to %d pieces", SYZYGY_MAX_PIECES)
+	}
+
+	// The leading color is the one with fewer pawns (but some), which compresses
+	// better.
+	whitePawns, blackPawns := counts[WHITE_OFFSET][PAWN_MASK], counts[BLACK_OFFSET][PAWN_MASK]
+	table.hasPawns = whitePawns+blackPawns > 0
+	if blackPawns == 0 || (whitePawns > 0 && blackPawns >= whitePawns) {
+		table.pawnCount = [2]int{whitePawns, blackPawns}
+	} else {
+		table.pawnCount = [2]int{blackPawns, whitePawns}
+	}
+
+	return table, nil
+}
+
+func (table *syzygyTable) files() int {
+	if table.hasPawns {
+		return 4
+	}
+	return 1
+}
+
+func (file *syzygyFile) get(sideToMove int, tbFile int) *syzygyPairsData {
+	return &file.items[sideToMove%file.sides][tbFile]
+}
+
+// load reads and parses the WDL or DTZ file the first time it's needed.
+func (table *syzygyTable) load(isDTZ bool) (*syzygyFile, error) {
+	file := &table.wdl
+	if isDTZ {
+		file = &table.dtz
+	}
+	file.once.Do(func() {
+		file.err = table.read(file, isDTZ)
+		if file.err != nil {
+			logger.Println(file.err)
+		}
+	})
+	return file, file.err
+}
+
+func (table *syzygyTable) read(file *syzygyFile, isDTZ bool) error {
+	data, err := os.ReadFile(file.filename)
+	if err != nil {
+		return err
+	}
+
+	magic := syzygyWDLMagic
+	if isDTZ {
+		magic = syzygyDTZMagic
+	}
+	if len(data) < 5 || string(data[:4]) != string(magic) {
+		return fmt.Errorf("%s: not a Syzygy table", file.filename)
+	}
+	if err := table.parse(file, data, isDTZ); err != nil {
+		return fmt.Errorf("%s: %s", file.filename, err)
+	}
+
+	return nil
+}
+
+// syzygyReader reads the little-endian values of a table file, failing (and
+// returning zeros) once it runs past the end.
+type syzygyReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+var errSyzygyTruncated = errors.New("Truncated table")
+
+func (reader *syzygyReader) bytes(n int) []byte {
+	if reader.err != nil || n < 0 || reader.pos+n > len(reader.data) {
+		reader.err = errSyzygyTruncated
+		return make([]byte, Max(n, 0))
+	}
+	b := reader.data[reader.pos : reader.pos+n]
+	reader.pos += n
+	return b
+}
+
+func (reader *syzygyReader) byte() byte {
+	return reader.bytes(1)[0]
+}
+
+func (reader *syzygyReader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(reader.bytes(2))
+}
+
+func (reader *syzygyReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(reader.bytes(4))
+}
+
+func (reader *syzygyReader) align(n int) {
+	if padding := (n - reader.pos%n) % n; padding > 0 {
+		reader.bytes(padding)
+	}
+}
+
+func (table *syzygyTable) parse(file *syzygyFile, data []byte, isDTZ bool) error {
+	reader := &syzygyReader{data: data, pos: 4}
+	flags := reader.byte()
+	if (flags&syzygyHasPawns != 0) != table.hasPawns || (flags&syzygySplit != 0) != (table.key != table.key2) {
+		return errors.New("Table doesn't match its material signature")
+	}
+
+	file.data = data
+	file.sides = 1
+	if !isDTZ && table.key != table.key2 {
+		file.sides = 2
+	}
+
+	// The piece order of each table, and the order in which the groups are
+	// encoded
+	bothPawns := table.hasPawns && table.pawnCount[1] > 0
+	for f := 0; f < table.files(); f++ {
+		order := reader.byte()
+		order2 := byte(0xFF)
+		if bothPawns {
+			order2 = reader.byte()
+		}
+		for k := 0; k < table.pieceCount; k++ {
+			pieces := reader.byte()
+			file.items[0][f].pieces[k] = pieces & 0xF
+			file.items[1][f].pieces[k] = pieces >> 4
+		}
+		for i := 0; i < file.sides; i++ {
+			shift := uint(4 * i)
+			table.setGroups(&file.items[i][f], [2]int{int(order>>shift) & 0xF, int(order2>>shift) & 0xF}, f)
+		}
+	}
+	reader.align(2)
+
+	for f := 0; f < table.files(); f++ {
+		for i := 0; i < file.sides; i++ {
+			if err := reader.readSizes(&file.items[i][f]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if isDTZ {
+		for f := 0; f < table.files(); f++ {
+			d := file.get(0, f)
+			if d.flags&syzygyFlagMapped == 0 {
+				continue
+			}
+			// Four lists of values, by WDL result, each preceded by its length
+			for i := 0; i < 4; i++ {
+				if d.flags&syzygyFlagWide != 0 {
+					reader.align(2)
+					d.mapIdx[i] = reader.pos + 2
+					reader.bytes(2 * int(reader.uint16()))
+				} else {
+					d.mapIdx[i] = reader.pos + 1
+					reader.bytes(int(reader.byte()))
+				}
+			}
+		}
+		reader.align(2)
+	}
+
+	for f := 0; f < table.files(); f++ {
+		for i := 0; i < file.sides; i++ {
+			d := &file.items[i][f]
+			d.sparseIndex = reader.bytes(6 * d.sparseIndexSize)
+		}
+	}
+	for f := 0; f < table.files(); f++ {
+		for i := 0; i < file.sides; i++ {
+			d := &file.items[i][f]
+			d.blockLength = reader.bytes(2 * d.blockLengthSize)
+		}
+	}
+	for f := 0; f < table.files(); f++ {
+		for i := 0; i < file.sides; i++ {
+			d := &file.items[i][f]
+			if d.flags&syzygyFlagSingleValue != 0 {
+				continue
+			}
+			reader.align(64)
+			d.data = reader.bytes(d.numBlocks * d.blockSize)
+		}
+	}
+
+	return reader.err
+}
+
+// setGroups splits the pieces into groups and works out the multiplier of each
+// group's index.  The groups aren't necessarily encoded in piece order: order
+// gives the position of the leading group and of the second color's pawns.
+func (table *syzygyTable) setGroups(d *syzygyPairsData, order [2]int, f int) {
+	firstLen := 2
+	if table.hasPawns {
+		firstLen = 0
+	} else if table.hasUniquePieces {
+		firstLen = 3
+	}
+
+	n := 0
+	d.groupLen[n] = 1
+	for i := 1; i < table.pieceCount; i++ {
+		firstLen--
+		if firstLen > 0 || d.pieces[i] == d.pieces[i-1] {
+			d.groupLen[n]++
+		} else {
+			n++
+			d.groupLen[n] = 1
+		}
+	}
+	n++
+	d.groupLen[n] = 0
+
+	bothPawns := table.hasPawns && table.pawnCount[1] > 0
+	next := 1
+	freeSquares := 64 - d.groupLen[0]
+	if bothPawns {
+		next = 2
+		freeSquares -= d.groupLen[1]
+	}
+
+	var index uint64 = 1
+	for k := 0; next < n || k == order[0] || k == order[1]; k++ {
+		switch {
+		case k == order[0]:
+			d.groupIdx[0] = index
+			switch {
+			case table.hasPawns:
+				index *= syzygyEncoding.leadPawnsSize[d.groupLen[0]][f]
+			case table.hasUniquePieces:
+				index *= 31332
+			default:
+				index *= 462
+			}
+		case k == order[1]:
+			d.groupIdx[1] = index
+			index *= syzygyEncoding.binomial[d.groupLen[1]][48-d.groupLen[0]]
+		default:
+			d.groupIdx[next] = index
+			index *= syzygyEncoding.binomial[d.groupLen[next]][freeSquares]
+			freeSquares -= d.groupLen[next]
+			next++
+		}
+	}
+	d.groupIdx[n] = index
+}
+
+// size is the number of positions in the table.
+func (d *syzygyPairsData) size() uint64 {
+	n := 0
+	for d.groupLen[n] != 0 {
+		n++
+	}
+	return d.groupIdx[n]
+}
+
+// readSizes reads the header of the compressed data: the block sizes and the
+// canonical Huffman code of the symbols.
+func (reader *syzygyReader) readSizes(d *syzygyPairsData) error {
+	d.flags = reader.byte()
+	if d.flags&syzygyFlagSingleValue != 0 {
+		// Every position has the same value, which is stored in place of the
+		// symbol length
+		d.minSymLen = int(reader.byte())
+		return reader.err
+	}
+
+	d.blockSize = 1 << reader.byte()
+	d.span = 1 << reader.byte()
+	d.sparseIndexSize = int((d.size() + d.span - 1) / d.span)
+	padding := int(reader.byte())
+	d.numBlocks = int(reader.uint32())
+	d.blockLengthSize = d.numBlocks + padding
+	maxSymLen := int(reader.byte())
+	d.minSymLen = int(reader.byte())
+	if d.minSymLen < 1 || maxSymLen < d.minSymLen || maxSymLen > 32 {
+		return errors.New("Invalid symbol lengths")
+	}
+	d.lowestSym = reader.bytes(2 * (maxSymLen - d.minSymLen + 1))
+
+	// Codes are ordered so that longer codes have lower values.  base64[i] is the
+	// lowest code of length minSymLen+i, left-justified in 64 bits, so a code of
+	// that length is the first i with bits >= base64[i].
+	d.base64 = make([]uint64, maxSymLen-d.minSymLen+1)
+	for i := len(d.base64) - 2; i >= 0; i-- {
+		d.base64[i] = (d.base64[i+1] + uint64(d.lowestSymbol(i)) - uint64(d.lowestSymbol(i+1))) / 2
+	}
+	for i := range d.base64 {
+		d.base64[i] <<= uint(64 - i - d.minSymLen)
+	}
+
+	symbols := int(reader.uint16())
+	d.btree = reader.bytes(3 * symbols)
+	reader.bytes(symbols & 1)
+	if reader.err != nil {
+		return reader.err
+	}
+
+	// Each symbol is either a value or a pair of symbols.  symlen is the number of
+	// values it expands to, less one.
+	d.symlen = make([]uint8, symbols)
+	visited := make([]bool, symbols)
+	for sym := 0; sym < symbols; sym++ {
+		right := d.right(sym)
+		if right != 0xFFF && (d.left(sym) >= symbols || right >= symbols) {
+			return errors.New("Invalid symbol")
+		}
+	}
+	for sym := 0; sym < symbols; sym++ {
+		if !visited[sym] {
+			d.symlen[sym] = d.setSymlen(sym, visited)
+		}
+	}
+
+	return nil
+}
+
+func (d *syzygyPairsData) setSymlen(sym int, visited []bool) uint8 {
+	visited[sym] = true
+	right := d.right(sym)
+	if right == 0xFFF {
+		return 0
+	}
+	left := d.left(sym)
+	if !visited[left] {
+		d.symlen[left] = d.setSymlen(left, visited)
+	}
+	if !visited[right] {
+		d.symlen[right] = d.setSymlen(right, visited)
+	}
+	return d.symlen[left] + d.symlen[right] + 1
+}
+
+func (d *syzygyPairsData) lowestSymbol(i int) int {
+	return int(binary.LittleEndian.Uint16(d.lowestSym[2*i:]))
+}
+
+// left is the first symbol of a pair, or the value of a single symbol.
+func (d *syzygyPairsData) left(sym int) int {
+	return int(d.btree[3*sym+1]&0xF)<<8 | int(d.btree[3*sym])
+}
+
+func (d *syzygyPairsData) right(sym int) int {
+	return int(d.btree[3*sym+2])<<4 | int(d.btree[3*sym+1]>>4)
+}
+
+func (d *syzygyPairsData) blockLengthAt(block int) int {
+	return int(binary.LittleEndian.Uint16(d.blockLength[2*block:]))
+}
+
+// dataBytes reads big-endian bits of the compressed data, as zeros past the end.
+func (d *syzygyPairsData) dataBytes(pos int, n int) uint64 {
+	var value uint64
+	for i := 0; i < n; i++ {
+		value <<= 8
+		if pos+i < len(d.data) {
+			value |= uint64(d.data[pos+i])
+		}
+	}
+	return value
+}
+
+// decompress returns the value stored for the index.
+func (d *syzygyPairsData) decompress(index uint64) (int, bool) {
+	if d.flags&syzygyFlagSingleValue != 0 {
+		return d.minSymLen, true
+	}
+
+	// The sparse index gives the block and offset of the position in the middle of
+	// each span.  From there, walk through the blocks (each stores blockLength+1
+	// values) to the one with the index.
+	k := index / d.span
+	if k >= uint64(d.sparseIndexSize) {
+		return 0, false
+	}
+	block := int(binary.LittleEndian.Uint32(d.sparseIndex[6*k:]))
+	offset := int(binary.LittleEndian.Uint16(d.sparseIndex[6*k+4:]))
+	offset += int(index%d.span) - int(d.span/2)
+
+	for offset < 0 {
+		block--
+		if block < 0 {
+			return 0, false
+		}
+		offset += d.blockLengthAt(block) + 1
+	}
+	for {
+		if block >= d.blockLengthSize {
+			return 0, false
+		}
+		length := d.blockLengthAt(block)
+		if offset <= length {
+			break
+		}
+		offset -= length + 1
+		block++
+	}
+	if block >= d.numBlocks {
+		return 0, false
+	}
+
+	// Decode symbols until reaching the one that covers the offset
+	pos := block * d.blockSize
+	buf := d.dataBytes(pos, 8)
+	pos += 8
+	bufSize := 64
+	var sym int
+	for {
+		length := 0
+		for length < len(d.base64)-1 && buf < d.base64[length] {
+			length++
+		}
+		sym = int((buf-d.base64[length])>>uint(64-length-d.minSymLen)) + d.lowestSymbol(length)
+		if sym >= len(d.symlen) {
+			return 0, false
+		}
+		if offset < int(d.symlen[sym])+1 {
+			break
+		}
+		offset -= int(d.symlen[sym]) + 1
+
+		length += d.minSymLen
+		buf <<= uint(length)
+		bufSize -= length
+		if bufSize <= 32 {
+			bufSize += 32
+			buf |= d.dataBytes(pos, 4) << uint(64-bufSize)
+			pos += 4
+		}
+	}
+
+	// Then expand the pairs down to the value
+	for d.symlen[sym] != 0 {
+		left := d.left(sym)
+		if offset < int(d.symlen[left])+1 {
+			sym = left
+		} else {
+			offset -= int(d.symlen[left]) + 1
+			sym = d.right(sym)
+		}
+	}
+
+	return d.left(sym), true
+}
+
+// encode finds the table and index of the position.  The colors are flipped if
+// the table's white pieces are black on the board (or for symmetric material
+// with black to move); the board is mirrored so that the leading piece or pawn
+// is in the a1-d1-d4 triangle or on files a-d.
+func (table *syzygyTable) encode(file *syzygyFile, boardState *BoardState, isDTZ bool) (*syzygyPairsData, int, uint64, syzygyState) {
+	key := materialKeyFromCounts(boardCounts(boardState))
+	flipColor := key != table.key || (table.key == table.key2 && boardState.sideToMove == BLACK_OFFSET)
+	sideToMove := boardState.sideToMove
+	var flipSquares, flipPiece byte
+	if flipColor {
+		sideToMove = oppositeColorOffset(sideToMove)
+		flipSquares = 56
+		flipPiece = 8
+	}
+
+	var squares, pieces [SYZYGY_MAX_PIECES]byte
+	size := 0
+	tbFile := 0
+	var leadPawns uint64
+	if table.hasPawns {
+		leadColor := int((file.items[0][0].pieces[0] ^ flipPiece) >> 3)
+		leadPawns = boardState.bitboards.piece[PAWN_MASK] & boardState.bitboards.color[leadColor]
+		for pawns := leadPawns; pawns != 0; pawns &= pawns - 1 {
+			squares[size] = byte(bits.TrailingZeros64(pawns)) ^ flipSquares
+			size++
+		}
+		lead := 0
+		for i := 1; i < size; i++ {
+			if syzygyEncoding.mapPawns[squares[i]] > syzygyEncoding.mapPawns[squares[lead]] {
+				lead = i
+			}
+		}
+		squares[0], squares[lead] = squares[lead], squares[0]
+		tbFile = syzygyEdgeDistance(int(squareFile(squares[0])))
+	}
+	leadPawnsCount := size
+
+	if isDTZ && int(file.get(sideToMove, tbFile).flags&syzygyFlagSTM) != sideToMove &&
+		(table.key != table.key2 || table.hasPawns) {
+		return nil, 0, 0, syzygyChangeSTM
+	}
+
+	for occupied := boardState.GetAllOccupanciesBitboard() &^ leadPawns; occupied != 0; occupied &= occupied - 1 {
+		sq := byte(bits.TrailingZeros64(occupied))
+		piece := boardState.PieceAtSquare(sq)
+		code := piece & 0x7
+		if piece&BLACK_MASK != 0 {
+			code |= 8
+		}
+		squares[size] = sq ^ flipSquares
+		pieces[size] = code ^ flipPiece
+		size++
+	}
+
+	d := file.get(sideToMove, tbFile)
+
+	// Put the pieces in the table's order
+	for i := leadPawnsCount; i < size-1; i++ {
+		for j := i + 1; j < size; j++ {
+			if d.pieces[i] == pieces[j] {
+				pieces[i], pieces[j] = pieces[j], pieces[i]
+				squares[i], squares[j] = squares[j], squares[i]
+				break
+			}
+		}
+	}
+
+	if squareFile(squares[0]) > 3 {
+		for i := 0; i < size; i++ {
+			squares[i] ^= 7
+		}
+	}
+
+	var index uint64
+	if table.hasPawns {
+		index = syzygyEncoding.leadPawnIdx[leadPawnsCount][squares[0]]
+		leading := squares[1:leadPawnsCount]
+		for i := 1; i < len(leading); i++ {
+			for j := i; j > 0 && syzygyEncoding.mapPawns[leading[j]] < syzygyEncoding.mapPawns[leading[j-1]]; j-- {
+				leading[j], leading[j-1] = leading[j-1], leading[j]
+			}
+		}
+		for i := 1; i < leadPawnsCount; i++ {
+			index += syzygyEncoding.binomial[i][syzygyEncoding.mapPawns[squares[i]]]
+		}
+	} else {
+		if squareRank(squares[0]) > 3 {
+			for i := 0; i < size; i++ {
+				squares[i] ^= 56
+			}
+		}
+		// Mirror on the diagonal so that the first piece of the leading group off
+		// it is below it
+		for i := 0; i < d.groupLen[0]; i++ {
+			off := syzygyOffDiagonal(squares[i])
+			if off == 0 {
+				continue
+			}
+			if off > 0 {
+				for j := i; j < size; j++ {
+					squares[j] = (squares[j]>>3 | squares[j]<<3) & 63
+				}
+			}
+			break
+		}
+		index = table.leadingPiecesIndex(squares[:size])
+	}
+	index *= d.groupIdx[0]
+
+	// The other groups, each sorted by square and with the squares taken by the
+	// groups before them removed
+	start := d.groupLen[0]
+	remainingPawns := table.hasPawns && table.pawnCount[1] > 0
+	for next := 1; d.groupLen[next] != 0; next++ {
+		group := squares[start : start+d.groupLen[next]]
+		for i := 1; i < len(group); i++ {
+			for j := i; j > 0 && group[j] < group[j-1]; j-- {
+				group[j], group[j-1] = group[j-1], group[j]
+			}
+		}
+
+		var n uint64
+		for i, sq := range group {
+			adjust := 0
+			for _, other := range squares[:start] {
+				if sq > other {
+					adjust++
+				}
+			}
+			if remainingPawns {
+				adjust += 8
+			}
+			n += syzygyEncoding.binomial[i+1][int(sq)-adjust]
+		}
+		remainingPawns = false
+		index += n * d.groupIdx[next]
+		start += d.groupLen[next]
+	}
+
+	return d, tbFile, index, syzygyOK
+}
+
+// leadingPiecesIndex encodes the leading group of a table without pawns: three
+// unique pieces, or the two kings.
+func (table *syzygyTable) leadingPiecesIndex(squares []byte) uint64 {
+	encoding := syzygyEncoding
+	if !table.hasUniquePieces {
+		return uint64(encoding.mapKK[encoding.mapA1D1D4[squares[0]]][squares[1]])
+	}
+
+	adjust1 := 0
+	if squares[1] > squares[0] {
+		adjust1 = 1
+	}
+	adjust2 := 0
+	if squares[2] > squares[0] {
+		adjust2++
+	}
+	if squares[2] > squares[1] {
+		adjust2++
+	}
+	rank0, rank1, rank2 := int(squareRank(squares[0])), int(squareRank(squares[1])), int(squareRank(squares[2]))
+
+	switch {
+	case syzygyOffDiagonal(squares[0]) != 0:
+		return uint64((encoding.mapA1D1D4[squares[0]]*63+int(squares[1])-adjust1)*62 + int(squares[2]) - adjust2)
+	case syzygyOffDiagonal(squares[1]) != 0:
+		return uint64((6*63+rank0*28+encoding.mapB1H1H7[squares[1]])*62 + int(squares[2]) - adjust2)
+	case syzygyOffDiagonal(squares[2]) != 0:
+		return uint64(6*63*62 + 4*28*62 + rank0*7*28 + (rank1-adjust1)*28 + encoding.mapB1H1H7[squares[2]])
+	}
+	return uint64(6*63*62 + 4*28*62 + 4*7*28 + rank0*7*6 + (rank1-adjust1)*6 + rank2 - adjust2)
+}
+
+// probeTable looks the position up in the WDL or DTZ table, without resolving
+// captures.  For DTZ, wdl is the position's WDL result.
+func probeSyzygyTable(boardState *BoardState, isDTZ bool, wdl int) (int, syzygyState) {
+	if bits.OnesCount64(boardState.GetAllOccupanciesBitboard()) == 2 {
+		// King against king
+		return 0, syzygyOK
+	}
+
+	table, ok := syzygyTables[materialKeyFromCounts(boardCounts(boardState))]
+	if !ok {
+		return 0, syzygyFail
+	}
+	file, err := table.load(isDTZ)
+	if err != nil {
+		return 0, syzygyFail
+	}
+
+	d, tbFile, index, state := table.encode(file, boardState, isDTZ)
+	if state != syzygyOK {
+		return 0, state
+	}
+	value, ok := d.decompress(index)
+	if !ok {
+		return 0, syzygyFail
+	}
+
+	if !isDTZ {
+		return value - 2, syzygyOK
+	}
+	return file.mapDTZ(file.get(0, tbFile), value, wdl), syzygyOK
+}
+
+// mapDTZ converts a stored DTZ value into plies.
+func (file *syzygyFile) mapDTZ(d *syzygyPairsData, value int, wdl int) int {
+	if d.flags&syzygyFlagMapped != 0 {
+		mapIdx := d.mapIdx[[]int{1, 3, 0, 2, 0}[wdl+2]]
+		if d.flags&syzygyFlagWide != 0 {
+			if pos := mapIdx + 2*value; pos+2 <= len(file.data) {
+				value = int(binary.LittleEndian.Uint16(file.data[pos:]))
+			}
+		} else if pos := mapIdx + value; pos < len(file.data) {
+			value = int(file.data[pos])
+		}
+	}
+
+	// Some tables store moves rather than plies
+	if (wdl == SYZYGY_WIN && d.flags&syzygyFlagWinPlies == 0) ||
+		(wdl == SYZYGY_LOSS && d.flags&syzygyFlagLossPlies == 0) ||
+		wdl == SYZYGY_CURSED_WIN || wdl == SYZYGY_BLESSED_LOSS {
+		value *= 2
+	}
+
+	return value + 1
+}
+
+func isZeroingMove(boardState *BoardState, move Move) bool {
+	return move.Flags()&CAPTURE_MASK != 0 || boardState.bitboards.piece[PAWN_MASK]&(1<<move.From()) != 0
+}
+
+// syzygySearch plays the captures (and, if checkZeroingMoves is set, the pawn
+// moves) before probing the WDL table.  The tables may store any value for
+// positions where such a move is best, and know nothing of en passant.  The
+// state is syzygyZeroingBestMove if one of those moves is at least as good as the
+// table's result.
+func syzygySearch(boardState *BoardState, checkZeroingMoves bool) (int, syzygyState) {
+	bestValue := SYZYGY_LOSS
+	moves := GenerateLegalMoves(boardState)
+	moveCount := 0
+
+	for _, move := range moves {
+		if move.Flags()&CAPTURE_MASK == 0 && (!checkZeroingMoves || !isZeroingMove(boardState, move)) {
+			continue
+		}
+		moveCount++
+
+		boardState.ApplyMove(move)
+		value, state := syzygySearch(boardState, false)
+		boardState.UnapplyMove(move)
+		if state == syzygyFail {
+			return SYZYGY_DRAW, syzygyFail
+		}
+
+		if -value > bestValue {
+			bestValue = -value
+			if bestValue >= SYZYGY_WIN {
+				return bestValue, syzygyZeroingBestMove
+			}
+		}
+	}
+
+	// If every move has been searched the table isn't needed (and the stored value
+	// could be wrong, e.g. if the only move is an en passant capture).
+	noMoreMoves := moveCount > 0 && moveCount == len(moves)
+	value := bestValue
+	if !noMoreMoves {
+		var state syzygyState
+		value, state = probeSyzygyTable(boardState, false, 0)
+		if state == syzygyFail {
+			return SYZYGY_DRAW, syzygyFail
+		}
+	}
+
+	if bestValue >= value {
+		if bestValue > SYZYGY_DRAW || noMoreMoves {
+			return bestValue, syzygyZeroingBestMove
+		}
+		return bestValue, syzygyOK
+	}
+	return value, syzygyOK
+}
+
+// ProbeSyzygyWDL returns the WDL result for the side to move.
+func ProbeSyzygyWDL(boardState *BoardState) (int, bool) {
+	value, state := syzygySearch(boardState, false)
+	return value, state != syzygyFail
+}
+
+// dtzBeforeZeroing is the DTZ of a position where the best move is a capture or
+// pawn move with the given result.
+func dtzBeforeZeroing(wdl int) int {
+	switch wdl {
+	case SYZYGY_WIN:
+		return 1
+	case SYZYGY_CURSED_WIN:
+		return 101
+	case SYZYGY_BLESSED_LOSS:
+		return -101
+	case SYZYGY_LOSS:
+		return -1
+	}
+	return 0
+}
+
+// ProbeSyzygyDTZ returns the DTZ of the position in plies: positive for a win,
+// negative for a loss and 0 for a draw.  Cursed wins and blessed losses are more
+// than 100 plies from zeroing.
+func ProbeSyzygyDTZ(boardState *BoardState) (int, bool) {
+	return probeSyzygyDTZ(boardState, true)
+}
+
+func probeSyzygyDTZ(boardState *BoardState, allowSearch bool) (int, bool) {
+	wdl, state := syzygySearch(boardState, true)
+	if state == syzygyFail {
+		return 0, false
+	}
+	if wdl == SYZYGY_DRAW {
+		return 0, true
+	}
+	if state == syzygyZeroingBestMove {
+		return dtzBeforeZeroing(wdl), true
+	}
+
+	dtz, state := probeSyzygyTable(boardState, true, wdl)
+	if state == syzygyFail {
+		return 0, false
+	}
+	if state != syzygyChangeSTM {
+		if wdl == SYZYGY_CURSED_WIN || wdl == SYZYGY_BLESSED_LOSS {
+			dtz += 100
+		}
+		return dtz * syzygySign(wdl), true
+	}
+	if !allowSearch {
+		return 0, false
+	}
+
+	// The table only has the other side to move, so search one ply: the best DTZ
+	// of the moves that keep the result.
+	minDTZ := 0xFFFF
+	for _, move := range GenerateLegalMoves(boardState) {
+		zeroing := isZeroingMove(boardState, move)
+		boardState.ApplyMove(move)
+
+		var dtz int
+		var ok bool
+		if zeroing {
+			var value int
+			value, ok = ProbeSyzygyWDL(boardState)
+			dtz = -dtzBeforeZeroing(value)
+		} else {
+			dtz, ok = probeSyzygyDTZ(boardState, false)
+			dtz = -dtz
+		}
+		if dtz == 1 && boardState.IsCheckmate() {
+			minDTZ = 1
+		}
+		boardState.UnapplyMove(move)
+		if !ok {
+			return 0, false
+		}
+
+		if !zeroing {
+			dtz += syzygySign(dtz)
+		}
+		if dtz < minDTZ && syzygySign(dtz) == syzygySign(wdl) {
+			minDTZ = dtz
+		}
+	}
+
+	if minDTZ == 0xFFFF {
+		// No legal moves: checkmate
+		return -1, true
+	}
+	return minDTZ, true
+}
+
+// canProbeSyzygy is true if the position could be in a table.
+func canProbeSyzygy(boardState *BoardState) bool {
+	return len(syzygyTables) > 0 &&
+		bits.OnesCount64(boardState.GetAllOccupanciesBitboard()) <= syzygyMaxPieces &&
+		!boardState.boardInfo.whiteCanCastleKingside && !boardState.boardInfo.whiteCanCastleQueenside &&
+		!boardState.boardInfo.blackCanCastleKingside && !boardState.boardInfo.blackCanCastleQueenside
+}
+
+// probeSyzygyScore converts a WDL result into a search score.  Cursed wins and
+// blessed losses are scored as (nearly) draws.  The WDL tables assume the
+// fifty-move count starts from zero, so only positions right after a capture or
+// pawn move are probed.
+func probeSyzygyScore(boardState *BoardState, currentDepth uint) (int16, bool) {
+	if boardState.halfmoveClock != 0 || !canProbeSyzygy(boardState) {
+		return 0, false
+	}
+	wdl, ok := ProbeSyzygyWDL(boardState)
+	if !ok {
+		return 0, false
+	}
+	return syzygyWDLScore(wdl, currentDepth), true
+}
+
+func syzygyWDLScore(wdl int, currentDepth uint) int16 {
+	switch wdl {
+	case SYZYGY_WIN:
+		return int16(SYZYGY_WIN_SCORE - int(currentDepth))
+	case SYZYGY_LOSS:
+		return -int16(SYZYGY_WIN_SCORE - int(currentDepth))
+	}
+	return int16(syzygySign(wdl))
+}
+
+// probeSyzygyRoot picks the root move with the DTZ tables.  Wins that can be
+// converted before the fifty-move rule runs out are played with the shortest
+// DTZ, losses are dragged out as long as possible, and otherwise a win that the
+// fifty-move rule turns into a draw is still preferred to a plain draw.
+func probeSyzygyRoot(boardState *BoardState) (Move, int16, bool) {
+	if !canProbeSyzygy(boardState) {
+		return 0, 0, false
+	}
+
+	fiftyMoveCount := int(boardState.halfmoveClock)
+	var bestMove Move
+	bestRank := -SYZYGY_MAX_DTZ - 1
+	var bestScore int16
+	for _, move := range GenerateLegalMoves(boardState) {
+		zeroing := isZeroingMove(boardState, move)
+		boardState.ApplyMove(move)
+
+		// The DTZ counted from the root position
+		var dtz int
+		var ok bool
+		if zeroing {
+			var wdl int
+			wdl, ok = ProbeSyzygyWDL(boardState)
+			dtz = dtzBeforeZeroing(-wdl)
+		} else {
+			dtz, ok = ProbeSyzygyDTZ(boardState)
+			dtz = -dtz
+			dtz += syzygySign(dtz)
+		}
+		if dtz == 2 && boardState.IsCheckmate() {
+			dtz = 1
+		}
+		boardState.UnapplyMove(move)
+		if !ok {
+			return 0, 0, false
+		}
+
+		var rank int
+		var score int16
+		switch {
+		case dtz > 0 && dtz+fiftyMoveCount <= 100:
+			rank = SYZYGY_MAX_DTZ - dtz
+			score = int16(SYZYGY_WIN_SCORE - dtz)
+		case dtz > 0:
+			rank = SYZYGY_MAX_DTZ - dtz - fiftyMoveCount
+			score = 1
+		case dtz < 0 && -dtz+fiftyMoveCount <= 100:
+			rank = -SYZYGY_MAX_DTZ - dtz
+			score = -int16(SYZYGY_WIN_SCORE + dtz)
+		case dtz < 0:
+			rank = -SYZYGY_MAX_DTZ - dtz + fiftyMoveCount
+			score = -1
+		}
+		if rank > bestRank {
+			bestRank = rank
+			bestMove = move
+			bestScore = score
+		}
+	}
+
+	if bestMove == 0 {
+		return 0, 0, false
+	}
+	return bestMove, bestScore, true
+}
+
+// probeRootTables picks the root move from the DTM tables if they cover the
+// position, otherwise from the Syzygy tables.
+func probeRootTables(boardState *BoardState, moves []Move, start int) (Move, int16, bool) {
+	if move, score, ok := probeTablebaseRoot(boardState, moves, start); ok {
+		return move, score, true
+	}
+	return probeSyzygyRoot(boardState)
+}
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// Tables from the Syzygy distribution, see testdata/syzygy/README.md
+	SYZYGY_TESTDATA = "testdata/syzygy"
+	// Tables written from the DTM tables by TestWriteSyzygyTestdata
+	SYZYGY_GENERATED_TESTDATA = "testdata/syzygy-generated"
+)
+
+var syzygyTestSignatures = []string{"KQvK", "KRvK", "KBvK", "KNvK", "KPvK"}
+
+var updateSyzygy = flag.Bool("update-syzygy", false, "Regenerate the Syzygy tables in "+SYZYGY_GENERATED_TESTDATA)
+
+// useSyzygyTables loads the tables for the test and restores the previous ones
+// afterwards.
+func useSyzygyTables(t *testing.T, path string) int {
+	previous, previousMaxPieces := syzygyTables, syzygyMaxPieces
+	t.Cleanup(func() {
+		syzygyTables, syzygyMaxPieces = previous, previousMaxPieces
+	})
+
+	count, err := LoadSyzygyTables(path)
+	assert.Nil(t, err)
+	return count
+}
+
+// forEachSyzygyTestSet runs the test with the real tables, and again with the
+// generated ones.  The real ones are skipped if they're missing.
+func forEachSyzygyTestSet(t *testing.T, f func(t *testing.T)) {
+	t.Run("real", func(t *testing.T) {
+		for _, signature := range syzygyTestSignatures {
+			for _, extension := range []string{SYZYGY_WDL_EXTENSION, SYZYGY_DTZ_EXTENSION} {
+				if _, err := os.Stat(filepath.Join(SYZYGY_TESTDATA, signature+extension)); err != nil {
+					t.Skipf("%s%s isn't in %s, see its README.md", signature, extension, SYZYGY_TESTDATA)
+				}
+			}
+		}
+		useSyzygyTables(t, SYZYGY_TESTDATA)
+		f(t)
+	})
+	t.Run("generated", func(t *testing.T) {
+		useSyzygyTables(t, SYZYGY_GENERATED_TESTDATA)
+		f(t)
+	})
+}
+
+func TestSyzygyEncodingTables(t *testing.T) {
+	encoding := syzygyEncoding
+
+	kingPairs := 0
+	for index := 0; index < 10; index++ {
+		for sq := 0; sq < 64; sq++ {
+			kingPairs = Max(kingPairs, encoding.mapKK[index][sq]+1)
+		}
+	}
+	assert.Equal(t, 462, kingPairs)
+
+	assert.Equal(t, uint64(6), encoding.leadPawnsSize[1][0])
+	assert.Equal(t, 47, encoding.mapPawns[SQUARE_A2])
+	assert.Equal(t, 46, encoding.mapPawns[SQUARE_H2])
+	assert.Equal(t, 0, encoding.mapPawns[SQUARE_E7])
+	assert.Equal(t, uint64(62*61/2), encoding.binomial[2][62])
+	assert.Equal(t, 9, encoding.mapA1D1D4[SQUARE_D4])
+	assert.Equal(t, 27, encoding.mapB1H1H7[SQUARE_H7])
+}
+
+func TestLoadSyzygyTables(t *testing.T) {
+	assert.Equal(t, len(syzygyTestSignatures), useSyzygyTables(t, SYZYGY_GENERATED_TESTDATA))
+	assert.Equal(t, 3, syzygyMaxPieces)
+
+	count, err := LoadSyzygyTables("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 0, len(syzygyTables))
+
+	_, err = LoadSyzygyTables("/nonexistent/syzygy")
+	assert.NotNil(t, err)
+
+	// A corrupt table fails when it's probed
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "KQvK.rtbw"), []byte("not a table"), 0644))
+	count, err = LoadSyzygyTables(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	boardState, _ := CreateBoardStateFromFENString("8/8/8/3k4/8/8/8/Q3K3 w - - 0 1")
+	_, ok := ProbeSyzygyWDL(&boardState)
+	assert.False(t, ok)
+}
+
+func TestSyzygyKnownPositions(t *testing.T) {
+	forEachSyzygyTestSet(t, func(t *testing.T) {
+		for _, test := range []struct {
+			fen string
+			wdl int
+			dtz int
+		}{
+			// Mate in one, and the other side to move
+			{"k7/8/1K6/8/8/8/8/7R w - - 0 1", SYZYGY_WIN, 1},
+			{"k7/8/1K6/8/8/8/8/7R b - - 0 1", SYZYGY_LOSS, 0},
+			// The queen can be taken or get away
+			{"8/8/8/8/8/2k5/1Q6/7K b - - 0 1", SYZYGY_DRAW, 0},
+			{"8/8/8/8/8/2k5/1Q6/7K w - - 0 1", SYZYGY_WIN, 0},
+			// Stalemate, and the pawn that can't be stopped
+			{"4k3/4P3/4K3/8/8/8/8/8 b - - 0 1", SYZYGY_DRAW, 0},
+			{"8/8/8/8/P7/8/7k/K7 w - - 0 1", SYZYGY_WIN, 1},
+			{"8/8/8/8/8/8/2k5/K1N5 w - - 0 1", SYZYGY_DRAW, 0},
+		} {
+			boardState, _ := CreateBoardStateFromFENString(test.fen)
+			wdl, ok := ProbeSyzygyWDL(&boardState)
+			assert.True(t, ok, test.fen)
+			assert.Equal(t, test.wdl, wdl, test.fen)
+
+			dtz, ok := ProbeSyzygyDTZ(&boardState)
+			assert.True(t, ok, test.fen)
+			assert.Equal(t, syzygySign(test.wdl), syzygySign(dtz), test.fen)
+			if test.dtz != 0 {
+				assert.Equal(t, test.dtz, dtz, test.fen)
+			}
+		}
+	})
+}
+
+// syzygyTestPositions calls f with every legal position in the DTM table, and the
+// same position with the colors reversed.
+func syzygyTestPositions(t *testing.T, tb *Tablebase, f func(boardState *BoardState, entry DTMEntry)) {
+	boardState, flipped := CreateEmptyBoardState(), CreateEmptyBoardState()
+	var occupied, flippedOccupied []byte
+	for index := 0; index < tb.size; index++ {
+		squares, sideToMove := tb.decode(index)
+		position := squares[:len(tb.slots)]
+		if !tb.isValidPlacement(position) || tb.canonicalIndex(position, sideToMove) != index {
+			continue
+		}
+		tb.setupBoard(&boardState, occupied, position, sideToMove)
+		occupied = append(occupied[:0], position...)
+		if boardState.IsInCheck(oppositeColorOffset(sideToMove)) {
+			continue
+		}
+		f(&boardState, tb.dtm[index])
+
+		for _, sq := range flippedOccupied {
+			flipped.SetPieceAtSquare(sq, EMPTY_SQUARE)
+		}
+		flippedOccupied = flippedOccupied[:0]
+		for _, sq := range position {
+			flipped.SetPieceAtSquare(sq^56, boardState.PieceAtSquare(sq)^(WHITE_MASK|BLACK_MASK))
+			flippedOccupied = append(flippedOccupied, sq^56)
+		}
+		flipped.sideToMove = oppositeColorOffset(sideToMove)
+		f(&flipped, tb.dtm[index])
+	}
+}
+
+func TestSyzygyWDLMatchesTablebase(t *testing.T) {
+	useTablebases(t, "KPvK")
+	forEachSyzygyTestSet(t, func(t *testing.T) {
+
+		for _, signature := range []string{"KQvK", "KRvK", "KPvK"} {
+			tb := findTablebaseForSignature(t, signature)
+			checked := 0
+			syzygyTestPositions(t, tb, func(boardState *BoardState, entry DTMEntry) {
+				wdl, ok := ProbeSyzygyWDL(boardState)
+				assert.True(t, ok)
+
+				expected := SYZYGY_DRAW
+				if entry.IsWin() {
+					expected = SYZYGY_WIN
+				} else if entry.IsLoss() {
+					expected = SYZYGY_LOSS
+				}
+				if wdl != expected {
+					assert.Equal(t, expected, wdl, boardState.ToFENString())
+				}
+				checked++
+			})
+			assert.True(t, checked > 10000, signature)
+		}
+
+		for _, fen := range []string{"8/8/8/3k4/8/8/8/B3K3 w - - 0 1", "8/8/8/3k4/8/8/8/4K2n b - - 0 1"} {
+			boardState, _ := CreateBoardStateFromFENString(fen)
+			wdl, ok := ProbeSyzygyWDL(&boardState)
+			assert.True(t, ok)
+			assert.Equal(t, SYZYGY_DRAW, wdl)
+		}
+	})
+}
+
+// Without captures or pawn moves, the DTZ of the tables without pawns is the
+// distance to mate.
+func TestSyzygyDTZMatchesTablebase(t *testing.T) {
+	useTablebases(t, "KQvK", "KRvK")
+	forEachSyzygyTestSet(t, func(t *testing.T) {
+
+		for _, signature := range []string{"KQvK", "KRvK"} {
+			tb := findTablebaseForSignature(t, signature)
+			syzygyTestPositions(t, tb, func(boardState *BoardState, entry DTMEntry) {
+				dtz, ok := ProbeSyzygyDTZ(boardState)
+				assert.True(t, ok)
+
+				expected := 0
+				switch {
+				case entry.IsWin():
+					expected = entry.Plies()
+				case entry.IsLoss():
+					expected = -Max(entry.Plies(), 1)
+				}
+				if dtz != expected {
+					assert.Equal(t, expected, dtz, boardState.ToFENString())
+				}
+			})
+		}
+	})
+}
+
+// TestSyzygyDTZIsConsistent checks the DTZ of every KPvK position against its
+// moves: a win has a move that keeps the win one ply closer to zeroing (or is a
+// winning capture or pawn move), and a loss only has moves to wins that are at
+// most one ply closer.  Every fifth position is checked, to keep the test quick.
+func TestSyzygyDTZIsConsistent(t *testing.T) {
+	useTablebases(t, "KPvK")
+	forEachSyzygyTestSet(t, func(t *testing.T) {
+
+		tb := findTablebaseForSignature(t, "KPvK")
+		positions := 0
+		syzygyTestPositions(t, tb, func(boardState *BoardState, entry DTMEntry) {
+			positions++
+			if positions%5 != 0 {
+				return
+			}
+			dtz, ok := ProbeSyzygyDTZ(boardState)
+			assert.True(t, ok)
+			if entry.IsDraw() {
+				assert.Equal(t, 0, dtz)
+				return
+			}
+
+			best := 0
+			for _, move := range GenerateLegalMoves(boardState) {
+				zeroing := isZeroingMove(boardState, move)
+				boardState.ApplyMove(move)
+				var result int
+				if zeroing {
+					wdl, _ := ProbeSyzygyWDL(boardState)
+					result = -dtzBeforeZeroing(wdl)
+				} else {
+					successor, _ := ProbeSyzygyDTZ(boardState)
+					result = -successor
+					result += syzygySign(result)
+					if boardState.IsCheckmate() {
+						result = 1
+					}
+				}
+				boardState.UnapplyMove(move)
+
+				if syzygySign(result) == syzygySign(dtz) && (best == 0 || result < best) {
+					best = result
+				}
+			}
+			if len(GenerateLegalMoves(boardState)) == 0 {
+				best = -1
+			}
+			if best != dtz {
+				assert.Equal(t, best, dtz, boardState.ToFENString())
+			}
+		})
+	})
+}
+
+func TestProbeSyzygyRoot(t *testing.T) {
+	forEachSyzygyTestSet(t, func(t *testing.T) {
+
+		// Mate in one is played
+		boardState, _ := CreateBoardStateFromFENString("k7/8/1K6/8/8/8/8/7R w - - 0 1")
+		move, score, ok := probeSyzygyRoot(&boardState)
+		assert.True(t, ok)
+		assert.Equal(t, "h1h8", MoveToXboardString(move))
+		assert.Equal(t, int16(SYZYGY_WIN_SCORE-1), score)
+
+		// The black king has to be driven to the edge: 31 plies to mate
+		fen := "8/8/8/3k4/8/8/8/R3K3 w - - %d 1"
+		boardState, _ = CreateBoardStateFromFENString(fmt.Sprintf(fen, 0))
+		dtz, ok := ProbeSyzygyDTZ(&boardState)
+		assert.True(t, ok)
+		assert.True(t, dtz > 20)
+
+		move, score, ok = probeSyzygyRoot(&boardState)
+		assert.True(t, ok)
+		assert.Equal(t, int16(SYZYGY_WIN_SCORE-dtz), score)
+		boardState.ApplyMove(move)
+		after, _ := ProbeSyzygyDTZ(&boardState)
+		assert.Equal(t, -(dtz - 1), after)
+		boardState.UnapplyMove(move)
+
+		// The fifty-move rule gets there first
+		boardState, _ = CreateBoardStateFromFENString(fmt.Sprintf(fen, 100-dtz+1))
+		_, score, ok = probeSyzygyRoot(&boardState)
+		assert.True(t, ok)
+		assert.Equal(t, int16(1), score)
+
+		boardState, _ = CreateBoardStateFromFENString(fmt.Sprintf(fen, 100-dtz))
+		_, score, ok = probeSyzygyRoot(&boardState)
+		assert.True(t, ok)
+		assert.Equal(t, int16(SYZYGY_WIN_SCORE-dtz), score)
+
+		// The losing side takes the longest way
+		boardState, _ = CreateBoardStateFromFENString("8/8/8/3k4/8/8/8/R3K3 b - - 0 1")
+		move, score, ok = probeSyzygyRoot(&boardState)
+		assert.True(t, ok)
+		dtz, _ = ProbeSyzygyDTZ(&boardState)
+		assert.Equal(t, int16(-(SYZYGY_WIN_SCORE + dtz)), score)
+		boardState.ApplyMove(move)
+		after, _ = ProbeSyzygyDTZ(&boardState)
+		assert.Equal(t, -dtz-1, after)
+		boardState.UnapplyMove(move)
+
+		// Castling rights keep the tables out
+		boardState, _ = CreateBoardStateFromFENString("8/8/8/3k4/8/8/8/R3K3 w Q - 0 1")
+		_, _, ok = probeSyzygyRoot(&boardState)
+		assert.False(t, ok)
+	})
+}
+
+func TestSearchUsesSyzygy(t *testing.T) {
+	forEachSyzygyTestSet(t, func(t *testing.T) {
+
+		// Winning the knight leaves KQvK
+		boardState, _ := CreateBoardStateFromFENString("8/8/8/3k4/8/8/1n6/Q3K3 w - - 0 1")
+		stats := SearchStats{}
+		result := Search(&boardState, 3, &stats, &SearchMoveInfo{})
+		assert.True(t, stats.tbhits > 0)
+		assert.True(t, result.value > SYZYGY_WIN_SCORE-100, result.value)
+		assert.Equal(t, "a1b2", MoveToXboardString(result.move))
+
+		// At the root the move comes straight from the tables
+		boardState, _ = CreateBoardStateFromFENString("8/8/8/3k4/8/8/8/Q3K3 w - - 0 1")
+		stats = SearchStats{}
+		result = Search(&boardState, 3, &stats, &SearchMoveInfo{})
+		assert.Equal(t, uint64(1), stats.tbhits)
+		assert.True(t, result.value > SYZYGY_WIN_SCORE-100)
+		boardState.ApplyMove(result.move)
+		wdl, _ := ProbeSyzygyWDL(&boardState)
+		assert.Equal(t, SYZYGY_LOSS, wdl)
+	})
+}
+
+func TestProbeSyzygyScoreAfterZeroingMove(t *testing.T) {
+	forEachSyzygyTestSet(t, func(t *testing.T) {
+
+		boardState, _ := CreateBoardStateFromFENString("8/8/8/3k4/8/8/1n6/Q3K3 w - - 3 1")
+		move, err := ParsePrettyMove("Qxb2", &boardState)
+		assert.Nil(t, err)
+		boardState.ApplyMove(move)
+		_, ok := probeSyzygyScore(&boardState, 1)
+		assert.True(t, ok)
+
+		// With moves since the capture the fifty-move rule could matter
+		move, err = ParsePrettyMove("Kc4", &boardState)
+		assert.Nil(t, err)
+		boardState.ApplyMove(move)
+		_, ok = probeSyzygyScore(&boardState, 2)
+		assert.False(t, ok)
+	})
+}
+
+func TestXboardSyzygyPathOption(t *testing.T) {
+	previous, previousMaxPieces := syzygyTables, syzygyMaxPieces
+	t.Cleanup(func() {
+		syzygyTables, syzygyMaxPieces = previous, previousMaxPieces
+	})
+
+	var state XboardState
+	_, state = ProcessXboardCommand("new", state)
+	action, state := ProcessXboardCommand("option SyzygyPath="+SYZYGY_GENERATED_TESTDATA, state)
+	assert.NotEqual(t, ACTION_ERROR, action)
+	assert.Equal(t, 3, syzygyMaxPieces)
+
+	action, _ = ProcessXboardCommand("option SyzygyPath=/nonexistent/syzygy", state)
+	assert.Equal(t, ACTION_ERROR, action)
+}
+
+// TestWriteSyzygyTestdata regenerates the tables in testdata/syzygy-generated
+// from the DTM tables (go test -run TestWriteSyzygyTestdata -update-syzygy).
+// The files are written in the Syzygy format with a simple encoding: one
+// Huffman-coded symbol per value, no pairs.  They only add a check that the
+// reader agrees with the writer; the real tables are what show it reads the
+// format.
+func TestWriteSyzygyTestdata(t *testing.T) {
+	if !*updateSyzygy {
+		t.Skip("Run with -update-syzygy to regenerate the tables")
+	}
+	useTablebases(t, "KPvK")
+	assert.Nil(t, os.MkdirAll(SYZYGY_GENERATED_TESTDATA, 0755))
+
+	for _, signature := range syzygyTestSignatures {
+		writeSyzygyTestTable(t, SYZYGY_GENERATED_TESTDATA, signature)
+	}
+}
+
+const (
+	syzygyTestBlockSize = 6
+	syzygyTestIdxBits   = 10
+)
+
+func writeSyzygyTestTable(t *testing.T, dir string, signature string) {
+	table, err := newSyzygyTable(signature, dir)
+	assert.Nil(t, err)
+	tb, err := NewTablebase(signature)
+	assert.Nil(t, err)
+
+	// The writer only handles three different pieces, in table order with a lone
+	// pawn moved to the front
+	var pieces []byte
+	for _, slot := range tb.slots {
+		pieces = append(pieces, byte(slot.color<<3)|slot.piece)
+	}
+	if table.hasPawns {
+		pieces[0], pieces[1] = pieces[1], pieces[0]
+	}
+
+	var files [2]*syzygyFile
+	for i, isDTZ := range []bool{false, true} {
+		file := &syzygyFile{sides: 1}
+		if !isDTZ && table.key != table.key2 {
+			file.sides = 2
+		}
+		for f := 0; f < table.files(); f++ {
+			for side := 0; side < file.sides; side++ {
+				d := &file.items[side][f]
+				copy(d.pieces[:], pieces)
+				table.setGroups(d, [2]int{0, 0xF}, f)
+			}
+		}
+		files[i] = file
+	}
+
+	wdl, dtz := solveSyzygyTestTable(t, tb)
+
+	// Place each position's values in the tables
+	var values [2][2][4][]int
+	for i, file := range files {
+		for side := 0; side < file.sides; side++ {
+			for f := 0; f < table.files(); f++ {
+				values[i][side][f] = make([]int, file.items[side][f].size())
+				for index := range values[i][side][f] {
+					values[i][side][f][index] = syzygyTestUnset
+				}
+			}
+		}
+	}
+	boardState := CreateEmptyBoardState()
+	var occupied []byte
+	for position := range wdl {
+		if wdl[position] == syzygyTestInvalid {
+			continue
+		}
+		squares, sideToMove := syzygyTestDecode(position, len(tb.slots))
+		tb.setupBoard(&boardState, occupied, squares, sideToMove)
+		occupied = squares
+
+		for i, file := range files {
+			d, tbFile, index, state := table.encode(file, &boardState, i == 1)
+			if state == syzygyChangeSTM {
+				continue
+			}
+			side := 0
+			if d != &file.items[0][tbFile] {
+				side = 1
+			}
+			value := int(wdl[position]) + 2
+			if i == 1 {
+				value = int(dtz[position])
+			}
+			stored := &values[i][side][tbFile][index]
+			if *stored != syzygyTestUnset && *stored != value {
+				t.Fatalf("%s: %s and another position share index %d", signature, tb.positionFen(squares, sideToMove), index)
+			}
+			*stored = value
+		}
+	}
+
+	for i, file := range files {
+		var buf bytes.Buffer
+		if i == 0 {
+			buf.Write(syzygyWDLMagic)
+		} else {
+			buf.Write(syzygyDTZMagic)
+		}
+		var flags byte
+		if table.key != table.key2 {
+			flags |= syzygySplit
+		}
+		if table.hasPawns {
+			flags |= syzygyHasPawns
+		}
+		buf.WriteByte(flags)
+		for f := 0; f < table.files(); f++ {
+			buf.WriteByte(0)
+			for _, piece := range pieces {
+				buf.WriteByte(piece | piece<<4)
+			}
+		}
+		syzygyTestAlign(&buf, 2)
+
+		// DTZ values are mapped: the symbol is the index of the value in the list for
+		// the position's result
+		var maps [4][][]int
+		var sections [2][4]*syzygyTestPairs
+		for f := 0; f < table.files(); f++ {
+			for side := 0; side < file.sides; side++ {
+				tableValues := values[i][side][f]
+				var tableFlags byte
+				if i == 1 {
+					tableFlags = syzygyFlagMapped | syzygyFlagWinPlies | syzygyFlagLossPlies
+					maps[f], tableValues = syzygyTestMapDTZ(tableValues)
+				} else {
+					for index, value := range tableValues {
+						if value == syzygyTestUnset {
+							tableValues[index] = -1
+						}
+					}
+				}
+				sections[side][f] = encodeSyzygyTestPairs(tableValues, tableFlags)
+				buf.Write(sections[side][f].header)
+			}
+		}
+		if i == 1 {
+			for f := 0; f < table.files(); f++ {
+				for _, list := range maps[f] {
+					buf.WriteByte(byte(len(list)))
+					for _, value := range list {
+						buf.WriteByte(byte(value))
+					}
+				}
+			}
+			syzygyTestAlign(&buf, 2)
+		}
+		for f := 0; f < table.files(); f++ {
+			for side := 0; side < file.sides; side++ {
+				buf.Write(sections[side][f].sparseIndex)
+			}
+		}
+		for f := 0; f < table.files(); f++ {
+			for side := 0; side < file.sides; side++ {
+				buf.Write(sections[side][f].blockLengths)
+			}
+		}
+		for f := 0; f < table.files(); f++ {
+			for side := 0; side < file.sides; side++ {
+				if len(sections[side][f].data) > 0 {
+					syzygyTestAlign(&buf, 64)
+					buf.Write(sections[side][f].data)
+				}
+			}
+		}
+
+		filename := table.wdl.filename
+		if i == 1 {
+			filename = table.dtz.filename
+		}
+		assert.Nil(t, os.WriteFile(filename, buf.Bytes(), 0644))
+	}
+}
+
+const syzygyTestInvalid = 127
+
+// syzygyTestUnset marks the table entries no position was stored in.
+const syzygyTestUnset = -1 << 20
+
+func syzygyTestDecode(position int, pieces int) ([]byte, int) {
+	squares := make([]byte, pieces)
+	for slot := range squares {
+		squares[slot] = byte(position >> uint(1+6*slot) & 63)
+	}
+	return squares, position & 1
+}
+
+func syzygyTestEncode(squares []byte, sideToMove int) int {
+	position := sideToMove
+	for slot, sq := range squares {
+		position |= int(sq) << uint(1+6*slot)
+	}
+	return position
+}
+
+// solveSyzygyTestTable works out the WDL and DTZ of every position (indexed by
+// the square of each piece) from the DTM tables, by retrograde analysis on the
+// moves that don't zero the fifty-move count.
+func solveSyzygyTestTable(t *testing.T, tb *Tablebase) ([]int8, []int16) {
+	positions := 2 << uint(6*len(tb.slots))
+	wdl := make([]int8, positions)
+	dtz := make([]int16, positions)
+	successors := make([][]int32, positions)
+
+	boardState := CreateEmptyBoardState()
+	var occupied []byte
+	for position := 0; position < positions; position++ {
+		squares, sideToMove := syzygyTestDecode(position, len(tb.slots))
+		wdl[position] = syzygyTestInvalid
+		if !tb.isValidPlacement(squares) {
+			continue
+		}
+		tb.setupBoard(&boardState, occupied, squares, sideToMove)
+		occupied = squares
+		if boardState.IsInCheck(oppositeColorOffset(sideToMove)) {
+			continue
+		}
+
+		entry, ok := ProbeTablebase(&boardState)
+		assert.True(t, ok)
+		switch {
+		case entry.IsWin():
+			wdl[position] = SYZYGY_WIN
+		case entry.IsLoss():
+			wdl[position] = SYZYGY_LOSS
+		default:
+			wdl[position] = SYZYGY_DRAW
+		}
+
+		moves := GenerateLegalMoves(&boardState)
+		if len(moves) == 0 && wdl[position] == SYZYGY_LOSS {
+			dtz[position] = -1
+		}
+		onlyZeroing := true
+		for _, move := range moves {
+			zeroing := isZeroingMove(&boardState, move)
+			boardState.ApplyMove(move)
+			if zeroing {
+				if successor, _ := ProbeTablebase(&boardState); successor.IsLoss() {
+					dtz[position] = 1
+				}
+			} else {
+				onlyZeroing = false
+				if boardState.IsCheckmate() {
+					dtz[position] = 1
+				}
+				successorSquares, successorSideToMove := tb.boardSquares(&boardState, false)
+				successors[position] = append(successors[position],
+					int32(syzygyTestEncode(successorSquares[:len(tb.slots)], successorSideToMove)))
+			}
+			boardState.UnapplyMove(move)
+		}
+		if wdl[position] == SYZYGY_LOSS && onlyZeroing {
+			dtz[position] = -1
+		}
+		if wdl[position] != SYZYGY_WIN && dtz[position] > 0 {
+			dtz[position] = 0
+		}
+	}
+
+	// A win is n plies from zeroing if it has a move to a loss n-1 plies away; a
+	// loss is n plies away if all of its moves go to wins and the furthest is n-1
+	for n := int16(2); ; n++ {
+		changed := false
+		for position := range wdl {
+			if dtz[position] != 0 {
+				continue
+			}
+			switch wdl[position] {
+			case SYZYGY_WIN:
+				for _, successor := range successors[position] {
+					if dtz[successor] == -(n - 1) {
+						dtz[position] = n
+						changed = true
+						break
+					}
+				}
+			case SYZYGY_LOSS:
+				furthest := int16(1)
+				for _, successor := range successors[position] {
+					if dtz[successor] <= 0 {
+						furthest = -1
+						break
+					}
+					furthest = int16(Max(int(furthest), int(dtz[successor])))
+				}
+				if furthest == n-1 {
+					dtz[position] = -n
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	for position := range wdl {
+		if (wdl[position] == SYZYGY_WIN || wdl[position] == SYZYGY_LOSS) && dtz[position] == 0 {
+			squares, sideToMove := syzygyTestDecode(position, len(tb.slots))
+			t.Fatalf("%s: no DTZ", tb.positionFen(squares, sideToMove))
+		}
+	}
+
+	return wdl, dtz
+}
+
+// syzygyTestMapDTZ builds the lists of DTZ values (less one) for wins and losses,
+// and replaces each DTZ with its index in its list.
+func syzygyTestMapDTZ(values []int) ([][]int, []int) {
+	lists := make([][]int, 4)
+	for _, value := range values {
+		if value == syzygyTestUnset || value == 0 {
+			continue
+		}
+		list := 0
+		if value < 0 {
+			list = 1
+		}
+		if magnitude := Abs(value) - 1; !containsInt(lists[list], magnitude) {
+			lists[list] = append(lists[list], magnitude)
+			sort.Ints(lists[list])
+		}
+	}
+
+	mapped := make([]int, len(values))
+	for index, value := range values {
+		switch {
+		case value == syzygyTestUnset || value == 0:
+			mapped[index] = -1
+		case value > 0:
+			mapped[index] = sort.SearchInts(lists[0], value-1)
+		default:
+			mapped[index] = sort.SearchInts(lists[1], -value-1)
+		}
+	}
+	return lists, mapped
+}
+
+type syzygyTestPairs struct {
+	header       []byte
+	sparseIndex  []byte
+	blockLengths []byte
+	data         []byte
+}
+
+// encodeSyzygyTestPairs Huffman-codes the values (-1 for positions that don't
+// matter) with a canonical code, one symbol per value.
+func encodeSyzygyTestPairs(values []int, flags byte) *syzygyTestPairs {
+	frequencies := make(map[int]int)
+	for _, value := range values {
+		if value >= 0 {
+			frequencies[value]++
+		}
+	}
+	common := 0
+	for value, frequency := range frequencies {
+		if frequency > frequencies[common] || (frequency == frequencies[common] && value < common) {
+			common = value
+		}
+	}
+	if len(frequencies) == 0 {
+		frequencies[0] = 1
+	}
+
+	pairs := &syzygyTestPairs{}
+	if len(frequencies) == 1 {
+		pairs.header = []byte{flags | syzygyFlagSingleValue, byte(common)}
+		return pairs
+	}
+	for index, value := range values {
+		if value < 0 {
+			values[index] = common
+			frequencies[common]++
+		}
+	}
+
+	// Huffman code lengths
+	type node struct {
+		frequency int
+		symbols   []int
+	}
+	lengths := make(map[int]int)
+	var nodes []node
+	for value, frequency := range frequencies {
+		nodes = append(nodes, node{frequency, []int{value}})
+	}
+	for len(nodes) > 1 {
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].frequency != nodes[j].frequency {
+				return nodes[i].frequency < nodes[j].frequency
+			}
+			return nodes[i].symbols[0] < nodes[j].symbols[0]
+		})
+		merged := node{nodes[0].frequency + nodes[1].frequency, append(append([]int{}, nodes[0].symbols...), nodes[1].symbols...)}
+		for _, value := range merged.symbols {
+			lengths[value]++
+		}
+		nodes = append([]node{merged}, nodes[2:]...)
+	}
+
+	// Symbols are numbered from the longest code down
+	var symbols []int
+	for value := range lengths {
+		symbols = append(symbols, value)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if lengths[symbols[i]] != lengths[symbols[j]] {
+			return lengths[symbols[i]] > lengths[symbols[j]]
+		}
+		return symbols[i] < symbols[j]
+	})
+	minLen, maxLen := lengths[symbols[len(symbols)-1]], lengths[symbols[0]]
+	counts := make([]int, maxLen+2)
+	for _, value := range symbols {
+		counts[lengths[value]]++
+	}
+	h := maxLen - minLen + 1
+	lowest := make([]int, h)
+	base := make([]int, h)
+	for i := h - 2; i >= 0; i-- {
+		lowest[i] = lowest[i+1] + counts[minLen+i+1]
+		base[i] = (base[i+1] + counts[minLen+i+1]) / 2
+	}
+	codes := make(map[int]uint64)
+	for symbol, value := range symbols {
+		i := lengths[value] - minLen
+		codes[value] = uint64(base[i] + symbol - lowest[i])
+	}
+
+	// Pack the codes into blocks
+	blockBytes := 1 << syzygyTestBlockSize
+	var blockStarts []int
+	var data []byte
+	var block []byte
+	var bitCount int
+	for index, value := range values {
+		length := lengths[value]
+		if index == 0 || bitCount+length > 8*blockBytes {
+			data = append(data, block...)
+			block = make([]byte, blockBytes)
+			bitCount = 0
+			blockStarts = append(blockStarts, index)
+		}
+		for bit := length - 1; bit >= 0; bit-- {
+			if codes[value]>>uint(bit)&1 != 0 {
+				block[bitCount/8] |= 0x80 >> uint(bitCount%8)
+			}
+			bitCount++
+		}
+	}
+	data = append(data, block...)
+	pairs.data = data
+
+	blockStarts = append(blockStarts, len(values))
+	for i := 0; i+1 < len(blockStarts); i++ {
+		pairs.blockLengths = binary.LittleEndian.AppendUint16(pairs.blockLengths, uint16(blockStarts[i+1]-blockStarts[i]-1))
+	}
+
+	span := 1 << syzygyTestIdxBits
+	for k := 0; k*span < len(values); k++ {
+		middle := k*span + span/2
+		block := sort.SearchInts(blockStarts, middle+1) - 1
+		block = Min(block, len(blockStarts)-2)
+		pairs.sparseIndex = binary.LittleEndian.AppendUint32(pairs.sparseIndex, uint32(block))
+		pairs.sparseIndex = binary.LittleEndian.AppendUint16(pairs.sparseIndex, uint16(middle-blockStarts[block]))
+	}
+
+	header := []byte{flags, syzygyTestBlockSize, syzygyTestIdxBits, 0}
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(blockStarts)-1))
+	header = append(header, byte(maxLen), byte(minLen))
+	for i := 0; i < h; i++ {
+		header = binary.LittleEndian.AppendUint16(header, uint16(lowest[i]))
+	}
+	header = binary.LittleEndian.AppendUint16(header, uint16(len(symbols)))
+	for _, value := range symbols {
+		header = append(header, byte(value), byte(value>>8)|0xF0, 0xFF)
+	}
+	if len(symbols)%2 == 1 {
+		header = append(header, 0)
+	}
+	pairs.header = header
+
+	return pairs
+}
+
+func syzygyTestAlign(buf *bytes.Buffer, n int) {
+	for buf.Len()%n != 0 {
+		buf.WriteByte(0)
+	}
+}
@@ -0,0 +1,1039 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Endgame tablebases for up to four pieces (kings included), built in memory by
+// retrograde analysis.
+//
+// A table holds the distance to mate (DTM) of every position with the given
+// material.  The first side of the signature is stored as white; positions with
+// the colors reversed are probed by flipping the board.  Positions are indexed by
+// the square of each piece, with the white king restricted to the a1-d1-d4
+// triangle (or to files a-d when there are pawns) by using the board's symmetry.
+// Castling and en passant are ignored.
+//
+// Generation has two phases:
+//
+//  1. Every position is set up on a board and its legal moves generated with the
+//     normal move generator.  Checkmates are losses in 0.  Captures and
+//     promotions leave the table and are scored from the (already built) smaller
+//     tables.  The moves that stay in the table are counted.
+//  2. Starting from the checkmates, positions are decided in order of distance to
+//     mate: every predecessor of a loss in n is a win in n+1, and a predecessor of
+//     a win is a loss once all of its moves have been shown to lose.
+//     Predecessors are found by "un-moving" the pieces of the side that just moved.
+//
+// Positions that are still undecided at the end are draws.
+
+// A DTM entry is 0 for a draw (or an illegal position), otherwise the number of
+// plies to mate plus one.  The side to move wins when the plies are odd (the
+// entry is even) and loses when they're even (the entry is odd).
+type DTMEntry uint16
+
+const TABLEBASE_MAX_PIECES = 4
+const TABLEBASE_FILE_EXTENSION = ".rtb"
+
+var tablebaseFileMagic = []byte("RATB1")
+
+func (entry DTMEntry) IsDraw() bool {
+	return entry == 0
+}
+
+func (entry DTMEntry) IsWin() bool {
+	return entry != 0 && entry%2 == 0
+}
+
+func (entry DTMEntry) IsLoss() bool {
+	return entry%2 == 1
+}
+
+// Plies is the number of plies until mate (meaningless for a draw).
+func (entry DTMEntry) Plies() int {
+	return int(entry) - 1
+}
+
+func dtmEntryFromPlies(plies int) DTMEntry {
+	return DTMEntry(plies + 1)
+}
+
+// dtmFromSuccessor converts the entry of the position after a move into the
+// entry that move gives the side that made it.
+func dtmFromSuccessor(entry DTMEntry) DTMEntry {
+	if entry.IsDraw() {
+		return 0
+	}
+	return dtmEntryFromPlies(entry.Plies() + 1)
+}
+
+type tablebaseSlot struct {
+	color int
+	piece byte
+}
+
+type Tablebase struct {
+	signature   string
+	counts      [2][7]int
+	slots       []tablebaseSlot
+	hasPawns    bool
+	kingSquares int
+	size        int
+	dtm         []DTMEntry
+}
+
+// tablebases holds every loaded or generated table, keyed by the material key of
+// the signature.
+var tablebases = make(map[uint64]*Tablebase)
+
+// The white king is restricted to the a1-d1-d4 triangle in tables without pawns
+// (index 0) and to files a-d in tables with pawns (index 1).  tablebaseKingIndex
+// is -1 for the squares outside the region.
+var tablebaseKingIndex, tablebaseKingSquare = createTablebaseKingIndex()
+
+var tablebasePieceOrder = []byte{QUEEN_MASK, ROOK_MASK, BISHOP_MASK, KNIGHT_MASK, PAWN_MASK}
+
+func createTablebaseKingIndex() ([2][64]int, [2][32]byte) {
+	var kingIndex [2][64]int
+	var kingSquare [2][32]byte
+	triangle, half := 0, 0
+	for sq := byte(0); sq < 64; sq++ {
+		file, rank := squareFile(sq), squareRank(sq)
+		kingIndex[0][sq] = -1
+		kingIndex[1][sq] = -1
+		if file <= 3 && rank <= file {
+			kingIndex[0][sq] = triangle
+			kingSquare[0][triangle] = sq
+			triangle++
+		}
+		if file <= 3 {
+			kingIndex[1][sq] = half
+			kingSquare[1][half] = sq
+			half++
+		}
+	}
+	return kingIndex, kingSquare
+}
+
+func NewTablebase(signature string) (*Tablebase, error) {
+	counts, err := ParseMaterialSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	return newTablebaseFromCounts(counts)
+}
+
+func newTablebaseFromCounts(counts [2][7]int) (*Tablebase, error) {
+	tb := &Tablebase{counts: counts, signature: materialSignature(counts)}
+	for _, color := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		tb.slots = append(tb.slots, tablebaseSlot{color, KING_MASK})
+		for _, piece := range tablebasePieceOrder {
+			for i := 0; i < counts[color][piece]; i++ {
+				tb.slots = append(tb.slots, tablebaseSlot{color, piece})
+			}
+		}
+	}
+	if len(tb.slots) > TABLEBASE_MAX_PIECES {
+		return nil, fmt.Errorf("Tablebases are limited to %d pieces: %s", TABLEBASE_MAX_PIECES, tb.signature)
+	}
+	if len(tb.slots) < 3 {
+		return nil, fmt.Errorf("Nothing to generate for %s", tb.signature)
+	}
+
+	tb.hasPawns = counts[WHITE_OFFSET][PAWN_MASK]+counts[BLACK_OFFSET][PAWN_MASK] > 0
+	tb.kingSquares = 10
+	if tb.hasPawns {
+		tb.kingSquares = 32
+	}
+	tb.size = 2 * tb.kingSquares
+	for i := 1; i < len(tb.slots); i++ {
+		tb.size *= 64
+	}
+
+	return tb, nil
+}
+
+// materialSignature is the inverse of ParseMaterialSignature.
+func materialSignature(counts [2][7]int) string {
+	var sb strings.Builder
+	for color, side := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		if color > 0 {
+			sb.WriteString("v")
+		}
+		sb.WriteString("K")
+		for _, piece := range tablebasePieceOrder {
+			sb.WriteString(strings.Repeat(string(pieceToChar(piece)), counts[side][piece]))
+		}
+	}
+	return sb.String()
+}
+
+func pieceToChar(piece byte) byte {
+	return "?PNBRQK"[piece]
+}
+
+func (tb *Tablebase) Signature() string {
+	return tb.signature
+}
+
+func (tb *Tablebase) kingRegion() int {
+	if tb.hasPawns {
+		return 1
+	}
+	return 0
+}
+
+func (tb *Tablebase) kingIndexTable() *[64]int {
+	return &tablebaseKingIndex[tb.kingRegion()]
+}
+
+// transformSquare applies one of the 8 symmetries of the board: bit 0 mirrors
+// the files, bit 1 the ranks and bit 2 swaps files and ranks.
+func transformSquare(sq byte, transform int) byte {
+	if transform&1 != 0 {
+		sq ^= 7
+	}
+	if transform&2 != 0 {
+		sq ^= 56
+	}
+	if transform&4 != 0 {
+		sq = (sq%8)*8 + sq/8
+	}
+	return sq
+}
+
+// index computes the index of a position whose white king is already in the
+// allowed region.
+func (tb *Tablebase) index(squares []byte, sideToMove int) int {
+	i := 0
+	for slot := len(squares) - 1; slot >= 1; slot-- {
+		i = i*64 + int(squares[slot])
+	}
+	return sideToMove + 2*(tb.kingIndexTable()[squares[0]]+tb.kingSquares*i)
+}
+
+// canonicalIndex returns the index of the position under whichever symmetry puts
+// the white king in the allowed region (the smallest such index if there are
+// several), with identical pieces sorted by square.  Symmetric positions share an
+// index.
+func (tb *Tablebase) canonicalIndex(squares []byte, sideToMove int) int {
+	transforms := 8
+	if tb.hasPawns {
+		transforms = 2
+	}
+	kingIndex := tb.kingIndexTable()
+
+	best := -1
+	var transformed [TABLEBASE_MAX_PIECES]byte
+	for transform := 0; transform < transforms; transform++ {
+		if kingIndex[transformSquare(squares[0], transform)] < 0 {
+			continue
+		}
+		for slot, sq := range squares {
+			transformed[slot] = transformSquare(sq, transform)
+		}
+		tb.sortIdenticalPieces(transformed[:len(squares)])
+		if i := tb.index(transformed[:len(squares)], sideToMove); best < 0 || i < best {
+			best = i
+		}
+	}
+
+	return best
+}
+
+func (tb *Tablebase) sortIdenticalPieces(squares []byte) {
+	for i := 1; i < len(squares); i++ {
+		for j := i; j > 0 && tb.slots[j] == tb.slots[j-1] && squares[j] < squares[j-1]; j-- {
+			squares[j], squares[j-1] = squares[j-1], squares[j]
+		}
+	}
+}
+
+func (tb *Tablebase) decode(index int) ([TABLEBASE_MAX_PIECES]byte, int) {
+	var squares [TABLEBASE_MAX_PIECES]byte
+	sideToMove := index & 1
+	index >>= 1
+
+	squares[0] = tablebaseKingSquare[tb.kingRegion()][index%tb.kingSquares]
+	index /= tb.kingSquares
+	for slot := 1; slot < len(tb.slots); slot++ {
+		squares[slot] = byte(index % 64)
+		index /= 64
+	}
+
+	return squares, sideToMove
+}
+
+// boardSquares reads the squares of the table's pieces off the board.  flip
+// swaps the colors, for boards where the table's white pieces are black.
+func (tb *Tablebase) boardSquares(boardState *BoardState, flip bool) ([TABLEBASE_MAX_PIECES]byte, int) {
+	var squares [TABLEBASE_MAX_PIECES]byte
+	sideToMove := boardState.sideToMove
+	if flip {
+		sideToMove = oppositeColorOffset(sideToMove)
+	}
+
+	var flipSquare byte
+	if flip {
+		flipSquare = 56
+	}
+	for slot := 0; slot < len(tb.slots); {
+		group := tb.slots[slot]
+		color := group.color
+		if flip {
+			color = oppositeColorOffset(color)
+		}
+		bitboard := boardState.bitboards.piece[group.piece] & boardState.bitboards.color[color]
+		for ; slot < len(tb.slots) && tb.slots[slot] == group; slot++ {
+			squares[slot] = byte(bits.TrailingZeros64(bitboard)) ^ flipSquare
+			bitboard &= bitboard - 1
+		}
+	}
+
+	return squares, sideToMove
+}
+
+// setupBoard places the position on the board, clearing the squares listed in
+// occupied (the previous position) first.
+func (tb *Tablebase) setupBoard(boardState *BoardState, occupied []byte, squares []byte, sideToMove int) {
+	for _, sq := range occupied {
+		boardState.SetPieceAtSquare(sq, EMPTY_SQUARE)
+	}
+	for slot, sq := range squares {
+		colorMask := WHITE_MASK
+		if tb.slots[slot].color == BLACK_OFFSET {
+			colorMask = BLACK_MASK
+		}
+		boardState.SetPieceAtSquare(sq, colorMask|tb.slots[slot].piece)
+	}
+	boardState.sideToMove = sideToMove
+	boardState.boardInfo = BoardInfo{}
+}
+
+func isTriviallyDrawn(counts [2][7]int) bool {
+	pieces := 0
+	minors := 0
+	for _, side := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		for piece := PAWN_MASK; piece <= QUEEN_MASK; piece++ {
+			pieces += counts[side][piece]
+		}
+		minors += counts[side][KNIGHT_MASK] + counts[side][BISHOP_MASK]
+	}
+	return pieces == 0 || (pieces == 1 && minors == 1)
+}
+
+func boardCounts(boardState *BoardState) [2][7]int {
+	var counts [2][7]int
+	for _, side := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		for piece := PAWN_MASK; piece <= KING_MASK; piece++ {
+			counts[side][piece] = bits.OnesCount64(boardState.bitboards.piece[piece] & boardState.bitboards.color[side])
+		}
+	}
+	return counts
+}
+
+func flipCounts(counts [2][7]int) [2][7]int {
+	counts[WHITE_OFFSET], counts[BLACK_OFFSET] = counts[BLACK_OFFSET], counts[WHITE_OFFSET]
+	return counts
+}
+
+// findTablebase returns the table for the material, and whether the colors need
+// to be flipped to probe it.
+func findTablebase(counts [2][7]int) (*Tablebase, bool) {
+	if tb, ok := tablebases[materialKeyFromCounts(counts)]; ok {
+		return tb, false
+	}
+	if tb, ok := tablebases[materialKeyFromCounts(flipCounts(counts))]; ok {
+		return tb, true
+	}
+	return nil, false
+}
+
+// ProbeTablebase returns the DTM entry for the side to move.  ok is false if
+// there's no table for the position.
+func ProbeTablebase(boardState *BoardState) (DTMEntry, bool) {
+	if bits.OnesCount64(boardState.GetAllOccupanciesBitboard()) > TABLEBASE_MAX_PIECES {
+		return 0, false
+	}
+	counts := boardCounts(boardState)
+	if isTriviallyDrawn(counts) {
+		return 0, true
+	}
+
+	tb, flip := findTablebase(counts)
+	if tb == nil {
+		return 0, false
+	}
+	squares, sideToMove := tb.boardSquares(boardState, flip)
+	return tb.dtm[tb.canonicalIndex(squares[:len(tb.slots)], sideToMove)], true
+}
+
+// probeTablebaseScore converts a tablebase hit into a search score, using the
+// same mate distances as getNoLegalMoveResult.
+func probeTablebaseScore(boardState *BoardState, currentDepth uint) (int16, bool) {
+	if len(tablebases) == 0 || boardState.boardInfo.enPassantTargetSquare != 0 ||
+		boardState.boardInfo.whiteCanCastleKingside || boardState.boardInfo.whiteCanCastleQueenside ||
+		boardState.boardInfo.blackCanCastleKingside || boardState.boardInfo.blackCanCastleQueenside {
+		return 0, false
+	}
+
+	entry, ok := ProbeTablebase(boardState)
+	if !ok {
+		return 0, false
+	}
+	if entry.IsDraw() {
+		return 0, true
+	}
+
+	score := int16(CHECKMATE_SCORE - int(currentDepth) - entry.Plies() + 1)
+	if entry.IsLoss() {
+		return -score, true
+	}
+	return score, true
+}
+
+// probeTablebaseRoot picks the move that mates fastest (or loses slowest, or
+// keeps the draw) if every move leads to a position with a table.
+func probeTablebaseRoot(boardState *BoardState, moves []Move, start int) (Move, int16, bool) {
+	if _, ok := probeTablebaseScore(boardState, 0); !ok {
+		return 0, 0, false
+	}
+
+	var bestMove Move
+	var bestScore int16 = -INFINITY
+	end := GenerateMoves(boardState, moves, start)
+	for _, move := range moves[start:end] {
+		if move.IsCastle() && !boardState.TestCastleLegality(move) {
+			continue
+		}
+		offset := boardState.sideToMove
+		boardState.ApplyMove(move)
+		if boardState.IsInCheck(offset) {
+			boardState.UnapplyMove(move)
+			continue
+		}
+		score, ok := probeTablebaseScore(boardState, 1)
+		boardState.UnapplyMove(move)
+		if !ok {
+			return 0, 0, false
+		}
+		if -score > bestScore {
+			bestScore = -score
+			bestMove = move
+		}
+	}
+
+	if bestMove == 0 {
+		// Checkmate or stalemate, leave it to the search
+		return 0, 0, false
+	}
+	return bestMove, bestScore, true
+}
+
+// GenerateTablebase builds the table for the signature, along with any smaller
+// tables it depends on that aren't already loaded.  Each new table is registered
+// and passed to generated (which may be nil) as soon as it's built.
+func GenerateTablebase(signature string, generated func(tb *Tablebase) error) (*Tablebase, error) {
+	counts, err := ParseMaterialSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	return generateTablebase(counts, generated)
+}
+
+func generateTablebase(counts [2][7]int, generated func(tb *Tablebase) error) (*Tablebase, error) {
+	if tb, _ := findTablebase(counts); tb != nil {
+		return tb, nil
+	}
+
+	for _, dependency := range tablebaseDependencies(counts) {
+		if isTriviallyDrawn(dependency) {
+			continue
+		}
+		if _, err := generateTablebase(dependency, generated); err != nil {
+			return nil, err
+		}
+	}
+
+	tb, err := newTablebaseFromCounts(counts)
+	if err != nil {
+		return nil, err
+	}
+	tb.generate()
+	tablebases[materialKeyFromCounts(counts)] = tb
+
+	if generated != nil {
+		if err := generated(tb); err != nil {
+			return tb, err
+		}
+	}
+
+	return tb, nil
+}
+
+// tablebaseDependencies lists the material reachable by a single capture or
+// promotion (or both).
+func tablebaseDependencies(counts [2][7]int) [][2][7]int {
+	dependencies := make([][2][7]int, 0)
+	for _, side := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		other := oppositeColorOffset(side)
+		for captured := PAWN_MASK; captured <= QUEEN_MASK; captured++ {
+			if counts[other][captured] == 0 {
+				continue
+			}
+			dependency := counts
+			dependency[other][captured]--
+			dependencies = append(dependencies, dependency)
+		}
+		if counts[side][PAWN_MASK] == 0 {
+			continue
+		}
+		for promotion := KNIGHT_MASK; promotion <= QUEEN_MASK; promotion++ {
+			dependency := counts
+			dependency[side][PAWN_MASK]--
+			dependency[side][promotion]++
+			dependencies = append(dependencies, dependency)
+			for captured := KNIGHT_MASK; captured <= QUEEN_MASK; captured++ {
+				if counts[other][captured] == 0 {
+					continue
+				}
+				withCapture := dependency
+				withCapture[other][captured]--
+				dependencies = append(dependencies, withCapture)
+			}
+		}
+	}
+	return dependencies
+}
+
+const (
+	tablebaseInvalid    = 1
+	tablebaseCannotLose = 2
+)
+
+type tablebaseGenerator struct {
+	tb         *Tablebase
+	flags      []byte
+	moveCounts []uint8
+	lossFloor  []DTMEntry
+	buckets    [][]uint32
+}
+
+func (generator *tablebaseGenerator) schedule(entry DTMEntry, index int) {
+	plies := entry.Plies()
+	for len(generator.buckets) <= plies {
+		generator.buckets = append(generator.buckets, nil)
+	}
+	generator.buckets[plies] = append(generator.buckets[plies], uint32(index))
+}
+
+func (tb *Tablebase) generate() {
+	generator := &tablebaseGenerator{
+		tb:         tb,
+		flags:      make([]byte, tb.size),
+		moveCounts: make([]uint8, tb.size),
+		lossFloor:  make([]DTMEntry, tb.size),
+	}
+	tb.dtm = make([]DTMEntry, tb.size)
+
+	generator.countMoves()
+	generator.propagate()
+}
+
+// countMoves is the first phase: it marks invalid positions, scores checkmates
+// and moves that leave the table, and counts the moves that stay in it.
+func (generator *tablebaseGenerator) countMoves() {
+	tb := generator.tb
+	boardState := CreateEmptyBoardState()
+	moves := make([]Move, 256)
+	successors := make([]int, 0, 64)
+	var occupied []byte
+
+	for index := 0; index < tb.size; index++ {
+		squares, sideToMove := tb.decode(index)
+		position := squares[:len(tb.slots)]
+		if !tb.isValidPlacement(position) || tb.canonicalIndex(position, sideToMove) != index {
+			generator.flags[index] = tablebaseInvalid
+			continue
+		}
+
+		tb.setupBoard(&boardState, occupied, position, sideToMove)
+		occupied = position
+		if boardState.IsInCheck(oppositeColorOffset(sideToMove)) {
+			generator.flags[index] = tablebaseInvalid
+			continue
+		}
+
+		legalMoves := 0
+		successors = successors[:0]
+		var bestWin DTMEntry
+		moveCount := GenerateMoves(&boardState, moves, 0)
+		for _, move := range moves[:moveCount] {
+			boardState.ApplyMove(move)
+			if boardState.IsInCheck(sideToMove) {
+				boardState.UnapplyMove(move)
+				continue
+			}
+			legalMoves++
+
+			if move.Flags()&(CAPTURE_MASK|PROMOTION_MASK) != 0 {
+				entry, ok := ProbeTablebase(&boardState)
+				if !ok {
+					panic(fmt.Errorf("Missing tablebase for %s", materialSignature(boardCounts(&boardState))))
+				}
+				result := dtmFromSuccessor(entry)
+				switch {
+				case result.IsWin():
+					if bestWin == 0 || result < bestWin {
+						bestWin = result
+					}
+				case result.IsLoss():
+					if result > generator.lossFloor[index] {
+						generator.lossFloor[index] = result
+					}
+				default:
+					generator.flags[index] |= tablebaseCannotLose
+				}
+			} else {
+				successorSquares, successorSideToMove := tb.boardSquares(&boardState, false)
+				successor := tb.canonicalIndex(successorSquares[:len(tb.slots)], successorSideToMove)
+				if !containsInt(successors, successor) {
+					successors = append(successors, successor)
+				}
+			}
+			boardState.UnapplyMove(move)
+		}
+		generator.moveCounts[index] = uint8(len(successors))
+
+		if bestWin != 0 {
+			generator.flags[index] |= tablebaseCannotLose
+			generator.schedule(bestWin, index)
+		}
+
+		if legalMoves == 0 {
+			if boardState.IsInCheck(sideToMove) {
+				generator.schedule(dtmEntryFromPlies(0), index)
+			} else {
+				generator.flags[index] |= tablebaseCannotLose
+			}
+		} else if len(successors) == 0 && generator.flags[index]&tablebaseCannotLose == 0 {
+			// Every move leaves the table and loses
+			generator.schedule(generator.lossFloor[index], index)
+		}
+	}
+	for _, sq := range occupied {
+		boardState.SetPieceAtSquare(sq, EMPTY_SQUARE)
+	}
+}
+
+func (tb *Tablebase) isValidPlacement(squares []byte) bool {
+	for i, sq := range squares {
+		if tb.slots[i].piece == PAWN_MASK && (sq < SQUARE_A2 || sq > SQUARE_H7) {
+			return false
+		}
+		for _, other := range squares[:i] {
+			if sq == other {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// propagate is the second phase: positions are decided in order of distance to
+// mate, working backwards from each decided position to its predecessors.
+func (generator *tablebaseGenerator) propagate() {
+	tb := generator.tb
+	predecessors := make([]int, 0, 128)
+
+	for plies := 0; plies < len(generator.buckets); plies++ {
+		entry := dtmEntryFromPlies(plies)
+		for _, index := range generator.buckets[plies] {
+			if tb.dtm[index] != 0 {
+				continue
+			}
+			tb.dtm[index] = entry
+
+			predecessors = generator.predecessors(int(index), predecessors[:0])
+			for _, predecessor := range predecessors {
+				if tb.dtm[predecessor] != 0 {
+					continue
+				}
+				if entry.IsLoss() {
+					generator.schedule(dtmEntryFromPlies(plies+1), predecessor)
+					continue
+				}
+				if generator.flags[predecessor]&tablebaseCannotLose != 0 {
+					continue
+				}
+				generator.moveCounts[predecessor]--
+				if generator.moveCounts[predecessor] == 0 {
+					loss := dtmEntryFromPlies(plies + 1)
+					if generator.lossFloor[predecessor] > loss {
+						loss = generator.lossFloor[predecessor]
+					}
+					generator.schedule(loss, predecessor)
+				}
+			}
+		}
+		generator.buckets[plies] = nil
+	}
+}
+
+// predecessors appends the (distinct, valid) positions that lead to the position
+// by a move that stays in the table: one of the pieces of the side that just
+// moved is moved back to an empty square.
+func (generator *tablebaseGenerator) predecessors(index int, predecessors []int) []int {
+	tb := generator.tb
+	squares, sideToMove := tb.decode(index)
+	position := squares[:len(tb.slots)]
+	mover := oppositeColorOffset(sideToMove)
+
+	var occupancy uint64
+	for _, sq := range position {
+		occupancy |= 1 << sq
+	}
+
+	var previous [TABLEBASE_MAX_PIECES]byte
+	for slot, sq := range position {
+		if tb.slots[slot].color != mover {
+			continue
+		}
+		var from uint64
+		if tb.slots[slot].piece == PAWN_MASK {
+			from = pawnUnmoves(sq, mover, occupancy)
+		} else {
+			from = pieceAttacks(tb.slots[slot].piece, sq, occupancy) &^ occupancy
+		}
+		for from != 0 {
+			copy(previous[:], position)
+			previous[slot] = byte(bits.TrailingZeros64(from))
+			from &= from - 1
+
+			predecessor := tb.canonicalIndex(previous[:len(position)], mover)
+			if generator.flags[predecessor]&tablebaseInvalid == 0 && !containsInt(predecessors, predecessor) {
+				predecessors = append(predecessors, predecessor)
+			}
+		}
+	}
+
+	return predecessors
+}
+
+func pawnUnmoves(sq byte, color int, occupancy uint64) uint64 {
+	var from uint64
+	if color == WHITE_OFFSET {
+		if sq >= SQUARE_A3 && occupancy&(1<<(sq-8)) == 0 {
+			from |= 1 << (sq - 8)
+			if squareRank(sq) == 3 && occupancy&(1<<(sq-16)) == 0 {
+				from |= 1 << (sq - 16)
+			}
+		}
+	} else {
+		if sq <= SQUARE_H6 && occupancy&(1<<(sq+8)) == 0 {
+			from |= 1 << (sq + 8)
+			if squareRank(sq) == 4 && occupancy&(1<<(sq+16)) == 0 {
+				from |= 1 << (sq + 16)
+			}
+		}
+	}
+	return from
+}
+
+// pieceAttacks returns the squares attacked by a (non-pawn) piece.
+func pieceAttacks(piece byte, sq byte, occupancy uint64) uint64 {
+	switch piece {
+	case KING_MASK:
+		return moveBitboards.kingAttacks[sq].board
+	case KNIGHT_MASK:
+		return moveBitboards.knightAttacks[sq].board
+	case BISHOP_MASK:
+		return moveBitboards.bishopAttacks[sq][hashKey(occupancy, moveBitboards.bishopMagics[sq])].board
+	case ROOK_MASK:
+		return moveBitboards.rookAttacks[sq][hashKey(occupancy, moveBitboards.rookMagics[sq])].board
+	case QUEEN_MASK:
+		return pieceAttacks(BISHOP_MASK, sq, occupancy) | pieceAttacks(ROOK_MASK, sq, occupancy)
+	}
+	return 0
+}
+
+// Verify checks every position against its successors using the normal move
+// generator: a win must have a move to a loss one ply shorter and no faster mate,
+// a loss must only have moves to wins (the longest one ply shorter), and a draw
+// must have a drawing move and no winning one.
+func (tb *Tablebase) Verify() error {
+	boardState := CreateEmptyBoardState()
+	moves := make([]Move, 256)
+	var occupied []byte
+	defer func() {
+		for _, sq := range occupied {
+			boardState.SetPieceAtSquare(sq, EMPTY_SQUARE)
+		}
+	}()
+
+	for index := 0; index < tb.size; index++ {
+		squares, sideToMove := tb.decode(index)
+		position := squares[:len(tb.slots)]
+		if !tb.isValidPlacement(position) || tb.canonicalIndex(position, sideToMove) != index {
+			continue
+		}
+		tb.setupBoard(&boardState, occupied, position, sideToMove)
+		occupied = position
+		if boardState.IsInCheck(oppositeColorOffset(sideToMove)) {
+			if tb.dtm[index] != 0 {
+				return fmt.Errorf("%s: illegal position has a value", tb.positionString(position, sideToMove))
+			}
+			continue
+		}
+
+		var bestWin, worstLoss DTMEntry
+		hasDraw := false
+		legalMoves := 0
+		moveCount := GenerateMoves(&boardState, moves, 0)
+		for _, move := range moves[:moveCount] {
+			boardState.ApplyMove(move)
+			if !boardState.IsInCheck(sideToMove) {
+				legalMoves++
+				entry, ok := ProbeTablebase(&boardState)
+				if !ok {
+					boardState.UnapplyMove(move)
+					return fmt.Errorf("Missing tablebase for %s", materialSignature(boardCounts(&boardState)))
+				}
+				result := dtmFromSuccessor(entry)
+				switch {
+				case result.IsWin():
+					if bestWin == 0 || result < bestWin {
+						bestWin = result
+					}
+				case result.IsLoss():
+					if result > worstLoss {
+						worstLoss = result
+					}
+				default:
+					hasDraw = true
+				}
+			}
+			boardState.UnapplyMove(move)
+		}
+
+		var expected DTMEntry
+		switch {
+		case legalMoves == 0 && boardState.IsInCheck(sideToMove):
+			expected = dtmEntryFromPlies(0)
+		case bestWin != 0:
+			expected = bestWin
+		case !hasDraw && legalMoves > 0:
+			expected = worstLoss
+		}
+		if tb.dtm[index] != expected {
+			return fmt.Errorf("%s: expected %s, was %s",
+				tb.positionString(position, sideToMove), expected, tb.dtm[index])
+		}
+	}
+
+	return nil
+}
+
+func (entry DTMEntry) String() string {
+	switch {
+	case entry.IsDraw():
+		return "draw"
+	case entry.IsWin():
+		return fmt.Sprintf("win in %d plies", entry.Plies())
+	default:
+		return fmt.Sprintf("loss in %d plies", entry.Plies())
+	}
+}
+
+// positionFen returns the FEN of a position in the table.
+func (tb *Tablebase) positionFen(squares []byte, sideToMove int) string {
+	var board [64]byte
+	for slot, sq := range squares {
+		piece := pieceToChar(tb.slots[slot].piece)
+		if tb.slots[slot].color == BLACK_OFFSET {
+			piece += 'a' - 'A'
+		}
+		board[sq] = piece
+	}
+
+	var sb strings.Builder
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			piece := board[rank*8+file]
+			if piece == 0 {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				sb.WriteByte(byte('0' + empty))
+				empty = 0
+			}
+			sb.WriteByte(piece)
+		}
+		if empty > 0 {
+			sb.WriteByte(byte('0' + empty))
+		}
+		if rank > 0 {
+			sb.WriteByte('/')
+		}
+	}
+	if sideToMove == WHITE_OFFSET {
+		sb.WriteString(" w - - 0 1")
+	} else {
+		sb.WriteString(" b - - 0 1")
+	}
+
+	return sb.String()
+}
+
+func (tb *Tablebase) positionString(squares []byte, sideToMove int) string {
+	return fmt.Sprintf("%s (%s)", tb.signature, tb.positionFen(squares, sideToMove))
+}
+
+// Stats counts the wins, losses and draws (from the side to move's point of view)
+// and the longest mate in the table.
+func (tb *Tablebase) Stats() (wins int, losses int, draws int, longest int) {
+	for _, entry := range tb.dtm {
+		switch {
+		case entry.IsWin():
+			wins++
+		case entry.IsLoss():
+			losses++
+		default:
+			draws++
+		}
+		if entry.Plies() > longest {
+			longest = entry.Plies()
+		}
+	}
+	return
+}
+
+func tablebaseFilename(dir string, signature string) string {
+	return filepath.Join(dir, signature+TABLEBASE_FILE_EXTENSION)
+}
+
+// WriteTablebase stores the table as a small header (magic, signature) followed
+// by the gzipped DTM entries.
+func WriteTablebase(dir string, tb *Tablebase) error {
+	file, err := os.Create(tablebaseFilename(dir, tb.signature))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writer.Write(tablebaseFileMagic)
+	writer.WriteByte(byte(len(tb.signature)))
+	writer.WriteString(tb.signature)
+
+	compressed := gzip.NewWriter(writer)
+	if err := binary.Write(compressed, binary.LittleEndian, tb.dtm); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+func ReadTablebase(filename string) (*Tablebase, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(tablebaseFileMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != string(tablebaseFileMagic) {
+		return nil, fmt.Errorf("%s: not a tablebase file", filename)
+	}
+	length, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, length)
+	if _, err := io.ReadFull(reader, signature); err != nil {
+		return nil, err
+	}
+
+	tb, err := NewTablebase(string(signature))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	compressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	tb.dtm = make([]DTMEntry, tb.size)
+	if err := binary.Read(compressed, binary.LittleEndian, tb.dtm); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return tb, nil
+}
+
+// LoadTablebases reads every table in the directory.
+func LoadTablebases(dir string) (int, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*"+TABLEBASE_FILE_EXTENSION))
+	if err != nil {
+		return 0, err
+	}
+	for _, filename := range filenames {
+		tb, err := ReadTablebase(filename)
+		if err != nil {
+			return 0, err
+		}
+		tablebases[materialKeyFromCounts(tb.counts)] = tb
+	}
+	return len(filenames), nil
+}
+
+// RunGenerateTablebase builds the table for the signature (and its dependencies),
+// writing each one to dir and verifying it.
+func RunGenerateTablebase(signature string, dir string) (bool, error) {
+	if dir == "" {
+		return false, errors.New("Must specify a directory for the tables (--tbpath)")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+
+	_, err := GenerateTablebase(signature, func(tb *Tablebase) error {
+		wins, losses, draws, longest := tb.Stats()
+		fmt.Printf("%s: %d wins, %d losses, %d draws/illegal, longest mate %d plies\n",
+			tb.signature, wins, losses, draws, longest)
+		if err := tb.Verify(); err != nil {
+			return err
+		}
+		fmt.Printf("%s: verified\n", tb.signature)
+		return WriteTablebase(dir, tb)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
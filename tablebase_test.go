@@ -0,0 +1,191 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useTablebases generates the tables for the test and removes them afterwards, so
+// they don't change the results of other searches.
+func useTablebases(t *testing.T, signatures ...string) {
+	previous := tablebases
+	tablebases = make(map[uint64]*Tablebase)
+	t.Cleanup(func() {
+		tablebases = previous
+	})
+
+	for _, signature := range signatures {
+		_, err := GenerateTablebase(signature, nil)
+		assert.Nil(t, err)
+	}
+}
+
+func findTablebaseForSignature(t *testing.T, signature string) *Tablebase {
+	counts, err := ParseMaterialSignature(signature)
+	assert.Nil(t, err)
+	tb, _ := findTablebase(counts)
+	assert.NotNil(t, tb, signature)
+	return tb
+}
+
+func TestTablebaseLongestMates(t *testing.T) {
+	useTablebases(t, "KQvK", "KRvK")
+
+	// Mate in 10 and mate in 16, from the losing side
+	_, _, _, longest := findTablebaseForSignature(t, "KQvK").Stats()
+	assert.Equal(t, 20, longest)
+	_, _, _, longest = findTablebaseForSignature(t, "KRvK").Stats()
+	assert.Equal(t, 32, longest)
+}
+
+func TestTablebaseVerify(t *testing.T) {
+	useTablebases(t, "KPvK")
+
+	for _, signature := range []string{"KQvK", "KRvK", "KPvK"} {
+		assert.Nil(t, findTablebaseForSignature(t, signature).Verify(), signature)
+	}
+}
+
+func TestTablebaseMatchesKPKBitbase(t *testing.T) {
+	useTablebases(t, "KPvK")
+	tb := findTablebaseForSignature(t, "KPvK")
+
+	boardState := CreateEmptyBoardState()
+	for sideToMove := WHITE_OFFSET; sideToMove <= BLACK_OFFSET; sideToMove++ {
+		for pawn := SQUARE_A2; pawn <= SQUARE_H7; pawn++ {
+			for whiteKing := byte(0); whiteKing < 64; whiteKing++ {
+				for blackKing := byte(0); blackKing < 64; blackKing++ {
+					if whiteKing == pawn || blackKing == pawn || squareDistance(whiteKing, blackKing) <= 1 ||
+						(sideToMove == WHITE_OFFSET && whitePawnAttacks(pawn)&(1<<blackKing) != 0) {
+						continue
+					}
+					squares := []byte{whiteKing, pawn, blackKing}
+					entry := tb.dtm[tb.canonicalIndex(squares, sideToMove)]
+					win := kpkBitbase.Probe(WHITE_OFFSET, whiteKing, pawn, blackKing, sideToMove)
+
+					if sideToMove == WHITE_OFFSET {
+						assert.Equal(t, win, entry.IsWin(), tb.positionFen(squares, sideToMove))
+					} else {
+						assert.Equal(t, win, entry.IsLoss(), tb.positionFen(squares, sideToMove))
+					}
+				}
+			}
+		}
+	}
+
+	// Probing from a board, including with the colors reversed
+	assert.Nil(t, boardState.ResetFromFENString("3k4/8/3K4/3P4/8/8/8/8 w - - 0 1"))
+	entry, ok := ProbeTablebase(&boardState)
+	assert.True(t, ok)
+	assert.True(t, entry.IsWin())
+
+	assert.Nil(t, boardState.ResetFromFENString("8/8/8/8/3p4/3k4/8/3K4 b - - 0 1"))
+	flipped, ok := ProbeTablebase(&boardState)
+	assert.True(t, ok)
+	assert.Equal(t, entry, flipped)
+}
+
+func TestTablebaseSymmetricPositionsShareEntries(t *testing.T) {
+	useTablebases(t, "KRvK")
+	tb := findTablebaseForSignature(t, "KRvK")
+
+	squares := []byte{SQUARE_B6, SQUARE_H1, SQUARE_A8}
+	index := tb.canonicalIndex(squares, WHITE_OFFSET)
+	for transform := 0; transform < 8; transform++ {
+		transformed := make([]byte, len(squares))
+		for i, sq := range squares {
+			transformed[i] = transformSquare(sq, transform)
+		}
+		assert.Equal(t, index, tb.canonicalIndex(transformed, WHITE_OFFSET))
+	}
+	assert.Equal(t, dtmEntryFromPlies(1), tb.dtm[index])
+}
+
+func TestTablebaseWriteAndLoad(t *testing.T) {
+	useTablebases(t, "KRvK")
+	tb := findTablebaseForSignature(t, "KRvK")
+
+	dir := t.TempDir()
+	assert.Nil(t, WriteTablebase(dir, tb))
+
+	loaded, err := ReadTablebase(tablebaseFilename(dir, "KRvK"))
+	assert.Nil(t, err)
+	assert.Equal(t, tb.signature, loaded.signature)
+	assert.Equal(t, tb.dtm, loaded.dtm)
+
+	tablebases = make(map[uint64]*Tablebase)
+	count, err := LoadTablebases(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Nil(t, findTablebaseForSignature(t, "KRvK").Verify())
+
+	_, err = ReadTablebase(writeTestFile(t, "bad.rtb", "not a tablebase"))
+	assert.NotNil(t, err)
+}
+
+func TestNewTablebaseLimits(t *testing.T) {
+	_, err := NewTablebase("KQRvKR")
+	assert.NotNil(t, err)
+	_, err = NewTablebase("KvK")
+	assert.NotNil(t, err)
+
+	tb, err := NewTablebase("KRPvK")
+	assert.Nil(t, err)
+	assert.Equal(t, 2*32*64*64*64, tb.size)
+}
+
+func TestSearchUsesTablebase(t *testing.T) {
+	useTablebases(t, "KRvK")
+	tb := findTablebaseForSignature(t, "KRvK")
+
+	// Find a position that is mate in 16 and check the search sees all of it
+	var fen string
+	for index, entry := range tb.dtm {
+		if entry == dtmEntryFromPlies(31) {
+			squares, sideToMove := tb.decode(index)
+			fen = tb.positionFen(squares[:len(tb.slots)], sideToMove)
+			break
+		}
+	}
+	assert.NotEqual(t, "", fen)
+
+	boardState, err := CreateBoardStateFromFENString(fen)
+	assert.Nil(t, err)
+	stats := SearchStats{}
+	result := Search(&boardState, 2, &stats, &SearchMoveInfo{})
+
+	assert.True(t, result.IsCheckmate(), fen)
+	assert.Equal(t, CHECKMATE_SCORE-30, result.value, fen)
+	assert.True(t, stats.tbhits > 0)
+
+	// The chosen move keeps the mate in 15 for the next move
+	boardState.ApplyMove(result.move)
+	entry, ok := ProbeTablebase(&boardState)
+	assert.True(t, ok)
+	assert.Equal(t, dtmEntryFromPlies(30), entry)
+}
+
+func TestSearchScoresRepetitionBeforeProbingTablebase(t *testing.T) {
+	useTablebases(t, "KRvK")
+	boardState, err := CreateBoardStateFromFENString("8/8/8/4k3/8/8/8/R3K3 w - - 0 1")
+	assert.Nil(t, err)
+
+	// Back in the search's starting position, which is a draw by repetition even
+	// though the table has it as a win
+	boardState.startSearch()
+	for _, str := range []string{"Ra2", "Kd5", "Ra1", "Ke5"} {
+		move, err := ParsePrettyMove(str, &boardState)
+		assert.Nil(t, err)
+		boardState.ApplyMove(move)
+	}
+	moves := make([]Move, MAX_SEARCH_PLY*256)
+	scores := make([]int16, len(moves))
+	var moveStart [MAX_SEARCH_PLY]int
+	stats := SearchStats{}
+	score := searchAlphaBeta(&boardState, &stats, &SearchMoveInfo{}, nil, 2, 4, -INFINITY, INFINITY,
+		SearchConfig{startingDepth: 2}, moves, scores, moveStart[:])
+
+	assert.Equal(t, int16(0), score)
+	assert.Equal(t, uint64(0), stats.tbhits)
+}
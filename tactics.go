@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,12 +18,54 @@ type TacticsOptions struct {
 	tacticsDebug         string
 	tacticsHashVariation string
 	tacticsDepth         uint
+	// Number of positions searched at the same time
+	threads uint
+	// Reports of the run, written if set
+	jsonFile  string
+	junitFile string
 }
 
-func RunTacticsFile(epdFile string, variation string, options TacticsOptions) (bool, error) {
-	successPositions := 0
-	totalPositions := 0
+// TacticsResult is the outcome of one position of a suite.  The score is for
+// the side to move.
+type TacticsResult struct {
+	Name     string `json:"name"`
+	FEN      string `json:"fen"`
+	Expected string `json:"expected"`
+	Move     string `json:"move"`
+	Solved   bool   `json:"solved"`
+	Score    string `json:"score"`
+	Depth    uint   `json:"depth"`
+	Nodes    uint64 `json:"nodes"`
+	TimeMs   int64  `json:"timeMs"`
+	// When the search first found the solution and kept it until the end
+	SolvedDepth  uint   `json:"solvedDepth"`
+	SolvedTimeMs int64  `json:"solvedTimeMs"`
+	Error        string `json:"error,omitempty"`
+
+	stats SearchStats
+}
+
+type TacticsReport struct {
+	Suite     string          `json:"suite"`
+	Positions int             `json:"positions"`
+	Solved    int             `json:"solved"`
+	TimeMs    int64           `json:"timeMs"`
+	Results   []TacticsResult `json:"results"`
+}
+
+// tacticsExpectation is what a position tests: one of the best moves (bm), none
+// of the moves to avoid (am), and a mate (dm).  A position with none of them
+// can't be scored.
+type tacticsExpectation struct {
+	bestMoves  []Move
+	avoidMoves []Move
+	mate       bool
+	// Moves to mate, 0 for any mate
+	mateIn  int
+	summary string
+}
 
+func RunTacticsFile(epdFile string, variation string, options TacticsOptions) (bool, error) {
 	lines, err := ParseAndFilterEpdFile(epdFile, options.epdRegex)
 	if err != nil {
 		return false, err
@@ -29,65 +75,262 @@ func RunTacticsFile(epdFile string, variation string, options TacticsOptions) (b
 		return false, fmt.Errorf("Can only specify variation if regex filters to 1 positions, got %d", len(lines))
 	}
 
+	threads := options.threads
+	if threads == 0 {
+		threads = 1
+	}
+
+	start := time.Now()
+	results := make([]TacticsResult, len(lines))
+	jobs := make(chan int)
+	done := make(chan int)
+	var wg sync.WaitGroup
+	for i := uint(0); i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				results[index] = RunTacticsPosition(&lines[index], variation, options)
+				done <- index
+			}
+		}()
+	}
+	go func() {
+		for index := range lines {
+			jobs <- index
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+	}()
+
+	// Printed as each position finishes, which isn't the file order with more
+	// than one thread
+	colour := stdoutIsTerminal()
 	var totalStats SearchStats
-	for _, line := range lines {
-		prettyMove, result, err := RunTacticsFen(line.fen, variation, options)
+	report := TacticsReport{
+		Suite:     strings.TrimSuffix(filepath.Base(epdFile), filepath.Ext(epdFile)),
+		Positions: len(lines),
+	}
+	for index := range done {
+		result := &results[index]
+		totalStats.add(result.stats)
+		if result.Solved {
+			report.Solved++
+		}
+		fmt.Println(result.String(colour))
+	}
+	report.TimeMs = time.Since(start).Milliseconds()
+	report.Results = results
 
-		if err != nil {
+	fmt.Printf("Complete.  %d/%d positions correct (%.2f%%)\n", report.Solved, report.Positions,
+		100.0*float64(report.Solved)/float64(report.Positions))
+	fmt.Printf("Final stats %s", totalStats.String())
+
+	if options.jsonFile != "" {
+		if err := WriteTacticsJSON(options.jsonFile, &report); err != nil {
 			return false, err
 		}
+	}
+	if options.junitFile != "" {
+		if err := WriteTacticsJUnit(options.junitFile, &report); err != nil {
+			return false, err
+		}
+	}
 
-		totalStats.add(result.stats)
+	return report.Solved == report.Positions, nil
+}
 
-		var res string
-		totalPositions++
-
-		var moveToCheck string
-		var wantMatch bool
-		var desiredSummary string
-
-		if line.bestMove != "" {
-			moveToCheck = line.bestMove
-			wantMatch = true
-			desiredSummary = "expected"
-		} else if line.avoidMove != "" {
-			moveToCheck = line.avoidMove
-			wantMatch = false
-			desiredSummary = "avoid"
-		}
-
-		var success bool
-		if moveToCheck != "" {
-			var moveMatches bool
-			if strings.Contains(moveToCheck, prettyMove) ||
-				strings.Contains(moveToCheck, SquareToAlgebraicString(result.move.From())+SquareToAlgebraicString(result.move.To())) {
-				moveMatches = true
-			}
-			success = moveMatches == wantMatch
-		} else {
-			// for now assume no move specified means checkmate is the desired result
-			moveToCheck = "Mate"
-			success = result.flags == CHECKMATE_FLAG
+// RunTacticsPosition searches a position of a suite within its budget, see
+// tacticsBudget.  Problems with the position are reported in the result.
+func RunTacticsPosition(line *EpdLine, variation string, options TacticsOptions) TacticsResult {
+	result := TacticsResult{Name: line.name, FEN: line.fen}
+	boardState, err := CreateBoardStateFromFENStringWithVariation(line.fen, variation)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	expectation, err := parseTacticsExpectation(line, &boardState)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Expected = expectation.summary
+
+	thinkingTimeMs, depth := tacticsBudget(line, options)
+	config := ExternalSearchConfig{}
+	config.isDebug = options.tacticsDebug != ""
+	config.debugMoves = options.tacticsDebug
+	config.searchToDepth = depth
+
+	// The solution has to stay the best move once found, so a change of mind
+	// starts over
+	start := time.Now()
+	var solvedDepth uint
+	var solvedTime time.Duration
+	searchResult := thinkAndWait(&boardState, thinkingTimeMs, config, func(thinkingOutput ThinkingOutput) {
+		if !expectation.isSolvedBy(thinkingOutput.move, int(thinkingOutput.value)) {
+			solvedDepth = 0
+		} else if solvedDepth == 0 {
+			solvedDepth, solvedTime = thinkingOutput.ply, time.Since(start)
 		}
+	})
+	elapsed := time.Since(start)
 
-		if prettyMove != "" && success {
-			res = "\033[1;32mOK\033[0m"
-			successPositions++
-		} else {
-			res = "\033[1;31mFAIL\033[0m"
+	value := searchResult.value
+	if boardState.sideToMove == BLACK_OFFSET {
+		value = -value
+	}
+	result.Solved = expectation.isSolvedBy(searchResult.move, value)
+	if result.Solved {
+		if solvedDepth == 0 {
+			solvedDepth, solvedTime = searchResult.depth, elapsed
 		}
-		fmt.Printf("[%s - %s] %s=%s move=%s result=%s\n",
-			line.name, res, desiredSummary, moveToCheck, prettyMove, result.String())
+		result.SolvedDepth = solvedDepth
+		result.SolvedTimeMs = solvedTime.Milliseconds()
+	}
+	if searchResult.move != 0 {
+		result.Move = MoveToPrettyString(searchResult.move, &boardState)
 	}
+	result.Score = searchScoreString(searchResult, boardState.sideToMove)
+	result.Depth = searchResult.depth
+	result.Nodes = searchResult.stats.Nodes()
+	result.TimeMs = elapsed.Milliseconds()
+	result.stats = searchResult.stats
 
-	fmt.Printf("Complete.  %d/%d positions correct (%.2f%%)\n", successPositions, totalPositions,
-		100.0*float64(successPositions)/float64(totalPositions))
-	fmt.Printf("Final stats %s", totalStats.String())
-	if totalPositions == successPositions {
-		return true, nil
+	return result
+}
+
+func (result *TacticsResult) String(colour bool) string {
+	status := "OK"
+	if result.Error != "" {
+		status = "ERROR"
+	} else if !result.Solved {
+		status = "FAIL"
+	}
+	if colour && result.Solved {
+		status = "\033[1;32m" + status + "\033[0m"
+	} else if colour {
+		status = "\033[1;31m" + status + "\033[0m"
+	}
+
+	if result.Error != "" {
+		return fmt.Sprintf("[%s - %s] %s", result.Name, status, result.Error)
+	}
+	str := fmt.Sprintf("[%s - %s] %s move=%s score=%s depth=%d nodes=%d time=%.2fs",
+		result.Name, status, result.Expected, result.Move, result.Score, result.Depth, result.Nodes,
+		float64(result.TimeMs)/1000)
+	if result.Solved {
+		str += fmt.Sprintf(" solved=%d/%.2fs", result.SolvedDepth, float64(result.SolvedTimeMs)/1000)
+	}
+	return str
+}
+
+// tacticsBudget returns the thinking time and depth for the position.  acs
+// (seconds) and acd on the line replace the defaults from the options, unless
+// they're 0, as they can be in a file annotated from short searches.  With a
+// depth the search runs until it's reached, however long that takes.
+func tacticsBudget(line *EpdLine, options TacticsOptions) (uint, uint) {
+	thinkingTimeMs := options.thinkingtimeMs
+	depth := options.tacticsDepth
+
+	seconds, _ := line.IntOperation("acs")
+	lineDepth, _ := line.IntOperation("acd")
+	if seconds > 0 || lineDepth > 0 {
+		thinkingTimeMs, depth = 0, 0
+		if seconds > 0 {
+			thinkingTimeMs = uint(seconds) * 1000
+		}
+		if lineDepth > 0 {
+			depth = uint(lineDepth)
+		}
+	}
+
+	if depth != 0 {
+		thinkingTimeMs = NO_TIME_LIMIT
+	}
+	return thinkingTimeMs, depth
+}
+
+func parseTacticsExpectation(line *EpdLine, boardState *BoardState) (tacticsExpectation, error) {
+	var expectation tacticsExpectation
+	var summaries []string
+	var err error
+
+	if operands, ok := line.Operation("bm"); ok {
+		if expectation.bestMoves, err = parseTacticsMoves(operands, boardState); err != nil {
+			return expectation, err
+		}
+		summaries = append(summaries, "bm "+strings.Join(operands, " "))
+	}
+	if operands, ok := line.Operation("am"); ok {
+		if expectation.avoidMoves, err = parseTacticsMoves(operands, boardState); err != nil {
+			return expectation, err
+		}
+		summaries = append(summaries, "am "+strings.Join(operands, " "))
+	}
+
+	if mateIn, ok := line.IntOperation("dm"); ok {
+		expectation.mate = true
+		expectation.mateIn = int(mateIn)
+		summaries = append(summaries, fmt.Sprintf("dm %d", mateIn))
+	} else if len(summaries) == 0 {
+		return expectation, fmt.Errorf("Unscorable position, it has no bm, am or dm")
 	}
 
-	return false, nil
+	expectation.summary = strings.Join(summaries, "; ")
+	return expectation, nil
+}
+
+func parseTacticsMoves(operands []string, boardState *BoardState) ([]Move, error) {
+	moves := make([]Move, 0, len(operands))
+	for _, operand := range operands {
+		move, err := ParsePrettyMove(operand, boardState)
+		if err != nil {
+			move, err = ParseXboardMove(operand, boardState)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s into a move", operand)
+		}
+		moves = append(moves, move)
+	}
+	return moves, nil
+}
+
+// isSolvedBy returns true if playing the move, with the given score for the side
+// to move, meets the expectation.
+func (expectation *tacticsExpectation) isSolvedBy(move Move, value int) bool {
+	if move == 0 {
+		return false
+	}
+	if len(expectation.bestMoves) > 0 && !containsTacticsMove(expectation.bestMoves, move) {
+		return false
+	}
+	if containsTacticsMove(expectation.avoidMoves, move) {
+		return false
+	}
+	if expectation.mate {
+		if value <= CHECKMATE_SCORE-100 {
+			return false
+		}
+		if expectation.mateIn > 0 && MateInMoves(value) > expectation.mateIn {
+			return false
+		}
+	}
+	return true
+}
+
+// containsTacticsMove compares the squares and promotion piece only, as parsed
+// moves don't always have the same flags as the ones the search generates.
+func containsTacticsMove(moves []Move, move Move) bool {
+	for _, m := range moves {
+		if m.From() == move.From() && m.To() == move.To() &&
+			m.IsPromotion() == move.IsPromotion() &&
+			(!move.IsPromotion() || m.GetPromotionPiece() == move.GetPromotionPiece()) {
+			return true
+		}
+	}
+	return false
 }
 
 func RunTacticsFen(fen string, variation string, options TacticsOptions) (string, SearchResult, error) {
@@ -96,36 +339,26 @@ func RunTacticsFen(fen string, variation string, options TacticsOptions) (string
 		return "", SearchResult{}, err
 	}
 
-	ch := make(chan SearchResult)
-	thinkingChan := make(chan ThinkingOutput)
 	output := bufio.NewWriter(os.Stderr)
 
 	output.Write([]byte(boardState.String()))
 	output.WriteRune('\n')
 	output.Flush()
 
-	go func() {
-		for thinkingOutput := range thinkingChan {
-			if thinkingOutput.ply > 0 {
-				sendThinkingOutput(output, thinkingOutput)
-			}
-		}
-	}()
-
 	config := ExternalSearchConfig{}
 	config.isDebug = options.tacticsDebug != ""
 	config.debugMoves = options.tacticsDebug
 	config.searchToDepth = options.tacticsDepth
 	thinkingTimeMs := options.thinkingtimeMs
 	if options.tacticsDepth != 0 {
-		thinkingTimeMs = INFINITY
+		thinkingTimeMs = NO_TIME_LIMIT
 	}
 
-	// Question: Why are stats needed both in the thinkAndChooseMove and
-	// returned in the SearchResult?
-	stats := SearchStats{}
-	go thinkAndChooseMove(&boardState, thinkingTimeMs, &stats, config, ch, thinkingChan)
-	result := <-ch
+	result := thinkAndWait(&boardState, thinkingTimeMs, config, func(thinkingOutput ThinkingOutput) {
+		if thinkingOutput.ply > 0 {
+			sendThinkingOutput(output, thinkingOutput)
+		}
+	})
 
 	output.Flush()
 
@@ -135,9 +368,6 @@ func RunTacticsFen(fen string, variation string, options TacticsOptions) (string
 	}
 
 	if options.tacticsHashVariation != "" {
-		// "Wiggle room" to allow search to abort
-		time.Sleep(time.Duration(200) * time.Millisecond)
-
 		fmt.Println("---- Transposition Table information ----")
 		moveList, err := VariationToMoveList(options.tacticsHashVariation, &boardState)
 		if err != nil {
@@ -157,8 +387,102 @@ func RunTacticsFen(fen string, variation string, options TacticsOptions) (string
 		}
 
 	}
-	// .... can't use variation from transposition table while boardState is still being
-	// searched, bad things
 
 	return MoveToPrettyString(result.move, &boardState), result, nil
 }
+
+func WriteTacticsJSON(filename string, report *TacticsReport) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitSeconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
+
+// WriteTacticsJUnit writes the report as JUnit XML, one test case per position,
+// so CI can show the solve rate of the suite.
+func WriteTacticsJUnit(filename string, report *TacticsReport) error {
+	suite := junitTestSuite{
+		Name:  report.Suite,
+		Tests: len(report.Results),
+		Time:  junitSeconds(report.TimeMs),
+	}
+	for i := range report.Results {
+		result := &report.Results[i]
+		testCase := junitTestCase{
+			Name:      result.Name,
+			ClassName: report.Suite,
+			Time:      junitSeconds(result.TimeMs),
+		}
+		if result.Error != "" {
+			testCase.Error = &junitFailure{Message: result.Error, Text: result.FEN}
+			suite.Errors++
+		} else {
+			if !result.Solved {
+				testCase.Failure = &junitFailure{
+					Message: fmt.Sprintf("expected %s, got %s", result.Expected, result.Move),
+					Text:    result.FEN,
+				}
+				suite.Failures++
+			}
+			testCase.SystemOut = result.String(false)
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	suites := junitTestSuites{
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+	b, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
+
+// stdoutIsTerminal returns false when the output is redirected, so escape codes
+// aren't written into logs.
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTacticsExpectation(t *testing.T) {
+	line, err := ParseEpdLine("3k4/8/3K4/8/8/8/8/7R w - - bm Rh8#; am Rg1 h1a1; id \"rook mate\";")
+	assert.Nil(t, err)
+	boardState, err := CreateBoardStateFromFENString(line.fen)
+	assert.Nil(t, err)
+
+	expectation, err := parseTacticsExpectation(&line, &boardState)
+	assert.Nil(t, err)
+	assert.Equal(t, "bm Rh8#; am Rg1 h1a1", expectation.summary)
+	assert.False(t, expectation.mate)
+
+	rh8, _ := ParsePrettyMove("Rh8", &boardState)
+	ra1, _ := ParsePrettyMove("Ra1", &boardState)
+	rg1, _ := ParsePrettyMove("Rg1", &boardState)
+	assert.True(t, expectation.isSolvedBy(rh8, CHECKMATE_SCORE))
+	assert.False(t, expectation.isSolvedBy(ra1, 0))
+	assert.False(t, expectation.isSolvedBy(rg1, 0))
+	assert.False(t, expectation.isSolvedBy(0, 0))
+
+	line.SetOperation("bm", "Rxh9")
+	_, err = parseTacticsExpectation(&line, &boardState)
+	assert.NotNil(t, err)
+
+	// With only dm a mate for the side to move is expected
+	line, _ = ParseEpdLine("3k4/8/3K4/8/8/8/8/7R w - - dm 1;")
+	expectation, err = parseTacticsExpectation(&line, &boardState)
+	assert.Nil(t, err)
+	assert.Equal(t, "dm 1", expectation.summary)
+	assert.True(t, expectation.isSolvedBy(rh8, CHECKMATE_SCORE))
+	assert.False(t, expectation.isSolvedBy(rh8, CHECKMATE_SCORE-2))
+	assert.False(t, expectation.isSolvedBy(rh8, -CHECKMATE_SCORE))
+
+	line, _ = ParseEpdLine("3k4/8/3K4/8/8/8/8/7R w - - id \"no solution\";")
+	_, err = parseTacticsExpectation(&line, &boardState)
+	assert.EqualError(t, err, "Unscorable position, it has no bm, am or dm")
+}
+
+func TestTacticsBudget(t *testing.T) {
+	options := TacticsOptions{thinkingtimeMs: 1500}
+	line, _ := ParseEpdLine("3k4/8/3K4/8/8/8/8/7R w - - bm Rh8;")
+	thinkingTimeMs, depth := tacticsBudget(&line, options)
+	assert.Equal(t, uint(1500), thinkingTimeMs)
+	assert.Equal(t, uint(0), depth)
+
+	line.SetOperation("acs", "3")
+	thinkingTimeMs, depth = tacticsBudget(&line, TacticsOptions{tacticsDepth: 8})
+	assert.Equal(t, uint(3000), thinkingTimeMs)
+	assert.Equal(t, uint(0), depth)
+
+	line.SetOperation("acd", "4")
+	thinkingTimeMs, depth = tacticsBudget(&line, options)
+	assert.Equal(t, NO_TIME_LIMIT, thinkingTimeMs)
+	assert.Equal(t, uint(4), depth)
+
+	// Zeros from a short annotating search leave the defaults
+	line.SetOperation("acs", "0")
+	line.SetOperation("acd", "0")
+	thinkingTimeMs, depth = tacticsBudget(&line, options)
+	assert.Equal(t, uint(1500), thinkingTimeMs)
+	assert.Equal(t, uint(0), depth)
+}
+
+func TestRunTacticsFile(t *testing.T) {
+	filename := writeTestFile(t, "suite.epd",
+		"3k4/8/3K4/8/8/8/8/7R w - - bm Rh8; id \"rook mate\";\n"+
+			"6k1/5ppp/8/8/8/8/8/R3K3 w Q - dm 1; id \"mate\";\n"+
+			"8/1k3r2/8/8/2N5/8/8/K7 w - - bm Nd6; acd 2; id \"fork\";\n"+
+			"8/1k3r2/8/8/2N5/8/8/K7 w - - bm Na5+; id \"wrong\";\n"+
+			"8/1k3r2/8/8/2N5/8/8/K7 w - - bm Qd1; id \"illegal\";\n")
+	dir := t.TempDir()
+	options := TacticsOptions{
+		tacticsDepth: 3,
+		threads:      3,
+		jsonFile:     filepath.Join(dir, "results.json"),
+		junitFile:    filepath.Join(dir, "results.xml"),
+	}
+
+	success, err := RunTacticsFile(filename, "", options)
+	assert.Nil(t, err)
+	assert.False(t, success)
+
+	b, err := os.ReadFile(options.jsonFile)
+	assert.Nil(t, err)
+	var report TacticsReport
+	assert.Nil(t, json.Unmarshal(b, &report))
+	assert.Equal(t, "suite", report.Suite)
+	assert.Equal(t, 5, report.Positions)
+	assert.Equal(t, 3, report.Solved)
+
+	// Results are in file order, whichever finished first
+	results := report.Results
+	assert.Equal(t, 5, len(results))
+	assert.Equal(t, "rook mate", results[0].Name)
+	assert.True(t, results[0].Solved)
+	assert.Equal(t, "+M1", results[0].Score)
+	assert.Equal(t, uint(1), results[0].SolvedDepth)
+
+	assert.Equal(t, "dm 1", results[1].Expected)
+	assert.True(t, results[1].Solved)
+	assert.Equal(t, "Ra8#", results[1].Move)
+
+	assert.True(t, results[2].Solved)
+	assert.Equal(t, uint(2), results[2].Depth)
+	assert.Greater(t, results[2].SolvedDepth, uint(0))
+	assert.LessOrEqual(t, results[2].SolvedDepth, uint(2))
+
+	assert.False(t, results[3].Solved)
+	assert.Equal(t, "Nd6+", results[3].Move)
+	assert.Equal(t, uint(0), results[3].SolvedDepth)
+
+	assert.False(t, results[4].Solved)
+	assert.NotEqual(t, "", results[4].Error)
+
+	b, err = os.ReadFile(options.junitFile)
+	assert.Nil(t, err)
+	var suites junitTestSuites
+	assert.Nil(t, xml.Unmarshal(b, &suites))
+	assert.Equal(t, 5, suites.Tests)
+	assert.Equal(t, 1, suites.Failures)
+	assert.Equal(t, 1, suites.Errors)
+	assert.Equal(t, 1, len(suites.Suites))
+	testCases := suites.Suites[0].TestCases
+	assert.Equal(t, 5, len(testCases))
+	assert.Nil(t, testCases[0].Failure)
+	assert.Equal(t, "wrong", testCases[3].Name)
+	assert.Equal(t, "expected bm Na5+, got Nd6+", testCases[3].Failure.Message)
+	assert.NotNil(t, testCases[4].Error)
+}
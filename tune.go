@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Texel-style tuning: https://www.chessprogramming.org/Texel%27s_Tuning_Method
+//
+// Given a set of positions labelled with the result of the game they were taken
+// from, the evaluation error is the mean squared difference between the result
+// and the quiescence search score mapped onto [0, 1] by a sigmoid.  Parameters
+// are then optimised with a local search: each parameter is nudged up or down
+// and the change is kept if the error improves.
+
+type TuneOptions struct {
+	outputFile string
+	iterations uint
+	threads    uint
+	k          float64
+}
+
+type TuningPosition struct {
+	fen string
+	// result from white's perspective: 1 = win, 0.5 = draw, 0 = loss
+	result float64
+}
+
+type tunableParam struct {
+	name  string
+	value *int
+}
+
+func tunableParams(params *EvalParams) []tunableParam {
+	tunable := []tunableParam{
+		{"endgameMaterialThreshold", &params.EndgameMaterialThreshold},
+		{"pawn", &params.Pawn},
+		{"knight", &params.Knight},
+		{"bishop", &params.Bishop},
+		{"rook", &params.Rook},
+		{"queen", &params.Queen},
+		{"kingInCenter", &params.KingInCenter},
+		{"kingPawnCover", &params.KingPawnCover},
+		{"kingCannotCastle", &params.KingCannotCastle},
+		{"endgameKingOnEdge", &params.EndgameKingOnEdge},
+		{"endgameKingNearEdge", &params.EndgameKingNearEdge},
+		{"endgameQueenBonus", &params.EndgameQueenBonus},
+		{"pawnInCenter", &params.PawnInCenter},
+		{"pieceInCenter", &params.PieceInCenter},
+		{"pieceAttacksCenter", &params.PieceAttacksCenter},
+		{"isolatedPawn", &params.IsolatedPawn},
+		{"doubledPawn", &params.DoubledPawn},
+		{"lackOfDevelopment", &params.LackOfDevelopment},
+	}
+	for rank := RANK_2; rank <= RANK_7; rank++ {
+		tunable = append(tunable, tunableParam{
+			fmt.Sprintf("passedPawnByRank[%d]", rank),
+			&params.PassedPawnByRank[rank],
+		})
+	}
+
+	return tunable
+}
+
+// ParseResultString converts a PGN-style result ("1-0", "0-1", "1/2-1/2") or a
+// number between 0 and 1 into a score from white's perspective.
+func ParseResultString(str string) (float64, error) {
+	str = strings.Trim(str, "[]\";")
+	switch str {
+	case "1-0":
+		return 1, nil
+	case "0-1":
+		return 0, nil
+	case "1/2-1/2", "1/2":
+		return 0.5, nil
+	}
+
+	result, err := strconv.ParseFloat(str, 64)
+	if err != nil || result < 0 || result > 1 {
+		return 0, fmt.Errorf("Invalid game result: %s", str)
+	}
+
+	return result, nil
+}
+
+// ParseTuningFile reads labelled positions for tuning.  Files ending in .epd are
+// read with the EPD parser and must have a c9 opcode holding the result.  Any
+// other file is treated as one position per line, the FEN followed by the
+// result, e.g.
+//
+// rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq - 0 2 [0.5]
+// 8/8/4k3/8/8/3QK3/8/8 b - - 1-0
+func ParseTuningFile(filename string) ([]TuningPosition, error) {
+	positions := make([]TuningPosition, 0)
+
+	if filepath.Ext(filename) == ".epd" {
+		lines, err := ParseAndFilterEpdFile(filename, "")
+		if err != nil {
+			return positions, err
+		}
+		for _, line := range lines {
+			result, err := ParseResultString(line.result)
+			if err != nil {
+				return positions, fmt.Errorf("%s: %s", line.name, err)
+			}
+			positions = append(positions, TuningPosition{fen: line.fen, result: result})
+		}
+
+		return positions, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return positions, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			return positions, fmt.Errorf("Line %d: expected a FEN followed by a result", lineNumber)
+		}
+		result, err := ParseResultString(line[i+1:])
+		if err != nil {
+			return positions, fmt.Errorf("Line %d: %s", lineNumber, err)
+		}
+		positions = append(positions, TuningPosition{fen: strings.TrimSpace(line[:i]), result: result})
+	}
+
+	return positions, scanner.Err()
+}
+
+// tuningWorker owns the board and search buffers used to score a slice of the
+// positions; boards are expensive to create so they are reused between positions.
+type tuningWorker struct {
+	boardState BoardState
+	moves      []Move
+	moveScores []int16
+	moveStart  [64]int
+	stats      SearchStats
+}
+
+func newTuningWorker() *tuningWorker {
+	moves := make([]Move, 64*256)
+	return &tuningWorker{
+		boardState: CreateEmptyBoardState(),
+		moves:      moves,
+		moveScores: make([]int16, len(moves)),
+	}
+}
+
+// quiescentScore returns the quiescence search score for the position from white's perspective.
+func (worker *tuningWorker) quiescentScore(fen string, params *EvalParams) (int, error) {
+	if err := worker.boardState.ResetFromFENString(fen); err != nil {
+		return 0, err
+	}
+	worker.boardState.evalParams = params
+
+	score := int(searchQuiescent(&worker.boardState, &worker.stats, 0, 0, -INFINITY, INFINITY,
+		SearchConfig{}, worker.moves, worker.moveScores, worker.moveStart[:]))
+	if worker.boardState.sideToMove == BLACK_OFFSET {
+		score = -score
+	}
+
+	return score, nil
+}
+
+func sigmoid(score float64, k float64) float64 {
+	return 1 / (1 + math.Pow(10, -k*score/400))
+}
+
+type Tuner struct {
+	positions []TuningPosition
+	workers   []*tuningWorker
+	k         float64
+}
+
+func NewTuner(positions []TuningPosition, threads uint) *Tuner {
+	if threads == 0 {
+		threads = 1
+	}
+	tuner := &Tuner{positions: positions, k: 1}
+	for i := uint(0); i < threads; i++ {
+		tuner.workers = append(tuner.workers, newTuningWorker())
+	}
+
+	return tuner
+}
+
+// Error returns the mean squared error of the sigmoid-scaled quiescence scores
+// against the game results.  Positions are split between the tuner's workers.
+func (tuner *Tuner) Error(params EvalParams) (float64, error) {
+	if len(tuner.positions) == 0 {
+		return 0, errors.New("No positions to tune on")
+	}
+
+	var wg sync.WaitGroup
+	sums := make([]float64, len(tuner.workers))
+	errs := make([]error, len(tuner.workers))
+	chunk := (len(tuner.positions) + len(tuner.workers) - 1) / len(tuner.workers)
+
+	for i, worker := range tuner.workers {
+		start := Min(i*chunk, len(tuner.positions))
+		end := Min(start+chunk, len(tuner.positions))
+		wg.Add(1)
+		go func(i int, worker *tuningWorker, positions []TuningPosition) {
+			defer wg.Done()
+			for _, position := range positions {
+				score, err := worker.quiescentScore(position.fen, &params)
+				if err != nil {
+					errs[i] = fmt.Errorf("%s: %s", position.fen, err)
+					return
+				}
+				diff := position.result - sigmoid(float64(score), tuner.k)
+				sums[i] += diff * diff
+			}
+		}(i, worker, tuner.positions[start:end])
+	}
+	wg.Wait()
+
+	total := 0.0
+	for i := range sums {
+		if errs[i] != nil {
+			return 0, errs[i]
+		}
+		total += sums[i]
+	}
+
+	return total / float64(len(tuner.positions)), nil
+}
+
+// FitK finds the sigmoid scaling constant that minimises the error for the given
+// parameters, so the tuning doesn't just rescale every weight.
+func (tuner *Tuner) FitK(params EvalParams) (float64, error) {
+	bestK := tuner.k
+	bestError, err := tuner.Error(params)
+	if err != nil {
+		return bestK, err
+	}
+
+	for step := 0.5; step >= 0.001; step /= 10 {
+		improved := true
+		for improved {
+			improved = false
+			for _, k := range []float64{bestK + step, bestK - step} {
+				if k <= 0 {
+					continue
+				}
+				tuner.k = k
+				e, err := tuner.Error(params)
+				if err != nil {
+					return bestK, err
+				}
+				if e < bestError {
+					bestError, bestK, improved = e, k, true
+					break
+				}
+			}
+		}
+	}
+	tuner.k = bestK
+
+	return bestK, nil
+}
+
+// Tune runs local search over all tunable parameters until no single step improves
+// the error or the iteration limit is reached.  iterationDone is called after each
+// pass with the best parameters found so far.
+func (tuner *Tuner) Tune(
+	params EvalParams,
+	iterations uint,
+	iterationDone func(iteration uint, params EvalParams, e float64) error,
+) (EvalParams, float64, error) {
+	bestError, err := tuner.Error(params)
+	if err != nil {
+		return params, 0, err
+	}
+
+	for iteration := uint(1); iterations == 0 || iteration <= iterations; iteration++ {
+		improved := false
+		for _, param := range tunableParams(&params) {
+			for _, delta := range []int{1, -1} {
+				*param.value += delta
+				e, err := tuner.Error(params)
+				if err != nil {
+					return params, bestError, err
+				}
+				if e < bestError {
+					bestError = e
+					improved = true
+					break
+				}
+				*param.value -= delta
+			}
+		}
+
+		if iterationDone != nil {
+			if err := iterationDone(iteration, params, bestError); err != nil {
+				return params, bestError, err
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+
+	return params, bestError, nil
+}
+
+func RunTuneFile(tuneFile string, options TuneOptions) (bool, error) {
+	positions, err := ParseTuningFile(tuneFile)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("Loaded %d positions from %s\n", len(positions), tuneFile)
+
+	tuner := NewTuner(positions, options.threads)
+	params := *evalParams
+
+	if options.k > 0 {
+		tuner.k = options.k
+	} else {
+		k, err := tuner.FitK(params)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("Fitted K=%.3f\n", k)
+	}
+
+	start := time.Now()
+	initialError, err := tuner.Error(params)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("Initial error: %.6f\n", initialError)
+
+	params, finalError, err := tuner.Tune(params, options.iterations,
+		func(iteration uint, params EvalParams, e float64) error {
+			fmt.Printf("Iteration %d: error=%.6f (%s)\n", iteration, e, time.Since(start))
+			return WriteEvalParams(options.outputFile, params)
+		})
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("Final error: %.6f, parameters written to %s\n", finalError, options.outputFile)
+
+	return true, nil
+}
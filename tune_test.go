@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, name string, contents string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestParseResultString(t *testing.T) {
+	for str, expected := range map[string]float64{
+		"1-0":         1,
+		"0-1":         0,
+		"1/2-1/2":     0.5,
+		"\"1/2-1/2\"": 0.5,
+		"[0.5]":       0.5,
+		"0.25":        0.25,
+	} {
+		result, err := ParseResultString(str)
+		assert.Nil(t, err, str)
+		assert.Equal(t, expected, result, str)
+	}
+
+	_, err := ParseResultString("2-0")
+	assert.NotNil(t, err)
+	_, err = ParseResultString("1.5")
+	assert.NotNil(t, err)
+}
+
+func TestParseTuningFileText(t *testing.T) {
+	filename := writeTestFile(t, "positions.txt",
+		"# comment\n"+
+			"rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq - 0 2 [0.5]\n"+
+			"\n"+
+			"8/8/4k3/8/8/3QK3/8/8 b - - 1-0\n")
+
+	positions, err := ParseTuningFile(filename)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []TuningPosition{
+		{fen: "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq - 0 2", result: 0.5},
+		{fen: "8/8/4k3/8/8/3QK3/8/8 b - -", result: 1},
+	}, positions)
+}
+
+func TestParseTuningFileEpd(t *testing.T) {
+	filename := writeTestFile(t, "positions.epd",
+		"8/8/4k3/8/8/3QK3/8/8 b - - c9 \"1-0\";\n"+
+			"8/8/4k3/8/8/3qK3/8/8 w - - c9 \"0-1\";\n")
+
+	positions, err := ParseTuningFile(filename)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []TuningPosition{
+		{fen: "8/8/4k3/8/8/3QK3/8/8 b - -", result: 1},
+		{fen: "8/8/4k3/8/8/3qK3/8/8 w - -", result: 0},
+	}, positions)
+}
+
+func TestTuningQuiescentScoreIsFromWhitePerspective(t *testing.T) {
+	worker := newTuningWorker()
+	params := DefaultEvalParams()
+
+	whiteToMove, err := worker.quiescentScore("4k3/8/8/8/8/8/8/Q3K3 w - -", &params)
+	assert.Nil(t, err)
+	blackToMove, err := worker.quiescentScore("4k3/8/8/8/8/8/8/Q3K3 b - -", &params)
+	assert.Nil(t, err)
+
+	assert.True(t, whiteToMove > 0)
+	assert.True(t, blackToMove > 0)
+}
+
+func TestTunerErrorPrefersCorrectLabels(t *testing.T) {
+	positions := []TuningPosition{
+		{fen: "4k3/8/8/8/8/8/8/Q3K3 w - -", result: 1},
+		{fen: "4k3/8/8/8/8/8/8/q3K3 w - -", result: 0},
+	}
+	mislabelled := []TuningPosition{
+		{fen: "4k3/8/8/8/8/8/8/Q3K3 w - -", result: 0},
+		{fen: "4k3/8/8/8/8/8/8/q3K3 w - -", result: 1},
+	}
+
+	correctError, err := NewTuner(positions, 2).Error(DefaultEvalParams())
+	assert.Nil(t, err)
+	wrongError, err := NewTuner(mislabelled, 2).Error(DefaultEvalParams())
+	assert.Nil(t, err)
+
+	assert.True(t, correctError < wrongError)
+}
+
+func TestTunerImprovesError(t *testing.T) {
+	// A rook up is only scored as a narrow win in these (made up) games, so
+	// tuning should pull the rook value down.  The pawns keep the positions out of
+	// the known-win KXK endgame.
+	positions := []TuningPosition{
+		{fen: "4k3/pp6/8/8/8/8/PP6/R3K3 w - -", result: 0.6},
+		{fen: "r3k3/pp6/8/8/8/8/PP6/4K3 w - -", result: 0.4},
+		{fen: "4k3/pppp4/8/8/8/8/PPPP4/4K3 w - -", result: 0.5},
+	}
+	tuner := NewTuner(positions, 2)
+	initialError, err := tuner.Error(DefaultEvalParams())
+	assert.Nil(t, err)
+
+	iterations := 0
+	params, finalError, err := tuner.Tune(DefaultEvalParams(), 3, func(uint, EvalParams, float64) error {
+		iterations++
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, iterations)
+	assert.True(t, finalError < initialError)
+	assert.True(t, params.Rook < ROOK_EVAL_SCORE)
+}
@@ -42,6 +42,14 @@ func Max(x, y int) int {
 	return x
 }
 
+// Abs returns the absolute value of x.
+func Abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
 func MaxUint(x, y uint) uint {
 	if x < y {
 		return y
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// PositionProblem identifies the reason ValidatePosition rejected a position.
+type PositionProblem int
+
+const (
+	POSITION_MISSING_KING PositionProblem = iota
+	POSITION_EXTRA_KING
+	POSITION_PAWN_ON_BACK_RANK
+	POSITION_IMPOSSIBLE_CASTLING
+	POSITION_IMPOSSIBLE_EN_PASSANT
+	POSITION_OPPONENT_IN_CHECK
+)
+
+// PositionError is returned for a position that can't arise in a game, such as
+// one with two white kings.  Use errors.As to find out which problem it was.
+type PositionError struct {
+	problem PositionProblem
+	detail  string
+}
+
+func (err *PositionError) Error() string {
+	return "Illegal position (" + err.detail + ")"
+}
+
+// ValidatePosition checks that the position could have been reached in a
+// legal game: one king each, no pawns on the first or last rank, castling
+// rights backed by an unmoved king and rook, an en passant square behind a
+// pawn that just moved two squares, and the side not to move not in check.
+// Only the first problem found is returned.
+func ValidatePosition(boardState *BoardState) error {
+	for _, offset := range []int{WHITE_OFFSET, BLACK_OFFSET} {
+		kings := bits.OnesCount64(boardState.bitboards.color[offset] & boardState.bitboards.piece[KING_MASK])
+		if kings == 0 {
+			return &PositionError{POSITION_MISSING_KING, colorName(offset) + " has no king"}
+		} else if kings > 1 {
+			return &PositionError{POSITION_EXTRA_KING, fmt.Sprintf("%s has %d kings", colorName(offset), kings)}
+		}
+	}
+
+	if err := validatePawnRanks(boardState); err != nil {
+		return err
+	}
+
+	castlingRights := []struct {
+		allowed bool
+		name    string
+		king    byte
+		rook    byte
+		color   byte
+	}{
+		{boardState.boardInfo.whiteCanCastleKingside, "white kingside", SQUARE_E1, SQUARE_H1, WHITE_MASK},
+		{boardState.boardInfo.whiteCanCastleQueenside, "white queenside", SQUARE_E1, SQUARE_A1, WHITE_MASK},
+		{boardState.boardInfo.blackCanCastleKingside, "black kingside", SQUARE_E8, SQUARE_H8, BLACK_MASK},
+		{boardState.boardInfo.blackCanCastleQueenside, "black queenside", SQUARE_E8, SQUARE_A8, BLACK_MASK},
+	}
+	for _, right := range castlingRights {
+		if right.allowed && (boardState.PieceAtSquare(right.king) != KING_MASK|right.color ||
+			boardState.PieceAtSquare(right.rook) != ROOK_MASK|right.color) {
+			return &PositionError{POSITION_IMPOSSIBLE_CASTLING, fmt.Sprintf("%s castling without a king on %s and a rook on %s",
+				right.name, SquareToAlgebraicString(right.king), SquareToAlgebraicString(right.rook))}
+		}
+	}
+
+	// The pawn that moved two squares is in front of the target square, and
+	// the squares it passed over must be empty
+	if sq := boardState.boardInfo.enPassantTargetSquare; sq != 0 {
+		rank, pawn, from, to := RANK_6, PAWN_MASK|BLACK_MASK, sq+8, sq-8
+		if boardState.sideToMove == BLACK_OFFSET {
+			rank, pawn, from, to = RANK_3, PAWN_MASK|WHITE_MASK, sq-8, sq+8
+		}
+		if Rank(sq) != rank || boardState.PieceAtSquare(to) != pawn ||
+			!isSquareEmpty(boardState.PieceAtSquare(sq)) || !isSquareEmpty(boardState.PieceAtSquare(from)) {
+			return &PositionError{POSITION_IMPOSSIBLE_EN_PASSANT, "no pawn can be captured en passant on " + SquareToAlgebraicString(sq)}
+		}
+	}
+
+	otherSide := oppositeColorOffset(boardState.sideToMove)
+	if boardState.IsInCheck(otherSide) {
+		return &PositionError{POSITION_OPPONENT_IN_CHECK, colorName(otherSide) + " is in check but it's " +
+			colorName(boardState.sideToMove) + " to move"}
+	}
+
+	return nil
+}
+
+// validatePawnRanks is also used while loading a FEN, because move generation
+// can't cope with pawns that can't move forward.
+func validatePawnRanks(boardState *BoardState) error {
+	backRanks := uint64(0xFF000000000000FF)
+	if boardState.bitboards.piece[PAWN_MASK]&backRanks != 0 {
+		return &PositionError{POSITION_PAWN_ON_BACK_RANK, "pawn on the first or last rank"}
+	}
+	return nil
+}
+
+func colorName(offset int) string {
+	if offset == WHITE_OFFSET {
+		return "white"
+	}
+	return "black"
+}
+
+// RunValidateEpd checks every position in the EPD file, printing the lines
+// that can't be parsed or hold an illegal position.  It succeeds if there are
+// none.
+func RunValidateEpd(epdFile string) (bool, error) {
+	file, err := os.Open(epdFile)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Creating boards is slow, so one is reused for every line
+	boardState := CreateEmptyBoardState()
+	positions, invalid := 0, 0
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		positions++
+
+		line, err := ParseEpdLine(text)
+		if err == nil {
+			err = boardState.ResetFromFENString(line.fen)
+		}
+		if err == nil {
+			err = ValidatePosition(&boardState)
+		}
+		if err != nil {
+			invalid++
+			fmt.Printf("%s:%d: %s: %s\n", epdFile, lineNumber, err, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	fmt.Printf("%d positions, %d invalid\n", positions, invalid)
+	return invalid == 0, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePosition(t *testing.T) {
+	for _, fen := range []string{
+		STARTING_FEN,
+		"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1",
+		"rnbqkbnr/pp1ppppp/8/2pP4/8/8/PPP1PPPP/RNBQKBNR w KQkq c6 0 2",
+		"4k3/8/8/8/8/8/8/4K3 b - - 0 1",
+		"4k3/4Q3/8/8/8/8/8/4K3 b - - 0 1",
+	} {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err, fen)
+		assert.Nil(t, ValidatePosition(&boardState), fen)
+	}
+}
+
+func TestValidatePositionProblems(t *testing.T) {
+	for fen, problem := range map[string]PositionProblem{
+		"8/8/8/8/8/8/8/4K3 w - - 0 1":                                   POSITION_MISSING_KING,
+		"4k3/8/8/8/8/8/8/8 w - - 0 1":                                   POSITION_MISSING_KING,
+		"4k3/8/8/8/8/8/8/K3K3 w - - 0 1":                                POSITION_EXTRA_KING,
+		"4k2k/8/8/8/8/8/8/4K3 w - - 0 1":                                POSITION_EXTRA_KING,
+		"4k3/8/8/8/8/8/8/4K3 w K - 0 1":                                 POSITION_IMPOSSIBLE_CASTLING,
+		"r3k3/8/8/8/8/8/8/R4K2 w Qq - 0 1":                              POSITION_IMPOSSIBLE_CASTLING,
+		"r3k3/8/8/8/8/8/8/R3K3 w Qk - 0 1":                              POSITION_IMPOSSIBLE_CASTLING,
+		"4k3/8/8/8/8/8/8/4K3 b - e3 0 1":                                POSITION_IMPOSSIBLE_EN_PASSANT,
+		"4k3/8/8/8/4P3/8/8/4K3 w - e3 0 1":                              POSITION_IMPOSSIBLE_EN_PASSANT,
+		"4k3/8/8/8/4P3/4N3/8/4K3 b - e3 0 1":                            POSITION_IMPOSSIBLE_EN_PASSANT,
+		"4k3/8/8/8/8/8/8/4K3 b - e6 0 1":                                POSITION_IMPOSSIBLE_EN_PASSANT,
+		"4k3/4Q3/8/8/8/8/8/4K3 w - - 0 1":                               POSITION_OPPONENT_IN_CHECK,
+		"rnbqkbnr/ppppp1pp/8/5p1Q/4P3/8/PPPP1PPP/RNB1KBNR w KQkq - 0 1": POSITION_OPPONENT_IN_CHECK,
+	} {
+		boardState, err := CreateBoardStateFromFENString(fen)
+		assert.Nil(t, err, fen)
+
+		var positionErr *PositionError
+		if assert.True(t, errors.As(ValidatePosition(&boardState), &positionErr), fen) {
+			assert.Equal(t, problem, positionErr.problem, fen)
+		}
+	}
+}
+
+func TestBackRankPawnIsPositionError(t *testing.T) {
+	_, err := CreateBoardStateFromFENString("P3k3/8/8/8/8/8/8/4K3 w - - 0 1")
+
+	var positionErr *PositionError
+	assert.True(t, errors.As(err, &positionErr))
+	assert.Equal(t, POSITION_PAWN_ON_BACK_RANK, positionErr.problem)
+}
+
+func TestRunValidateEpd(t *testing.T) {
+	valid := writeTestFile(t, "valid.epd", "# openings\n"+
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - bm e4; id \"start\";\n\n"+
+		"4k3/8/8/8/8/8/8/4K3 w - -\n")
+	success, err := RunValidateEpd(valid)
+	assert.Nil(t, err)
+	assert.True(t, success)
+
+	invalid := writeTestFile(t, "invalid.epd", "4k3/8/8/8/8/8/8/4K3 w - -\n"+
+		"8/8/8/8/8/8/8/4K3 w - -\n"+
+		"not a position\n")
+	success, err = RunValidateEpd(invalid)
+	assert.Nil(t, err)
+	assert.False(t, success)
+
+	_, err = RunValidateEpd(valid + ".missing")
+	assert.NotNil(t, err)
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +16,8 @@ var logger *log.Logger = nil
 
 // https://www.gnu.org/software/xboard/engine-intf.html
 
+const ENGINE_NAME = "ra v0.0.1"
+
 type XboardMove struct {
 	move   Move
 	result SearchResult // possibly uninitialized
@@ -28,14 +32,36 @@ type XboardState struct {
 	forceMode    bool
 	post         bool
 	randomMode   bool
+	ownBook      bool
+	bookDepth    int
 	opponentName string
 	moveHistory  []XboardMove
 	err          error
 	initialFEN   string
 	result       string
-
-	// TODO: time control per side
-	// TODO: recent sd limit
+	// The comment from the result command (e.g. "White mates")
+	resultComment string
+	// The side the engine is playing, used for the PGN player tags
+	engineSide int
+	// Finished games are appended to this PGN file, if set
+	pgnFile string
+	// The number from the last ping command, to send back with pong
+	pingNumber string
+	// Depth of the bench command
+	benchDepth uint
+
+	// Time control from the level command: the moves per session (0 for the
+	// whole game), the time for a session and the increment per move
+	levelMoves     int
+	levelTime      time.Duration
+	levelIncrement time.Duration
+	// Fixed time per move from the st command, if set
+	moveTime time.Duration
+	// Search depth limit from the sd command, if set
+	depthLimit uint
+	// The clocks from the time and otim commands, if they've been sent
+	engineTime   time.Duration
+	opponentTime time.Duration
 }
 
 const (
@@ -48,10 +74,19 @@ const (
 	ACTION_WAIT           = iota
 	ACTION_GAME_OVER      = iota
 	ACTION_ERROR          = iota
+	ACTION_PONG           = iota
+	ACTION_BENCH          = iota
 )
 
+// The thinking time per move when there's no time control
+const DEFAULT_THINKING_TIME_MS = 7400
+
+// Time kept back from every move for the overhead of sending it, as the search
+// only checks the clock every 50ms
+const MOVE_OVERHEAD = 100 * time.Millisecond
+
 func RunXboard(scanner *bufio.Scanner, output *bufio.Writer) (bool, error) {
-	var state XboardState
+	var state XboardState = XboardState{ownBook: true, bookDepth: DEFAULT_BOOK_DEPTH}
 	var action int = ACTION_NOTHING
 	sendPreamble(output)
 
@@ -85,12 +120,34 @@ ReadLoop:
 		case ACTION_QUIT:
 			break ReadLoop
 
+		case ACTION_PONG:
+			sendStringMessage(output, fmt.Sprintf("pong %s\n", state.pingNumber))
+
+		case ACTION_BENCH:
+			result, err := Bench(state.benchDepth, func(index int, fen string, nodes uint64) {})
+			if err != nil {
+				sendStringMessage(output, "Error ("+err.Error()+")\n")
+				break
+			}
+			for _, line := range strings.Split(result.String(), "\n") {
+				sendStringMessage(output, "# "+line+"\n")
+			}
+
 		case ACTION_THINK:
 			// TODO: use think code but never time out
 
 		case ACTION_THINK_AND_MOVE:
 			sendBoardAsComment(output, state.boardState)
 
+			if move, ok := state.bookMove(); ok {
+				sendStringMessage(output, fmt.Sprintf("move %s\n", MoveToXboardString(move)))
+				sendStringMessage(output, "# book move\n")
+
+				state.boardState.ApplyMove(move)
+				state.moveHistory = append(state.moveHistory, XboardMove{move: move})
+				break
+			}
+
 			ch := make(chan SearchResult)
 			thinkingChan := make(chan ThinkingOutput)
 
@@ -102,9 +159,9 @@ ReadLoop:
 				}
 			}()
 
-			// TODO - smarter thinking
 			stats := SearchStats{}
-			go thinkAndChooseMove(state.boardState, 7400, &stats, ExternalSearchConfig{}, ch, thinkingChan)
+			config := ExternalSearchConfig{searchToDepth: state.depthLimit}
+			go thinkAndChooseMove(state.boardState, state.thinkingTimeMs(), &stats, config, ch, thinkingChan)
 			result := <-ch
 			move := result.move
 
@@ -119,6 +176,11 @@ ReadLoop:
 
 		case ACTION_GAME_OVER:
 			sendGameAsComment(output, &state)
+			if state.pgnFile != "" {
+				if err := AppendPGNFile(state.pgnFile, state.Game()); err != nil {
+					logger.Println(err)
+				}
+			}
 		}
 
 		logger.Println("Waiting for commands...")
@@ -131,7 +193,65 @@ ReadLoop:
 }
 
 func sendPreamble(output *bufio.Writer) {
-	sendStringMessage(output, "feature myname=\"ra v0.0.1\" setboard=1 sigterm=0 sigint=0 done=1\n")
+	sendStringMessage(output, "feature myname=\""+ENGINE_NAME+"\" setboard=1 sigterm=0 sigint=0 "+
+		"option=\"EvalParams -file \" option=\"SyzygyPath -path \" "+
+		"option=\"OwnBook -check 1\" option=\"BookFile -file \" option=\"BookDepth -spin 20 0 500\" "+
+		"option=\"PGNFile -file \" ping=1 done=1\n")
+}
+
+// thinkingTimeMs returns how long to think for the next move: the time from the
+// st command, or a share of the engine's clock spread over the moves left in
+// the session.
+func (state *XboardState) thinkingTimeMs() uint {
+	if state.moveTime > 0 {
+		return uint(state.moveTime.Milliseconds())
+	}
+	if state.engineTime <= 0 {
+		return DEFAULT_THINKING_TIME_MS
+	}
+
+	movesToGo := 30
+	if state.levelMoves > 0 {
+		movesToGo = state.levelMoves - (len(state.moveHistory)/2)%state.levelMoves
+	}
+	thinkingTime := state.engineTime/time.Duration(movesToGo) + state.levelIncrement*3/4
+	if thinkingTime > state.engineTime/2 {
+		thinkingTime = state.engineTime / 2
+	}
+	thinkingTime -= MOVE_OVERHEAD
+	if thinkingTime < 10*time.Millisecond {
+		thinkingTime = 10 * time.Millisecond
+	}
+	return uint(thinkingTime.Milliseconds())
+}
+
+// parseLevelTime parses the session time of the level command, in minutes or
+// minutes:seconds.
+func parseLevelTime(str string) (time.Duration, error) {
+	minutes, seconds, hasSeconds := strings.Cut(str, ":")
+	m, err := strconv.Atoi(minutes)
+	if err != nil {
+		return 0, err
+	}
+	duration := time.Duration(m) * time.Minute
+	if hasSeconds {
+		s, err := strconv.Atoi(seconds)
+		if err != nil {
+			return 0, err
+		}
+		duration += time.Duration(s) * time.Second
+	}
+	return duration, nil
+}
+
+// bookMove chooses a move from the opening book, if the book is enabled and the
+// game is still within the book depth.  In random mode the move is picked in
+// proportion to the book weights, otherwise the most played move is chosen.
+func (state *XboardState) bookMove() (Move, bool) {
+	if !state.ownBook || openingBook == nil || gamePly(state.boardState) >= 2*state.bookDepth {
+		return 0, false
+	}
+	return openingBook.ChooseMove(state.boardState, state.randomMode, bookRand)
 }
 
 func sendStringMessage(output *bufio.Writer, str string) {
@@ -148,27 +268,84 @@ func sendBoardAsComment(output *bufio.Writer, boardState *BoardState) {
 }
 
 func sendGameAsComment(output *bufio.Writer, state *XboardState) {
-	boardState, err := CreateBoardStateFromFENString(state.initialFEN)
-	if err != nil {
+	var sb strings.Builder
+	if err := state.Game().WritePGN(&sb); err != nil {
 		panic("Initial FEN was invalid - should never happen")
 	}
+	for _, line := range strings.Split(strings.TrimSpace(sb.String()), "\n") {
+		sendStringMessage(output, "# "+line+"\n")
+	}
+}
 
-	var gameAsPgn string
-	for i, xboardMove := range state.moveHistory {
-		if i%2 == 0 {
-			gameAsPgn += fmt.Sprintf("%d. ", (i/2)+1)
-		}
-		gameAsPgn += MoveToPrettyString(xboardMove.move, &boardState) + " "
+// Game returns the game played so far, with the engine's search results as move
+// comments.
+func (state *XboardState) Game() *Game {
+	engine, opponent := ENGINE_NAME, state.opponentName
+	if opponent == "" {
+		opponent = "?"
+	}
+	white, black := opponent, engine
+	if state.engineSide == WHITE_OFFSET {
+		white, black = engine, opponent
+	}
+
+	game := &Game{
+		tags: map[string]string{
+			"Event": "Computer chess game",
+			"Site":  "?",
+			"Date":  time.Now().Format("2006.01.02"),
+			"Round": "-",
+			"White": white,
+			"Black": black,
+		},
+		initialFEN:    state.initialFEN,
+		result:        state.result,
+		resultComment: state.resultComment,
+	}
+	if game.initialFEN == "" {
+		game.initialFEN = STARTING_FEN
+	}
+
+	sideToMove := WHITE_OFFSET
+	if fields := strings.Fields(game.initialFEN); len(fields) > 1 && fields[1] == "b" {
+		sideToMove = BLACK_OFFSET
+	}
+	for _, xboardMove := range state.moveHistory {
+		comment := ""
 		if xboardMove.HasResult() {
-			gameAsPgn += fmt.Sprintf("{%d/%d %s} ",
-				xboardMove.result.value,
-				xboardMove.result.depth,
-				xboardMove.result.pv)
+			comment = searchResultComment(xboardMove.result, sideToMove)
 		}
-		boardState.ApplyMove(xboardMove.move)
+		game.moves = append(game.moves, xboardMove.move)
+		game.comments = append(game.comments, comment)
+		sideToMove = oppositeColorOffset(sideToMove)
 	}
-	gameAsComment := fmt.Sprintf("# %s %s\n", strings.Trim(gameAsPgn, " "), state.result)
-	sendStringMessage(output, gameAsComment)
+
+	return game
+}
+
+// searchResultComment formats a search result as a PGN comment:
+// {+0.35/12 1.2s}, with the score in pawns from the point of view of the side
+// that moved, or {-M3/20 0.5s} for a mate.
+func searchResultComment(result SearchResult, sideToMove int) string {
+	return fmt.Sprintf("%s/%d %.1fs", searchScoreString(result, sideToMove), result.depth, result.time.Seconds())
+}
+
+// searchScoreString formats the score in pawns for the side to move, or the
+// moves to mate (+M3).
+func searchScoreString(result SearchResult, sideToMove int) string {
+	value := result.value
+	if sideToMove == BLACK_OFFSET {
+		value = -value
+	}
+
+	sign := "+"
+	if value < 0 {
+		sign, value = "-", -value
+	}
+	if result.IsCheckmate() {
+		return fmt.Sprintf("%sM%d", sign, MateInMoves(value))
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, value/100, value%100)
 }
 
 func sendThinkingOutput(output *bufio.Writer, thinkingOutput ThinkingOutput) {
@@ -182,6 +359,10 @@ func sendThinkingOutput(output *bufio.Writer, thinkingOutput ThinkingOutput) {
 	))
 }
 
+// NO_TIME_LIMIT as the thinking time makes thinkAndChooseMove search until it
+// reaches config.searchToDepth, however long that takes.
+const NO_TIME_LIMIT = ^uint(0)
+
 func thinkAndChooseMove(
 	boardState *BoardState,
 	thinkingTimeMs uint,
@@ -190,32 +371,28 @@ func thinkAndChooseMove(
 	ch chan SearchResult,
 	thinkingChan chan ThinkingOutput,
 ) {
-	shouldAbort = false
+	abort := &atomic.Bool{}
+	config.abort = abort
 	// NOTE - There seems to be a bug in the TT where the wrong move is being returned
 	// For now clear out the TT before starting to think
 	generateTranspositionTable(boardState)
 	searchMoveInfo := SearchMoveInfo{}
 
-	searchQuit := make(chan bool)
+	searchDone := make(chan bool)
 	resultCh := make(chan SearchResult)
 
 	go func() {
-		var i uint = 1
-		// var res SearchResult
-
-		for {
-			select {
-			case <-searchQuit:
-				close(resultCh)
-				close(searchQuit)
-				return
-			default:
-				// TODO: having to copy the board state indicates a bug somewhere
-				state := CopyBoardState(boardState)
-				result := SearchWithConfig(&state, uint(i), stats, &searchMoveInfo, config, thinkingChan)
-				resultCh <- result
-				i = i + 1
+		defer close(searchDone)
+
+		for i := uint(1); !abort.Load(); i++ {
+			// TODO: having to copy the board state indicates a bug somewhere
+			state := CopyBoardState(boardState)
+			result := SearchWithConfig(&state, i, stats, &searchMoveInfo, config, thinkingChan)
+			if abort.Load() {
+				// The search didn't finish
+				break
 			}
+			resultCh <- result
 		}
 	}()
 
@@ -225,6 +402,10 @@ func thinkAndChooseMove(
 		startTime := time.Now()
 		// after no output for 50ms we check the value
 		checkInterval := 50
+		timeIsUp := func() bool {
+			return thinkingTimeMs != NO_TIME_LIMIT &&
+				time.Since(startTime) > time.Duration(thinkingTimeMs)*time.Millisecond
+		}
 
 	ThinkingLoop:
 		for {
@@ -237,7 +418,6 @@ func thinkAndChooseMove(
 					bestResult.flags == DRAW_FLAG ||
 					bestResult.depth == MAX_DEPTH {
 					logger.Println("Best result is terminal, time to stop thinking")
-					shouldAbort = true
 					break ThinkingLoop
 				}
 
@@ -246,28 +426,76 @@ func thinkAndChooseMove(
 					break ThinkingLoop
 				}
 
+				// Results can keep arriving within the check interval at low depths
+				if timeIsUp() {
+					logger.Println("Thinking time is up!")
+					break ThinkingLoop
+				}
+
 			case <-time.After(time.Duration(checkInterval) * time.Millisecond):
-				if time.Since(startTime) > time.Duration(thinkingTimeMs)*time.Millisecond {
+				if timeIsUp() {
 					logger.Println("Thinking time is up!")
 					break ThinkingLoop
 				}
 			}
 		}
 
-		shouldAbort = true
+		// Wait for the search to stop (discarding any result it finishes with),
+		// so the next search doesn't start while this one is still running
+		abort.Store(true)
+	WaitLoop:
+		for {
+			select {
+			case <-resultCh:
+			case <-searchDone:
+				break WaitLoop
+			}
+		}
+		close(thinkingChan)
+
 		ch <- bestResult
 		close(ch)
-		searchQuit <- true
 	}()
 }
 
+// thinkAndWait runs thinkAndChooseMove and waits for the result, passing every
+// new principal variation to onThinking.
+func thinkAndWait(
+	boardState *BoardState,
+	thinkingTimeMs uint,
+	config ExternalSearchConfig,
+	onThinking func(ThinkingOutput),
+) SearchResult {
+	ch := make(chan SearchResult)
+	thinkingChan := make(chan ThinkingOutput)
+	thinkingDone := make(chan bool)
+	go func() {
+		defer close(thinkingDone)
+		for thinkingOutput := range thinkingChan {
+			onThinking(thinkingOutput)
+		}
+	}()
+
+	stats := SearchStats{}
+	go thinkAndChooseMove(boardState, thinkingTimeMs, &stats, config, ch, thinkingChan)
+	result := <-ch
+	<-thinkingDone
+	return result
+}
+
 var protoverRegexp = regexp.MustCompile("^protover \\d$")
 var variantRegexp = regexp.MustCompile("^variant \\w+$")
 var moveRegexp = regexp.MustCompile("^([abcdefgh][1-8]){2}([nbqr])?$")
-var pingRegexp = regexp.MustCompile("^ping \\d$")
+var pingRegexp = regexp.MustCompile("^ping (\\d+)$")
+var levelRegexp = regexp.MustCompile("^level (\\d+) (\\d+(?::\\d+)?) (\\d+(?:\\.\\d+)?)$")
+var stRegexp = regexp.MustCompile("^st (\\d+)$")
+var benchRegexp = regexp.MustCompile("^bench( \\d+)?$")
+var sdRegexp = regexp.MustCompile("^sd (\\d+)$")
+var timeRegexp = regexp.MustCompile("^(time|otim) (-?\\d+)$")
 var resultRegexp = regexp.MustCompile("^result (1\\-0|0\\-1|1/2\\-1/2|\\*)( {([^}]+)})?")
 var fenRegexp = regexp.MustCompile("^setboard (.*)$")
 var nameRegexp = regexp.MustCompile("^name (.*)$")
+var optionRegexp = regexp.MustCompile("^option ([^=]+)(=(.*))?$")
 
 func ProcessXboardCommand(command string, state XboardState) (int, XboardState) {
 	var action = ACTION_NOTHING
@@ -300,6 +528,12 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 		state.randomMode = false
 		state.err = nil
 		state.result = ""
+		state.resultComment = ""
+		state.moveHistory = nil
+		state.engineSide = BLACK_OFFSET
+		state.depthLimit = 0
+		state.engineTime = 0
+		state.opponentTime = 0
 		action = ACTION_HALT
 
 	case variantRegexp.MatchString(command):
@@ -334,6 +568,7 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 		// Start the engine's clock. Start thinking and eventually make a move.
 
 		state.forceMode = false
+		state.engineSide = state.boardState.sideToMove
 		action = ACTION_THINK_AND_MOVE
 
 	case command == "playother":
@@ -344,6 +579,9 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 		// pondering. If the engine later receives a move, it should start thinking and eventually reply.
 
 		state.forceMode = false
+		if state.boardState != nil {
+			state.engineSide = oppositeColorOffset(state.boardState.sideToMove)
+		}
 		action = ACTION_WAIT
 
 	case moveRegexp.MatchString(command):
@@ -364,11 +602,13 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 			break
 		}
 
-		isLegal, err := state.boardState.IsMoveLegal(move)
-		if !isLegal {
+		legalMove, ok := findLegalMove(state.boardState, move)
+		if !ok {
 			action = ACTION_ERROR
-			state.err = errors.New("Illegal move (" + err.Error() + ")")
+			state.err = errors.New("Illegal move: " + command)
+			break
 		}
+		move = legalMove
 
 		logger.Printf("Applying move %s\n", MoveToString(move, state.boardState))
 		state.boardState.ApplyMove(move)
@@ -404,7 +644,61 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 		// especially important in simple engines that do not ponder and do not poll for input while thinking,
 		// but it is needed in all engines.
 
-		// TODO: implement this
+		state.pingNumber = pingRegexp.FindStringSubmatch(command)[1]
+		action = ACTION_PONG
+
+	case levelRegexp.MatchString(command):
+		// level MPS BASE INC: in conventional clock mode, MPS moves are to be played in BASE minutes (or
+		// minutes:seconds) and then the clock is reset for the next session. In incremental mode MPS is 0, BASE
+		// is the time for the whole game and INC seconds are added after each move.
+
+		arr := levelRegexp.FindStringSubmatch(command)
+		levelTime, err := parseLevelTime(arr[2])
+		increment, err2 := strconv.ParseFloat(arr[3], 64)
+		if err != nil || err2 != nil {
+			action = ACTION_ERROR
+			state.err = errors.New("Error (invalid time control): " + command)
+			break
+		}
+		state.levelMoves, _ = strconv.Atoi(arr[1])
+		state.levelTime = levelTime
+		state.levelIncrement = time.Duration(increment * float64(time.Second))
+		state.moveTime = 0
+
+	case benchRegexp.MatchString(command):
+		// Not part of the protocol: search the bench positions (to an optional depth) and report the nodes
+		// searched, as a signature of the search.
+
+		state.benchDepth = BENCH_DEPTH
+		if depth := strings.TrimSpace(benchRegexp.FindStringSubmatch(command)[1]); depth != "" {
+			d, _ := strconv.Atoi(depth)
+			state.benchDepth = uint(d)
+		}
+		action = ACTION_BENCH
+
+	case stRegexp.MatchString(command):
+		// Set an exact number of seconds per move, instead of a conventional or incremental clock.
+
+		seconds, _ := strconv.Atoi(stRegexp.FindStringSubmatch(command)[1])
+		state.moveTime = time.Duration(seconds) * time.Second
+
+	case sdRegexp.MatchString(command):
+		// The engine should limit its thinking to DEPTH ply.
+
+		depth, _ := strconv.Atoi(sdRegexp.FindStringSubmatch(command)[1])
+		state.depthLimit = uint(depth)
+
+	case timeRegexp.MatchString(command):
+		// Set a clock that always belongs to the engine (time) or its opponent (otim), in centiseconds. xboard
+		// sends both before every move the engine is to make.
+
+		arr := timeRegexp.FindStringSubmatch(command)
+		centiseconds, _ := strconv.Atoi(arr[2])
+		if arr[1] == "time" {
+			state.engineTime = time.Duration(centiseconds) * 10 * time.Millisecond
+		} else {
+			state.opponentTime = time.Duration(centiseconds) * 10 * time.Millisecond
+		}
 
 	case command == "draw":
 		// The engine's opponent offers the engine a draw. To accept the draw, send "offer draw". To decline,
@@ -439,9 +733,8 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 
 		action = ACTION_GAME_OVER
 		arr := resultRegexp.FindStringSubmatch(command)
-		result := arr[1]
-		comment := arr[3]
-		state.result = fmt.Sprintf("%s {%s}", result, comment)
+		state.result = arr[1]
+		state.resultComment = arr[3]
 
 	case fenRegexp.MatchString(command):
 		// The setboard command is the new way to set up positions, beginning in protocol version 2. It is not used
@@ -464,8 +757,23 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 
 		fenString := fenRegexp.FindStringSubmatch(command)[1]
 		boardState, err := CreateBoardStateFromFENString(fenString)
+		if err == nil {
+			err = ValidatePosition(&boardState)
+		}
 
-		if err != nil {
+		// A pawn on the back rank is found while loading the FEN, the other
+		// problems by ValidatePosition
+		var positionErr *PositionError
+		if errors.As(err, &positionErr) {
+			// Moves are answered with "Illegal move" until the next new or setboard
+			logger.Println(err)
+			state.boardState = nil
+			state.moveHistory = nil
+			state.err = errors.New("tellusererror Illegal position")
+			action = ACTION_ERROR
+
+			break
+		} else if err != nil {
 			state.err = errors.New("Error (" + err.Error() + ")")
 			action = ACTION_ERROR
 
@@ -473,6 +781,7 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 		}
 		state.boardState = &boardState
 		state.initialFEN = fenString
+		state.moveHistory = nil
 
 	case command == "hint":
 		// If the user asks for a hint, xboard sends your engine the command "hint". Your engine should respond with
@@ -485,6 +794,11 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 		// the user asks to undo a move your engine made. (GNU Chess 4 actually switches to playing the opposite color
 		// in this case.)
 
+		if len(state.moveHistory) < 1 {
+			action = ACTION_ERROR
+			state.err = errors.New("Error (no move to undo): " + command)
+			break
+		}
 		idx := len(state.moveHistory) - 1
 		xboardMove := state.moveHistory[idx]
 		state.moveHistory = state.moveHistory[:idx]
@@ -495,12 +809,17 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 		// when the user is on move. Your engine should undo the last two moves (one for each player) and continue
 		// playing the same color.
 
+		if len(state.moveHistory) < 2 {
+			action = ACTION_ERROR
+			state.err = errors.New("Error (no moves to remove): " + command)
+			break
+		}
 		idx := len(state.moveHistory) - 2
 		xboardMove1 := state.moveHistory[idx]
 		xboardMove2 := state.moveHistory[idx+1]
 		state.moveHistory = state.moveHistory[:idx]
-		state.boardState.UnapplyMove(xboardMove1.move)
 		state.boardState.UnapplyMove(xboardMove2.move)
+		state.boardState.UnapplyMove(xboardMove1.move)
 		action = ACTION_THINK_AND_MOVE
 
 	case command == "hard":
@@ -535,6 +854,59 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 
 		// TODO: We should say hi!
 
+	case optionRegexp.MatchString(command):
+		// This command changes the setting of the option NAME defined by the engine (through an earlier feature
+		// command) to the given VALUE. XBoard will in general do no syntax checking other than that the value is
+		// of the appropriate type.
+
+		arr := optionRegexp.FindStringSubmatch(command)
+		name, value := arr[1], arr[3]
+
+		switch name {
+		case "EvalParams":
+			params := DefaultEvalParams()
+			if value != "" {
+				var err error
+				params, err = LoadEvalParams(value)
+				if err != nil {
+					action = ACTION_ERROR
+					state.err = errors.New("Error (" + err.Error() + "): " + command)
+					break
+				}
+			}
+			SetEvalParams(params)
+			if state.boardState != nil {
+				state.boardState.evalParams = evalParams
+			}
+		case "SyzygyPath":
+			count, err := LoadSyzygyTables(value)
+			if err != nil {
+				action = ACTION_ERROR
+				state.err = errors.New("Error (" + err.Error() + "): " + command)
+				break
+			}
+			logger.Printf("Loaded %d Syzygy tables from %s\n", count, value)
+		case "OwnBook":
+			state.ownBook = value == "1"
+		case "BookFile":
+			if err := SetOpeningBook(value); err != nil {
+				action = ACTION_ERROR
+				state.err = errors.New("Error (" + err.Error() + "): " + command)
+			}
+		case "BookDepth":
+			depth, err := strconv.Atoi(value)
+			if err != nil || depth < 0 {
+				action = ACTION_ERROR
+				state.err = errors.New("Error (invalid book depth): " + command)
+				break
+			}
+			state.bookDepth = depth
+		case "PGNFile":
+			state.pgnFile = value
+		default:
+			action = ACTION_ERROR
+			state.err = errors.New("Error (unknown option): " + command)
+		}
 	}
 
 	return action, state
@@ -544,12 +916,26 @@ func ProcessXboardCommand(command string, state XboardState) (int, XboardState)
 // Doesn't test move legality (e.g. would put the moving player in check, castle is legal, etc)
 func ParseXboardMove(command string, boardState *BoardState) (Move, error) {
 	var move Move
+	if len(command) != 4 && len(command) != 5 {
+		return move, fmt.Errorf("Invalid move %s", command)
+	}
 
 	from := command[0:2]
 	to := command[2:4]
-	var promotion byte
+	var promotionPiece byte
 	if len(command) == 5 {
-		promotion = command[4]
+		switch command[4] {
+		case 'b':
+			promotionPiece = BISHOP_MASK
+		case 'q':
+			promotionPiece = QUEEN_MASK
+		case 'r':
+			promotionPiece = ROOK_MASK
+		case 'n':
+			promotionPiece = KNIGHT_MASK
+		default:
+			return move, fmt.Errorf("Invalid promotion piece in %s", command)
+		}
 	}
 
 	from_sq, from_err := ParseAlgebraicSquare(from)
@@ -574,7 +960,8 @@ func ParseXboardMove(command string, boardState *BoardState) (Move, error) {
 	if destPiece != 0 {
 		isCapture = true
 	}
-	if boardState.boardInfo.enPassantTargetSquare == to_sq && boardState.boardInfo.enPassantTargetSquare > 0 {
+	if boardState.boardInfo.enPassantTargetSquare == to_sq && boardState.boardInfo.enPassantTargetSquare > 0 &&
+		fromPiece&0x0F == PAWN_MASK {
 		isEnPassantCapture = true
 	}
 
@@ -592,28 +979,21 @@ func ParseXboardMove(command string, boardState *BoardState) (Move, error) {
 		}
 	}
 
+	if promotionPiece != 0 && (isKingsideCastle || isQueensideCastle || isEnPassantCapture) {
+		return move, fmt.Errorf("Invalid promotion in %s", command)
+	}
+
 	if isKingsideCastle {
 		move = CreateKingsideCastle(from_sq, to_sq)
 	} else if isQueensideCastle {
 		move = CreateQueensideCastle(from_sq, to_sq)
 	} else if isEnPassantCapture {
 		move = CreateEnPassantCapture(from_sq, to_sq)
-	} else if promotion != 0 {
-		var pieceMask byte
-		switch promotion {
-		case 'b':
-			pieceMask = BISHOP_MASK
-		case 'q':
-			pieceMask = QUEEN_MASK
-		case 'r':
-			pieceMask = ROOK_MASK
-		case 'n':
-			pieceMask = KNIGHT_MASK
-		}
+	} else if promotionPiece != 0 {
 		if isCapture {
-			move = CreatePromotionCapture(from_sq, to_sq, pieceMask)
+			move = CreatePromotionCapture(from_sq, to_sq, promotionPiece)
 		} else {
-			move = CreatePromotion(from_sq, to_sq, pieceMask)
+			move = CreatePromotion(from_sq, to_sq, promotionPiece)
 		}
 	} else {
 		move = CreateMove(from_sq, to_sq)
@@ -622,6 +1002,17 @@ func ParseXboardMove(command string, boardState *BoardState) (Move, error) {
 	return move, nil
 }
 
+// findLegalMove returns the legal move with the parsed move's squares and
+// promotion, which has the flags ParseXboardMove can't work out.
+func findLegalMove(boardState *BoardState, move Move) (Move, bool) {
+	for _, legalMove := range GenerateLegalMoves(boardState) {
+		if containsTacticsMove([]Move{legalMove}, move) {
+			return legalMove, true
+		}
+	}
+	return 0, false
+}
+
 func MoveToXboardString(move Move) string {
 	from := SquareToAlgebraicString(move.From())
 	to := SquareToAlgebraicString(move.To())
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -57,6 +62,43 @@ func TestProcessInvalidFENState(t *testing.T) {
 	assert.NotNil(t, state.err)
 }
 
+func TestProcessSetboardIllegalPosition(t *testing.T) {
+	var state XboardState
+	var action int
+
+	_, state = ProcessXboardCommand("new", state)
+	action, state = ProcessXboardCommand("setboard 4k3/8/8/8/8/8/8/4K2R w KQ - 0 1", state)
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.Equal(t, "tellusererror Illegal position", state.err.Error())
+	assert.Nil(t, state.boardState)
+
+	action, state = ProcessXboardCommand("e1g1", state)
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.True(t, strings.HasPrefix(state.err.Error(), "Illegal move"))
+
+	action, state = ProcessXboardCommand("setboard 4k3/8/8/8/8/8/8/4K2R w K - 0 1", state)
+	assert.Equal(t, ACTION_HALT, action)
+	assert.NotNil(t, state.boardState)
+}
+
+func TestProcessSetboardPawnOnBackRank(t *testing.T) {
+	var state XboardState
+	var action int
+
+	_, state = ProcessXboardCommand("new", state)
+	_, state = ProcessXboardCommand("force", state)
+	action, state = ProcessXboardCommand("setboard P3k3/8/8/8/8/8/8/4K3 w - - 0 1", state)
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.Equal(t, "tellusererror Illegal position", state.err.Error())
+	assert.Nil(t, state.boardState)
+	assert.Nil(t, state.moveHistory)
+
+	// Not played on the game from before the setboard
+	action, state = ProcessXboardCommand("e2e4", state)
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.True(t, strings.HasPrefix(state.err.Error(), "Illegal move"))
+}
+
 func TestProcessUndoCommand(t *testing.T) {
 	var state XboardState
 	var action int
@@ -64,7 +106,7 @@ func TestProcessUndoCommand(t *testing.T) {
 	_, state = ProcessXboardCommand("new", state)
 	_, state = ProcessXboardCommand("force", state)
 	_, state = ProcessXboardCommand("e2e4", state)
-	_, state = ProcessXboardCommand("e5e7", state)
+	_, state = ProcessXboardCommand("e7e5", state)
 	action, state = ProcessXboardCommand("undo", state)
 
 	assert.Equal(t, BLACK_MASK|PAWN_MASK, state.boardState.PieceAtSquare(SQUARE_E7))
@@ -134,6 +176,14 @@ func TestParseXboardMoveMove(t *testing.T) {
 	assert.Equal(t, CreateMove(SQUARE_E2, SQUARE_E4), move)
 }
 
+func TestParseXboardMoveInvalidLength(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	for _, command := range []string{"", "e4", "Nf3", "e7e8qq"} {
+		_, err := ParseXboardMove(command, &boardState)
+		assert.NotNil(t, err, command)
+	}
+}
+
 func TestParseXboardMoveCapture(t *testing.T) {
 	boardState := CreateEmptyBoardState()
 	boardState.SetPieceAtSquare(SQUARE_A1, ROOK_MASK|WHITE_MASK)
@@ -218,3 +268,244 @@ func TestParseXboardMoveEnPassantCapture(t *testing.T) {
 	assert.Equal(t, SQUARE_E5, move.From())
 	assert.Equal(t, SQUARE_D6, move.To())
 }
+
+func TestProcessOptionCommandUnknownOption(t *testing.T) {
+	var state XboardState
+	var action int
+
+	action, state = ProcessXboardCommand("option NotAnOption=1", state)
+
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.Equal(t, "Error (unknown option): option NotAnOption=1", state.err.Error())
+}
+
+func TestProcessOptionCommandEvalParamsMissingFile(t *testing.T) {
+	var state XboardState
+	var action int
+
+	_, state = ProcessXboardCommand("new", state)
+	action, state = ProcessXboardCommand("option EvalParams=/nonexistent/params.json", state)
+
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.True(t, strings.HasPrefix(state.err.Error(), "Error ("))
+	assert.True(t, strings.HasSuffix(state.err.Error(), "): option EvalParams=/nonexistent/params.json"))
+	assert.Equal(t, evalParams, state.boardState.evalParams)
+}
+
+func TestXboardSaveGamePGN(t *testing.T) {
+	filename := writeTestFile(t, "games.pgn", "")
+	commands := []string{
+		"new",
+		"name bob",
+		"option PGNFile=" + filename,
+		"force",
+		"e2e4",
+		"e7e5",
+		"result 1-0 {Black resigns}",
+		"quit",
+	}
+	scanner := bufio.NewScanner(strings.NewReader(strings.Join(commands, "\n")))
+	var output bytes.Buffer
+	_, err := RunXboard(scanner, bufio.NewWriter(&output))
+	assert.Nil(t, err)
+	assert.Contains(t, output.String(), "# 1. e4 e5 {Black resigns} 1-0\n")
+
+	file, err := os.Open(filename)
+	assert.Nil(t, err)
+	defer file.Close()
+	games, err := ReadPGNGames(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(games))
+	assert.Equal(t, "bob", games[0].tags["White"])
+	assert.Equal(t, ENGINE_NAME, games[0].tags["Black"])
+	assert.Equal(t, "1-0", games[0].result)
+	assert.Equal(t, 2, len(games[0].moves))
+}
+
+func TestSearchResultComment(t *testing.T) {
+	result := SearchResult{value: -35, depth: 12, time: 1200 * time.Millisecond}
+	assert.Equal(t, "-0.35/12 1.2s", searchResultComment(result, WHITE_OFFSET))
+	assert.Equal(t, "+0.35/12 1.2s", searchResultComment(result, BLACK_OFFSET))
+
+	result = SearchResult{value: CHECKMATE_SCORE - 5, flags: CHECKMATE_FLAG, depth: 6}
+	assert.Equal(t, "+M3/6 0.0s", searchResultComment(result, WHITE_OFFSET))
+}
+
+func TestProcessPingCommand(t *testing.T) {
+	var state XboardState
+	var action int
+
+	action, state = ProcessXboardCommand("ping 12", state)
+
+	assert.Equal(t, ACTION_PONG, action)
+	assert.Equal(t, "12", state.pingNumber)
+}
+
+func TestXboardThinkingTime(t *testing.T) {
+	var state XboardState
+	var action int
+
+	_, state = ProcessXboardCommand("new", state)
+	assert.Equal(t, uint(DEFAULT_THINKING_TIME_MS), state.thinkingTimeMs())
+
+	action, state = ProcessXboardCommand("level 40 5 0", state)
+	assert.Equal(t, ACTION_NOTHING, action)
+	assert.Equal(t, 40, state.levelMoves)
+	assert.Equal(t, 5*time.Minute, state.levelTime)
+	_, state = ProcessXboardCommand("time 4000", state)
+	_, state = ProcessXboardCommand("otim 3000", state)
+	assert.Equal(t, 30*time.Second, state.opponentTime)
+	// 40 seconds over the 40 moves of the session, less the overhead
+	assert.Equal(t, uint(900), state.thinkingTimeMs())
+
+	_, state = ProcessXboardCommand("level 0 0:30 1.5", state)
+	assert.Equal(t, 30*time.Second, state.levelTime)
+	assert.Equal(t, 1500*time.Millisecond, state.levelIncrement)
+	// 40/30 seconds and three quarters of the increment, less the overhead
+	assert.Equal(t, uint(2358), state.thinkingTimeMs())
+
+	_, state = ProcessXboardCommand("time 10", state)
+	assert.Equal(t, uint(10), state.thinkingTimeMs())
+
+	_, state = ProcessXboardCommand("st 2", state)
+	assert.Equal(t, uint(2000), state.thinkingTimeMs())
+
+	_, state = ProcessXboardCommand("sd 6", state)
+	assert.Equal(t, uint(6), state.depthLimit)
+	_, state = ProcessXboardCommand("new", state)
+	assert.Equal(t, uint(0), state.depthLimit)
+}
+
+func TestThinkWithoutTimeLimit(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	config := ExternalSearchConfig{searchToDepth: 5}
+	result := thinkAndWait(&boardState, NO_TIME_LIMIT, config, func(ThinkingOutput) {})
+	assert.Equal(t, uint(5), result.depth)
+	assert.NotEqual(t, Move(0), result.move)
+}
+
+func TestProcessBenchCommand(t *testing.T) {
+	var state XboardState
+	var action int
+
+	action, state = ProcessXboardCommand("bench", state)
+	assert.Equal(t, ACTION_BENCH, action)
+	assert.Equal(t, uint(BENCH_DEPTH), state.benchDepth)
+
+	action, state = ProcessXboardCommand("bench 2", state)
+	assert.Equal(t, ACTION_BENCH, action)
+	assert.Equal(t, uint(2), state.benchDepth)
+}
+
+func TestParseXboardMoveInvalidPromotion(t *testing.T) {
+	boardState := CreateInitialBoardState()
+	for _, command := range []string{"a1a1\x00", "e7e8x", "e7e8k", "e7e8Q"} {
+		_, err := ParseXboardMove(command, &boardState)
+		assert.NotNil(t, err, command)
+	}
+
+	// A promotion piece is only taken on a move that can be a promotion
+	boardState, _ = CreateBoardStateFromFENString("r3k2r/8/8/8/5pP1/8/8/R3K2R b KQkq g3 0 1")
+	for _, command := range []string{"e8g8q", "e8c8n", "f4g3q"} {
+		_, err := ParseXboardMove(command, &boardState)
+		assert.NotNil(t, err, command)
+	}
+	boardState, _ = CreateBoardStateFromFENString("r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1")
+	_, err := ParseXboardMove("e1g1q", &boardState)
+	assert.NotNil(t, err)
+}
+
+func TestParseXboardMoveToEnPassantSquare(t *testing.T) {
+	boardState, _ := CreateBoardStateFromFENString("8/2p5/3p4/KP5r/1R3pPk/8/4P3/8 b - g3 0 1")
+	move, err := ParseXboardMove("h4g3", &boardState)
+	assert.Nil(t, err)
+	assert.False(t, move.IsEnPassantCapture())
+
+	move, err = ParseXboardMove("f4g3", &boardState)
+	assert.Nil(t, err)
+	assert.True(t, move.IsEnPassantCapture())
+}
+
+func FuzzParseXboardMove(f *testing.F) {
+	f.Add(STARTING_FEN, "e2e4")
+	f.Add("r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 b kq - 0 1", "b2a1q")
+	f.Add(STARTING_FEN, "a0a9")
+	f.Add(STARTING_FEN, "e7e8x")
+
+	boardState := CreateInitialBoardState()
+	f.Fuzz(func(t *testing.T, fen string, command string) {
+		if err := boardState.ResetFromFENString(fen); err != nil {
+			return
+		}
+		move, err := ParseXboardMove(command, &boardState)
+		if err == nil && MoveToXboardString(move) != command {
+			t.Fatalf("%s parsed as %s", command, MoveToXboardString(move))
+		}
+	})
+}
+
+// Commands, one per line, never panic and report problems as errors xboard
+// understands.
+func FuzzProcessXboardCommand(f *testing.F) {
+	f.Add("e2e4\ne7e5\nundo\nremove")
+	f.Add("undo\nremove\nremove")
+	f.Add("setboard 8/8/8/8/8/8/8/8 w - - 0 1\ne2e4\ngo")
+	f.Add("force\ne2e4\ne5e7\ne2e5\nsetboard rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1\nd7d5")
+	f.Add("level 40 5:00 0\ntime 1000\notim 900\nst 5\nsd 3\nping 7\nresult 1-0 {White mates}")
+
+	f.Fuzz(func(t *testing.T, commands string) {
+		var state XboardState
+		_, state = ProcessXboardCommand("new", state)
+		_, state = ProcessXboardCommand("force", state)
+		for _, command := range strings.Split(commands, "\n") {
+			// Options load files and change global settings
+			if strings.HasPrefix(command, "option") {
+				continue
+			}
+			var action int
+			action, state = ProcessXboardCommand(command, state)
+			if action == ACTION_ERROR {
+				err := state.err.Error()
+				if !strings.HasPrefix(err, "Error") && !strings.HasPrefix(err, "Illegal move") && err != "tellusererror Illegal position" {
+					t.Fatalf("%s: %s", command, state.err)
+				}
+				state.err = nil
+			}
+		}
+	})
+}
+
+func TestProcessIllegalMoveCommand(t *testing.T) {
+	var state XboardState
+	var action int
+
+	_, state = ProcessXboardCommand("new", state)
+	_, state = ProcessXboardCommand("force", state)
+	for _, command := range []string{"e2e5", "e7e5", "a1a3", "e1g1", "a2a1q"} {
+		action, state = ProcessXboardCommand(command, state)
+		assert.Equal(t, ACTION_ERROR, action, command)
+		assert.Equal(t, "Illegal move: "+command, state.err.Error())
+		assert.Equal(t, STARTING_FEN, state.boardState.ToFENString())
+		assert.Empty(t, state.moveHistory)
+	}
+}
+
+func TestProcessUndoCommandWithoutMoves(t *testing.T) {
+	var state XboardState
+	var action int
+
+	action, state = ProcessXboardCommand("undo", state)
+	assert.Equal(t, ACTION_ERROR, action)
+
+	_, state = ProcessXboardCommand("new", state)
+	_, state = ProcessXboardCommand("force", state)
+	action, state = ProcessXboardCommand("undo", state)
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.Equal(t, "Error (no move to undo): undo", state.err.Error())
+
+	_, state = ProcessXboardCommand("e2e4", state)
+	action, state = ProcessXboardCommand("remove", state)
+	assert.Equal(t, ACTION_ERROR, action)
+	assert.Equal(t, "Error (no moves to remove): remove", state.err.Error())
+	assert.Equal(t, 1, len(state.moveHistory))
+}